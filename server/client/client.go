@@ -0,0 +1,261 @@
+// Package client is a typed Go client for the chai server's REST API.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"chai/server/internal"
+)
+
+// The server's own request and response types, so the client can't drift
+// from what the handlers read and write
+type (
+	Session              = internal.Session
+	Message              = internal.Message
+	SessionEvent         = internal.SessionEvent
+	SessionResponse      = internal.SessionResponse
+	CreateSessionRequest = internal.CreateSessionRequest
+	ApproveRequest       = internal.ApproveRequest
+)
+
+// Options configures optional Client behavior.
+type Options struct {
+	// HTTPClient sends the requests. Nil uses http.DefaultClient. Prompt
+	// streams last as long as the prompt, so its Timeout should be zero or
+	// longer than the server's prompt timeout.
+	HTTPClient *http.Client
+
+	// AuthToken is sent as a Bearer token, for servers started with -auth-token
+	AuthToken string
+}
+
+// Client calls a chai server's REST API.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	authToken  string
+}
+
+// New creates a client for the server at baseURL, e.g. "http://localhost:8080"
+// or a base path such as "https://example.com/chai". A nil opts uses the defaults.
+func New(baseURL string, opts *Options) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+	if opts != nil {
+		if opts.HTTPClient != nil {
+			c.httpClient = opts.HTTPClient
+		}
+		c.authToken = opts.AuthToken
+	}
+	return c
+}
+
+// APIError is returned when the server answers with a non-2xx status.
+type APIError struct {
+	StatusCode int
+	Message    string            // the response's "error"
+	Fields     map[string]string // per-field problems of a validation error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("chai: %d %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// CreateSession creates a session.
+func (c *Client) CreateSession(ctx context.Context, req CreateSessionRequest) (*Session, error) {
+	var session Session
+	if err := c.call(ctx, http.MethodPost, "/api/sessions", req, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListSessions returns the sessions that aren't archived or deleted.
+func (c *Client) ListSessions(ctx context.Context) ([]Session, error) {
+	var sessions []Session
+	if err := c.call(ctx, http.MethodGet, "/api/sessions", nil, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetSession returns a session with its messages.
+func (c *Client) GetSession(ctx context.Context, id string) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.call(ctx, http.MethodGet, sessionPath(id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// DeleteSession moves a session to the server's recycle bin.
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, sessionPath(id), nil, nil)
+}
+
+// Approve answers a permission_request event of a running prompt; set
+// req.ToolUseID to the event's request_id.
+func (c *Client) Approve(ctx context.Context, sessionID string, req ApproveRequest) error {
+	return c.call(ctx, http.MethodPost, sessionPath(sessionID)+"/approve", req, nil)
+}
+
+// Event is one event of a prompt stream, such as "connected", "claude" (a
+// line of the CLI's stream-json output), "permission_request" or "done".
+// Data is the event's JSON payload.
+type Event struct {
+	Type string
+	Data json.RawMessage
+
+	// Err is set on a final event when the stream broke off, e.g. the
+	// connection dropped, rather than ending with the server's last event.
+	Err error
+}
+
+// Stream sends a prompt and returns its events as they arrive. The channel
+// closes after the prompt's final event (done, error or cancelled), or when
+// ctx is cancelled, which also disconnects and so stops the prompt. Errors
+// before the stream starts, such as a busy session, are returned directly.
+func (c *Client) Stream(ctx context.Context, sessionID, prompt string) (<-chan Event, error) {
+	resp, err := c.do(ctx, http.MethodPost, sessionPath(sessionID)+"/prompt", internal.PromptRequest{Prompt: prompt})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		defer resp.Body.Close()
+		send := func(e Event) bool {
+			select {
+			case events <- e:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if err := readSSE(resp.Body, send); err != nil && ctx.Err() == nil {
+			send(Event{Err: err})
+		}
+	}()
+	return events, nil
+}
+
+// readSSE parses server-sent events from r, passing each to send until send
+// returns false or r ends.
+func readSSE(r io.Reader, send func(Event) bool) error {
+	reader := bufio.NewReader(r)
+	var event Event
+	var data []byte
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// A blank line ends the event
+			if event.Type != "" || data != nil {
+				event.Data = data
+				if !send(event) {
+					return nil
+				}
+			}
+			event, data = Event{}, nil
+		case strings.HasPrefix(line, ":"):
+			// Comment
+		case strings.HasPrefix(line, "event:"):
+			event.Type = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+}
+
+// sessionPath returns the API path of a session.
+func sessionPath(id string) string {
+	return "/api/sessions/" + url.PathEscape(id)
+}
+
+// call sends a request with body encoded as JSON, if not nil, and decodes a
+// 2xx response into out, if not nil.
+func (c *Client) call(ctx context.Context, method, path string, body, out any) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// do sends a request with body encoded as JSON, if not nil.
+func (c *Client) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	}
+	return c.httpClient.Do(req)
+}
+
+// decodeError builds an APIError from a failed response's {"error","fields"} body.
+func decodeError(resp *http.Response) error {
+	var body internal.ValidationError
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(data, &body); err != nil || body.Error == "" {
+		body.Error = strings.TrimSpace(string(data))
+		if body.Error == "" {
+			body.Error = http.StatusText(resp.StatusCode)
+		}
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: body.Error, Fields: body.Fields}
+}
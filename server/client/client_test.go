@@ -0,0 +1,208 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"chai/server/internal"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// setupTestServer serves the real handlers, running the given shell script as
+// the Claude CLI, and returns a client for them.
+func setupTestServer(t *testing.T, claudeScript string) *Client {
+	t.Helper()
+
+	repo, err := internal.NewRepository(filepath.Join(t.TempDir(), "chai.db"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create repository: %v", err)
+	}
+	t.Cleanup(func() { repo.Close() })
+
+	claudeCmd := filepath.Join(t.TempDir(), "fake-claude")
+	if err := os.WriteFile(claudeCmd, []byte("#!/bin/sh\n"+claudeScript), 0o755); err != nil {
+		t.Fatalf("Failed to write fake claude: %v", err)
+	}
+	handlers := internal.NewHandlers(repo, internal.NewClaudeManager(t.TempDir(), claudeCmd, nil), time.Minute, nil)
+
+	r := chi.NewRouter()
+	r.Route("/api/sessions", func(r chi.Router) {
+		r.Get("/", handlers.ListSessions)
+		r.Post("/", handlers.CreateSession)
+		r.Route("/{id}", func(r chi.Router) {
+			r.Get("/", handlers.GetSession)
+			r.Delete("/", handlers.DeleteSession)
+			r.Post("/prompt", handlers.Prompt)
+			r.Post("/approve", handlers.Approve)
+		})
+	})
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return New(server.URL, nil)
+}
+
+// assistantText returns the text of a claude event's assistant message.
+func assistantText(e Event) string {
+	var line struct {
+		Type    string
+		Message struct {
+			Content []struct{ Type, Text string }
+		}
+	}
+	if e.Type != "claude" || json.Unmarshal(e.Data, &line) != nil || line.Type != "assistant" {
+		return ""
+	}
+	var text string
+	for _, block := range line.Message.Content {
+		text += block.Text
+	}
+	return text
+}
+
+// collect reads a stream to its end, calling onEvent for each event.
+func collect(t *testing.T, events <-chan Event, onEvent func(Event)) []string {
+	t.Helper()
+	var types []string
+	for e := range events {
+		if e.Err != nil {
+			t.Fatalf("Stream broke off: %v", e.Err)
+		}
+		types = append(types, e.Type)
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+	return types
+}
+
+func TestClient_Sessions(t *testing.T) {
+	c := setupTestServer(t, "")
+	ctx := context.Background()
+
+	created, err := c.CreateSession(ctx, CreateSessionRequest{Title: "Refactor"})
+	if err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if created.ID == "" || created.Title == nil || *created.Title != "Refactor" {
+		t.Fatalf("Created = %+v, want a session titled Refactor", created)
+	}
+
+	got, err := c.GetSession(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got.Session.ID != created.ID || got.Messages == nil || len(got.Messages) != 0 {
+		t.Errorf("GetSession = %+v, want the session with no messages", got)
+	}
+
+	sessions, err := c.ListSessions(ctx)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != created.ID {
+		t.Errorf("ListSessions = %+v, want the created session", sessions)
+	}
+
+	if err := c.DeleteSession(ctx, created.ID); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	if _, err := c.GetSession(ctx, created.ID); !IsNotFound(err) {
+		t.Errorf("GetSession after delete = %v, want a 404", err)
+	}
+}
+
+func TestClient_ValidationError(t *testing.T) {
+	c := setupTestServer(t, "")
+
+	_, err := c.CreateSession(context.Background(), CreateSessionRequest{PermissionMode: "yolo"})
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("CreateSession error = %v, want an APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Fields["permission_mode"] == "" {
+		t.Errorf("APIError = %+v, want a 400 naming permission_mode", apiErr)
+	}
+}
+
+func TestClient_Stream(t *testing.T) {
+	c := setupTestServer(t, `read line
+echo '{"type":"assistant","message":{"content":[{"type":"text","text":"Hello"}]}}'
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	ctx := context.Background()
+	session, _ := c.CreateSession(ctx, CreateSessionRequest{})
+
+	events, err := c.Stream(ctx, session.ID, "hi")
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	var text string
+	types := collect(t, events, func(e Event) { text += assistantText(e) })
+
+	if types[0] != "connected" || types[len(types)-1] != "done" {
+		t.Errorf("Events = %v, want connected first and done last", types)
+	}
+	if text != "Hello" {
+		t.Errorf("Text = %q, want Hello", text)
+	}
+
+	resp, _ := c.GetSession(ctx, session.ID)
+	if len(resp.Messages) != 2 || resp.Messages[1].Content != "Hello" {
+		t.Errorf("Messages = %+v, want the prompt and reply", resp.Messages)
+	}
+}
+
+func TestClient_StreamMissingSession(t *testing.T) {
+	c := setupTestServer(t, "")
+
+	// A missing session fails before any event is streamed
+	if _, err := c.Stream(context.Background(), "missing", "hi"); !IsNotFound(err) {
+		t.Errorf("Stream error = %v, want a 404", err)
+	}
+}
+
+func TestClient_Approve(t *testing.T) {
+	// The fake CLI only replies once its tool use is allowed
+	c := setupTestServer(t, `read line
+echo '{"type":"control_request","request_id":"req-1","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"ls"}}}'
+read response
+case "$response" in
+*'"behavior":"allow"'*) echo '{"type":"assistant","message":{"content":[{"type":"text","text":"Listed"}]}}' ;;
+esac
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	ctx := context.Background()
+	session, _ := c.CreateSession(ctx, CreateSessionRequest{})
+
+	events, err := c.Stream(ctx, session.ID, "list files")
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	var text string
+	types := collect(t, events, func(e Event) {
+		text += assistantText(e)
+		if e.Type != "permission_request" {
+			return
+		}
+		var permission struct {
+			RequestID string `json:"request_id"`
+		}
+		json.Unmarshal(e.Data, &permission)
+		if err := c.Approve(ctx, session.ID, ApproveRequest{ToolUseID: permission.RequestID, Decision: "allow"}); err != nil {
+			t.Errorf("Approve failed: %v", err)
+		}
+	})
+
+	if !slices.Contains(types, "permission_request") || text != "Listed" {
+		t.Errorf("Events = %v with text %q, want a permission request and then the reply", types, text)
+	}
+}
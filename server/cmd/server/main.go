@@ -5,6 +5,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +19,9 @@ import (
 	"chai/server/internal"
 )
 
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
 	// Register flags
 	f := internal.RegisterFlags()
@@ -38,27 +42,162 @@ func main() {
 		cfg.WorkDir = wd
 	}
 
-	// Make db path absolute
+	// Make db and backup paths absolute, under the data dir if one is set
+	dataDir := cfg.WorkDir
+	if cfg.DataDir != "" {
+		dataDir = cfg.DataDir
+	}
 	if !filepath.IsAbs(cfg.DBPath) {
-		cfg.DBPath = filepath.Join(cfg.WorkDir, cfg.DBPath)
+		cfg.DBPath = filepath.Join(dataDir, cfg.DBPath)
+	}
+	if cfg.BackupDir != "" && !filepath.IsAbs(cfg.BackupDir) {
+		cfg.BackupDir = filepath.Join(dataDir, cfg.BackupDir)
+	}
+	if cfg.ClaudeLogFile != "" && !filepath.IsAbs(cfg.ClaudeLogFile) {
+		cfg.ClaudeLogFile = filepath.Join(dataDir, cfg.ClaudeLogFile)
+	}
+	if !filepath.IsAbs(cfg.TLSAutocertCache) {
+		cfg.TLSAutocertCache = filepath.Join(dataDir, cfg.TLSAutocertCache)
 	}
 
 	// Initialize repository
-	repo, err := internal.NewRepository(cfg.DBPath)
+	repo, err := internal.NewRepository(cfg.DBPath, &internal.RepositoryOptions{
+		UniqueTitles: cfg.UniqueTitles,
+		BusyTimeout:  cfg.DBBusyTimeout,
+		JournalMode:  cfg.DBJournalMode,
+		ReadConns:    cfg.DBReadConns,
+
+		MaxSessions:          cfg.MaxSessions,
+		ArchiveOldestOnLimit: cfg.ArchiveOldestSessions,
+		MaxEventsPerPrompt:   cfg.MaxEventsPerPrompt,
+		CompressEvents:       cfg.CompressEvents,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer repo.Close()
 
-	// Start background event cleanup (every 5 minutes, delete events older than 1 hour)
-	stopCleanup := repo.StartEventCleanup(5*time.Minute, 1*time.Hour)
+	// Start background event cleanup (every 5 minutes, delete events older than
+	// 1 hour), reclaiming the freed space and WAL growth after it deletes
+	stopCleanup := repo.StartEventCleanup(5*time.Minute, 1*time.Hour, internal.DBMaintenance{
+		Interval: cfg.DBMaintenanceInterval,
+		Vacuum:   cfg.DBVacuum,
+	})
 	defer stopCleanup()
 
+	// Claude CLI stderr and stdin logging go to the server log unless a file
+	// is configured, since stdin payloads can carry tool input
+	claudeLogOut := log.Writer()
+	if cfg.ClaudeLogFile != "" {
+		logFile, err := os.OpenFile(cfg.ClaudeLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalf("Failed to open Claude log file: %v", err)
+		}
+		defer logFile.Close()
+		claudeLogOut = logFile
+	}
+
 	// Initialize Claude manager
-	claude := internal.NewClaudeManager(cfg.WorkDir, cfg.ClaudeCmd)
+	claude := internal.NewClaudeManager(cfg.WorkDir, cfg.ClaudeCmd, &internal.ClaudeManagerOptions{
+		MaxLineBytes:       cfg.MaxOutputLineBytes,
+		PendingRequestTTL:  cfg.PendingRequestTTL,
+		PermissionTimeout:  cfg.PermissionTimeout,
+		MaxPendingRequests: cfg.MaxPendingRequests,
+		ExtraArgs:          cfg.ExtraClaudeArgs,
+		StdinWriteTimeout:  cfg.StdinWriteTimeout,
+		Logger:             log.New(claudeLogOut, cfg.ClaudeLogPrefix, log.LstdFlags|log.Lmsgprefix),
+		QuietStderr:        !cfg.ClaudeLogStderr,
+		StdinLog:           cfg.ClaudeLogStdin,
+	})
+
+	// Drop stale entries from the Claude manager's in-memory maps
+	if cfg.OrphanSweepInterval > 0 {
+		stopClaudeSweeper := claude.StartSweeper(cfg.OrphanSweepInterval)
+		defer stopClaudeSweeper()
+	}
+
+	// Purge sessions that have outlived the recycle bin retention
+	if cfg.DeletedRetention > 0 {
+		stopPurger := internal.StartDeletedSessionPurger(repo, min(cfg.DeletedRetention, time.Hour), cfg.DeletedRetention)
+		defer stopPurger()
+	}
+
+	// Archive sessions with no recent activity
+	if cfg.AutoArchiveAfter > 0 {
+		stopArchiver := internal.StartAutoArchiver(repo, min(cfg.AutoArchiveAfter, time.Hour), cfg.AutoArchiveAfter)
+		defer stopArchiver()
+	}
+
+	// Check for the Claude CLI and probe its version once. Unless it is
+	// required, a missing CLI is reported by /api/info rather than stopping
+	// the server
+	info := internal.InfoResponse{Version: version, ClaudeCmd: cfg.ClaudeCmd}
+	if err := claude.Validate(); err != nil {
+		if cfg.RequireClaude {
+			log.Fatalf("Claude CLI check failed: %v", err)
+		}
+		log.Printf("WARNING: %v; prompts will fail until it is installed", err)
+		info.ClaudeError = err.Error()
+	} else {
+		versionCtx, cancelVersion := context.WithTimeout(context.Background(), 10*time.Second)
+		if v, err := claude.Version(versionCtx); err != nil {
+			log.Printf("Warning: could not determine Claude CLI version: %v", err)
+			info.ClaudeError = err.Error()
+		} else {
+			log.Printf("Claude CLI version %s", v)
+			info.ClaudeAvailable = true
+			info.ClaudeVersion = v
+		}
+		cancelVersion()
+	}
+
+	// Deliver lifecycle webhooks in the background
+	var webhooks *internal.WebhookDispatcher
+	if cfg.WebhookURL != "" {
+		webhooks = internal.NewWebhookDispatcher(internal.WebhookOptions{URL: cfg.WebhookURL, Secret: cfg.WebhookSecret})
+		defer webhooks.Close()
+	}
 
 	// Initialize handlers
-	handlers := internal.NewHandlers(repo, claude, cfg.PromptTimeout)
+	handlers := internal.NewHandlers(repo, claude, cfg.PromptTimeout, &internal.HandlersOptions{
+		SSEBufferSize:        cfg.SSEBufferSize,
+		MaxStreamDuration:    cfg.MaxStreamDuration,
+		CollapseErrors:       cfg.CollapseErrors,
+		MaxPromptBytes:       cfg.MaxPromptBytes,
+		LenientTemplates:     cfg.LenientTemplates,
+		LockWorkdir:          cfg.LockWorkdirAcrossSessions,
+		WorkDir:              cfg.WorkDir,
+		EnvPolicy:            internal.NewEnvPolicy(cfg.SessionEnvAllow, cfg.SessionEnvDeny),
+		ClaudeCmdAllow:       internal.NewCommandAllowlist(cfg.ClaudeCmdAllow),
+		DeletedRetention:     cfg.DeletedRetention,
+		PersistSnapshots:     cfg.PersistSnapshots,
+		TextEvents:           cfg.TextEvents,
+		ToolEvents:           cfg.ToolEvents,
+		ThinkingEvents:       cfg.ThinkingEvents,
+		PersistThinking:      cfg.PersistThinking,
+		PersistEventTypes:    internal.NewEventTypeFilter(cfg.PersistEventTypes),
+		LongPollTimeout:      cfg.LongPollTimeout,
+		IdempotencyWindow:    cfg.IdempotencyWindow,
+		MaxPromptTimeout:     cfg.MaxPromptTimeout,
+		BackupDir:            cfg.BackupDir,
+		MaxAttachments:       cfg.MaxAttachments,
+		MaxAttachmentBytes:   cfg.MaxAttachmentBytes,
+		AllowRawArgs:         cfg.AllowRawArgs,
+		AuthToken:            cfg.AuthToken,
+		CreateWorkDir:        cfg.CreateWorkDir,
+		ConcurrentPrompts:    cfg.ConcurrentPrompts,
+		MaxConcurrentPrompts: cfg.MaxConcurrentPrompts,
+		ReadOnly:             cfg.ReadOnly,
+		Webhooks:             webhooks,
+		Info:                 info,
+	})
+
+	// Reset sessions left streaming without a live process (e.g. after a
+	// handler panic). Handlers also counts prompts waiting for a slot as live.
+	if cfg.OrphanSweepInterval > 0 {
+		stopSweeper := internal.StartStreamSweeper(repo, handlers, cfg.OrphanSweepInterval, cfg.OrphanStreamTimeout, internal.StreamStatus(cfg.OrphanStreamStatus))
+		defer stopSweeper()
+	}
 
 	// Set up Chi router with middleware
 	r := chi.NewRouter()
@@ -67,33 +206,79 @@ func main() {
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	// In read-only mode only the admin API, which can turn it off, may write
+	r.Use(internal.RejectWritesWhenReadOnly(handlers.ReadOnly(), internal.IsAdminRequest))
 
 	// Health check
 	r.Get("/health", handlers.Health)
 
+	// OpenAPI description of the routes below
+	r.Get("/openapi.json", handlers.OpenAPI)
+
+	// Each open prompt stream holds a connection, so cap them per client. The
+	// one limiter covers both /api and the chat completions route below.
+	limitStreams := internal.LimitConnectionsPerIP(cfg.MaxSSEConnectionsPerIP, internal.IsPromptRequest)
+
+	// OpenAI-compatible chat completions, streamed like /prompt so no request timeout
+	r.With(limitStreams).Post("/v1/chat/completions", handlers.ChatCompletions)
+
 	// API routes with grouping
 	r.Route("/api", func(r chi.Router) {
+		// Prompts stream for up to the prompt timeout and long-polls wait up to
+		// the long-poll timeout, so they are exempt. So are the full export and
+		// backup, which TimeoutHandler would otherwise buffer whole in memory.
+		r.Use(internal.RequestTimeout(cfg.RequestTimeout, func(r *http.Request) bool {
+			return internal.IsPromptRequest(r) || internal.IsLongPollRequest(r) || internal.IsBulkExportRequest(r)
+		}))
+		r.Use(limitStreams)
+
+		r.Get("/info", handlers.Info)
+
 		r.Route("/sessions", func(r chi.Router) {
 			r.Get("/", handlers.ListSessions)
 			r.Post("/", handlers.CreateSession)
+			r.Get("/count", handlers.CountSessions)
 
 			r.Route("/{id}", func(r chi.Router) {
 				r.Get("/", handlers.GetSession)
 				r.Delete("/", handlers.DeleteSession)
+				r.Post("/system", handlers.SetSystemMessage)
+				r.Post("/fork", handlers.ForkSession)
 				r.Post("/prompt", handlers.Prompt)
+				r.Post("/prompt/preflight", handlers.PromptPreflight)
+				r.Post("/retry-failed", handlers.RetryFailed)
+				r.Post("/continue", handlers.Continue)
 				r.Post("/approve", handlers.Approve)
+				r.Post("/cancel", handlers.Cancel)
+				r.Post("/archive", handlers.Archive)
+				r.Post("/unarchive", handlers.Unarchive)
+				r.Post("/restore", handlers.Restore)
 				r.Get("/events", handlers.GetEvents)
+				r.Delete("/events", handlers.DeleteEvents)
+				r.Get("/bookmark", handlers.GetBookmark)
+				r.Put("/bookmark", handlers.SetBookmark)
+				r.Get("/prompts/{promptId}/snapshot", handlers.GetPromptSnapshot)
+				r.Get("/stats", handlers.GetSessionStats)
 			})
 		})
+
+		// Operator endpoints, protected by the auth token when one is configured
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(internal.RequireAuthToken(cfg.AuthToken))
+			r.Get("/active", handlers.ListActive)
+			r.Post("/active/kill", handlers.KillActiveOlderThan)
+			r.Post("/active/{id}/kill", handlers.KillActive)
+			r.Get("/export-all", handlers.ExportAll)
+			r.Get("/stats", handlers.Stats)
+			r.Post("/backup", handlers.Backup)
+			r.Get("/readonly", handlers.GetReadOnly)
+			r.Post("/readonly", handlers.SetReadOnly)
+		})
 	})
 
 	// Create server
 	addr := fmt.Sprintf(":%d", cfg.Port)
-	server := &http.Server{
-		Addr:        addr,
-		Handler:     r,
-		IdleTimeout: 10 * time.Minute,
-	}
+	server := internal.NewHTTPServer(addr, internal.WithBasePath(cfg.BasePath, r), cfg.EnableH2C)
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -103,23 +288,33 @@ func main() {
 		sig := <-sigChan
 		log.Printf("Received signal %v, shutting down...", sig)
 
-		// Kill all Claude processes
-		claude.Shutdown()
-
-		// Graceful HTTP shutdown with timeout
-		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("HTTP server shutdown error: %v", err)
-		}
+		internal.Shutdown(server, handlers, claude, internal.ShutdownOptions{
+			Mode:           cfg.ShutdownMode,
+			Timeout:        cfg.ShutdownTimeout,
+			ReconnectDelay: cfg.ReconnectDelay,
+		})
 	}()
 
-	// Start server
-	log.Printf("Server starting on %s", addr)
+	// Certificates for the autocert domains are obtained on first use
+	if cfg.TLSAutocertDomains != "" {
+		server.TLSConfig = internal.NewAutocertManager(cfg.TLSAutocertDomains, cfg.TLSAutocertCache, cfg.TLSAutocertEmail).TLSConfig()
+		log.Printf("Autocert domains: %s (cache %s)", cfg.TLSAutocertDomains, cfg.TLSAutocertCache)
+	}
+
+	// Start server, over TLS when a certificate is configured
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	scheme := "http"
+	if cfg.TLSCertFile != "" || cfg.TLSAutocertDomains != "" {
+		scheme = "https"
+	}
+	log.Printf("Server starting on %s%s (%s)", addr, cfg.BasePath, scheme)
 	log.Printf("Database: %s", cfg.DBPath)
 	log.Printf("Working directory: %s", cfg.WorkDir)
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+	if err := internal.Serve(server, ln, cfg.TLSCertFile, cfg.TLSKeyFile); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
 
@@ -1,6 +1,6 @@
 module chai/server
 
-go 1.22
+go 1.24.0
 
 require (
 	github.com/google/uuid v1.6.0
@@ -8,3 +8,9 @@ require (
 )
 
 require github.com/go-chi/chi/v5 v5.2.4
+
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/net v0.47.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+)
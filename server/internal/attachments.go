@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrAttachmentTooLarge is returned when an attachment exceeds the size limit
+var ErrAttachmentTooLarge = errors.New("attachment too large")
+
+// attachmentMediaTypes are the image types Claude accepts
+var attachmentMediaTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// resolveAttachments validates prompt attachments against the count and size
+// limits and loads path attachments from workDir. It returns the image sources
+// to send to Claude and the info to record on the user message.
+func resolveAttachments(attachments []Attachment, workDir string, maxCount, maxBytes int) ([]ImageSource, []AttachmentInfo, error) {
+	if len(attachments) > maxCount {
+		return nil, nil, fmt.Errorf("too many attachments: %d exceeds %d", len(attachments), maxCount)
+	}
+
+	images := make([]ImageSource, 0, len(attachments))
+	infos := make([]AttachmentInfo, 0, len(attachments))
+	for i, a := range attachments {
+		var data []byte
+		var err error
+		switch {
+		case a.Data != "" && a.Path != "":
+			return nil, nil, fmt.Errorf("attachment %d: set data or path, not both", i)
+		case a.Data != "":
+			if base64.StdEncoding.DecodedLen(len(a.Data)) > maxBytes+2 {
+				return nil, nil, fmt.Errorf("attachment %d: %w", i, ErrAttachmentTooLarge)
+			}
+			if data, err = base64.StdEncoding.DecodeString(a.Data); err != nil {
+				return nil, nil, fmt.Errorf("attachment %d: invalid base64 data", i)
+			}
+		case a.Path != "":
+			if data, err = readAttachmentFile(a.Path, workDir, maxBytes); err != nil {
+				return nil, nil, fmt.Errorf("attachment %d: %w", i, err)
+			}
+		default:
+			return nil, nil, fmt.Errorf("attachment %d: data or path is required", i)
+		}
+		if len(data) > maxBytes {
+			return nil, nil, fmt.Errorf("attachment %d: %w", i, ErrAttachmentTooLarge)
+		}
+
+		mediaType := a.MediaType
+		if mediaType == "" {
+			mediaType = http.DetectContentType(data)
+		}
+		if !attachmentMediaTypes[mediaType] {
+			return nil, nil, fmt.Errorf("attachment %d: unsupported media type %q", i, mediaType)
+		}
+
+		images = append(images, ImageSource{
+			Type:      "base64",
+			MediaType: mediaType,
+			Data:      base64.StdEncoding.EncodeToString(data),
+		})
+		infos = append(infos, AttachmentInfo{MediaType: mediaType, SizeBytes: len(data), Path: a.Path})
+	}
+	return images, infos, nil
+}
+
+// readAttachmentFile reads path, relative to workDir unless absolute, refusing
+// files that resolve outside workDir or are larger than maxBytes.
+func readAttachmentFile(path, workDir string, maxBytes int) ([]byte, error) {
+	base := resolveWorkDir(workDir)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, errors.New("file not found")
+	}
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.New("path is outside the working directory")
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, errors.New("file not found")
+	}
+	if info.Size() > int64(maxBytes) {
+		return nil, ErrAttachmentTooLarge
+	}
+	return os.ReadFile(resolved)
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPNG is enough of a PNG for content sniffing
+var testPNG = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestResolveAttachments_Data(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+
+	images, infos, err := resolveAttachments([]Attachment{
+		{Data: encoded},
+		{Data: encoded, MediaType: "image/webp"},
+	}, t.TempDir(), 10, 1024)
+	if err != nil {
+		t.Fatalf("resolveAttachments failed: %v", err)
+	}
+
+	if len(images) != 2 || images[0].Type != "base64" || images[0].Data != encoded {
+		t.Fatalf("Images = %+v", images)
+	}
+	if images[0].MediaType != "image/png" {
+		t.Errorf("Detected media type = %s, want image/png", images[0].MediaType)
+	}
+	if images[1].MediaType != "image/webp" {
+		t.Errorf("Explicit media type = %s, want image/webp", images[1].MediaType)
+	}
+	if infos[0].SizeBytes != len(testPNG) || infos[0].Path != "" {
+		t.Errorf("Info = %+v, want size %d and no path", infos[0], len(testPNG))
+	}
+}
+
+func TestResolveAttachments_Path(t *testing.T) {
+	workDir := t.TempDir()
+	os.MkdirAll(filepath.Join(workDir, "img"), 0o755)
+	os.WriteFile(filepath.Join(workDir, "img", "shot.png"), testPNG, 0o644)
+
+	images, infos, err := resolveAttachments([]Attachment{{Path: "img/shot.png"}}, workDir, 10, 1024)
+	if err != nil {
+		t.Fatalf("resolveAttachments failed: %v", err)
+	}
+	if images[0].Data != base64.StdEncoding.EncodeToString(testPNG) || images[0].MediaType != "image/png" {
+		t.Errorf("Image = %+v, want the file contents as png", images[0])
+	}
+	if infos[0].Path != "img/shot.png" {
+		t.Errorf("Info path = %q, want img/shot.png", infos[0].Path)
+	}
+}
+
+func TestResolveAttachments_Invalid(t *testing.T) {
+	workDir := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.png"), testPNG, 0o644)
+	os.Symlink(filepath.Join(outside, "secret.png"), filepath.Join(workDir, "link.png"))
+	os.WriteFile(filepath.Join(workDir, "notes.txt"), []byte("plain text"), 0o644)
+
+	encoded := base64.StdEncoding.EncodeToString(testPNG)
+	tests := []struct {
+		name        string
+		attachments []Attachment
+		want        string
+	}{
+		{"too many", []Attachment{{Data: encoded}, {Data: encoded}, {Data: encoded}}, "too many attachments"},
+		{"neither", []Attachment{{MediaType: "image/png"}}, "data or path is required"},
+		{"both", []Attachment{{Data: encoded, Path: "a.png"}}, "not both"},
+		{"bad base64", []Attachment{{Data: "not base64!"}}, "invalid base64"},
+		{"unsupported type", []Attachment{{Path: "notes.txt"}}, "unsupported media type"},
+		{"missing file", []Attachment{{Path: "missing.png"}}, "file not found"},
+		{"parent dir", []Attachment{{Path: "../" + filepath.Base(outside) + "/secret.png"}}, "outside the working directory"},
+		{"absolute outside", []Attachment{{Path: filepath.Join(outside, "secret.png")}}, "outside the working directory"},
+		{"symlink escape", []Attachment{{Path: "link.png"}}, "outside the working directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := resolveAttachments(tt.attachments, workDir, 2, 32)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveAttachments_TooLarge(t *testing.T) {
+	workDir := t.TempDir()
+	large := append(append([]byte{}, testPNG...), make([]byte, 64)...)
+	os.WriteFile(filepath.Join(workDir, "big.png"), large, 0o644)
+
+	for _, a := range []Attachment{
+		{Data: base64.StdEncoding.EncodeToString(large)},
+		{Path: "big.png"},
+	} {
+		if _, _, err := resolveAttachments([]Attachment{a}, workDir, 10, 32); !errors.Is(err, ErrAttachmentTooLarge) {
+			t.Errorf("resolveAttachments(%+v) = %v, want ErrAttachmentTooLarge", a, err)
+		}
+	}
+}
@@ -2,60 +2,374 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"os"
 	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+// ErrPromptCancelled is returned by RunPrompt when the prompt was cancelled via CancelPrompt
+var ErrPromptCancelled = errors.New("prompt cancelled")
+
+// ErrShuttingDown is returned by RunPrompt once Drain has been called
+var ErrShuttingDown = errors.New("server is shutting down")
+
 // ClaudeProcess manages a running Claude CLI instance
 type ClaudeProcess struct {
-	cmd    *exec.Cmd
-	stdin  io.WriteCloser
-	stdout io.ReadCloser
-	stderr io.ReadCloser
-	mu     sync.Mutex
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	stdout    io.ReadCloser
+	stderr    io.ReadCloser
+	startedAt time.Time
+	cancelled atomic.Bool
+	exited    atomic.Bool // set once cmd.Wait has returned
+	mu        sync.Mutex
+	// stdinBroken is set, under mu, once a stdin write times out. The
+	// abandoned write may still complete, so nothing else may be written
+	// after it or the two frames could interleave.
+	stdinBroken bool
+}
+
+// ActiveProcess describes a running Claude CLI process
+type ActiveProcess struct {
+	SessionID string
+	PromptID  string // only set for concurrent prompts
+	StartedAt time.Time
+}
+
+// processKey returns the processes map key for a prompt. Single-flight
+// sessions run at most one process, keyed by the session alone; concurrent
+// prompts each get their own entry.
+func processKey(sessionID, promptID string) string {
+	if promptID == "" {
+		return sessionID
+	}
+	return sessionID + "/" + promptID
+}
+
+// splitProcessKey is the inverse of processKey
+func splitProcessKey(key string) (sessionID, promptID string) {
+	sessionID, promptID, _ = strings.Cut(key, "/")
+	return sessionID, promptID
 }
 
 // PendingRequest stores data from a control_request for later response
 type PendingRequest struct {
 	RequestID string
 	SessionID string
+	PromptID  string // the concurrent prompt that asked, if any
+	ToolName  string
 	ToolInput map[string]any
+	CreatedAt time.Time
+
+	timer *time.Timer // denies the request when PermissionTimeout passes
+}
+
+// defaultMaxLineBytes is the largest Claude CLI stdout line accepted when unconfigured.
+// Lines are buffered only as far as they actually grow, so this is a safety cap.
+const defaultMaxLineBytes = 64 * 1024 * 1024
+
+// ErrLineTooLong is returned when Claude CLI writes a stdout line over the configured limit
+var ErrLineTooLong = errors.New("claude output line too long")
+
+// ErrStdinWriteTimeout is returned when a write to Claude CLI stdin does not
+// complete within the configured StdinWriteTimeout
+var ErrStdinWriteTimeout = errors.New("claude stdin write timed out")
+
+// ErrPermissionRequestNotFound is returned when answering a permission request
+// the server already settled itself: swept, timed out or evicted
+var ErrPermissionRequestNotFound = errors.New("permission request not found")
+
+// ErrProcessNotFound is returned when killing a session or prompt that has no
+// running Claude process, e.g. because it exited in the meantime
+var ErrProcessNotFound = errors.New("no running claude process")
+
+// ErrClaudeNotFound is returned by Version and RunPrompt when the Claude CLI
+// command does not exist
+var ErrClaudeNotFound = errors.New("claude CLI not found")
+
+// ErrClaudeTimeout is returned by RunPrompt when the prompt's context deadline
+// passes before Claude finishes. It also matches context.DeadlineExceeded.
+var ErrClaudeTimeout = errors.New("claude prompt timed out")
+
+// stderrTailBytes is how much of the end of Claude's stderr a ClaudeExitError keeps
+const stderrTailBytes = 4 * 1024
+
+// stderrDrainTimeout bounds how long RunPrompt waits for Claude's stderr to
+// close once stdout has
+const stderrDrainTimeout = time.Second
+
+// ClaudeExitError is returned by RunPrompt when the Claude CLI exits with an
+// error on its own (not cancelled, killed by chai or timed out).
+type ClaudeExitError struct {
+	Code   int    // exit code, or -1 if the process was killed by a signal
+	Signal string // the signal that killed the process, e.g. "killed" for an OOM kill
+	Stderr string // the end of the CLI's stderr, up to stderrTailBytes
+}
+
+func (e *ClaudeExitError) Error() string {
+	msg := fmt.Sprintf("claude exited with code %d", e.Code)
+	if e.Signal != "" {
+		msg = "claude killed by signal: " + e.Signal
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// ClaudeResultError is returned by RunPrompt when Claude's result event
+// reports a failed turn, such as subtype "error_max_turns" or
+// "error_during_execution", even if the CLI then exits cleanly.
+type ClaudeResultError struct {
+	Subtype string
+}
+
+func (e *ClaudeResultError) Error() string {
+	return fmt.Sprintf("claude result: %s", e.Subtype)
+}
+
+// resultFailed reports whether a result event's subtype marks a failed turn.
+// Older CLIs omit the subtype, so only an explicit non-success value counts.
+func resultFailed(subtype string) bool {
+	return subtype != "" && subtype != "success"
+}
+
+// tailBuffer keeps the last max bytes written to it
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.buf)
+}
+
+// claudeVersionPattern matches the version number in `claude --version` output,
+// e.g. "1.0.3 (Claude Code)"
+var claudeVersionPattern = regexp.MustCompile(`\d+\.\d+(\.\d+)?[0-9A-Za-z.+-]*`)
+
+// ClaudeManagerOptions configures optional ClaudeManager behavior.
+type ClaudeManagerOptions struct {
+	// MaxLineBytes is the largest single JSON line read from Claude CLI stdout.
+	// Zero uses a 64MB limit.
+	MaxLineBytes int
+
+	// PendingRequestTTL is how long a permission request may wait for a
+	// decision before the sweep drops it. Zero keeps requests until answered.
+	PendingRequestTTL time.Duration
+
+	// PermissionTimeout is how long a running prompt's permission request may
+	// wait for a decision before it is denied, so a Claude process isn't left
+	// blocked on stdin by a client that went away. Zero waits indefinitely.
+	PermissionTimeout time.Duration
+
+	// ExtraArgs are appended to every Claude CLI invocation after the built-in
+	// args and before the session's own extra args.
+	ExtraArgs []string
+
+	// MaxPendingRequests caps the pending request map; storing past the cap
+	// evicts the oldest request. Zero means no cap.
+	MaxPendingRequests int
+
+	// StdinWriteTimeout bounds how long a permission response may block writing
+	// to a wedged process's stdin. Zero waits indefinitely.
+	StdinWriteTimeout time.Duration
+
+	// Logger receives the Claude CLI's stderr lines and the permission
+	// responses written to its stdin. Nil uses the standard logger.
+	Logger *log.Logger
+
+	// QuietStderr stops logging the Claude CLI's stderr. The end of it is still
+	// kept for ClaudeExitError.
+	QuietStderr bool
+
+	// StdinLog is how permission responses written to stdin are logged:
+	// StdinLogFull, StdinLogRedacted or StdinLogOff. Empty is StdinLogRedacted.
+	StdinLog string
+}
+
+// How permission responses written to the Claude CLI's stdin are logged. The
+// full payload repeats the tool input, which may hold file contents or secrets.
+const (
+	StdinLogFull     = "full"     // the JSON payload as written
+	StdinLogRedacted = "redacted" // the request ID, decision and size only
+	StdinLogOff      = "off"
+)
+
+// ClaudeManagerStats reports the size of the manager's maps and how many
+// entries cleanup has removed since startup.
+type ClaudeManagerStats struct {
+	Processes               int   `json:"processes"`
+	PendingRequests         int   `json:"pending_requests"`
+	SweptPendingRequests    int64 `json:"swept_pending_requests"`
+	SweptProcesses          int64 `json:"swept_processes"`
+	EvictedPendingRequests  int64 `json:"evicted_pending_requests"`
+	TimedOutPendingRequests int64 `json:"timed_out_pending_requests"`
 }
 
 // ClaudeManager handles Claude CLI interactions
 type ClaudeManager struct {
 	workingDir      string
 	claudeCmd       string
-	processes       map[string]*ClaudeProcess  // sessionID -> process
+	opts            ClaudeManagerOptions
+	processes       map[string]*ClaudeProcess  // processKey(sessionID, promptID) -> process
 	pendingRequests map[string]*PendingRequest // requestID -> pending request data
+	settled         map[string]string          // requestID -> sessionID of requests swept, timed out or evicted
+	settledOrder    []string                   // settled request IDs, oldest first
+	active          sync.WaitGroup             // running RunPrompt calls
+	draining        bool                       // guarded by mu; set once by Drain
+	stats           ClaudeManagerStats         // guarded by mu; map sizes are filled in by Stats
 	mu              sync.RWMutex
 }
 
-func NewClaudeManager(workingDir, claudeCmd string) *ClaudeManager {
-	return &ClaudeManager{
+// NewClaudeManager creates a manager for Claude CLI processes. A nil opts uses the defaults.
+func NewClaudeManager(workingDir, claudeCmd string, opts *ClaudeManagerOptions) *ClaudeManager {
+	cm := &ClaudeManager{
 		workingDir:      workingDir,
 		claudeCmd:       claudeCmd,
 		processes:       make(map[string]*ClaudeProcess),
 		pendingRequests: make(map[string]*PendingRequest),
+		settled:         make(map[string]string),
 	}
+	if opts != nil {
+		cm.opts = *opts
+	}
+	if cm.opts.MaxLineBytes <= 0 {
+		cm.opts.MaxLineBytes = defaultMaxLineBytes
+	}
+	if cm.opts.Logger == nil {
+		cm.opts.Logger = log.Default()
+	}
+	return cm
 }
 
 // StorePendingRequest saves control_request data for later response
 func (cm *ClaudeManager) StorePendingRequest(sessionID, requestID string, toolInput map[string]any) {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-	cm.pendingRequests[requestID] = &PendingRequest{
+	cm.storePendingRequest(&PendingRequest{
 		RequestID: requestID,
 		SessionID: sessionID,
 		ToolInput: toolInput,
+	})
+}
+
+func (cm *ClaudeManager) storePendingRequest(req *PendingRequest) {
+	req.CreatedAt = time.Now()
+	cm.mu.Lock()
+	var evicted []*PendingRequest
+	if _, ok := cm.pendingRequests[req.RequestID]; !ok && cm.opts.MaxPendingRequests > 0 {
+		for len(cm.pendingRequests) >= cm.opts.MaxPendingRequests {
+			evicted = append(evicted, cm.evictOldestPendingRequest())
+		}
+	}
+	cm.pendingRequests[req.RequestID] = req
+	cm.mu.Unlock()
+
+	// An evicted request can no longer be approved, so its process, which is
+	// blocked waiting for an answer, is told no
+	for _, old := range evicted {
+		cm.denyPendingRequest(old, pendingEvictedMessage)
+	}
+}
+
+// pendingEvictedMessage is sent to Claude when a permission request is denied
+// to make room under MaxPendingRequests
+const pendingEvictedMessage = "Permission request dropped: too many pending requests"
+
+// evictOldestPendingRequest drops the oldest pending request and returns it.
+// Callers hold mu and ensure the map isn't empty.
+func (cm *ClaudeManager) evictOldestPendingRequest() *PendingRequest {
+	var oldest *PendingRequest
+	for _, req := range cm.pendingRequests {
+		if oldest == nil || req.CreatedAt.Before(oldest.CreatedAt) {
+			oldest = req
+		}
+	}
+	log.Printf("Evicting pending request %s for session %s: pending request limit reached", oldest.RequestID, oldest.SessionID)
+	delete(cm.pendingRequests, oldest.RequestID)
+	if oldest.timer != nil {
+		oldest.timer.Stop()
+	}
+	cm.settleLocked(oldest)
+	cm.stats.EvictedPendingRequests++
+	return oldest
+}
+
+// maxSettledRequests bounds how many settled request IDs are remembered
+const maxSettledRequests = 1000
+
+// settleLocked records that req was resolved by the server rather than
+// answered, so a late answer gets ErrPermissionRequestNotFound. Only the most
+// recent maxSettledRequests are kept. Callers hold mu.
+func (cm *ClaudeManager) settleLocked(req *PendingRequest) {
+	if _, ok := cm.settled[req.RequestID]; !ok {
+		cm.settledOrder = append(cm.settledOrder, req.RequestID)
+	}
+	cm.settled[req.RequestID] = req.SessionID
+	if len(cm.settledOrder) > maxSettledRequests {
+		delete(cm.settled, cm.settledOrder[0])
+		cm.settledOrder = cm.settledOrder[1:]
 	}
 }
 
+// denyPendingRequest denies a request already removed from the pending map to
+// the process that asked, if it is still running.
+func (cm *ClaudeManager) denyPendingRequest(req *PendingRequest, message string) {
+	cm.mu.RLock()
+	proc := cm.processes[processKey(req.SessionID, req.PromptID)]
+	cm.mu.RUnlock()
+	if proc == nil || proc.exited.Load() {
+		return
+	}
+	if err := cm.writePermissionResponse(proc, req.RequestID, req, "deny", message, false); err != nil {
+		log.Printf("Warning: failed to deny evicted permission request %s: %v", req.RequestID, err)
+	}
+}
+
+// PendingRequestForSession returns the oldest pending request for a session
+// without removing it, or nil if the session is not awaiting a permission decision
+func (cm *ClaudeManager) PendingRequestForSession(sessionID string) *PendingRequest {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	var oldest *PendingRequest
+	for _, req := range cm.pendingRequests {
+		if req.SessionID != sessionID {
+			continue
+		}
+		if oldest == nil || req.CreatedAt.Before(oldest.CreatedAt) {
+			oldest = req
+		}
+	}
+	return oldest
+}
+
 // GetPendingRequest retrieves and removes a pending request
 func (cm *ClaudeManager) GetPendingRequest(requestID string) *PendingRequest {
 	cm.mu.Lock()
@@ -63,10 +377,43 @@ func (cm *ClaudeManager) GetPendingRequest(requestID string) *PendingRequest {
 	req, ok := cm.pendingRequests[requestID]
 	if ok {
 		delete(cm.pendingRequests, requestID)
+		if req.timer != nil {
+			req.timer.Stop()
+		}
 	}
 	return req
 }
 
+// permissionTimeoutMessage is sent to Claude when a permission request is
+// denied for going unanswered
+const permissionTimeoutMessage = "Permission request timed out"
+
+// expirePendingRequest denies req when its permission timeout fires, if it is
+// still waiting. It reports whether the denial was sent.
+func (cm *ClaudeManager) expirePendingRequest(req *PendingRequest) bool {
+	cm.mu.Lock()
+	if cm.pendingRequests[req.RequestID] != req {
+		// Answered, swept or evicted in the meantime
+		cm.mu.Unlock()
+		return false
+	}
+	delete(cm.pendingRequests, req.RequestID)
+	cm.settleLocked(req)
+	proc := cm.processes[processKey(req.SessionID, req.PromptID)]
+	cm.stats.TimedOutPendingRequests++
+	cm.mu.Unlock()
+	if proc == nil {
+		return false
+	}
+
+	log.Printf("Permission request %s for session %s timed out after %s, denying", req.RequestID, req.SessionID, cm.opts.PermissionTimeout)
+	if err := cm.writePermissionResponse(proc, req.RequestID, req, "deny", permissionTimeoutMessage, false); err != nil {
+		log.Printf("Warning: failed to deny timed out permission request %s: %v", req.RequestID, err)
+		return false
+	}
+	return true
+}
+
 // UserMessage is the JSON format for sending prompts via stdin
 type UserMessage struct {
 	Type    string         `json:"type"`
@@ -75,19 +422,129 @@ type UserMessage struct {
 
 type UserMessageMsg struct {
 	Role    string `json:"role"`
-	Content string `json:"content"`
+	Content any    `json:"content"` // the prompt string, or []UserContentBlock with images
 }
 
-// RunPrompt executes a prompt and streams events through the callback
-// The callback receives JSON lines from Claude CLI stdout
-func (cm *ClaudeManager) RunPrompt(
-	ctx context.Context,
-	sessionID string,
-	claudeSessionID *string,
-	prompt string,
-	workingDir *string,
-	onEvent func(line []byte) error,
-) (string, error) {
+// UserContentBlock is a text or image block in a multimodal user message
+type UserContentBlock struct {
+	Type   string       `json:"type"` // "text" or "image"
+	Text   string       `json:"text,omitempty"`
+	Source *ImageSource `json:"source,omitempty"`
+}
+
+// ImageSource is the inline data of an image content block
+type ImageSource struct {
+	Type      string `json:"type"` // "base64"
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+// PromptOptions carries per-session settings that affect how the Claude CLI is run
+type PromptOptions struct {
+	WorkingDir     *string           // overrides the manager's default working directory
+	ClaudeCmd      string            // overrides the manager's Claude CLI command when set
+	PermissionMode *string           // passed as --permission-mode
+	SystemPrompt   string            // the session's system message, passed as --append-system-prompt
+	Env            map[string]string // merged onto the server's environment
+	ExtraArgs      []string          // appended after the manager's ExtraArgs
+	RawArgs        []string          // when non-nil, used as the entire CLI arg list
+	Images         []ImageSource     // sent as image blocks ahead of the prompt text
+	PromptID       string            // set for concurrent prompts, keying the process by session and prompt
+
+	// OnPermissionTimeout is called after a permission request is denied for
+	// outlasting the manager's PermissionTimeout. It is never called
+	// concurrently with onEvent, nor after RunPrompt returns.
+	OnPermissionTimeout func(req *PendingRequest)
+}
+
+// userMessageContent returns the prompt as plain text, or as image blocks
+// followed by a text block when there are images.
+func userMessageContent(prompt string, images []ImageSource) any {
+	if len(images) == 0 {
+		return prompt
+	}
+	blocks := make([]UserContentBlock, 0, len(images)+1)
+	for i := range images {
+		blocks = append(blocks, UserContentBlock{Type: "image", Source: &images[i]})
+	}
+	return append(blocks, UserContentBlock{Type: "text", Text: prompt})
+}
+
+// PermissionModeBypass runs every tool without asking, skipping the
+// control_request approval flow. Handlers only accept it from trusted callers.
+const PermissionModeBypass = "bypassPermissions"
+
+// permissionModes are the values accepted by the Claude CLI --permission-mode flag
+var permissionModes = map[string]bool{
+	"default":            true,
+	"acceptEdits":        true,
+	"plan":               true,
+	PermissionModeBypass: true,
+}
+
+// IsValidPermissionMode reports whether mode is a known Claude CLI permission mode
+func IsValidPermissionMode(mode string) bool {
+	return permissionModes[mode]
+}
+
+// readLine reads one line of any length up to max bytes, without the trailing
+// newline (or "\r\n"). A final line without a newline is returned as is.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(bytes.TrimSuffix(line, []byte("\n"))) > max {
+			return nil, fmt.Errorf("%w: exceeds %d bytes", ErrLineTooLong, max)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+		return line, nil
+	}
+}
+
+// ClaudeCommand is the Claude CLI invocation RunPrompt makes for a prompt
+type ClaudeCommand struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	WorkingDir string   `json:"working_directory"`
+}
+
+// Command returns the CLI invocation RunPrompt would make with these options,
+// without starting anything. The prompt itself goes to stdin, not the args.
+func (cm *ClaudeManager) Command(claudeSessionID *string, opts PromptOptions) ClaudeCommand {
+	return ClaudeCommand{
+		Command:    cm.command(opts),
+		Args:       cm.buildArgs(claudeSessionID, opts),
+		WorkingDir: cm.workDir(opts),
+	}
+}
+
+// buildArgs returns the CLI args for a prompt run by this manager. The
+// deployment-wide extra args go ahead of the session's, so the session wins
+// for flags where the CLI takes the last value.
+func (cm *ClaudeManager) buildArgs(claudeSessionID *string, opts PromptOptions) []string {
+	opts.ExtraArgs = append(slices.Clone(cm.opts.ExtraArgs), opts.ExtraArgs...)
+	return buildClaudeArgs(claudeSessionID, opts)
+}
+
+// buildClaudeArgs assembles the CLI args for a prompt: the streaming flags,
+// then --resume, the permission mode and system prompt when set, then the
+// extra args. Raw args replace all of them.
+func buildClaudeArgs(claudeSessionID *string, opts PromptOptions) []string {
+	// Raw args bypass every default; the prompt is still written to stdin
+	if opts.RawArgs != nil {
+		return opts.RawArgs
+	}
+
 	args := []string{
 		"--verbose",
 		"--output-format", "stream-json",
@@ -99,12 +556,62 @@ func (cm *ClaudeManager) RunPrompt(
 		args = append(args, "--resume", *claudeSessionID)
 	}
 
-	cmd := exec.CommandContext(ctx, cm.claudeCmd, args...)
-	// Use session working directory if provided, otherwise use default
-	if workingDir != nil && *workingDir != "" {
-		cmd.Dir = *workingDir
-	} else {
-		cmd.Dir = cm.workingDir
+	if opts.PermissionMode != nil && *opts.PermissionMode != "" {
+		args = append(args, "--permission-mode", *opts.PermissionMode)
+	}
+
+	// The CLI doesn't keep the system prompt across --resume, so it is sent
+	// with every prompt, after Claude's own
+	if opts.SystemPrompt != "" {
+		args = append(args, "--append-system-prompt", opts.SystemPrompt)
+	}
+
+	return append(args, opts.ExtraArgs...)
+}
+
+// command returns the executable a prompt runs: the session's command if set,
+// otherwise the manager's.
+func (cm *ClaudeManager) command(opts PromptOptions) string {
+	if opts.ClaudeCmd != "" {
+		return opts.ClaudeCmd
+	}
+	return cm.claudeCmd
+}
+
+// workDir returns the directory a prompt runs in: the session's working
+// directory if set, otherwise the manager's default.
+func (cm *ClaudeManager) workDir(opts PromptOptions) string {
+	if opts.WorkingDir != nil && *opts.WorkingDir != "" {
+		return *opts.WorkingDir
+	}
+	return cm.workingDir
+}
+
+// RunPrompt executes a prompt and streams events through the callback
+// The callback receives JSON lines from Claude CLI stdout
+func (cm *ClaudeManager) RunPrompt(
+	ctx context.Context,
+	sessionID string,
+	claudeSessionID *string,
+	prompt string,
+	opts PromptOptions,
+	onEvent func(line []byte) error,
+) (string, error) {
+	// Register under the lock so Drain never waits on a group that is still growing
+	cm.mu.Lock()
+	if cm.draining {
+		cm.mu.Unlock()
+		return "", ErrShuttingDown
+	}
+	cm.active.Add(1)
+	cm.mu.Unlock()
+	defer cm.active.Done()
+
+	cmdName := cm.command(opts)
+	cmd := exec.CommandContext(ctx, cmdName, cm.buildArgs(claudeSessionID, opts)...)
+	cmd.Dir = cm.workDir(opts)
+	if len(opts.Env) > 0 {
+		cmd.Env = mergeEnv(os.Environ(), opts.Env)
 	}
 
 	stdin, err := cmd.StdinPipe()
@@ -123,23 +630,31 @@ func (cm *ClaudeManager) RunPrompt(
 	}
 
 	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+			return "", fmt.Errorf("%w: %s", ErrClaudeNotFound, cmdName)
+		}
 		return "", fmt.Errorf("start: %w", err)
 	}
 
 	proc := &ClaudeProcess{
-		cmd:    cmd,
-		stdin:  stdin,
-		stdout: stdout,
-		stderr: stderr,
+		cmd:       cmd,
+		stdin:     stdin,
+		stdout:    stdout,
+		stderr:    stderr,
+		startedAt: time.Now(),
 	}
 
+	key := processKey(sessionID, opts.PromptID)
 	cm.mu.Lock()
-	cm.processes[sessionID] = proc
+	cm.processes[key] = proc
 	cm.mu.Unlock()
 
 	defer func() {
 		cm.mu.Lock()
-		delete(cm.processes, sessionID)
+		// The sweep may already have dropped this entry and a newer prompt taken its place
+		if cm.processes[key] == proc {
+			delete(cm.processes, key)
+		}
 		cm.mu.Unlock()
 		stdin.Close()
 	}()
@@ -149,7 +664,7 @@ func (cm *ClaudeManager) RunPrompt(
 		Type: "user",
 		Message: UserMessageMsg{
 			Role:    "user",
-			Content: prompt,
+			Content: userMessageContent(prompt, opts.Images),
 		},
 	}
 	msgData, err := json.Marshal(userMsg)
@@ -161,22 +676,60 @@ func (cm *ClaudeManager) RunPrompt(
 		return "", fmt.Errorf("write prompt: %w", err)
 	}
 
-	// Read stderr in background for debugging
+	// onEvent and OnPermissionTimeout take turns, and neither runs once
+	// RunPrompt has returned
+	var callbackMu sync.Mutex
+	finished := false
+	defer func() {
+		callbackMu.Lock()
+		finished = true
+		callbackMu.Unlock()
+	}()
+	emit := func(line []byte) error {
+		callbackMu.Lock()
+		defer callbackMu.Unlock()
+		return onEvent(line)
+	}
+	// Denying under the lock keeps Claude's reaction to the denial from
+	// reaching onEvent ahead of OnPermissionTimeout
+	expire := func(req *PendingRequest) {
+		callbackMu.Lock()
+		defer callbackMu.Unlock()
+		if !finished && cm.expirePendingRequest(req) && opts.OnPermissionTimeout != nil {
+			opts.OnPermissionTimeout(req)
+		}
+	}
+
+	// Read stderr in background for debugging, keeping its end for a
+	// ClaudeExitError
+	stderrTail := &tailBuffer{max: stderrTailBytes}
+	stderrDone := make(chan struct{})
 	go func() {
+		defer close(stderrDone)
 		scanner := bufio.NewScanner(stderr)
 		for scanner.Scan() {
 			// Log stderr but don't fail - Claude CLI writes debug info here
-			fmt.Printf("[claude stderr] %s\n", scanner.Text())
+			if !cm.opts.QuietStderr {
+				cm.opts.Logger.Printf("[claude stderr] %s", scanner.Text())
+			}
+			fmt.Fprintln(stderrTail, scanner.Text())
 		}
 	}()
 
 	// Process stdout JSON lines
 	var resultSessionID string
-	scanner := bufio.NewScanner(stdout)
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024) // 1MB buffer for large responses
+	var resultErr error
+	var readErr error
+	reader := bufio.NewReaderSize(stdout, 64*1024)
 
-	for scanner.Scan() {
-		line := scanner.Bytes()
+	for {
+		line, err := readLine(reader, cm.opts.MaxLineBytes)
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+			}
+			break
+		}
 
 		// Try to extract session ID from result event
 		var event ClaudeEvent
@@ -185,54 +738,147 @@ func (cm *ClaudeManager) RunPrompt(
 				var result ResultEvent
 				if err := json.Unmarshal(line, &result); err == nil {
 					resultSessionID = result.SessionID
+					if resultFailed(result.Subtype) {
+						resultErr = &ClaudeResultError{Subtype: result.Subtype}
+					}
 				}
 				// Result received - send to callback, close stdin to signal done, and exit loop
-				onEvent(line)
+				emit(line)
 				stdin.Close()
 				break
 			}
+			// Store permission requests before the client sees them, so an
+			// approval can echo the tool input back as updatedInput
+			if event.Type == "control_request" {
+				var ctrlReq ControlRequest
+				if err := json.Unmarshal(line, &ctrlReq); err == nil && ctrlReq.RequestID != "" {
+					log.Printf("Storing pending control_request: request_id=%s tool=%s", ctrlReq.RequestID, ctrlReq.Request.ToolName)
+					pending := &PendingRequest{
+						RequestID: ctrlReq.RequestID,
+						SessionID: sessionID,
+						PromptID:  opts.PromptID,
+						ToolName:  ctrlReq.Request.ToolName,
+						ToolInput: ctrlReq.Request.Input,
+					}
+					if timeout := cm.opts.PermissionTimeout; timeout > 0 {
+						pending.timer = time.AfterFunc(timeout, func() { expire(pending) })
+					}
+					cm.storePendingRequest(pending)
+				}
+			}
 		}
 
 		// Send event to callback
-		if err := onEvent(line); err != nil {
+		if err := emit(line); err != nil {
 			// Client disconnected, kill the process
 			cmd.Process.Kill()
 			return resultSessionID, err
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return resultSessionID, fmt.Errorf("scanner: %w", err)
+	if readErr != nil {
+		if proc.cancelled.Load() {
+			return resultSessionID, ErrPromptCancelled
+		}
+		// Stop the CLI rather than leave it blocked writing output nobody reads
+		cmd.Process.Kill()
+		cmd.Wait()
+		proc.exited.Store(true)
+		return resultSessionID, fmt.Errorf("read stdout: %w", readErr)
 	}
 
-	if err := cmd.Wait(); err != nil {
+	// Wait closes stderr, so let the reader drain it first. A child process
+	// holding stderr open shouldn't hold up the prompt, hence the bound.
+	select {
+	case <-stderrDone:
+	case <-time.After(stderrDrainTimeout):
+	}
+	err = cmd.Wait()
+	proc.exited.Store(true)
+	if err != nil {
+		if proc.cancelled.Load() {
+			return resultSessionID, ErrPromptCancelled
+		}
 		// Check if context was cancelled
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return resultSessionID, fmt.Errorf("%w: %w", ErrClaudeTimeout, ctx.Err())
+		}
 		if ctx.Err() != nil {
 			return resultSessionID, ctx.Err()
 		}
+		// The CLI exits non-zero after a failed result; the result says why
+		if resultErr != nil {
+			return resultSessionID, resultErr
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return resultSessionID, &ClaudeExitError{Code: exitErr.ExitCode(), Signal: exitSignal(exitErr), Stderr: stderrTail.String()}
+		}
 		return resultSessionID, fmt.Errorf("wait: %w", err)
 	}
 
-	return resultSessionID, nil
+	return resultSessionID, resultErr
 }
 
-// SendPermissionResponse sends an approval/denial to the running Claude process
-// The requestID is the request_id from control_request events
-func (cm *ClaudeManager) SendPermissionResponse(sessionID, requestID, decision string) error {
-	cm.mu.RLock()
-	proc, ok := cm.processes[sessionID]
-	cm.mu.RUnlock()
+// exitSignal returns the name of the signal that ended a process, or "" if it
+// exited on its own.
+func exitSignal(exitErr *exec.ExitError) string {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return status.Signal().String()
+	}
+	return ""
+}
 
+// defaultDenyMessage is sent to Claude when a tool is denied without an explicit reason
+const defaultDenyMessage = "User denied permission"
+
+// SendPermissionResponse sends an approval/denial to the running Claude process
+// The requestID is the request_id from control_request events. For denials, message
+// tells Claude why (defaults to defaultDenyMessage) and interrupt halts the turn.
+//
+// A request the server already settled (swept, timed out or evicted, and so
+// denied) returns ErrPermissionRequestNotFound rather than being allowed late.
+func (cm *ClaudeManager) SendPermissionResponse(sessionID, requestID, decision, message string, interrupt bool) error {
+	cm.mu.Lock()
+	pendingReq := cm.pendingRequests[requestID]
+	if pendingReq != nil && pendingReq.SessionID != sessionID {
+		pendingReq = nil
+	}
+	if settledSession, ok := cm.settled[requestID]; ok && pendingReq == nil && settledSession == sessionID {
+		cm.mu.Unlock()
+		return ErrPermissionRequestNotFound
+	}
+	// The pending request names the concurrent prompt that asked, if any
+	var promptID string
+	if pendingReq != nil {
+		promptID = pendingReq.PromptID
+	}
+	proc, ok := cm.processes[processKey(sessionID, promptID)]
 	if !ok {
+		cm.mu.Unlock()
 		return fmt.Errorf("no active process for session %s", sessionID)
 	}
+	if pendingReq != nil {
+		delete(cm.pendingRequests, requestID)
+		if pendingReq.timer != nil {
+			pendingReq.timer.Stop()
+		}
+	}
+	cm.mu.Unlock()
 
-	// Get the pending request to include the original input
-	pendingReq := cm.GetPendingRequest(requestID)
+	return cm.writePermissionResponse(proc, requestID, pendingReq, decision, message, interrupt)
+}
 
+// writePermissionResponse writes a decision on requestID to proc's stdin. An
+// approval echoes pendingReq's tool input back as updatedInput.
+func (cm *ClaudeManager) writePermissionResponse(proc *ClaudeProcess, requestID string, pendingReq *PendingRequest, decision, message string, interrupt bool) error {
 	proc.mu.Lock()
 	defer proc.mu.Unlock()
 
+	if proc.stdinBroken {
+		return fmt.Errorf("write: %w: an earlier write is still blocked", ErrStdinWriteTimeout)
+	}
+
 	// Format: {"type":"control_response","response":{"subtype":"success","request_id":"...","response":{"behavior":"allow","updatedInput":{...}}}}
 	var response NestedControlResponse
 	if decision == "allow" {
@@ -255,14 +901,18 @@ func (cm *ClaudeManager) SendPermissionResponse(sessionID, requestID, decision s
 		}
 	} else {
 		// Denial uses the same structure as allow, with behavior: "deny" and a message
+		if message == "" {
+			message = defaultDenyMessage
+		}
 		response = NestedControlResponse{
 			Type: "control_response",
 			Response: NestedControlResponseBody{
 				Subtype:   "success",
 				RequestID: requestID,
 				Response: &PermissionDecision{
-					Behavior: "deny",
-					Message:  "User denied permission",
+					Behavior:  "deny",
+					Message:   message,
+					Interrupt: interrupt,
 				},
 			},
 		}
@@ -275,44 +925,317 @@ func (cm *ClaudeManager) SendPermissionResponse(sessionID, requestID, decision s
 
 	data = append(data, '\n')
 
-	log.Printf("[claude stdin] %s", string(data))
+	switch cm.opts.StdinLog {
+	case StdinLogFull:
+		cm.opts.Logger.Printf("[claude stdin] %s", data)
+	case StdinLogOff:
+	default:
+		cm.opts.Logger.Printf("[claude stdin] control_response request_id=%s behavior=%s (%d bytes, payload redacted)",
+			requestID, response.Response.Response.Behavior, len(data))
+	}
 
-	if _, err := proc.stdin.Write(data); err != nil {
+	if err := writeWithTimeout(proc.stdin, data, cm.opts.StdinWriteTimeout); err != nil {
+		if errors.Is(err, ErrStdinWriteTimeout) {
+			proc.stdinBroken = true
+		}
 		return fmt.Errorf("write: %w", err)
 	}
 
 	return nil
 }
 
-// KillProcess terminates a running Claude process
+// writeWithTimeout writes data to w, giving up with ErrStdinWriteTimeout after
+// timeout so callers holding a lock can release it. The abandoned write keeps
+// running in the background until w unblocks or is closed, so callers must not
+// write to w again. Zero waits indefinitely.
+func writeWithTimeout(w io.Writer, data []byte, timeout time.Duration) error {
+	if timeout <= 0 {
+		_, err := w.Write(data)
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrStdinWriteTimeout
+	}
+}
+
+// ListActive returns the running Claude processes, oldest first
+func (cm *ClaudeManager) ListActive() []ActiveProcess {
+	return cm.ListActiveOlderThan(0)
+}
+
+// ListActiveOlderThan returns the Claude processes that have been running for
+// longer than age, oldest first
+func (cm *ClaudeManager) ListActiveOlderThan(age time.Duration) []ActiveProcess {
+	cutoff := time.Now().Add(-age)
+	cm.mu.RLock()
+	active := make([]ActiveProcess, 0, len(cm.processes))
+	for key, proc := range cm.processes {
+		if age > 0 && !proc.startedAt.Before(cutoff) {
+			continue
+		}
+		sessionID, promptID := splitProcessKey(key)
+		active = append(active, ActiveProcess{SessionID: sessionID, PromptID: promptID, StartedAt: proc.startedAt})
+	}
+	cm.mu.RUnlock()
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].StartedAt.Before(active[j].StartedAt)
+	})
+	return active
+}
+
+// IsActive reports whether a session has a running Claude process
+func (cm *ClaudeManager) IsActive(sessionID string) bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	for key := range cm.processes {
+		if id, _ := splitProcessKey(key); id == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// CancelPrompt kills every running process for a session so RunPrompt returns
+// ErrPromptCancelled. This works even when the prompt is blocked waiting on a
+// permission decision, since pending requests are cleared by KillProcess.
+// Returns false if the session has no running process.
+func (cm *ClaudeManager) CancelPrompt(sessionID string) bool {
+	return cm.cancel(sessionID, "", true)
+}
+
+// CancelPromptByID cancels a single concurrent prompt of a session. Returns
+// false if that prompt has no running process.
+func (cm *ClaudeManager) CancelPromptByID(sessionID, promptID string) bool {
+	return cm.cancel(sessionID, promptID, false)
+}
+
+func (cm *ClaudeManager) cancel(sessionID, promptID string, all bool) bool {
+	procs := cm.targetProcesses(sessionID, promptID, all)
+	for _, proc := range procs {
+		proc.cancelled.Store(true)
+		proc.cmd.Process.Kill()
+	}
+	return len(procs) > 0
+}
+
+// KillProcess terminates every running Claude process for a session.
+// Returns ErrProcessNotFound if there was none to kill.
 func (cm *ClaudeManager) KillProcess(sessionID string) error {
+	return cm.kill(sessionID, "", true)
+}
+
+// KillPrompt terminates the Claude process of a single concurrent prompt.
+// Returns ErrProcessNotFound if there was none to kill.
+func (cm *ClaudeManager) KillPrompt(sessionID, promptID string) error {
+	return cm.kill(sessionID, promptID, false)
+}
+
+func (cm *ClaudeManager) kill(sessionID, promptID string, all bool) error {
+	var errs []error
+	killed := 0
+	for _, proc := range cm.targetProcesses(sessionID, promptID, all) {
+		if proc.exited.Load() {
+			continue
+		}
+		if err := proc.cmd.Process.Kill(); err != nil {
+			if !errors.Is(err, os.ErrProcessDone) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		killed++
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if killed == 0 {
+		return ErrProcessNotFound
+	}
+	return nil
+}
+
+// targetProcesses finds the processes of a session (all of them, or just the
+// one for promptID; "" is a single-flight session's process) and clears their
+// pending requests. The processes stay in
+// the map until RunPrompt returns, so they still count as active while dying.
+func (cm *ClaudeManager) targetProcesses(sessionID, promptID string, all bool) []*ClaudeProcess {
 	cm.mu.Lock()
-	proc, ok := cm.processes[sessionID]
-	// Clean up any pending requests for this session
+	defer cm.mu.Unlock()
+
+	var procs []*ClaudeProcess
+	if all {
+		for key, proc := range cm.processes {
+			if id, _ := splitProcessKey(key); id == sessionID {
+				procs = append(procs, proc)
+			}
+		}
+	} else if proc, ok := cm.processes[processKey(sessionID, promptID)]; ok {
+		procs = append(procs, proc)
+	}
+
 	for reqID, req := range cm.pendingRequests {
-		if req.SessionID == sessionID {
+		if req.SessionID == sessionID && (all || req.PromptID == promptID) {
 			delete(cm.pendingRequests, reqID)
 		}
 	}
-	cm.mu.Unlock()
+	return procs
+}
 
-	if !ok {
-		return nil // No process running
+// Validate checks that the Claude CLI command resolves to an executable, so a
+// missing install is reported at startup instead of on every prompt.
+func (cm *ClaudeManager) Validate() error {
+	if _, err := exec.LookPath(cm.claudeCmd); err != nil {
+		return fmt.Errorf("%w: %q is not an executable file or on PATH (set -claude-cmd or CHAI_CLAUDE_CMD): %v",
+			ErrClaudeNotFound, cm.claudeCmd, err)
+	}
+	return nil
+}
+
+// Version runs the Claude CLI with --version and returns its version number.
+// It returns ErrClaudeNotFound if the command does not exist.
+func (cm *ClaudeManager) Version(ctx context.Context) (string, error) {
+	cmd := exec.CommandContext(ctx, cm.claudeCmd, "--version")
+	cmd.Dir = cm.workingDir
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrClaudeNotFound, cm.claudeCmd)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s --version: %w", cm.claudeCmd, err)
+	}
+	return parseClaudeVersion(out)
+}
+
+// parseClaudeVersion extracts the version number from `claude --version` output.
+func parseClaudeVersion(out []byte) (string, error) {
+	version := claudeVersionPattern.Find(out)
+	if version == nil {
+		return "", fmt.Errorf("unrecognized claude --version output: %q", strings.TrimSpace(string(out)))
+	}
+	return string(version), nil
+}
+
+// Stats returns the current map sizes and cleanup counters
+func (cm *ClaudeManager) Stats() ClaudeManagerStats {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	stats := cm.stats
+	stats.Processes = len(cm.processes)
+	stats.PendingRequests = len(cm.pendingRequests)
+	return stats
+}
+
+// sweep drops pending requests older than the TTL whose process has exited,
+// and processes whose command has exited. A live process is still blocked on
+// its request, which stays answerable (PermissionTimeout denies it instead).
+// RunPrompt and KillProcess normally clean both maps up; the sweep catches
+// anything they miss. Returns the number of entries removed from each.
+func (cm *ClaudeManager) sweep() (pending, processes int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	if ttl := cm.opts.PendingRequestTTL; ttl > 0 {
+		cutoff := time.Now().Add(-ttl)
+		for id, req := range cm.pendingRequests {
+			proc := cm.processes[processKey(req.SessionID, req.PromptID)]
+			if req.CreatedAt.Before(cutoff) && (proc == nil || proc.exited.Load()) {
+				delete(cm.pendingRequests, id)
+				cm.settleLocked(req)
+				pending++
+			}
+		}
+	}
+
+	for id, proc := range cm.processes {
+		if proc.exited.Load() {
+			delete(cm.processes, id)
+			processes++
+		}
+	}
+
+	cm.stats.SweptPendingRequests += int64(pending)
+	cm.stats.SweptProcesses += int64(processes)
+	return pending, processes
+}
+
+// StartSweeper starts a background goroutine that periodically runs sweep.
+// Returns a function to stop the sweeper.
+func (cm *ClaudeManager) StartSweeper(interval time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if pending, processes := cm.sweep(); pending > 0 || processes > 0 {
+					log.Printf("Claude sweeper: removed %d stale pending requests and %d exited processes", pending, processes)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
 	}
+}
 
-	return proc.cmd.Process.Kill()
+// Draining reports whether Drain has been called
+func (cm *ClaudeManager) Draining() bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.draining
+}
+
+// Drain stops RunPrompt from starting new prompts and waits up to timeout for
+// running ones to finish. It reports whether every prompt finished in time;
+// call Shutdown afterwards to kill any stragglers.
+func (cm *ClaudeManager) Drain(timeout time.Duration) bool {
+	cm.mu.Lock()
+	cm.draining = true
+	cm.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		cm.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 // Shutdown terminates all running Claude processes
 func (cm *ClaudeManager) Shutdown() {
 	cm.mu.RLock()
-	sessionIDs := make([]string, 0, len(cm.processes))
-	for id := range cm.processes {
-		sessionIDs = append(sessionIDs, id)
+	sessionIDs := make(map[string]bool, len(cm.processes))
+	for key := range cm.processes {
+		id, _ := splitProcessKey(key)
+		sessionIDs[id] = true
 	}
 	cm.mu.RUnlock()
 
-	for _, id := range sessionIDs {
+	for id := range sessionIDs {
 		cm.KillProcess(id)
 	}
 }
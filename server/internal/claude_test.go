@@ -1,12 +1,23 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // mockWriteCloser captures data written to it for testing
@@ -35,8 +46,23 @@ func (m *mockWriteCloser) Bytes() []byte {
 	return m.buf.Bytes()
 }
 
+// blockingWriteCloser blocks every Write until release is closed, like the
+// stdin of a wedged process
+type blockingWriteCloser struct {
+	release chan struct{}
+	writes  atomic.Int32
+}
+
+func (b *blockingWriteCloser) Write(p []byte) (int, error) {
+	b.writes.Add(1)
+	<-b.release
+	return len(p), nil
+}
+
+func (b *blockingWriteCloser) Close() error { return nil }
+
 func TestSendPermissionResponse_AllowFormat(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	// Create a mock process with a mock stdin
 	mockStdin := &mockWriteCloser{}
@@ -61,7 +87,7 @@ func TestSendPermissionResponse_AllowFormat(t *testing.T) {
 	cm.StorePendingRequest(sessionID, requestID, toolInput)
 
 	// Send allow response
-	err := cm.SendPermissionResponse(sessionID, requestID, "allow")
+	err := cm.SendPermissionResponse(sessionID, requestID, "allow", "", false)
 	if err != nil {
 		t.Fatalf("SendPermissionResponse failed: %v", err)
 	}
@@ -104,7 +130,7 @@ func TestSendPermissionResponse_AllowFormat(t *testing.T) {
 }
 
 func TestSendPermissionResponse_DenyFormat(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	// Create a mock process with a mock stdin
 	mockStdin := &mockWriteCloser{}
@@ -122,7 +148,7 @@ func TestSendPermissionResponse_DenyFormat(t *testing.T) {
 	cm.mu.Unlock()
 
 	// Send deny response (no pending request needed for deny)
-	err := cm.SendPermissionResponse(sessionID, requestID, "deny")
+	err := cm.SendPermissionResponse(sessionID, requestID, "deny", "", false)
 	if err != nil {
 		t.Fatalf("SendPermissionResponse failed: %v", err)
 	}
@@ -158,8 +184,45 @@ func TestSendPermissionResponse_DenyFormat(t *testing.T) {
 	}
 }
 
+func TestSendPermissionResponse_DenyWithMessageAndInterrupt(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	mockStdin := &mockWriteCloser{}
+	proc := &ClaudeProcess{
+		cmd:   &exec.Cmd{},
+		stdin: mockStdin,
+	}
+
+	sessionID := "test-session"
+	cm.mu.Lock()
+	cm.processes[sessionID] = proc
+	cm.mu.Unlock()
+
+	err := cm.SendPermissionResponse(sessionID, "req-457", "deny", "Don't touch production config", true)
+	if err != nil {
+		t.Fatalf("SendPermissionResponse failed: %v", err)
+	}
+
+	data := bytes.TrimSuffix(mockStdin.Bytes(), []byte("\n"))
+
+	var response NestedControlResponse
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v\nData: %s", err, string(data))
+	}
+
+	if response.Response.Response == nil {
+		t.Fatal("Response.Response is nil")
+	}
+	if response.Response.Response.Message != "Don't touch production config" {
+		t.Errorf("Message = %q, want %q", response.Response.Response.Message, "Don't touch production config")
+	}
+	if !response.Response.Response.Interrupt {
+		t.Error("Interrupt = false, want true")
+	}
+}
+
 func TestSendPermissionResponse_AllowWithNoPendingRequest(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	// Create a mock process with a mock stdin
 	mockStdin := &mockWriteCloser{}
@@ -177,7 +240,7 @@ func TestSendPermissionResponse_AllowWithNoPendingRequest(t *testing.T) {
 	cm.mu.Unlock()
 
 	// Send allow response without pending request
-	err := cm.SendPermissionResponse(sessionID, requestID, "allow")
+	err := cm.SendPermissionResponse(sessionID, requestID, "allow", "", false)
 	if err != nil {
 		t.Fatalf("SendPermissionResponse failed: %v", err)
 	}
@@ -205,18 +268,151 @@ func TestSendPermissionResponse_AllowWithNoPendingRequest(t *testing.T) {
 	}
 }
 
+func TestSendPermissionResponse_SettledRequest(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", &ClaudeManagerOptions{PendingRequestTTL: time.Minute})
+
+	mockStdin := &mockWriteCloser{}
+	cm.processes["test-session"] = &ClaudeProcess{cmd: &exec.Cmd{}, stdin: mockStdin}
+
+	// A request swept after its prompt's process went away
+	cm.StorePendingRequest("test-session", "req-1", map[string]any{"command": "rm -rf /"})
+	cm.pendingRequests["req-1"].CreatedAt = time.Now().Add(-2 * time.Minute)
+	cm.pendingRequests["req-1"].PromptID = "gone"
+	cm.sweep()
+
+	// The server already settled it, so a late approval is refused
+	err := cm.SendPermissionResponse("test-session", "req-1", "allow", "", false)
+	if !errors.Is(err, ErrPermissionRequestNotFound) {
+		t.Fatalf("err = %v, want ErrPermissionRequestNotFound", err)
+	}
+	if len(mockStdin.Bytes()) != 0 {
+		t.Errorf("Wrote %q to stdin, want nothing", mockStdin.Bytes())
+	}
+
+	// The settled set is bounded
+	for i := range maxSettledRequests {
+		cm.mu.Lock()
+		cm.settleLocked(&PendingRequest{RequestID: fmt.Sprintf("req-%d", i+2), SessionID: "test-session"})
+		cm.mu.Unlock()
+	}
+	if len(cm.settled) != maxSettledRequests || len(cm.settledOrder) != maxSettledRequests {
+		t.Errorf("Remembered %d/%d settled requests, want %d", len(cm.settled), len(cm.settledOrder), maxSettledRequests)
+	}
+	if _, ok := cm.settled["req-1"]; ok {
+		t.Error("Oldest settled request was not forgotten")
+	}
+}
+
+func TestSendPermissionResponse_StdinWriteTimeout(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", &ClaudeManagerOptions{StdinWriteTimeout: 50 * time.Millisecond})
+
+	stdin := &blockingWriteCloser{release: make(chan struct{})}
+	defer close(stdin.release)
+	proc := &ClaudeProcess{cmd: &exec.Cmd{}, stdin: stdin}
+
+	cm.mu.Lock()
+	cm.processes["test-session"] = proc
+	cm.mu.Unlock()
+	cm.StorePendingRequest("test-session", "req-1", nil)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- cm.SendPermissionResponse("test-session", "req-1", "allow", "", false)
+	}()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrStdinWriteTimeout) {
+			t.Fatalf("err = %v, want ErrStdinWriteTimeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendPermissionResponse blocked past the write timeout")
+	}
+
+	// The process lock must be released even though the write is still stuck
+	if !proc.mu.TryLock() {
+		t.Fatal("Process lock still held after timeout")
+	}
+	proc.mu.Unlock()
+
+	// Nothing else is written while the abandoned write may still land
+	cm.StorePendingRequest("test-session", "req-2", nil)
+	if err := cm.SendPermissionResponse("test-session", "req-2", "deny", "", false); !errors.Is(err, ErrStdinWriteTimeout) {
+		t.Fatalf("Write after a timeout: err = %v, want ErrStdinWriteTimeout", err)
+	}
+	if n := stdin.writes.Load(); n != 1 {
+		t.Errorf("Got %d writes to stdin, want only the timed-out one", n)
+	}
+}
+
+func TestWriteWithTimeout(t *testing.T) {
+	var buf mockWriteCloser
+	if err := writeWithTimeout(&buf, []byte("ok"), time.Second); err != nil {
+		t.Fatalf("writeWithTimeout failed: %v", err)
+	}
+	if string(buf.Bytes()) != "ok" {
+		t.Errorf("Written = %q, want ok", buf.Bytes())
+	}
+
+	// Zero waits for the write however long it takes
+	stdin := &blockingWriteCloser{release: make(chan struct{})}
+	time.AfterFunc(50*time.Millisecond, func() { close(stdin.release) })
+	if err := writeWithTimeout(stdin, []byte("ok"), 0); err != nil {
+		t.Errorf("writeWithTimeout without timeout failed: %v", err)
+	}
+}
+
+func TestSendPermissionResponse_StdinLog(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantLogged bool
+		wantInput  bool
+	}{
+		{StdinLogFull, true, true},
+		{StdinLogRedacted, true, false},
+		{"", true, false},
+		{StdinLogOff, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("mode %q", tt.mode), func(t *testing.T) {
+			var logs bytes.Buffer
+			cm := NewClaudeManager("/tmp", "claude", &ClaudeManagerOptions{
+				Logger:   log.New(&logs, "", 0),
+				StdinLog: tt.mode,
+			})
+			cm.processes["test-session"] = &ClaudeProcess{cmd: &exec.Cmd{}, stdin: &mockWriteCloser{}}
+			cm.StorePendingRequest("test-session", "req-123", map[string]any{"command": "echo hunter2"})
+
+			if err := cm.SendPermissionResponse("test-session", "req-123", "allow", "", false); err != nil {
+				t.Fatalf("SendPermissionResponse failed: %v", err)
+			}
+
+			got := logs.String()
+			if logged := strings.Contains(got, "[claude stdin]"); logged != tt.wantLogged {
+				t.Errorf("Log = %q, want stdin logged: %v", got, tt.wantLogged)
+			}
+			if hasInput := strings.Contains(got, "hunter2"); hasInput != tt.wantInput {
+				t.Errorf("Log = %q, want tool input logged: %v", got, tt.wantInput)
+			}
+			if tt.wantLogged && !tt.wantInput && !strings.Contains(got, "request_id=req-123 behavior=allow") {
+				t.Errorf("Log = %q, want the request ID and decision", got)
+			}
+		})
+	}
+}
+
 func TestSendPermissionResponse_NoActiveProcess(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	// Don't register any process
-	err := cm.SendPermissionResponse("nonexistent-session", "req-123", "allow")
+	err := cm.SendPermissionResponse("nonexistent-session", "req-123", "allow", "", false)
 	if err == nil {
 		t.Error("Expected error for nonexistent session")
 	}
 }
 
 func TestPendingRequestStorage(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	sessionID := "session-1"
 	requestID := "req-1"
@@ -251,7 +447,7 @@ func TestPendingRequestStorage(t *testing.T) {
 }
 
 func TestPendingRequestNotFound(t *testing.T) {
-	cm := NewClaudeManager("/tmp", "claude")
+	cm := NewClaudeManager("/tmp", "claude", nil)
 
 	// Try to get nonexistent request
 	req := cm.GetPendingRequest("nonexistent")
@@ -260,6 +456,221 @@ func TestPendingRequestNotFound(t *testing.T) {
 	}
 }
 
+func TestPendingRequestForSession(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	if req := cm.PendingRequestForSession("session-1"); req != nil {
+		t.Fatal("Expected nil when no requests are pending")
+	}
+
+	cm.StorePendingRequest("session-1", "req-1", nil)
+	cm.StorePendingRequest("session-2", "req-2", nil)
+
+	req := cm.PendingRequestForSession("session-1")
+	if req == nil {
+		t.Fatal("Expected pending request for session-1")
+	}
+	if req.RequestID != "req-1" {
+		t.Errorf("RequestID = %q, want %q", req.RequestID, "req-1")
+	}
+
+	// Lookup must not consume the request
+	if cm.GetPendingRequest("req-1") == nil {
+		t.Error("Expected pending request to remain after lookup")
+	}
+}
+
+func TestRunPrompt_StoresControlRequest(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `read line
+echo '{"type":"control_request","request_id":"req-1","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"ls"}}}'
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+	var stored *PendingRequest
+	_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{},
+		func(line []byte) error {
+			// The request must already be stored when the client sees it
+			if strings.Contains(string(line), "control_request") {
+				stored = cm.GetPendingRequest("req-1")
+			}
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+
+	if stored == nil {
+		t.Fatal("control_request not stored before it was forwarded")
+	}
+	if stored.SessionID != "session-1" || stored.ToolName != "Bash" {
+		t.Errorf("Stored = %+v, want session-1 Bash", stored)
+	}
+	if stored.ToolInput["command"] != "ls" {
+		t.Errorf("ToolInput = %v, want command ls", stored.ToolInput)
+	}
+}
+
+func TestRunPrompt_PermissionTimeout(t *testing.T) {
+	// The fake CLI asks for permission, then echoes back whatever decision it
+	// is sent on stdin
+	claudeCmd := writeFakeClaude(t, `read line
+echo '{"type":"control_request","request_id":"req-1","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"ls"}}}'
+read response
+echo "$response"
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+
+	t.Run("unanswered", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), claudeCmd, &ClaudeManagerOptions{PermissionTimeout: 50 * time.Millisecond})
+		var timedOut []string
+		var lines []string
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello",
+			PromptOptions{OnPermissionTimeout: func(req *PendingRequest) {
+				timedOut = append(timedOut, req.RequestID+" "+req.ToolName)
+			}},
+			func(line []byte) error {
+				lines = append(lines, string(line))
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+
+		if !slices.Equal(timedOut, []string{"req-1 Bash"}) {
+			t.Errorf("Timed out = %q, want req-1 Bash", timedOut)
+		}
+		var response NestedControlResponse
+		if len(lines) != 3 || json.Unmarshal([]byte(lines[1]), &response) != nil {
+			t.Fatalf("Lines = %q, want the request, the decision Claude received and the result", lines)
+		}
+		decision := response.Response.Response
+		if response.Response.RequestID != "req-1" || decision == nil || decision.Behavior != "deny" || decision.Message != permissionTimeoutMessage {
+			t.Errorf("Decision = %s, want req-1 denied with %q", lines[1], permissionTimeoutMessage)
+		}
+		if cm.GetPendingRequest("req-1") != nil {
+			t.Error("Timed out request still pending")
+		}
+		if got := cm.Stats().TimedOutPendingRequests; got != 1 {
+			t.Errorf("TimedOutPendingRequests = %d, want 1", got)
+		}
+	})
+
+	t.Run("answered in time", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), claudeCmd, &ClaudeManagerOptions{PermissionTimeout: 50 * time.Millisecond})
+		timedOut := false
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello",
+			PromptOptions{OnPermissionTimeout: func(*PendingRequest) { timedOut = true }},
+			func(line []byte) error {
+				if strings.Contains(string(line), "control_request") {
+					return cm.SendPermissionResponse("session-1", "req-1", "allow", "", false)
+				}
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if timedOut || cm.Stats().TimedOutPendingRequests != 0 {
+			t.Error("Answered request timed out")
+		}
+	})
+}
+
+func TestListActive(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	if active := cm.ListActive(); len(active) != 0 {
+		t.Fatalf("Got %d active processes, want 0", len(active))
+	}
+
+	now := time.Now()
+	cm.mu.Lock()
+	cm.processes["newer"] = &ClaudeProcess{cmd: &exec.Cmd{}, startedAt: now}
+	cm.processes["older"] = &ClaudeProcess{cmd: &exec.Cmd{}, startedAt: now.Add(-time.Minute)}
+	cm.mu.Unlock()
+
+	active := cm.ListActive()
+	if len(active) != 2 {
+		t.Fatalf("Got %d active processes, want 2", len(active))
+	}
+	if active[0].SessionID != "older" || active[1].SessionID != "newer" {
+		t.Errorf("Order = [%s %s], want [older newer]", active[0].SessionID, active[1].SessionID)
+	}
+	if !active[0].StartedAt.Equal(now.Add(-time.Minute)) {
+		t.Errorf("StartedAt = %v, want %v", active[0].StartedAt, now.Add(-time.Minute))
+	}
+}
+
+func TestClaudeManager_ConcurrentPrompts(t *testing.T) {
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	start := func() *exec.Cmd {
+		cmd := exec.Command("sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Failed to start process: %v", err)
+		}
+		t.Cleanup(func() { cmd.Process.Kill() })
+		return cmd
+	}
+	first, second := start(), start()
+
+	cm.mu.Lock()
+	cm.processes[processKey("session-1", "p1")] = &ClaudeProcess{cmd: first, startedAt: time.Now()}
+	cm.processes[processKey("session-1", "p2")] = &ClaudeProcess{cmd: second, startedAt: time.Now()}
+	cm.mu.Unlock()
+	cm.StorePendingRequest("session-1", "req-1", nil)
+	cm.mu.Lock()
+	cm.pendingRequests["req-1"].PromptID = "p1"
+	cm.mu.Unlock()
+
+	active := cm.ListActive()
+	if len(active) != 2 || active[0].SessionID != "session-1" || active[0].PromptID == "" {
+		t.Fatalf("ListActive = %+v, want two prompts of session-1", active)
+	}
+	if !cm.IsActive("session-1") {
+		t.Error("IsActive = false, want true")
+	}
+
+	// Cancelling one prompt leaves the other running
+	if cm.CancelPromptByID("session-1", "missing") {
+		t.Error("CancelPromptByID of an unknown prompt = true, want false")
+	}
+	if !cm.CancelPromptByID("session-1", "p1") {
+		t.Fatal("CancelPromptByID = false, want true")
+	}
+	if err := first.Wait(); err == nil {
+		t.Error("Expected the cancelled prompt's process to be killed")
+	}
+	if second.ProcessState != nil {
+		t.Error("The other prompt's process should still be running")
+	}
+	if cm.GetPendingRequest("req-1") != nil {
+		t.Error("The cancelled prompt's pending request should be cleared")
+	}
+
+	// RunPrompt drops the cancelled prompt's entry once its process exits
+	cm.mu.Lock()
+	delete(cm.processes, processKey("session-1", "p1"))
+	cm.mu.Unlock()
+
+	// Killing the session reaches every prompt
+	if err := cm.KillProcess("session-1"); err != nil {
+		t.Fatalf("KillProcess failed: %v", err)
+	}
+	if err := second.Wait(); err == nil {
+		t.Error("Expected KillProcess to kill the remaining prompt")
+	}
+
+	// Nothing is left to kill, whether the process is gone or just finished
+	if err := cm.KillPrompt("session-1", "missing"); !errors.Is(err, ErrProcessNotFound) {
+		t.Errorf("KillPrompt of an unknown prompt = %v, want ErrProcessNotFound", err)
+	}
+	if err := cm.KillProcess("session-1"); !errors.Is(err, ErrProcessNotFound) {
+		t.Errorf("KillProcess after the process finished = %v, want ErrProcessNotFound", err)
+	}
+}
+
 // Verify the exact JSON format matches SDK expectations
 func TestControlResponseJSONFormat(t *testing.T) {
 	// Test allow format
@@ -351,3 +762,773 @@ func TestControlResponseJSONFormat(t *testing.T) {
 
 // Suppress unused import warning
 var _ = io.Discard
+
+// runWithArgCapture runs a prompt against a fake CLI that records its arguments,
+// one per line, and returns them
+func runWithArgCapture(t *testing.T, claudeSessionID *string, opts PromptOptions) []string {
+	t.Helper()
+
+	argsFile := filepath.Join(t.TempDir(), "args")
+	claudeCmd := writeFakeClaude(t, `printf '%s\n' "$@" > `+argsFile+`
+read line
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	_, err := cm.RunPrompt(context.Background(), "session-1", claudeSessionID, "hello", opts,
+		func(line []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Failed to read captured args: %v", err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// runWithStdinCapture runs a prompt and returns the user message Claude read from stdin
+func runWithStdinCapture(t *testing.T, prompt string, opts PromptOptions) map[string]any {
+	t.Helper()
+
+	stdinFile := filepath.Join(t.TempDir(), "stdin")
+	claudeCmd := writeFakeClaude(t, `read line
+printf '%s\n' "$line" > `+stdinFile+`
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	_, err := cm.RunPrompt(context.Background(), "session-1", nil, prompt, opts,
+		func(line []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+
+	data, err := os.ReadFile(stdinFile)
+	if err != nil {
+		t.Fatalf("Failed to read captured stdin: %v", err)
+	}
+	var msg map[string]any
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatalf("Invalid stdin JSON %s: %v", data, err)
+	}
+	return msg
+}
+
+func TestRunPrompt_TextContent(t *testing.T) {
+	msg := runWithStdinCapture(t, "hello", PromptOptions{})
+
+	content := msg["message"].(map[string]any)["content"]
+	if content != "hello" {
+		t.Errorf("Content = %v, want the plain prompt string", content)
+	}
+}
+
+func TestRunPrompt_ImageContent(t *testing.T) {
+	msg := runWithStdinCapture(t, "what is this?", PromptOptions{
+		Images: []ImageSource{{Type: "base64", MediaType: "image/png", Data: "aW1n"}},
+	})
+
+	want := `{"message":{"content":[` +
+		`{"source":{"data":"aW1n","media_type":"image/png","type":"base64"},"type":"image"},` +
+		`{"text":"what is this?","type":"text"}],"role":"user"},"type":"user"}`
+	got, _ := json.Marshal(msg)
+	if string(got) != want {
+		t.Errorf("stdin = %s\nwant    %s", got, want)
+	}
+}
+
+func TestRunPrompt_PermissionMode(t *testing.T) {
+	plan := "plan"
+	empty := ""
+
+	tests := []struct {
+		name string
+		mode *string
+		want string
+	}{
+		{"unset", nil, ""},
+		{"empty", &empty, ""},
+		{"plan", &plan, "plan"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := runWithArgCapture(t, nil, PromptOptions{PermissionMode: tt.mode})
+			if got := argValue(args, "--permission-mode"); got != tt.want {
+				t.Errorf("--permission-mode = %q, want %q (args: %v)", got, tt.want, args)
+			}
+		})
+	}
+}
+
+func TestClaudeManager_Command(t *testing.T) {
+	cm := NewClaudeManager("/srv/default", "/usr/bin/claude", &ClaudeManagerOptions{ExtraArgs: []string{"--model", "sonnet"}})
+	resume := "claude-1"
+	dir := "/srv/project"
+	mode := "plan"
+
+	cmd := cm.Command(&resume, PromptOptions{
+		WorkingDir:     &dir,
+		PermissionMode: &mode,
+		SystemPrompt:   "Be brief",
+		ExtraArgs:      []string{"--model", "opus"},
+	})
+	if cmd.Command != "/usr/bin/claude" || cmd.WorkingDir != "/srv/project" {
+		t.Errorf("Command = %+v, want the manager's CLI in the session's directory", cmd)
+	}
+	want := []string{
+		"--verbose", "--output-format", "stream-json", "--input-format", "stream-json", "--permission-prompt-tool", "stdio",
+		"--resume", "claude-1", "--permission-mode", "plan", "--append-system-prompt", "Be brief",
+		"--model", "sonnet", "--model", "opus",
+	}
+	if !slices.Equal(cmd.Args, want) {
+		t.Errorf("Args = %q, want %q", cmd.Args, want)
+	}
+	// The session's extra args come last, so its --model wins
+	if got := argValue(cmd.Args, "--model"); got != "opus" {
+		t.Errorf("--model = %q, want opus", got)
+	}
+
+	// Raw args replace everything; without a session directory the default is used
+	cmd = cm.Command(&resume, PromptOptions{RawArgs: []string{"-p"}})
+	if !slices.Equal(cmd.Args, []string{"-p"}) || cmd.WorkingDir != "/srv/default" {
+		t.Errorf("Command = %+v, want only the raw args in the default directory", cmd)
+	}
+
+	// A session's command replaces the manager's
+	cmd = cm.Command(nil, PromptOptions{ClaudeCmd: "/opt/chai/claude-mcp"})
+	if cmd.Command != "/opt/chai/claude-mcp" {
+		t.Errorf("Command = %q, want the session's command", cmd.Command)
+	}
+}
+
+func TestBuildClaudeArgs(t *testing.T) {
+	base := []string{"--verbose", "--output-format", "stream-json", "--input-format", "stream-json", "--permission-prompt-tool", "stdio"}
+	resume := "claude-1"
+	empty := ""
+	mode := "plan"
+
+	tests := []struct {
+		name            string
+		claudeSessionID *string
+		opts            PromptOptions
+		wantResume      bool
+	}{
+		{name: "new session", claudeSessionID: nil},
+		{name: "empty session ID", claudeSessionID: &empty},
+		{name: "resumed session", claudeSessionID: &resume, wantResume: true},
+		{name: "new session with options", opts: PromptOptions{PermissionMode: &mode, SystemPrompt: "Be brief", ExtraArgs: []string{"--model", "opus"}}},
+		{name: "resumed session with options", claudeSessionID: &resume, opts: PromptOptions{PermissionMode: &mode, SystemPrompt: "Be brief", ExtraArgs: []string{"--model", "opus"}}, wantResume: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := buildClaudeArgs(tt.claudeSessionID, tt.opts)
+			if !slices.Equal(args[:len(base)], base) {
+				t.Errorf("args = %q, want them to start with %q", args, base)
+			}
+			if got := slices.Contains(args, "--resume"); got != tt.wantResume {
+				t.Errorf("args = %q, --resume present = %v, want %v", args, got, tt.wantResume)
+			}
+			if tt.wantResume && argValue(args, "--resume") != resume {
+				t.Errorf("--resume = %q, want %q", argValue(args, "--resume"), resume)
+			}
+			if tt.opts.ExtraArgs != nil && !slices.Equal(args[len(args)-len(tt.opts.ExtraArgs):], tt.opts.ExtraArgs) {
+				t.Errorf("args = %q, want them to end with %q", args, tt.opts.ExtraArgs)
+			}
+		})
+	}
+}
+
+func TestRunPrompt_StderrLog(t *testing.T) {
+	script := "read line\necho 'debug output' >&2\nexit 3\n"
+	for _, quiet := range []bool{false, true} {
+		var logs bytes.Buffer
+		cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, script), &ClaudeManagerOptions{
+			Logger:      log.New(&logs, "claude: ", log.Lmsgprefix),
+			QuietStderr: quiet,
+		})
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, func([]byte) error { return nil })
+
+		if quiet {
+			if logs.Len() != 0 {
+				t.Errorf("Log = %q, want nothing with stderr logging off", logs.String())
+			}
+		} else if got := logs.String(); got != "claude: [claude stderr] debug output\n" {
+			t.Errorf("Log = %q, want the prefixed stderr line", got)
+		}
+		// The exit error keeps stderr either way
+		var exitErr *ClaudeExitError
+		if !errors.As(err, &exitErr) || exitErr.Stderr != "debug output\n" {
+			t.Errorf("RunPrompt error = %v, want a ClaudeExitError with the CLI's stderr", err)
+		}
+	}
+}
+
+func TestRunPrompt_SystemPrompt(t *testing.T) {
+	args := runWithArgCapture(t, nil, PromptOptions{})
+	if slices.Contains(args, "--append-system-prompt") {
+		t.Errorf("args = %v, want no system prompt when unset", args)
+	}
+
+	resume := "claude-1"
+	args = runWithArgCapture(t, &resume, PromptOptions{SystemPrompt: "Be terse"})
+	if got := argValue(args, "--append-system-prompt"); got != "Be terse" {
+		t.Errorf("--append-system-prompt = %q, want Be terse (args: %v)", got, args)
+	}
+}
+
+// fakeClaudeWithLine returns a fake CLI that emits one assistant line padded to
+// roughly size bytes, followed by a result
+func fakeClaudeWithLine(t *testing.T, size int) string {
+	return writeFakeClaude(t, fmt.Sprintf(`read line
+printf '{"type":"assistant","pad":"'
+head -c %d /dev/zero | tr '\0' a
+printf '"}\n'
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`, size))
+}
+
+func TestRunPrompt_LargeLine(t *testing.T) {
+	const size = 1536 * 1024
+	claudeCmd := fakeClaudeWithLine(t, size)
+
+	// The default limit delivers lines well over 1MB intact
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+	var lines [][]byte
+	_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{},
+		func(line []byte) error {
+			lines = append(lines, line)
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("Got %d lines, want 2", len(lines))
+	}
+	want := `{"type":"assistant","pad":"` + strings.Repeat("a", size) + `"}`
+	if string(lines[0]) != want {
+		t.Errorf("Large line was not delivered intact (got %d bytes, want %d)", len(lines[0]), len(want))
+	}
+
+	// A line over a configured limit fails the prompt with a clear error
+	cm = NewClaudeManager(t.TempDir(), claudeCmd, &ClaudeManagerOptions{MaxLineBytes: 64 * 1024})
+	_, err = cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{},
+		func(line []byte) error { return nil })
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("RunPrompt error = %v, want ErrLineTooLong", err)
+	}
+}
+
+func TestRunPrompt_TypedErrors(t *testing.T) {
+	noop := func(line []byte) error { return nil }
+
+	t.Run("not found", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), filepath.Join(t.TempDir(), "no-such-claude"), nil)
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, noop)
+		if !errors.Is(err, ErrClaudeNotFound) {
+			t.Errorf("RunPrompt error = %v, want ErrClaudeNotFound", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, "read line\nexec sleep 10\n"), nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := cm.RunPrompt(ctx, "session-1", nil, "hello", PromptOptions{}, noop)
+		if !errors.Is(err, ErrClaudeTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("RunPrompt error = %v, want ErrClaudeTimeout wrapping context.DeadlineExceeded", err)
+		}
+	})
+
+	t.Run("exited", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, "read line\necho 'debug output' >&2\necho 'invalid API key' >&2\nexit 3\n"), nil)
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, noop)
+		var exitErr *ClaudeExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("RunPrompt error = %v, want a ClaudeExitError", err)
+		}
+		if exitErr.Code != 3 {
+			t.Errorf("Code = %d, want 3", exitErr.Code)
+		}
+		if exitErr.Stderr != "debug output\ninvalid API key\n" {
+			t.Errorf("Stderr = %q, want the CLI's stderr", exitErr.Stderr)
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, "read line\nkill -KILL $$\n"), nil)
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, noop)
+		var exitErr *ClaudeExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("RunPrompt error = %v, want a ClaudeExitError", err)
+		}
+		if exitErr.Code != -1 || exitErr.Signal != "killed" {
+			t.Errorf("Code = %d, Signal = %q, want -1 and killed", exitErr.Code, exitErr.Signal)
+		}
+	})
+	for _, exit := range []int{0, 1} {
+		t.Run(fmt.Sprintf("error result exit %d", exit), func(t *testing.T) {
+			cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, fmt.Sprintf(`read line
+echo '{"type":"result","subtype":"error_max_turns","session_id":"claude-1","num_turns":3}'
+exit %d
+`, exit)), nil)
+			var sawResult bool
+			claudeSessionID, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, func(line []byte) error {
+				sawResult = sawResult || strings.Contains(string(line), `"type":"result"`)
+				return nil
+			})
+			var resultErr *ClaudeResultError
+			if !errors.As(err, &resultErr) || resultErr.Subtype != "error_max_turns" {
+				t.Fatalf("RunPrompt error = %v, want a ClaudeResultError for error_max_turns", err)
+			}
+			if !strings.Contains(err.Error(), "error_max_turns") {
+				t.Errorf("error %q should name the subtype", err)
+			}
+			if claudeSessionID != "claude-1" {
+				t.Errorf("claudeSessionID = %q, want claude-1 so the session can still resume", claudeSessionID)
+			}
+			if !sawResult {
+				t.Error("the result event should still reach the callback")
+			}
+		})
+	}
+
+	t.Run("success result", func(t *testing.T) {
+		cm := NewClaudeManager(t.TempDir(), writeFakeClaude(t, `read line
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`), nil)
+		if _, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{}, noop); err != nil {
+			t.Errorf("RunPrompt error = %v, want nil", err)
+		}
+	})
+}
+
+func TestTailBuffer(t *testing.T) {
+	tail := &tailBuffer{max: 8}
+	fmt.Fprint(tail, "hello ")
+	fmt.Fprint(tail, "world")
+	if got := tail.String(); got != "lo world" {
+		t.Errorf("tail = %q, want the last 8 bytes", got)
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+	input := "first\nsecond\r\n\n" + long + "\nlast"
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	want := []string{"first", "second", "", long, "last"}
+	for i, w := range want {
+		line, err := readLine(r, 1024*1024)
+		if err != nil {
+			t.Fatalf("line %d: readLine failed: %v", i, err)
+		}
+		if string(line) != w {
+			t.Errorf("line %d = %q, want %q", i, truncate(string(line)), truncate(w))
+		}
+	}
+	if _, err := readLine(r, 1024*1024); err != io.EOF {
+		t.Errorf("err = %v, want io.EOF", err)
+	}
+
+	// Exactly at the limit is fine; one byte over is not
+	r = bufio.NewReaderSize(strings.NewReader("abcd\nabcde\n"), 16)
+	if _, err := readLine(r, 4); err != nil {
+		t.Errorf("readLine at limit failed: %v", err)
+	}
+	if _, err := readLine(r, 4); !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("err = %v, want ErrLineTooLong", err)
+	}
+}
+
+// truncate shortens long strings in test failure output
+func truncate(s string) string {
+	if len(s) > 40 {
+		return s[:40] + "..."
+	}
+	return s
+}
+
+func TestDrain_WaitsForRunningPrompt(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `read line
+sleep 0.3
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{},
+			func(line []byte) error { return nil })
+		result <- err
+	}()
+	go func() {
+		for !cm.IsActive("session-1") {
+			time.Sleep(5 * time.Millisecond)
+		}
+		close(started)
+	}()
+	<-started
+
+	if !cm.Drain(5 * time.Second) {
+		t.Fatal("Drain timed out waiting for a prompt that finishes on its own")
+	}
+	if err := <-result; err != nil {
+		t.Errorf("Drained prompt failed: %v", err)
+	}
+
+	// New prompts are refused once draining
+	if !cm.Draining() {
+		t.Error("Draining() = false after Drain")
+	}
+	_, err := cm.RunPrompt(context.Background(), "session-2", nil, "hello", PromptOptions{},
+		func(line []byte) error { return nil })
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("RunPrompt error = %v, want ErrShuttingDown", err)
+	}
+}
+
+func TestDrain_Timeout(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, "read line\nexec sleep 30\n")
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello", PromptOptions{},
+			func(line []byte) error { return nil })
+		result <- err
+	}()
+	for !cm.IsActive("session-1") {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if cm.Drain(50 * time.Millisecond) {
+		t.Fatal("Drain reported success with a prompt still running")
+	}
+
+	// Shutdown kills the straggler
+	cm.Shutdown()
+	select {
+	case <-result:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not stop the remaining prompt")
+	}
+}
+
+func TestIsValidPermissionMode(t *testing.T) {
+	for _, mode := range []string{"default", "acceptEdits", "plan", "bypassPermissions"} {
+		if !IsValidPermissionMode(mode) {
+			t.Errorf("IsValidPermissionMode(%q) = false, want true", mode)
+		}
+	}
+	for _, mode := range []string{"", "Plan", "yolo"} {
+		if IsValidPermissionMode(mode) {
+			t.Errorf("IsValidPermissionMode(%q) = true, want false", mode)
+		}
+	}
+}
+
+func TestRunPrompt_Env(t *testing.T) {
+	t.Setenv("CHAI_TEST_INHERITED", "server")
+	t.Setenv("CHAI_TEST_OVERRIDE", "server")
+	claudeCmd := writeFakeClaude(t, `read line
+printf '{"type":"assistant","env":"%s|%s|%s"}\n' "$CHAI_TEST_INHERITED" "$CHAI_TEST_OVERRIDE" "$CHAI_TEST_ADDED"
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+	var lines []string
+	_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello",
+		PromptOptions{Env: map[string]string{
+			"CHAI_TEST_OVERRIDE": "session",
+			"CHAI_TEST_ADDED":    "added",
+		}},
+		func(line []byte) error {
+			lines = append(lines, string(line))
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if len(lines) == 0 {
+		t.Fatal("Got no output")
+	}
+
+	want := `{"type":"assistant","env":"server|session|added"}`
+	if lines[0] != want {
+		t.Errorf("Output = %s, want %s", lines[0], want)
+	}
+}
+
+func TestSweep_RemovesStalePendingRequests(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", &ClaudeManagerOptions{PendingRequestTTL: time.Minute})
+
+	cm.StorePendingRequest("session-1", "stale", nil)
+	cm.StorePendingRequest("session-1", "fresh", nil)
+	cm.pendingRequests["stale"].CreatedAt = time.Now().Add(-2 * time.Minute)
+
+	pending, processes := cm.sweep()
+	if pending != 1 || processes != 0 {
+		t.Errorf("sweep = (%d, %d), want (1, 0)", pending, processes)
+	}
+	if cm.GetPendingRequest("stale") != nil {
+		t.Error("Stale pending request was not removed")
+	}
+	if cm.GetPendingRequest("fresh") == nil {
+		t.Error("Fresh pending request was removed")
+	}
+
+	stats := cm.Stats()
+	if stats.SweptPendingRequests != 1 || stats.PendingRequests != 0 {
+		t.Errorf("Stats = %+v, want 1 swept and 0 pending", stats)
+	}
+}
+
+func TestSweep_KeepsRequestsOfLiveProcesses(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", &ClaudeManagerOptions{PendingRequestTTL: time.Minute})
+	cm.processes["session-1"] = &ClaudeProcess{startedAt: time.Now()}
+
+	// The process is still blocked on its request, so it stays answerable
+	cm.StorePendingRequest("session-1", "waiting", nil)
+	cm.pendingRequests["waiting"].CreatedAt = time.Now().Add(-2 * time.Minute)
+
+	if pending, _ := cm.sweep(); pending != 0 {
+		t.Errorf("Swept %d pending requests, want 0", pending)
+	}
+	if cm.PendingRequestForSession("session-1") == nil {
+		t.Error("Pending request of a live process was removed")
+	}
+
+	// Once the process exits, the request goes with it
+	cm.processes["session-1"].exited.Store(true)
+	if pending, _ := cm.sweep(); pending != 1 {
+		t.Errorf("Swept %d pending requests after exit, want 1", pending)
+	}
+}
+
+func TestSweep_NoTTLKeepsPendingRequests(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", nil)
+
+	cm.StorePendingRequest("session-1", "old", nil)
+	cm.pendingRequests["old"].CreatedAt = time.Now().Add(-24 * time.Hour)
+
+	if pending, _ := cm.sweep(); pending != 0 {
+		t.Errorf("Swept %d pending requests, want 0", pending)
+	}
+}
+
+func TestSweep_RemovesExitedProcesses(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", nil)
+
+	exited := &ClaudeProcess{startedAt: time.Now()}
+	exited.exited.Store(true)
+	cm.processes["exited"] = exited
+	cm.processes["running"] = &ClaudeProcess{startedAt: time.Now()}
+
+	if _, processes := cm.sweep(); processes != 1 {
+		t.Errorf("Swept %d processes, want 1", processes)
+	}
+	if cm.IsActive("exited") {
+		t.Error("Exited process was not removed")
+	}
+	if !cm.IsActive("running") {
+		t.Error("Running process was removed")
+	}
+	if stats := cm.Stats(); stats.Processes != 1 || stats.SweptProcesses != 1 {
+		t.Errorf("Stats = %+v, want 1 process and 1 swept", stats)
+	}
+}
+
+func TestStorePendingRequest_MaxPendingRequests(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", &ClaudeManagerOptions{MaxPendingRequests: 2})
+
+	cm.StorePendingRequest("session-1", "first", nil)
+	cm.pendingRequests["first"].CreatedAt = time.Now().Add(-time.Minute)
+	cm.StorePendingRequest("session-1", "second", nil)
+	cm.StorePendingRequest("session-1", "third", nil)
+
+	if cm.GetPendingRequest("first") != nil {
+		t.Error("Oldest pending request was not evicted")
+	}
+	if cm.GetPendingRequest("second") == nil || cm.GetPendingRequest("third") == nil {
+		t.Error("Newer pending requests were evicted")
+	}
+	if stats := cm.Stats(); stats.EvictedPendingRequests != 1 {
+		t.Errorf("EvictedPendingRequests = %d, want 1", stats.EvictedPendingRequests)
+	}
+}
+
+func TestStorePendingRequest_EvictionDenies(t *testing.T) {
+	cm := NewClaudeManager(t.TempDir(), "claude", &ClaudeManagerOptions{MaxPendingRequests: 1})
+
+	stdin := &mockWriteCloser{}
+	cm.processes["session-1"] = &ClaudeProcess{cmd: &exec.Cmd{}, stdin: stdin}
+
+	cm.StorePendingRequest("session-1", "first", map[string]any{"command": "ls"})
+	cm.StorePendingRequest("session-2", "second", nil)
+
+	// The process blocked on the evicted request is told no instead of waiting
+	var response NestedControlResponse
+	if err := json.Unmarshal(bytes.TrimSuffix(stdin.Bytes(), []byte("\n")), &response); err != nil {
+		t.Fatalf("Failed to parse the denial: %v", err)
+	}
+	if response.Response.RequestID != "first" || response.Response.Response.Behavior != "deny" {
+		t.Errorf("Response = %+v, want a denial of the evicted request", response.Response)
+	}
+
+	// And a late approval can't allow it
+	if err := cm.SendPermissionResponse("session-1", "first", "allow", "", false); !errors.Is(err, ErrPermissionRequestNotFound) {
+		t.Errorf("Approving the evicted request = %v, want ErrPermissionRequestNotFound", err)
+	}
+}
+
+func TestRunPrompt_RawArgs(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `read line
+printf '{"type":"assistant","args":"%s"}\n' "$*"
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+	resume := "claude-0"
+
+	run := func(opts PromptOptions) string {
+		t.Helper()
+		cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+		var lines []string
+		_, err := cm.RunPrompt(context.Background(), "session-1", &resume, "hello", opts,
+			func(line []byte) error {
+				lines = append(lines, string(line))
+				return nil
+			})
+		if err != nil {
+			t.Fatalf("RunPrompt failed: %v", err)
+		}
+		if len(lines) == 0 {
+			t.Fatal("Got no output")
+		}
+		return lines[0]
+	}
+
+	// Raw args replace the defaults, including --resume
+	got := run(PromptOptions{RawArgs: []string{"--model", "test"}})
+	if want := `{"type":"assistant","args":"--model test"}`; got != want {
+		t.Errorf("Output = %s, want %s", got, want)
+	}
+
+	got = run(PromptOptions{})
+	if !strings.Contains(got, "--output-format stream-json") || !strings.Contains(got, "--resume claude-0") {
+		t.Errorf("Output = %s, want the default args", got)
+	}
+}
+
+func TestRunPrompt_ExtraArgs(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `read line
+printf '{"type":"assistant","args":"%s"}\n' "$*"
+echo '{"type":"result","subtype":"success","session_id":"claude-1"}'
+`)
+
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, &ClaudeManagerOptions{
+		ExtraArgs: []string{"--mcp-config", "/etc/mcp.json"},
+	})
+	var lines []string
+	_, err := cm.RunPrompt(context.Background(), "session-1", nil, "hello",
+		PromptOptions{ExtraArgs: []string{"--allowedTools", "Read,Write"}},
+		func(line []byte) error {
+			lines = append(lines, string(line))
+			return nil
+		})
+	if err != nil {
+		t.Fatalf("RunPrompt failed: %v", err)
+	}
+	if len(lines) == 0 {
+		t.Fatal("Got no output")
+	}
+
+	// Built-in args come first, then the manager's, then the session's
+	want := `--permission-prompt-tool stdio --mcp-config /etc/mcp.json --allowedTools Read,Write"}`
+	if !strings.HasSuffix(lines[0], want) {
+		t.Errorf("Output = %s, want args ending in %s", lines[0], want)
+	}
+}
+
+func TestClaudeManager_Version(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `[ "$1" = "--version" ] && echo "1.0.3 (Claude Code)"
+`)
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	version, err := cm.Version(context.Background())
+	if err != nil {
+		t.Fatalf("Version failed: %v", err)
+	}
+	if version != "1.0.3" {
+		t.Errorf("Version = %q, want %q", version, "1.0.3")
+	}
+}
+
+func TestClaudeManager_Version_NotFound(t *testing.T) {
+	for _, cmd := range []string{"chai-no-such-claude", filepath.Join(t.TempDir(), "missing")} {
+		cm := NewClaudeManager(t.TempDir(), cmd, nil)
+		if _, err := cm.Version(context.Background()); !errors.Is(err, ErrClaudeNotFound) {
+			t.Errorf("Version(%q) error = %v, want ErrClaudeNotFound", cmd, err)
+		}
+	}
+}
+
+func TestClaudeManager_Version_Fails(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, `echo "boom" >&2
+exit 2
+`)
+	cm := NewClaudeManager(t.TempDir(), claudeCmd, nil)
+
+	_, err := cm.Version(context.Background())
+	if err == nil || errors.Is(err, ErrClaudeNotFound) {
+		t.Errorf("Version error = %v, want a non-not-found failure", err)
+	}
+}
+
+func TestParseClaudeVersion(t *testing.T) {
+	tests := []struct {
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{"1.0.3 (Claude Code)\n", "1.0.3", false},
+		{"claude 2.1.0-beta.1\n", "2.1.0-beta.1", false},
+		{"0.9\n", "0.9", false},
+		{"unknown\n", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseClaudeVersion([]byte(tt.out))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseClaudeVersion(%q) error = %v, wantErr %v", tt.out, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseClaudeVersion(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestClaudeManager_Validate(t *testing.T) {
+	claudeCmd := writeFakeClaude(t, "exit 0\n")
+	if err := NewClaudeManager(t.TempDir(), claudeCmd, nil).Validate(); err != nil {
+		t.Errorf("Validate with an executable failed: %v", err)
+	}
+
+	notExecutable := filepath.Join(t.TempDir(), "claude")
+	os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0o644)
+
+	for _, cmd := range []string{"chai-no-such-claude", notExecutable} {
+		err := NewClaudeManager(t.TempDir(), cmd, nil).Validate()
+		if !errors.Is(err, ErrClaudeNotFound) {
+			t.Errorf("Validate(%q) error = %v, want ErrClaudeNotFound", cmd, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), cmd) || !strings.Contains(err.Error(), "CHAI_CLAUDE_CMD") {
+			t.Errorf("Validate(%q) error %q should name the command and how to configure it", cmd, err)
+		}
+	}
+}
@@ -5,39 +5,245 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config holds all server configuration options.
 type Config struct {
-	Port            int
-	DBPath          string
-	WorkDir         string
-	ClaudeCmd       string
-	PromptTimeout   time.Duration
-	ShutdownTimeout time.Duration
+	Port                      int
+	DBPath                    string
+	WorkDir                   string
+	ClaudeCmd                 string
+	PromptTimeout             time.Duration
+	ShutdownTimeout           time.Duration
+	AuthToken                 string
+	UniqueTitles              bool
+	SSEBufferSize             int
+	OrphanSweepInterval       time.Duration
+	OrphanStreamTimeout       time.Duration
+	CollapseErrors            bool
+	MaxPromptBytes            int
+	MaxOutputLineBytes        int
+	ShutdownMode              string
+	LockWorkdirAcrossSessions bool
+	SessionEnvAllow           string
+	SessionEnvDeny            string
+	PendingRequestTTL         time.Duration
+	MaxPendingRequests        int
+	RequestTimeout            time.Duration
+	AllowRawArgs              bool
+	PersistSnapshots          bool
+	DeletedRetention          time.Duration
+	EnableH2C                 bool
+	ExtraClaudeArgs           []string
+	AutoArchiveAfter          time.Duration
+	TextEvents                bool
+	StdinWriteTimeout         time.Duration
+	LongPollTimeout           time.Duration
+	BackupDir                 string
+	DBMaintenanceInterval     time.Duration
+	DBVacuum                  bool
+	MaxAttachments            int
+	MaxAttachmentBytes        int
+	DBReadConns               int
+	DBBusyTimeout             time.Duration
+	DBJournalMode             string
+	RequireClaude             bool
+	CreateWorkDir             bool
+	ConcurrentPrompts         bool
+	ToolEvents                bool
+	OrphanStreamStatus        string
+	DataDir                   string
+	WebhookURL                string
+	WebhookSecret             string
+	PersistEventTypes         string
+	MaxSessions               int
+	ArchiveOldestSessions     bool
+	MaxEventsPerPrompt        int
+	TLSCertFile               string
+	TLSKeyFile                string
+	TLSAutocertDomains        string
+	TLSAutocertCache          string
+	TLSAutocertEmail          string
+	LenientTemplates          bool
+	IdempotencyWindow         time.Duration
+	MaxPromptTimeout          time.Duration
+	CompressEvents            bool
+	ConfigFile                string
+	MaxConcurrentPrompts      int
+	MaxSSEConnectionsPerIP    int
+	ReadOnly                  bool
+	ClaudeLogStderr           bool
+	ClaudeLogStdin            string
+	ClaudeLogFile             string
+	ClaudeLogPrefix           string
+	BasePath                  string
+	ClaudeCmdAllow            string
+	PermissionTimeout         time.Duration
+	MaxStreamDuration         time.Duration
+	ReconnectDelay            time.Duration
+	ThinkingEvents            bool
+	PersistThinking           bool
 }
 
 // configSource tracks where each config value came from.
 type configSource struct {
-	Port            string
-	DBPath          string
-	WorkDir         string
-	ClaudeCmd       string
-	PromptTimeout   string
-	ShutdownTimeout string
+	Port                      string
+	DBPath                    string
+	WorkDir                   string
+	ClaudeCmd                 string
+	PromptTimeout             string
+	ShutdownTimeout           string
+	AuthToken                 string
+	UniqueTitles              string
+	SSEBufferSize             string
+	OrphanSweepInterval       string
+	OrphanStreamTimeout       string
+	CollapseErrors            string
+	MaxPromptBytes            string
+	MaxOutputLineBytes        string
+	ShutdownMode              string
+	LockWorkdirAcrossSessions string
+	SessionEnvAllow           string
+	SessionEnvDeny            string
+	PendingRequestTTL         string
+	MaxPendingRequests        string
+	RequestTimeout            string
+	AllowRawArgs              string
+	PersistSnapshots          string
+	DeletedRetention          string
+	EnableH2C                 string
+	ExtraClaudeArgs           string
+	AutoArchiveAfter          string
+	TextEvents                string
+	StdinWriteTimeout         string
+	LongPollTimeout           string
+	BackupDir                 string
+	DBMaintenanceInterval     string
+	DBVacuum                  string
+	MaxAttachments            string
+	MaxAttachmentBytes        string
+	DBReadConns               string
+	DBBusyTimeout             string
+	DBJournalMode             string
+	RequireClaude             string
+	CreateWorkDir             string
+	ConcurrentPrompts         string
+	ToolEvents                string
+	OrphanStreamStatus        string
+	DataDir                   string
+	WebhookURL                string
+	WebhookSecret             string
+	PersistEventTypes         string
+	MaxSessions               string
+	ArchiveOldestSessions     string
+	MaxEventsPerPrompt        string
+	TLSCertFile               string
+	TLSKeyFile                string
+	TLSAutocertDomains        string
+	TLSAutocertCache          string
+	TLSAutocertEmail          string
+	LenientTemplates          string
+	IdempotencyWindow         string
+	MaxPromptTimeout          string
+	CompressEvents            string
+	ConfigFile                string
+	MaxConcurrentPrompts      string
+	MaxSSEConnectionsPerIP    string
+	ReadOnly                  string
+	ClaudeLogStderr           string
+	ClaudeLogStdin            string
+	ClaudeLogFile             string
+	ClaudeLogPrefix           string
+	BasePath                  string
+	ClaudeCmdAllow            string
+	PermissionTimeout         string
+	MaxStreamDuration         string
+	ReconnectDelay            string
+	ThinkingEvents            string
+	PersistThinking           string
 }
 
 // Flags holds the command-line flag pointers.
 type Flags struct {
-	port            *int
-	dbPath          *string
-	workDir         *string
-	claudeCmd       *string
-	promptTimeout   *time.Duration
-	shutdownTimeout *time.Duration
+	port                      *int
+	dbPath                    *string
+	workDir                   *string
+	claudeCmd                 *string
+	promptTimeout             *time.Duration
+	shutdownTimeout           *time.Duration
+	authToken                 *string
+	uniqueTitles              *bool
+	sseBufferSize             *int
+	orphanSweepInterval       *time.Duration
+	orphanStreamTimeout       *time.Duration
+	collapseErrors            *bool
+	maxPromptBytes            *int
+	maxOutputLineBytes        *int
+	shutdownMode              *string
+	lockWorkdirAcrossSessions *bool
+	sessionEnvAllow           *string
+	sessionEnvDeny            *string
+	pendingRequestTTL         *time.Duration
+	maxPendingRequests        *int
+	requestTimeout            *time.Duration
+	allowRawArgs              *bool
+	persistSnapshots          *bool
+	deletedRetention          *time.Duration
+	enableH2C                 *bool
+	extraClaudeArgs           *stringList
+	autoArchiveAfter          *time.Duration
+	textEvents                *bool
+	stdinWriteTimeout         *time.Duration
+	longPollTimeout           *time.Duration
+	backupDir                 *string
+	dbMaintenanceInterval     *time.Duration
+	dbVacuum                  *bool
+	maxAttachments            *int
+	maxAttachmentBytes        *int
+	dbReadConns               *int
+	dbBusyTimeout             *time.Duration
+	dbJournalMode             *string
+	requireClaude             *bool
+	createWorkDir             *bool
+	concurrentPrompts         *bool
+	toolEvents                *bool
+	orphanStreamStatus        *string
+	dataDir                   *string
+	webhookURL                *string
+	webhookSecret             *string
+	persistEventTypes         *string
+	maxSessions               *int
+	archiveOldestSessions     *bool
+	maxEventsPerPrompt        *int
+	tlsCertFile               *string
+	tlsKeyFile                *string
+	tlsAutocertDomains        *string
+	tlsAutocertCache          *string
+	tlsAutocertEmail          *string
+	lenientTemplates          *bool
+	idempotencyWindow         *time.Duration
+	maxPromptTimeout          *time.Duration
+	compressEvents            *bool
+	configFile                *string
+	maxConcurrentPrompts      *int
+	maxSSEConnectionsPerIP    *int
+	readOnly                  *bool
+	claudeLogStderr           *bool
+	claudeLogStdin            *string
+	claudeLogFile             *string
+	claudeLogPrefix           *string
+	basePath                  *string
+	claudeCmdAllow            *string
+	permissionTimeout         *time.Duration
+	maxStreamDuration         *time.Duration
+	reconnectDelay            *time.Duration
+	thinkingEvents            *bool
+	persistThinking           *bool
 }
 
 // LoadConfigOptions configures the behavior of LoadConfig.
@@ -49,12 +255,78 @@ type LoadConfigOptions struct {
 
 // defaults for configuration.
 const (
-	defaultPort            = 8080
-	defaultDBPath          = "chai.db"
-	defaultWorkDir         = ""
-	defaultClaudeCmd       = "claude"
-	defaultPromptTimeout   = 5 * time.Minute
-	defaultShutdownTimeout = 30 * time.Second
+	defaultPort                      = 8080
+	defaultDBPath                    = "chai.db"
+	defaultWorkDir                   = ""
+	defaultClaudeCmd                 = "claude"
+	defaultPromptTimeout             = 5 * time.Minute
+	defaultShutdownTimeout           = 30 * time.Second
+	defaultAuthToken                 = ""
+	defaultUniqueTitles              = false
+	defaultSSEBufferSize             = 256
+	defaultOrphanSweepInterval       = 1 * time.Minute
+	defaultOrphanStreamTimeout       = 2 * time.Minute
+	defaultCollapseErrors            = true
+	defaultMaxPromptBytes            = 1 << 20
+	defaultMaxOutputLineBytes        = 64 << 20
+	defaultShutdownMode              = ShutdownModeKill
+	defaultLockWorkdirAcrossSessions = false
+	defaultSessionEnvAllow           = ""
+	defaultSessionEnvDeny            = "PATH,HOME,LD_*,DYLD_*,CHAI_*"
+	defaultPendingRequestTTL         = 1 * time.Hour
+	defaultMaxPendingRequests        = 1000
+	defaultRequestTimeout            = 30 * time.Second
+	defaultAllowRawArgs              = false
+	defaultPersistSnapshots          = true
+	defaultDeletedRetention          = 7 * 24 * time.Hour
+	defaultEnableH2C                 = false
+	defaultAutoArchiveAfter          = 0
+	defaultTextEvents                = false
+	defaultStdinWriteTimeout         = 10 * time.Second
+	defaultLongPollTimeout           = 30 * time.Second
+	defaultBackupDir                 = "backups"
+	defaultDBMaintenanceInterval     = time.Hour
+	defaultDBVacuum                  = false
+	defaultMaxAttachments            = 10
+	defaultMaxAttachmentBytes        = 5 << 20
+	defaultDBReadConns               = 0
+	defaultDBBusyTimeout             = DefaultBusyTimeout
+	defaultDBJournalMode             = DefaultJournalMode
+	defaultRequireClaude             = false
+	defaultCreateWorkDir             = false
+	defaultConcurrentPrompts         = false
+	defaultToolEvents                = false
+	defaultOrphanStreamStatus        = "idle"
+	defaultDataDir                   = ""
+	defaultWebhookURL                = ""
+	defaultWebhookSecret             = ""
+	defaultPersistEventTypes         = ""
+	defaultMaxSessions               = 0
+	defaultArchiveOldestSessions     = false
+	defaultMaxEventsPerPrompt        = 0
+	defaultTLSCertFile               = ""
+	defaultTLSKeyFile                = ""
+	defaultTLSAutocertDomains        = ""
+	defaultTLSAutocertCache          = "autocert"
+	defaultTLSAutocertEmail          = ""
+	defaultLenientTemplates          = false
+	defaultIdempotencyWindow         = 10 * time.Minute
+	defaultMaxPromptTimeout          = time.Hour
+	defaultCompressEvents            = false
+	defaultMaxConcurrentPrompts      = 0
+	defaultMaxSSEConnectionsPerIP    = 0
+	defaultReadOnly                  = false
+	defaultClaudeLogStderr           = true
+	defaultClaudeLogStdin            = StdinLogRedacted
+	defaultClaudeLogFile             = ""
+	defaultClaudeLogPrefix           = ""
+	defaultBasePath                  = ""
+	defaultClaudeCmdAllow            = ""
+	defaultPermissionTimeout         = 0
+	defaultMaxStreamDuration         = 0
+	defaultReconnectDelay            = 5 * time.Second
+	defaultThinkingEvents            = false
+	defaultPersistThinking           = false
 )
 
 // flagChecker is a function type for checking if a flag was set.
@@ -64,15 +336,102 @@ type flagChecker func(name string) bool
 // RegisterFlags registers command-line flags and returns flag pointers.
 func RegisterFlags() *Flags {
 	return &Flags{
-		port:            flag.Int("port", defaultPort, "HTTP port (env: CHAI_PORT)"),
-		dbPath:          flag.String("db", defaultDBPath, "SQLite database path (env: CHAI_DB)"),
-		workDir:         flag.String("workdir", defaultWorkDir, "working directory for Claude CLI (env: CHAI_WORKDIR)"),
-		claudeCmd:       flag.String("claude-cmd", defaultClaudeCmd, "path to Claude CLI command (env: CHAI_CLAUDE_CMD)"),
-		promptTimeout:   flag.Duration("prompt-timeout", defaultPromptTimeout, "timeout for prompt requests (env: CHAI_PROMPT_TIMEOUT)"),
-		shutdownTimeout: flag.Duration("shutdown-timeout", defaultShutdownTimeout, "timeout for graceful shutdown (env: CHAI_SHUTDOWN_TIMEOUT)"),
+		port:                      flag.Int("port", defaultPort, "HTTP port (env: CHAI_PORT)"),
+		dbPath:                    flag.String("db", defaultDBPath, "SQLite database path (env: CHAI_DB)"),
+		workDir:                   flag.String("workdir", defaultWorkDir, "working directory for Claude CLI (env: CHAI_WORKDIR)"),
+		claudeCmd:                 flag.String("claude-cmd", defaultClaudeCmd, "path to Claude CLI command (env: CHAI_CLAUDE_CMD)"),
+		promptTimeout:             flag.Duration("prompt-timeout", defaultPromptTimeout, "timeout for prompt requests (env: CHAI_PROMPT_TIMEOUT)"),
+		shutdownTimeout:           flag.Duration("shutdown-timeout", defaultShutdownTimeout, "timeout for graceful shutdown (env: CHAI_SHUTDOWN_TIMEOUT)"),
+		authToken:                 flag.String("auth-token", defaultAuthToken, "bearer token required for admin endpoints (env: CHAI_AUTH_TOKEN)"),
+		uniqueTitles:              flag.Bool("unique-titles", defaultUniqueTitles, "reject sessions whose title is already in use (env: CHAI_UNIQUE_TITLES)"),
+		sseBufferSize:             flag.Int("sse-buffer-size", defaultSSEBufferSize, "events buffered per SSE client before a slow client is dropped, 0 to write inline (env: CHAI_SSE_BUFFER_SIZE)"),
+		orphanSweepInterval:       flag.Duration("orphan-sweep-interval", defaultOrphanSweepInterval, "how often to reset streaming sessions with no live process, 0 to disable (env: CHAI_ORPHAN_SWEEP_INTERVAL)"),
+		orphanStreamTimeout:       flag.Duration("orphan-stream-timeout", defaultOrphanStreamTimeout, "how long a streaming session must be without updates before the sweeper may reset it (env: CHAI_ORPHAN_STREAM_TIMEOUT)"),
+		collapseErrors:            flag.Bool("collapse-errors", defaultCollapseErrors, "persist consecutive identical error events once with a count (env: CHAI_COLLAPSE_ERRORS)"),
+		maxPromptBytes:            flag.Int("max-prompt-bytes", defaultMaxPromptBytes, "maximum prompt size in bytes, 0 for no limit (env: CHAI_MAX_PROMPT_BYTES)"),
+		maxOutputLineBytes:        flag.Int("max-output-line-bytes", defaultMaxOutputLineBytes, "maximum size of a single Claude CLI output line in bytes (env: CHAI_MAX_OUTPUT_LINE_BYTES)"),
+		shutdownMode:              flag.String("shutdown-mode", defaultShutdownMode, "on shutdown, kill Claude processes immediately (kill) or let running prompts finish within the shutdown timeout (drain) (env: CHAI_SHUTDOWN_MODE)"),
+		lockWorkdirAcrossSessions: flag.Bool("lock-workdir", defaultLockWorkdirAcrossSessions, "serialize prompts from different sessions that share a working directory (env: CHAI_LOCK_WORKDIR)"),
+		sessionEnvAllow:           flag.String("session-env-allow", defaultSessionEnvAllow, "comma-separated env variables sessions may set; NAME* matches a prefix, empty allows all not denied (env: CHAI_SESSION_ENV_ALLOW)"),
+		sessionEnvDeny:            flag.String("session-env-deny", defaultSessionEnvDeny, "comma-separated env variables sessions may never set; NAME* matches a prefix (env: CHAI_SESSION_ENV_DENY)"),
+		pendingRequestTTL:         flag.Duration("pending-request-ttl", defaultPendingRequestTTL, "age at which an unanswered permission request of an exited Claude process is dropped, 0 disables (env: CHAI_PENDING_REQUEST_TTL)"),
+		maxPendingRequests:        flag.Int("max-pending-requests", defaultMaxPendingRequests, "maximum permission requests held in memory; the oldest is evicted past it, 0 disables (env: CHAI_MAX_PENDING_REQUESTS)"),
+		requestTimeout:            flag.Duration("request-timeout", defaultRequestTimeout, "timeout for non-streaming API requests, 0 disables (env: CHAI_REQUEST_TIMEOUT)"),
+		allowRawArgs:              flag.Bool("allow-raw-args", defaultAllowRawArgs, "let authenticated prompts replace the Claude CLI args with raw_args and authenticated sessions add extra_args; requires -auth-token (env: CHAI_ALLOW_RAW_ARGS)"),
+		persistSnapshots:          flag.Bool("persist-snapshots", defaultPersistSnapshots, "save a snapshot of each finished prompt's reply and outcome (env: CHAI_PERSIST_SNAPSHOTS)"),
+		deletedRetention:          flag.Duration("deleted-retention", defaultDeletedRetention, "how long deleted sessions stay restorable before being purged, 0 deletes immediately (env: CHAI_DELETED_RETENTION)"),
+		enableH2C:                 flag.Bool("h2c", defaultEnableH2C, "serve HTTP/2 without TLS (h2c) alongside HTTP/1.1 (env: CHAI_ENABLE_H2C)"),
+		extraClaudeArgs:           stringListFlag("claude-arg", "extra argument appended to every Claude CLI invocation; repeat for more (env: CHAI_EXTRA_CLAUDE_ARGS, space-separated)"),
+		autoArchiveAfter:          flag.Duration("auto-archive-after", defaultAutoArchiveAfter, "archive sessions with no activity for this long, 0 disables (env: CHAI_AUTO_ARCHIVE_AFTER)"),
+		textEvents:                flag.Bool("text-events", defaultTextEvents, "emit normalized text events with incremental assistant text, a new event type clients opt in to (env: CHAI_TEXT_EVENTS)"),
+		stdinWriteTimeout:         flag.Duration("stdin-write-timeout", defaultStdinWriteTimeout, "time allowed to write a permission response to Claude stdin, 0 waits indefinitely (env: CHAI_STDIN_WRITE_TIMEOUT)"),
+		longPollTimeout:           flag.Duration("long-poll-timeout", defaultLongPollTimeout, "longest GET /events?wait=true blocks for new events, 0 disables waiting (env: CHAI_LONG_POLL_TIMEOUT)"),
+		backupDir:                 flag.String("backup-dir", defaultBackupDir, "directory for database backups from POST /api/admin/backup, empty disables (env: CHAI_BACKUP_DIR)"),
+		dbMaintenanceInterval:     flag.Duration("db-maintenance-interval", defaultDBMaintenanceInterval, "minimum time between WAL checkpoints (and vacuums) run after event cleanup deletes events, 0 disables (env: CHAI_DB_MAINTENANCE_INTERVAL)"),
+		dbVacuum:                  flag.Bool("db-vacuum", defaultDBVacuum, "also vacuum the database during maintenance, rewriting the whole file (env: CHAI_DB_VACUUM)"),
+		maxAttachments:            flag.Int("max-attachments", defaultMaxAttachments, "maximum image attachments per prompt, 0 rejects attachments (env: CHAI_MAX_ATTACHMENTS)"),
+		maxAttachmentBytes:        flag.Int("max-attachment-bytes", defaultMaxAttachmentBytes, "maximum decoded size of one prompt attachment in bytes (env: CHAI_MAX_ATTACHMENT_BYTES)"),
+		dbReadConns:               flag.Int("db-read-conns", defaultDBReadConns, "size of a separate read-only connection pool, 0 shares the single writer connection (env: CHAI_DB_READ_CONNS)"),
+		dbBusyTimeout:             flag.Duration("db-busy-timeout", defaultDBBusyTimeout, "how long a database connection waits on a lock before failing (env: CHAI_DB_BUSY_TIMEOUT)"),
+		dbJournalMode:             flag.String("db-journal-mode", defaultDBJournalMode, "SQLite journal mode (WAL, DELETE, TRUNCATE, PERSIST, MEMORY, OFF) (env: CHAI_DB_JOURNAL_MODE)"),
+		requireClaude:             flag.Bool("require-claude", defaultRequireClaude, "refuse to start when the Claude CLI command is not found (env: CHAI_REQUIRE_CLAUDE)"),
+		createWorkDir:             flag.Bool("create-workdir", defaultCreateWorkDir, "create a new session's working directory if it does not exist instead of rejecting the session (env: CHAI_CREATE_WORKDIR)"),
+		concurrentPrompts:         flag.Bool("concurrent-prompts", defaultConcurrentPrompts, "allow sessions created with concurrent_prompts to run several prompts at once, each in its own Claude process (env: CHAI_CONCURRENT_PROMPTS)"),
+		toolEvents:                flag.Bool("tool-events", defaultToolEvents, "emit normalized tool_call and tool_result events for Claude's tool activity, new event types clients opt in to (env: CHAI_TOOL_EVENTS)"),
+		orphanStreamStatus:        flag.String("orphan-stream-status", defaultOrphanStreamStatus, "stream status the sweeper resets orphaned streaming sessions to (idle or completed) (env: CHAI_ORPHAN_STREAM_STATUS)"),
+		dataDir:                   flag.String("data-dir", defaultDataDir, "directory for the database and backups when their paths are relative; defaults to the working directory (env: CHAI_DATA_DIR)"),
+		webhookURL:                flag.String("webhook-url", defaultWebhookURL, "URL to POST session lifecycle webhooks to, empty to disable (env: CHAI_WEBHOOK_URL)"),
+		webhookSecret:             flag.String("webhook-secret", defaultWebhookSecret, "secret for the HMAC-SHA256 signature sent with each webhook (env: CHAI_WEBHOOK_SECRET)"),
+		persistEventTypes:         flag.String("persist-event-types", defaultPersistEventTypes, "comma-separated Claude event types whose raw frames are persisted for catch-up, empty persists all (env: CHAI_PERSIST_EVENT_TYPES)"),
+		maxSessions:               flag.Int("max-sessions", defaultMaxSessions, "maximum live (not archived or deleted) sessions, 0 for unlimited (env: CHAI_MAX_SESSIONS)"),
+		archiveOldestSessions:     flag.Bool("archive-oldest-sessions", defaultArchiveOldestSessions, "at -max-sessions, archive the least recently updated idle sessions instead of rejecting new ones (env: CHAI_ARCHIVE_OLDEST_SESSIONS)"),
+		maxEventsPerPrompt:        flag.Int("max-events-per-prompt", defaultMaxEventsPerPrompt, "keep only each prompt's most recent events (plus its connected and user_prompt events), 0 for unlimited (env: CHAI_MAX_EVENTS_PER_PROMPT)"),
+		tlsCertFile:               flag.String("tls-cert", defaultTLSCertFile, "PEM certificate (chain) file; with -tls-key, serve HTTPS (env: CHAI_TLS_CERT)"),
+		tlsKeyFile:                flag.String("tls-key", defaultTLSKeyFile, "PEM private key file for -tls-cert (env: CHAI_TLS_KEY)"),
+		tlsAutocertDomains:        flag.String("tls-autocert-domains", defaultTLSAutocertDomains, "comma-separated domains to serve HTTPS for with certificates obtained from Let's Encrypt (env: CHAI_TLS_AUTOCERT_DOMAINS)"),
+		tlsAutocertCache:          flag.String("tls-autocert-cache", defaultTLSAutocertCache, "directory caching -tls-autocert-domains certificates; relative to the data directory (env: CHAI_TLS_AUTOCERT_CACHE)"),
+		tlsAutocertEmail:          flag.String("tls-autocert-email", defaultTLSAutocertEmail, "contact email for the ACME account, optional (env: CHAI_TLS_AUTOCERT_EMAIL)"),
+		lenientTemplates:          flag.Bool("lenient-templates", defaultLenientTemplates, "expand undefined prompt template variables to empty instead of rejecting the prompt (env: CHAI_LENIENT_TEMPLATES)"),
+		idempotencyWindow:         flag.Duration("idempotency-window", defaultIdempotencyWindow, "how long a prompt's Idempotency-Key is remembered, 0 to ignore the header (env: CHAI_IDEMPOTENCY_WINDOW)"),
+		maxPromptTimeout:          flag.Duration("max-prompt-timeout", defaultMaxPromptTimeout, "longest timeout a session or prompt may request, 0 to disallow overrides (env: CHAI_MAX_PROMPT_TIMEOUT)"),
+		compressEvents:            flag.Bool("compress-events", defaultCompressEvents, "gzip persisted event data when it makes it smaller (env: CHAI_COMPRESS_EVENTS)"),
+		configFile:                flag.String("config", "", "YAML or JSON file of option values, used when neither the flag nor env var is set (env: CHAI_CONFIG)"),
+		maxConcurrentPrompts:      flag.Int("max-concurrent-prompts", defaultMaxConcurrentPrompts, "maximum prompts running Claude at once across all sessions, 0 for unlimited (env: CHAI_MAX_CONCURRENT_PROMPTS)"),
+		maxSSEConnectionsPerIP:    flag.Int("max-sse-connections-per-ip", defaultMaxSSEConnectionsPerIP, "maximum open prompt streams per client IP, 0 for unlimited (env: CHAI_MAX_SSE_CONNECTIONS_PER_IP)"),
+		readOnly:                  flag.Bool("read-only", defaultReadOnly, "start in read-only mode, rejecting writes with 503 while still serving reads (env: CHAI_READ_ONLY)"),
+		claudeLogStderr:           flag.Bool("claude-log-stderr", defaultClaudeLogStderr, "log each line the Claude CLI writes to stderr (env: CHAI_CLAUDE_LOG_STDERR)"),
+		claudeLogStdin:            flag.String("claude-log-stdin", defaultClaudeLogStdin, "how permission responses written to the Claude CLI's stdin are logged: full, redacted or off (env: CHAI_CLAUDE_LOG_STDIN)"),
+		claudeLogFile:             flag.String("claude-log-file", defaultClaudeLogFile, "file the Claude CLI's stderr and stdin logging is appended to instead of the server log (env: CHAI_CLAUDE_LOG_FILE)"),
+		claudeLogPrefix:           flag.String("claude-log-prefix", defaultClaudeLogPrefix, "prefix for each line of Claude CLI stderr and stdin logging (env: CHAI_CLAUDE_LOG_PREFIX)"),
+		basePath:                  flag.String("base-path", defaultBasePath, "URL path prefix to serve every route under, e.g. /chai behind a reverse proxy (env: CHAI_BASE_PATH)"),
+		claudeCmdAllow:            flag.String("claude-cmd-allow", defaultClaudeCmdAllow, "comma-separated commands sessions may set as claude_cmd instead of -claude-cmd, empty rejects per-session commands (env: CHAI_CLAUDE_CMD_ALLOW)"),
+		permissionTimeout:         flag.Duration("permission-timeout", defaultPermissionTimeout, "deny a running prompt's permission request left unanswered this long, 0 waits indefinitely (env: CHAI_PERMISSION_TIMEOUT)"),
+		maxStreamDuration:         flag.Duration("max-stream-duration", defaultMaxStreamDuration, "close a prompt stream connection open this long, queueing included, with a terminal error event, 0 for no cap (env: CHAI_MAX_STREAM_DURATION)"),
+		reconnectDelay:            flag.Duration("reconnect-delay", defaultReconnectDelay, "delay suggested to prompt stream clients in the reconnect event sent at shutdown, 0 sends none (env: CHAI_RECONNECT_DELAY)"),
+		thinkingEvents:            flag.Bool("thinking-events", defaultThinkingEvents, "emit normalized thinking events with incremental reasoning from Claude's thinking blocks (env: CHAI_THINKING_EVENTS)"),
+		persistThinking:           flag.Bool("persist-thinking", defaultPersistThinking, "save an assistant reply's reasoning from thinking blocks with its message, separately from the answer text (env: CHAI_PERSIST_THINKING)"),
 	}
 }
 
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// stringListFlag registers a repeatable string flag.
+func stringListFlag(name, usage string) *stringList {
+	var l stringList
+	flag.Var(&l, name, usage)
+	return &l
+}
+
 // defaultFlagChecker uses flag.Visit to check if a flag was explicitly set.
 func defaultFlagChecker(name string) bool {
 	found := false
@@ -100,7 +459,170 @@ func validatePositiveDuration(d time.Duration, name, source string) error {
 	return nil
 }
 
-// LoadConfig loads configuration with precedence: flag > env > default.
+// loadString resolves a string option with precedence flag > env > file > default.
+// A nil flag pointer is treated as unset.
+func loadString(wasSet flagChecker, file *configFile, flagName string, flagVal *string, envName, def string) (string, string) {
+	env, from := file.lookup(envName)
+	if flagVal != nil && wasSet(flagName) {
+		return *flagVal, "flag"
+	}
+	if env != "" {
+		return env, from
+	}
+	return def, "default"
+}
+
+// loadStringList resolves a list option with precedence flag > env > file > default.
+// The env value is split on whitespace, so commas stay inside an item. A nil
+// flag pointer is treated as unset.
+func loadStringList(wasSet flagChecker, file *configFile, flagName string, flagVal *stringList, envName string) ([]string, string) {
+	env, from := file.lookup(envName)
+	if flagVal != nil && wasSet(flagName) {
+		return []string(*flagVal), "flag"
+	}
+	if env != "" {
+		return strings.Fields(env), from
+	}
+	return nil, "default"
+}
+
+// loadBool resolves a boolean option with precedence flag > env > file > default.
+// A nil flag pointer is treated as unset.
+func loadBool(wasSet flagChecker, file *configFile, flagName string, flagVal *bool, envName string, def bool) (bool, string, error) {
+	env, from := file.lookup(envName)
+	if flagVal != nil && wasSet(flagName) {
+		return *flagVal, "flag", nil
+	}
+	if env != "" {
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return false, "", fmt.Errorf("invalid %s value %q: %w", envName, env, err)
+		}
+		return b, from, nil
+	}
+	return def, "default", nil
+}
+
+// loadInt resolves an integer option with precedence flag > env > file > default.
+// A nil flag pointer is treated as unset.
+func loadInt(wasSet flagChecker, file *configFile, flagName string, flagVal *int, envName string, def int) (int, string, error) {
+	env, from := file.lookup(envName)
+	if flagVal != nil && wasSet(flagName) {
+		return *flagVal, "flag", nil
+	}
+	if env != "" {
+		n, err := strconv.Atoi(env)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid %s value %q: %w", envName, env, err)
+		}
+		return n, from, nil
+	}
+	return def, "default", nil
+}
+
+// loadDuration resolves a duration option with precedence flag > env > file > default.
+// A nil flag pointer is treated as unset.
+func loadDuration(wasSet flagChecker, file *configFile, flagName string, flagVal *time.Duration, envName string, def time.Duration) (time.Duration, string, error) {
+	env, from := file.lookup(envName)
+	if flagVal != nil && wasSet(flagName) {
+		return *flagVal, "flag", nil
+	}
+	if env != "" {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return 0, "", fmt.Errorf("invalid %s value %q: %w", envName, env, err)
+		}
+		return d, from, nil
+	}
+	return def, "default", nil
+}
+
+// validateNonNegativeDuration checks that a duration is zero (disabled) or positive.
+func validateNonNegativeDuration(d time.Duration, name, source string) error {
+	if d < 0 {
+		return fmt.Errorf("invalid %s value %v (from %s): must not be negative", name, d, source)
+	}
+	return nil
+}
+
+// validateNonNegative checks that an integer option is zero or greater.
+func validateNonNegative(n int, name, source string) error {
+	if n < 0 {
+		return fmt.Errorf("invalid %s value %d (from %s): must not be negative", name, n, source)
+	}
+	return nil
+}
+
+// Shutdown modes for ShutdownMode
+const (
+	ShutdownModeKill  = "kill"
+	ShutdownModeDrain = "drain"
+)
+
+// validateShutdownMode checks that a shutdown mode is known.
+func validateShutdownMode(mode, name, source string) error {
+	if mode != ShutdownModeKill && mode != ShutdownModeDrain {
+		return fmt.Errorf("invalid %s value %q (from %s): must be %q or %q", name, mode, source, ShutdownModeKill, ShutdownModeDrain)
+	}
+	return nil
+}
+
+// validateJournalMode checks that a SQLite journal mode is known.
+func validateJournalMode(mode, name, source string) error {
+	switch strings.ToUpper(mode) {
+	case "WAL", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "OFF":
+		return nil
+	}
+	return fmt.Errorf("invalid %s value %q (from %s): must be one of WAL, DELETE, TRUNCATE, PERSIST, MEMORY, OFF", name, mode, source)
+}
+
+// validateOrphanStreamStatus checks the status the orphan sweeper resets sessions to.
+func validateOrphanStreamStatus(status, name, source string) error {
+	switch StreamStatus(status) {
+	case StreamStatusIdle, StreamStatusCompleted:
+		return nil
+	}
+	return fmt.Errorf("invalid %s value %q (from %s): must be idle or completed", name, status, source)
+}
+
+// validateStdinLog checks how Claude stdin payloads are logged.
+func validateStdinLog(mode, name, source string) error {
+	switch mode {
+	case StdinLogFull, StdinLogRedacted, StdinLogOff:
+		return nil
+	}
+	return fmt.Errorf("invalid %s value %q (from %s): must be full, redacted or off", name, mode, source)
+}
+
+// validateBasePath checks that a base path is empty or an absolute URL path.
+func validateBasePath(path, name, source string) error {
+	if path == "" || (strings.HasPrefix(path, "/") && !strings.ContainsAny(path, "?#")) {
+		return nil
+	}
+	return fmt.Errorf("invalid %s value %q (from %s): must start with / and not contain ? or #", name, path, source)
+}
+
+// validateWebhookURL checks that a webhook URL, if set, is an absolute http(s) URL.
+func validateWebhookURL(raw, name, source string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid %s value %q (from %s): must be an http or https URL", name, raw, source)
+	}
+	return nil
+}
+
+// validatePositive checks that an integer option is greater than zero.
+func validatePositive(n int, name, source string) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid %s value %d (from %s): must be positive", name, n, source)
+	}
+	return nil
+}
+
+// LoadConfig loads configuration with precedence: flag > env > file > default.
 // Must be called after flag.Parse().
 func LoadConfig(f *Flags, opts *LoadConfigOptions) (*Config, error) {
 	return loadConfigWithChecker(f, opts, defaultFlagChecker)
@@ -111,18 +633,37 @@ func LoadConfig(f *Flags, opts *LoadConfigOptions) (*Config, error) {
 func loadConfigWithChecker(f *Flags, opts *LoadConfigOptions, wasSet flagChecker) (*Config, error) {
 	cfg := &Config{}
 	source := &configSource{}
+	var err error
+
+	// ConfigFile is resolved first since the file it names backs every
+	// other option.
+	if f.configFile != nil && wasSet("config") {
+		cfg.ConfigFile, source.ConfigFile = *f.configFile, "flag"
+	} else if env := os.Getenv("CHAI_CONFIG"); env != "" {
+		cfg.ConfigFile, source.ConfigFile = env, "env"
+	} else {
+		source.ConfigFile = "default"
+	}
+	var file *configFile
+	if cfg.ConfigFile != "" {
+		if file, err = loadConfigFile(cfg.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+	var env, from string
 
 	// Port
+	env, from = file.lookup("CHAI_PORT")
 	if wasSet("port") {
 		cfg.Port = *f.port
 		source.Port = "flag"
-	} else if env := os.Getenv("CHAI_PORT"); env != "" {
+	} else if env != "" {
 		p, err := strconv.Atoi(env)
 		if err != nil {
 			return nil, fmt.Errorf("invalid CHAI_PORT value %q: %w", env, err)
 		}
 		cfg.Port = p
-		source.Port = "env"
+		source.Port = from
 	} else {
 		cfg.Port = defaultPort
 		source.Port = "default"
@@ -132,52 +673,56 @@ func loadConfigWithChecker(f *Flags, opts *LoadConfigOptions, wasSet flagChecker
 	}
 
 	// DBPath
+	env, from = file.lookup("CHAI_DB")
 	if wasSet("db") {
 		cfg.DBPath = *f.dbPath
 		source.DBPath = "flag"
-	} else if env := os.Getenv("CHAI_DB"); env != "" {
+	} else if env != "" {
 		cfg.DBPath = env
-		source.DBPath = "env"
+		source.DBPath = from
 	} else {
 		cfg.DBPath = defaultDBPath
 		source.DBPath = "default"
 	}
 
 	// WorkDir
+	env, from = file.lookup("CHAI_WORKDIR")
 	if wasSet("workdir") {
 		cfg.WorkDir = *f.workDir
 		source.WorkDir = "flag"
-	} else if env := os.Getenv("CHAI_WORKDIR"); env != "" {
+	} else if env != "" {
 		cfg.WorkDir = env
-		source.WorkDir = "env"
+		source.WorkDir = from
 	} else {
 		cfg.WorkDir = defaultWorkDir
 		source.WorkDir = "default"
 	}
 
 	// ClaudeCmd
+	env, from = file.lookup("CHAI_CLAUDE_CMD")
 	if wasSet("claude-cmd") {
 		cfg.ClaudeCmd = *f.claudeCmd
 		source.ClaudeCmd = "flag"
-	} else if env := os.Getenv("CHAI_CLAUDE_CMD"); env != "" {
+	} else if env != "" {
 		cfg.ClaudeCmd = env
-		source.ClaudeCmd = "env"
+		source.ClaudeCmd = from
 	} else {
 		cfg.ClaudeCmd = defaultClaudeCmd
 		source.ClaudeCmd = "default"
 	}
 
 	// PromptTimeout
+	env, from = file.lookup("CHAI_PROMPT_TIMEOUT")
 	if wasSet("prompt-timeout") {
 		cfg.PromptTimeout = *f.promptTimeout
 		source.PromptTimeout = "flag"
-	} else if env := os.Getenv("CHAI_PROMPT_TIMEOUT"); env != "" {
+	} else if env != "" {
 		d, err := time.ParseDuration(env)
 		if err != nil {
 			return nil, fmt.Errorf("invalid CHAI_PROMPT_TIMEOUT value %q: %w", env, err)
 		}
 		cfg.PromptTimeout = d
-		source.PromptTimeout = "env"
+		source.PromptTimeout = from
 	} else {
 		cfg.PromptTimeout = defaultPromptTimeout
 		source.PromptTimeout = "default"
@@ -187,16 +732,17 @@ func loadConfigWithChecker(f *Flags, opts *LoadConfigOptions, wasSet flagChecker
 	}
 
 	// ShutdownTimeout
+	env, from = file.lookup("CHAI_SHUTDOWN_TIMEOUT")
 	if wasSet("shutdown-timeout") {
 		cfg.ShutdownTimeout = *f.shutdownTimeout
 		source.ShutdownTimeout = "flag"
-	} else if env := os.Getenv("CHAI_SHUTDOWN_TIMEOUT"); env != "" {
+	} else if env != "" {
 		d, err := time.ParseDuration(env)
 		if err != nil {
 			return nil, fmt.Errorf("invalid CHAI_SHUTDOWN_TIMEOUT value %q: %w", env, err)
 		}
 		cfg.ShutdownTimeout = d
-		source.ShutdownTimeout = "env"
+		source.ShutdownTimeout = from
 	} else {
 		cfg.ShutdownTimeout = defaultShutdownTimeout
 		source.ShutdownTimeout = "default"
@@ -205,6 +751,451 @@ func loadConfigWithChecker(f *Flags, opts *LoadConfigOptions, wasSet flagChecker
 		return nil, err
 	}
 
+	// AuthToken
+	cfg.AuthToken, source.AuthToken = loadString(wasSet, file, "auth-token", f.authToken, "CHAI_AUTH_TOKEN", defaultAuthToken)
+
+	// UniqueTitles
+	cfg.UniqueTitles, source.UniqueTitles, err = loadBool(wasSet, file, "unique-titles", f.uniqueTitles, "CHAI_UNIQUE_TITLES", defaultUniqueTitles)
+	if err != nil {
+		return nil, err
+	}
+
+	// SSEBufferSize
+	cfg.SSEBufferSize, source.SSEBufferSize, err = loadInt(wasSet, file, "sse-buffer-size", f.sseBufferSize, "CHAI_SSE_BUFFER_SIZE", defaultSSEBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.SSEBufferSize, "CHAI_SSE_BUFFER_SIZE", source.SSEBufferSize); err != nil {
+		return nil, err
+	}
+
+	// OrphanSweepInterval
+	cfg.OrphanSweepInterval, source.OrphanSweepInterval, err = loadDuration(wasSet, file, "orphan-sweep-interval", f.orphanSweepInterval, "CHAI_ORPHAN_SWEEP_INTERVAL", defaultOrphanSweepInterval)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.OrphanSweepInterval, "CHAI_ORPHAN_SWEEP_INTERVAL", source.OrphanSweepInterval); err != nil {
+		return nil, err
+	}
+
+	// OrphanStreamTimeout
+	cfg.OrphanStreamTimeout, source.OrphanStreamTimeout, err = loadDuration(wasSet, file, "orphan-stream-timeout", f.orphanStreamTimeout, "CHAI_ORPHAN_STREAM_TIMEOUT", defaultOrphanStreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePositiveDuration(cfg.OrphanStreamTimeout, "CHAI_ORPHAN_STREAM_TIMEOUT", source.OrphanStreamTimeout); err != nil {
+		return nil, err
+	}
+
+	// CollapseErrors
+	cfg.CollapseErrors, source.CollapseErrors, err = loadBool(wasSet, file, "collapse-errors", f.collapseErrors, "CHAI_COLLAPSE_ERRORS", defaultCollapseErrors)
+	if err != nil {
+		return nil, err
+	}
+
+	// MaxPromptBytes
+	cfg.MaxPromptBytes, source.MaxPromptBytes, err = loadInt(wasSet, file, "max-prompt-bytes", f.maxPromptBytes, "CHAI_MAX_PROMPT_BYTES", defaultMaxPromptBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxPromptBytes, "CHAI_MAX_PROMPT_BYTES", source.MaxPromptBytes); err != nil {
+		return nil, err
+	}
+
+	// MaxOutputLineBytes
+	cfg.MaxOutputLineBytes, source.MaxOutputLineBytes, err = loadInt(wasSet, file, "max-output-line-bytes", f.maxOutputLineBytes, "CHAI_MAX_OUTPUT_LINE_BYTES", defaultMaxOutputLineBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePositive(cfg.MaxOutputLineBytes, "CHAI_MAX_OUTPUT_LINE_BYTES", source.MaxOutputLineBytes); err != nil {
+		return nil, err
+	}
+
+	// ShutdownMode
+	cfg.ShutdownMode, source.ShutdownMode = loadString(wasSet, file, "shutdown-mode", f.shutdownMode, "CHAI_SHUTDOWN_MODE", defaultShutdownMode)
+	if err := validateShutdownMode(cfg.ShutdownMode, "CHAI_SHUTDOWN_MODE", source.ShutdownMode); err != nil {
+		return nil, err
+	}
+
+	// LockWorkdirAcrossSessions
+	cfg.LockWorkdirAcrossSessions, source.LockWorkdirAcrossSessions, err = loadBool(wasSet, file, "lock-workdir", f.lockWorkdirAcrossSessions, "CHAI_LOCK_WORKDIR", defaultLockWorkdirAcrossSessions)
+	if err != nil {
+		return nil, err
+	}
+
+	// SessionEnvAllow
+	cfg.SessionEnvAllow, source.SessionEnvAllow = loadString(wasSet, file, "session-env-allow", f.sessionEnvAllow, "CHAI_SESSION_ENV_ALLOW", defaultSessionEnvAllow)
+
+	// SessionEnvDeny
+	cfg.SessionEnvDeny, source.SessionEnvDeny = loadString(wasSet, file, "session-env-deny", f.sessionEnvDeny, "CHAI_SESSION_ENV_DENY", defaultSessionEnvDeny)
+
+	// PendingRequestTTL
+	cfg.PendingRequestTTL, source.PendingRequestTTL, err = loadDuration(wasSet, file, "pending-request-ttl", f.pendingRequestTTL, "CHAI_PENDING_REQUEST_TTL", defaultPendingRequestTTL)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.PendingRequestTTL, "CHAI_PENDING_REQUEST_TTL", source.PendingRequestTTL); err != nil {
+		return nil, err
+	}
+
+	// MaxPendingRequests
+	cfg.MaxPendingRequests, source.MaxPendingRequests, err = loadInt(wasSet, file, "max-pending-requests", f.maxPendingRequests, "CHAI_MAX_PENDING_REQUESTS", defaultMaxPendingRequests)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxPendingRequests, "CHAI_MAX_PENDING_REQUESTS", source.MaxPendingRequests); err != nil {
+		return nil, err
+	}
+
+	// RequestTimeout
+	cfg.RequestTimeout, source.RequestTimeout, err = loadDuration(wasSet, file, "request-timeout", f.requestTimeout, "CHAI_REQUEST_TIMEOUT", defaultRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.RequestTimeout, "CHAI_REQUEST_TIMEOUT", source.RequestTimeout); err != nil {
+		return nil, err
+	}
+
+	// AllowRawArgs
+	cfg.AllowRawArgs, source.AllowRawArgs, err = loadBool(wasSet, file, "allow-raw-args", f.allowRawArgs, "CHAI_ALLOW_RAW_ARGS", defaultAllowRawArgs)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AllowRawArgs && cfg.AuthToken == "" {
+		return nil, fmt.Errorf("CHAI_ALLOW_RAW_ARGS (from %s) requires CHAI_AUTH_TOKEN", source.AllowRawArgs)
+	}
+
+	// PersistSnapshots
+	cfg.PersistSnapshots, source.PersistSnapshots, err = loadBool(wasSet, file, "persist-snapshots", f.persistSnapshots, "CHAI_PERSIST_SNAPSHOTS", defaultPersistSnapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	// DeletedRetention
+	cfg.DeletedRetention, source.DeletedRetention, err = loadDuration(wasSet, file, "deleted-retention", f.deletedRetention, "CHAI_DELETED_RETENTION", defaultDeletedRetention)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.DeletedRetention, "CHAI_DELETED_RETENTION", source.DeletedRetention); err != nil {
+		return nil, err
+	}
+
+	// EnableH2C
+	cfg.EnableH2C, source.EnableH2C, err = loadBool(wasSet, file, "h2c", f.enableH2C, "CHAI_ENABLE_H2C", defaultEnableH2C)
+	if err != nil {
+		return nil, err
+	}
+
+	// ExtraClaudeArgs
+	cfg.ExtraClaudeArgs, source.ExtraClaudeArgs = loadStringList(wasSet, file, "claude-arg", f.extraClaudeArgs, "CHAI_EXTRA_CLAUDE_ARGS")
+
+	// AutoArchiveAfter
+	cfg.AutoArchiveAfter, source.AutoArchiveAfter, err = loadDuration(wasSet, file, "auto-archive-after", f.autoArchiveAfter, "CHAI_AUTO_ARCHIVE_AFTER", defaultAutoArchiveAfter)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.AutoArchiveAfter, "CHAI_AUTO_ARCHIVE_AFTER", source.AutoArchiveAfter); err != nil {
+		return nil, err
+	}
+
+	// TextEvents
+	cfg.TextEvents, source.TextEvents, err = loadBool(wasSet, file, "text-events", f.textEvents, "CHAI_TEXT_EVENTS", defaultTextEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// StdinWriteTimeout
+	cfg.StdinWriteTimeout, source.StdinWriteTimeout, err = loadDuration(wasSet, file, "stdin-write-timeout", f.stdinWriteTimeout, "CHAI_STDIN_WRITE_TIMEOUT", defaultStdinWriteTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.StdinWriteTimeout, "CHAI_STDIN_WRITE_TIMEOUT", source.StdinWriteTimeout); err != nil {
+		return nil, err
+	}
+
+	// LongPollTimeout
+	cfg.LongPollTimeout, source.LongPollTimeout, err = loadDuration(wasSet, file, "long-poll-timeout", f.longPollTimeout, "CHAI_LONG_POLL_TIMEOUT", defaultLongPollTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.LongPollTimeout, "CHAI_LONG_POLL_TIMEOUT", source.LongPollTimeout); err != nil {
+		return nil, err
+	}
+
+	// BackupDir
+	cfg.BackupDir, source.BackupDir = loadString(wasSet, file, "backup-dir", f.backupDir, "CHAI_BACKUP_DIR", defaultBackupDir)
+
+	// DBMaintenanceInterval
+	cfg.DBMaintenanceInterval, source.DBMaintenanceInterval, err = loadDuration(wasSet, file, "db-maintenance-interval", f.dbMaintenanceInterval, "CHAI_DB_MAINTENANCE_INTERVAL", defaultDBMaintenanceInterval)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.DBMaintenanceInterval, "CHAI_DB_MAINTENANCE_INTERVAL", source.DBMaintenanceInterval); err != nil {
+		return nil, err
+	}
+
+	// DBVacuum
+	cfg.DBVacuum, source.DBVacuum, err = loadBool(wasSet, file, "db-vacuum", f.dbVacuum, "CHAI_DB_VACUUM", defaultDBVacuum)
+	if err != nil {
+		return nil, err
+	}
+
+	// MaxAttachments
+	cfg.MaxAttachments, source.MaxAttachments, err = loadInt(wasSet, file, "max-attachments", f.maxAttachments, "CHAI_MAX_ATTACHMENTS", defaultMaxAttachments)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxAttachments, "CHAI_MAX_ATTACHMENTS", source.MaxAttachments); err != nil {
+		return nil, err
+	}
+
+	// MaxAttachmentBytes
+	cfg.MaxAttachmentBytes, source.MaxAttachmentBytes, err = loadInt(wasSet, file, "max-attachment-bytes", f.maxAttachmentBytes, "CHAI_MAX_ATTACHMENT_BYTES", defaultMaxAttachmentBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePositive(cfg.MaxAttachmentBytes, "CHAI_MAX_ATTACHMENT_BYTES", source.MaxAttachmentBytes); err != nil {
+		return nil, err
+	}
+
+	// DBReadConns
+	cfg.DBReadConns, source.DBReadConns, err = loadInt(wasSet, file, "db-read-conns", f.dbReadConns, "CHAI_DB_READ_CONNS", defaultDBReadConns)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.DBReadConns, "CHAI_DB_READ_CONNS", source.DBReadConns); err != nil {
+		return nil, err
+	}
+
+	// DBBusyTimeout
+	cfg.DBBusyTimeout, source.DBBusyTimeout, err = loadDuration(wasSet, file, "db-busy-timeout", f.dbBusyTimeout, "CHAI_DB_BUSY_TIMEOUT", defaultDBBusyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePositiveDuration(cfg.DBBusyTimeout, "CHAI_DB_BUSY_TIMEOUT", source.DBBusyTimeout); err != nil {
+		return nil, err
+	}
+
+	// DBJournalMode
+	cfg.DBJournalMode, source.DBJournalMode = loadString(wasSet, file, "db-journal-mode", f.dbJournalMode, "CHAI_DB_JOURNAL_MODE", defaultDBJournalMode)
+	if err := validateJournalMode(cfg.DBJournalMode, "CHAI_DB_JOURNAL_MODE", source.DBJournalMode); err != nil {
+		return nil, err
+	}
+
+	// RequireClaude
+	cfg.RequireClaude, source.RequireClaude, err = loadBool(wasSet, file, "require-claude", f.requireClaude, "CHAI_REQUIRE_CLAUDE", defaultRequireClaude)
+	if err != nil {
+		return nil, err
+	}
+
+	// CreateWorkDir
+	cfg.CreateWorkDir, source.CreateWorkDir, err = loadBool(wasSet, file, "create-workdir", f.createWorkDir, "CHAI_CREATE_WORKDIR", defaultCreateWorkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// ConcurrentPrompts
+	cfg.ConcurrentPrompts, source.ConcurrentPrompts, err = loadBool(wasSet, file, "concurrent-prompts", f.concurrentPrompts, "CHAI_CONCURRENT_PROMPTS", defaultConcurrentPrompts)
+	if err != nil {
+		return nil, err
+	}
+
+	// ToolEvents
+	cfg.ToolEvents, source.ToolEvents, err = loadBool(wasSet, file, "tool-events", f.toolEvents, "CHAI_TOOL_EVENTS", defaultToolEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// OrphanStreamStatus
+	cfg.OrphanStreamStatus, source.OrphanStreamStatus = loadString(wasSet, file, "orphan-stream-status", f.orphanStreamStatus, "CHAI_ORPHAN_STREAM_STATUS", defaultOrphanStreamStatus)
+	if err := validateOrphanStreamStatus(cfg.OrphanStreamStatus, "CHAI_ORPHAN_STREAM_STATUS", source.OrphanStreamStatus); err != nil {
+		return nil, err
+	}
+
+	// DataDir
+	cfg.DataDir, source.DataDir = loadString(wasSet, file, "data-dir", f.dataDir, "CHAI_DATA_DIR", defaultDataDir)
+
+	// WebhookURL
+	cfg.WebhookURL, source.WebhookURL = loadString(wasSet, file, "webhook-url", f.webhookURL, "CHAI_WEBHOOK_URL", defaultWebhookURL)
+	if err := validateWebhookURL(cfg.WebhookURL, "CHAI_WEBHOOK_URL", source.WebhookURL); err != nil {
+		return nil, err
+	}
+
+	// WebhookSecret
+	cfg.WebhookSecret, source.WebhookSecret = loadString(wasSet, file, "webhook-secret", f.webhookSecret, "CHAI_WEBHOOK_SECRET", defaultWebhookSecret)
+
+	// PersistEventTypes
+	cfg.PersistEventTypes, source.PersistEventTypes = loadString(wasSet, file, "persist-event-types", f.persistEventTypes, "CHAI_PERSIST_EVENT_TYPES", defaultPersistEventTypes)
+
+	// MaxSessions
+	cfg.MaxSessions, source.MaxSessions, err = loadInt(wasSet, file, "max-sessions", f.maxSessions, "CHAI_MAX_SESSIONS", defaultMaxSessions)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxSessions, "CHAI_MAX_SESSIONS", source.MaxSessions); err != nil {
+		return nil, err
+	}
+
+	// ArchiveOldestSessions
+	cfg.ArchiveOldestSessions, source.ArchiveOldestSessions, err = loadBool(wasSet, file, "archive-oldest-sessions", f.archiveOldestSessions, "CHAI_ARCHIVE_OLDEST_SESSIONS", defaultArchiveOldestSessions)
+	if err != nil {
+		return nil, err
+	}
+
+	// MaxEventsPerPrompt
+	cfg.MaxEventsPerPrompt, source.MaxEventsPerPrompt, err = loadInt(wasSet, file, "max-events-per-prompt", f.maxEventsPerPrompt, "CHAI_MAX_EVENTS_PER_PROMPT", defaultMaxEventsPerPrompt)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxEventsPerPrompt, "CHAI_MAX_EVENTS_PER_PROMPT", source.MaxEventsPerPrompt); err != nil {
+		return nil, err
+	}
+
+	// TLSCertFile
+	cfg.TLSCertFile, source.TLSCertFile = loadString(wasSet, file, "tls-cert", f.tlsCertFile, "CHAI_TLS_CERT", defaultTLSCertFile)
+
+	// TLSKeyFile
+	cfg.TLSKeyFile, source.TLSKeyFile = loadString(wasSet, file, "tls-key", f.tlsKeyFile, "CHAI_TLS_KEY", defaultTLSKeyFile)
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("CHAI_TLS_CERT (from %s) and CHAI_TLS_KEY (from %s) must be set together", source.TLSCertFile, source.TLSKeyFile)
+	}
+
+	// TLSAutocertDomains
+	cfg.TLSAutocertDomains, source.TLSAutocertDomains = loadString(wasSet, file, "tls-autocert-domains", f.tlsAutocertDomains, "CHAI_TLS_AUTOCERT_DOMAINS", defaultTLSAutocertDomains)
+	if cfg.TLSAutocertDomains != "" && cfg.TLSCertFile != "" {
+		return nil, fmt.Errorf("CHAI_TLS_AUTOCERT_DOMAINS (from %s) and CHAI_TLS_CERT (from %s) cannot both be set", source.TLSAutocertDomains, source.TLSCertFile)
+	}
+
+	// TLSAutocertCache
+	cfg.TLSAutocertCache, source.TLSAutocertCache = loadString(wasSet, file, "tls-autocert-cache", f.tlsAutocertCache, "CHAI_TLS_AUTOCERT_CACHE", defaultTLSAutocertCache)
+
+	// TLSAutocertEmail
+	cfg.TLSAutocertEmail, source.TLSAutocertEmail = loadString(wasSet, file, "tls-autocert-email", f.tlsAutocertEmail, "CHAI_TLS_AUTOCERT_EMAIL", defaultTLSAutocertEmail)
+
+	// LenientTemplates
+	cfg.LenientTemplates, source.LenientTemplates, err = loadBool(wasSet, file, "lenient-templates", f.lenientTemplates, "CHAI_LENIENT_TEMPLATES", defaultLenientTemplates)
+	if err != nil {
+		return nil, err
+	}
+
+	// IdempotencyWindow
+	cfg.IdempotencyWindow, source.IdempotencyWindow, err = loadDuration(wasSet, file, "idempotency-window", f.idempotencyWindow, "CHAI_IDEMPOTENCY_WINDOW", defaultIdempotencyWindow)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.IdempotencyWindow, "CHAI_IDEMPOTENCY_WINDOW", source.IdempotencyWindow); err != nil {
+		return nil, err
+	}
+
+	// MaxPromptTimeout
+	cfg.MaxPromptTimeout, source.MaxPromptTimeout, err = loadDuration(wasSet, file, "max-prompt-timeout", f.maxPromptTimeout, "CHAI_MAX_PROMPT_TIMEOUT", defaultMaxPromptTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.MaxPromptTimeout, "CHAI_MAX_PROMPT_TIMEOUT", source.MaxPromptTimeout); err != nil {
+		return nil, err
+	}
+
+	// CompressEvents
+	cfg.CompressEvents, source.CompressEvents, err = loadBool(wasSet, file, "compress-events", f.compressEvents, "CHAI_COMPRESS_EVENTS", defaultCompressEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// MaxConcurrentPrompts
+	cfg.MaxConcurrentPrompts, source.MaxConcurrentPrompts, err = loadInt(wasSet, file, "max-concurrent-prompts", f.maxConcurrentPrompts, "CHAI_MAX_CONCURRENT_PROMPTS", defaultMaxConcurrentPrompts)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxConcurrentPrompts, "CHAI_MAX_CONCURRENT_PROMPTS", source.MaxConcurrentPrompts); err != nil {
+		return nil, err
+	}
+
+	// MaxSSEConnectionsPerIP
+	cfg.MaxSSEConnectionsPerIP, source.MaxSSEConnectionsPerIP, err = loadInt(wasSet, file, "max-sse-connections-per-ip", f.maxSSEConnectionsPerIP, "CHAI_MAX_SSE_CONNECTIONS_PER_IP", defaultMaxSSEConnectionsPerIP)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegative(cfg.MaxSSEConnectionsPerIP, "CHAI_MAX_SSE_CONNECTIONS_PER_IP", source.MaxSSEConnectionsPerIP); err != nil {
+		return nil, err
+	}
+
+	// ReadOnly
+	cfg.ReadOnly, source.ReadOnly, err = loadBool(wasSet, file, "read-only", f.readOnly, "CHAI_READ_ONLY", defaultReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	// ClaudeLogStderr
+	cfg.ClaudeLogStderr, source.ClaudeLogStderr, err = loadBool(wasSet, file, "claude-log-stderr", f.claudeLogStderr, "CHAI_CLAUDE_LOG_STDERR", defaultClaudeLogStderr)
+	if err != nil {
+		return nil, err
+	}
+
+	// ClaudeLogStdin
+	cfg.ClaudeLogStdin, source.ClaudeLogStdin = loadString(wasSet, file, "claude-log-stdin", f.claudeLogStdin, "CHAI_CLAUDE_LOG_STDIN", defaultClaudeLogStdin)
+	if err := validateStdinLog(cfg.ClaudeLogStdin, "CHAI_CLAUDE_LOG_STDIN", source.ClaudeLogStdin); err != nil {
+		return nil, err
+	}
+
+	// ClaudeLogFile
+	cfg.ClaudeLogFile, source.ClaudeLogFile = loadString(wasSet, file, "claude-log-file", f.claudeLogFile, "CHAI_CLAUDE_LOG_FILE", defaultClaudeLogFile)
+
+	// ClaudeLogPrefix
+	cfg.ClaudeLogPrefix, source.ClaudeLogPrefix = loadString(wasSet, file, "claude-log-prefix", f.claudeLogPrefix, "CHAI_CLAUDE_LOG_PREFIX", defaultClaudeLogPrefix)
+
+	// BasePath
+	cfg.BasePath, source.BasePath = loadString(wasSet, file, "base-path", f.basePath, "CHAI_BASE_PATH", defaultBasePath)
+	if err := validateBasePath(cfg.BasePath, "CHAI_BASE_PATH", source.BasePath); err != nil {
+		return nil, err
+	}
+
+	// ClaudeCmdAllow
+	cfg.ClaudeCmdAllow, source.ClaudeCmdAllow = loadString(wasSet, file, "claude-cmd-allow", f.claudeCmdAllow, "CHAI_CLAUDE_CMD_ALLOW", defaultClaudeCmdAllow)
+
+	// PermissionTimeout
+	cfg.PermissionTimeout, source.PermissionTimeout, err = loadDuration(wasSet, file, "permission-timeout", f.permissionTimeout, "CHAI_PERMISSION_TIMEOUT", defaultPermissionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.PermissionTimeout, "CHAI_PERMISSION_TIMEOUT", source.PermissionTimeout); err != nil {
+		return nil, err
+	}
+
+	// MaxStreamDuration
+	cfg.MaxStreamDuration, source.MaxStreamDuration, err = loadDuration(wasSet, file, "max-stream-duration", f.maxStreamDuration, "CHAI_MAX_STREAM_DURATION", defaultMaxStreamDuration)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.MaxStreamDuration, "CHAI_MAX_STREAM_DURATION", source.MaxStreamDuration); err != nil {
+		return nil, err
+	}
+
+	// ReconnectDelay
+	cfg.ReconnectDelay, source.ReconnectDelay, err = loadDuration(wasSet, file, "reconnect-delay", f.reconnectDelay, "CHAI_RECONNECT_DELAY", defaultReconnectDelay)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateNonNegativeDuration(cfg.ReconnectDelay, "CHAI_RECONNECT_DELAY", source.ReconnectDelay); err != nil {
+		return nil, err
+	}
+
+	// ThinkingEvents
+	cfg.ThinkingEvents, source.ThinkingEvents, err = loadBool(wasSet, file, "thinking-events", f.thinkingEvents, "CHAI_THINKING_EVENTS", defaultThinkingEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// PersistThinking
+	cfg.PersistThinking, source.PersistThinking, err = loadBool(wasSet, file, "persist-thinking", f.persistThinking, "CHAI_PERSIST_THINKING", defaultPersistThinking)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := file.checkUnknown(); err != nil {
+		return nil, err
+	}
+
 	// Log effective configuration with sources
 	logConfig(cfg, source, opts)
 
@@ -226,4 +1217,80 @@ func logConfig(cfg *Config, source *configSource, opts *LoadConfigOptions) {
 	logger.Printf("  ClaudeCmd: %s (from %s)", cfg.ClaudeCmd, source.ClaudeCmd)
 	logger.Printf("  PromptTimeout: %s (from %s)", cfg.PromptTimeout, source.PromptTimeout)
 	logger.Printf("  ShutdownTimeout: %s (from %s)", cfg.ShutdownTimeout, source.ShutdownTimeout)
+	logger.Printf("  AuthToken: %s (from %s)", redact(cfg.AuthToken), source.AuthToken)
+	logger.Printf("  UniqueTitles: %t (from %s)", cfg.UniqueTitles, source.UniqueTitles)
+	logger.Printf("  SSEBufferSize: %d (from %s)", cfg.SSEBufferSize, source.SSEBufferSize)
+	logger.Printf("  OrphanSweepInterval: %s (from %s)", cfg.OrphanSweepInterval, source.OrphanSweepInterval)
+	logger.Printf("  OrphanStreamTimeout: %s (from %s)", cfg.OrphanStreamTimeout, source.OrphanStreamTimeout)
+	logger.Printf("  CollapseErrors: %t (from %s)", cfg.CollapseErrors, source.CollapseErrors)
+	logger.Printf("  MaxPromptBytes: %d (from %s)", cfg.MaxPromptBytes, source.MaxPromptBytes)
+	logger.Printf("  MaxOutputLineBytes: %d (from %s)", cfg.MaxOutputLineBytes, source.MaxOutputLineBytes)
+	logger.Printf("  ShutdownMode: %s (from %s)", cfg.ShutdownMode, source.ShutdownMode)
+	logger.Printf("  LockWorkdirAcrossSessions: %t (from %s)", cfg.LockWorkdirAcrossSessions, source.LockWorkdirAcrossSessions)
+	logger.Printf("  SessionEnvAllow: %s (from %s)", cfg.SessionEnvAllow, source.SessionEnvAllow)
+	logger.Printf("  SessionEnvDeny: %s (from %s)", cfg.SessionEnvDeny, source.SessionEnvDeny)
+	logger.Printf("  PendingRequestTTL: %s (from %s)", cfg.PendingRequestTTL, source.PendingRequestTTL)
+	logger.Printf("  MaxPendingRequests: %d (from %s)", cfg.MaxPendingRequests, source.MaxPendingRequests)
+	logger.Printf("  RequestTimeout: %s (from %s)", cfg.RequestTimeout, source.RequestTimeout)
+	logger.Printf("  AllowRawArgs: %t (from %s)", cfg.AllowRawArgs, source.AllowRawArgs)
+	logger.Printf("  PersistSnapshots: %t (from %s)", cfg.PersistSnapshots, source.PersistSnapshots)
+	logger.Printf("  DeletedRetention: %s (from %s)", cfg.DeletedRetention, source.DeletedRetention)
+	logger.Printf("  EnableH2C: %t (from %s)", cfg.EnableH2C, source.EnableH2C)
+	logger.Printf("  ExtraClaudeArgs: %q (from %s)", cfg.ExtraClaudeArgs, source.ExtraClaudeArgs)
+	logger.Printf("  AutoArchiveAfter: %s (from %s)", cfg.AutoArchiveAfter, source.AutoArchiveAfter)
+	logger.Printf("  TextEvents: %t (from %s)", cfg.TextEvents, source.TextEvents)
+	logger.Printf("  StdinWriteTimeout: %s (from %s)", cfg.StdinWriteTimeout, source.StdinWriteTimeout)
+	logger.Printf("  LongPollTimeout: %s (from %s)", cfg.LongPollTimeout, source.LongPollTimeout)
+	logger.Printf("  BackupDir: %s (from %s)", cfg.BackupDir, source.BackupDir)
+	logger.Printf("  DBMaintenanceInterval: %s (from %s)", cfg.DBMaintenanceInterval, source.DBMaintenanceInterval)
+	logger.Printf("  DBVacuum: %t (from %s)", cfg.DBVacuum, source.DBVacuum)
+	logger.Printf("  MaxAttachments: %d (from %s)", cfg.MaxAttachments, source.MaxAttachments)
+	logger.Printf("  MaxAttachmentBytes: %d (from %s)", cfg.MaxAttachmentBytes, source.MaxAttachmentBytes)
+	logger.Printf("  DBReadConns: %d (from %s)", cfg.DBReadConns, source.DBReadConns)
+	logger.Printf("  DBBusyTimeout: %s (from %s)", cfg.DBBusyTimeout, source.DBBusyTimeout)
+	logger.Printf("  DBJournalMode: %s (from %s)", cfg.DBJournalMode, source.DBJournalMode)
+	logger.Printf("  RequireClaude: %t (from %s)", cfg.RequireClaude, source.RequireClaude)
+	logger.Printf("  CreateWorkDir: %t (from %s)", cfg.CreateWorkDir, source.CreateWorkDir)
+	logger.Printf("  ConcurrentPrompts: %t (from %s)", cfg.ConcurrentPrompts, source.ConcurrentPrompts)
+	logger.Printf("  ToolEvents: %t (from %s)", cfg.ToolEvents, source.ToolEvents)
+	logger.Printf("  OrphanStreamStatus: %s (from %s)", cfg.OrphanStreamStatus, source.OrphanStreamStatus)
+	logger.Printf("  DataDir: %s (from %s)", cfg.DataDir, source.DataDir)
+	logger.Printf("  WebhookURL: %s (from %s)", cfg.WebhookURL, source.WebhookURL)
+	logger.Printf("  WebhookSecret: %s (from %s)", redact(cfg.WebhookSecret), source.WebhookSecret)
+	logger.Printf("  PersistEventTypes: %s (from %s)", cfg.PersistEventTypes, source.PersistEventTypes)
+	logger.Printf("  MaxSessions: %d (from %s)", cfg.MaxSessions, source.MaxSessions)
+	logger.Printf("  ArchiveOldestSessions: %t (from %s)", cfg.ArchiveOldestSessions, source.ArchiveOldestSessions)
+	logger.Printf("  MaxEventsPerPrompt: %d (from %s)", cfg.MaxEventsPerPrompt, source.MaxEventsPerPrompt)
+	logger.Printf("  TLSCertFile: %s (from %s)", cfg.TLSCertFile, source.TLSCertFile)
+	logger.Printf("  TLSKeyFile: %s (from %s)", cfg.TLSKeyFile, source.TLSKeyFile)
+	logger.Printf("  TLSAutocertDomains: %s (from %s)", cfg.TLSAutocertDomains, source.TLSAutocertDomains)
+	logger.Printf("  TLSAutocertCache: %s (from %s)", cfg.TLSAutocertCache, source.TLSAutocertCache)
+	logger.Printf("  TLSAutocertEmail: %s (from %s)", cfg.TLSAutocertEmail, source.TLSAutocertEmail)
+	logger.Printf("  LenientTemplates: %t (from %s)", cfg.LenientTemplates, source.LenientTemplates)
+	logger.Printf("  IdempotencyWindow: %s (from %s)", cfg.IdempotencyWindow, source.IdempotencyWindow)
+	logger.Printf("  MaxPromptTimeout: %s (from %s)", cfg.MaxPromptTimeout, source.MaxPromptTimeout)
+	logger.Printf("  CompressEvents: %t (from %s)", cfg.CompressEvents, source.CompressEvents)
+	logger.Printf("  ConfigFile: %s (from %s)", cfg.ConfigFile, source.ConfigFile)
+	logger.Printf("  MaxConcurrentPrompts: %d (from %s)", cfg.MaxConcurrentPrompts, source.MaxConcurrentPrompts)
+	logger.Printf("  MaxSSEConnectionsPerIP: %d (from %s)", cfg.MaxSSEConnectionsPerIP, source.MaxSSEConnectionsPerIP)
+	logger.Printf("  ReadOnly: %t (from %s)", cfg.ReadOnly, source.ReadOnly)
+	logger.Printf("  ClaudeLogStderr: %t (from %s)", cfg.ClaudeLogStderr, source.ClaudeLogStderr)
+	logger.Printf("  ClaudeLogStdin: %s (from %s)", cfg.ClaudeLogStdin, source.ClaudeLogStdin)
+	logger.Printf("  ClaudeLogFile: %s (from %s)", cfg.ClaudeLogFile, source.ClaudeLogFile)
+	logger.Printf("  ClaudeLogPrefix: %s (from %s)", strconv.Quote(cfg.ClaudeLogPrefix), source.ClaudeLogPrefix)
+	logger.Printf("  BasePath: %s (from %s)", cfg.BasePath, source.BasePath)
+	logger.Printf("  ClaudeCmdAllow: %s (from %s)", cfg.ClaudeCmdAllow, source.ClaudeCmdAllow)
+	logger.Printf("  PermissionTimeout: %s (from %s)", cfg.PermissionTimeout, source.PermissionTimeout)
+	logger.Printf("  MaxStreamDuration: %s (from %s)", cfg.MaxStreamDuration, source.MaxStreamDuration)
+	logger.Printf("  ReconnectDelay: %s (from %s)", cfg.ReconnectDelay, source.ReconnectDelay)
+	logger.Printf("  ThinkingEvents: %t (from %s)", cfg.ThinkingEvents, source.ThinkingEvents)
+	logger.Printf("  PersistThinking: %t (from %s)", cfg.PersistThinking, source.PersistThinking)
+}
+
+// redact hides secret values in the configuration log.
+func redact(secret string) string {
+	if secret == "" {
+		return "(not set)"
+	}
+	return "(set)"
 }
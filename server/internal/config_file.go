@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configFile holds option values read from a -config file, keyed by the env
+// var each one stands in for. A nil *configFile behaves as an empty file.
+type configFile struct {
+	path   string
+	values map[string]string
+	used   map[string]bool
+}
+
+// lookup returns an option's value from the environment, falling back to the
+// config file, along with the source it came from ("env" or "file"). An empty
+// value means neither provided one.
+func (c *configFile) lookup(envName string) (string, string) {
+	if c != nil {
+		c.used[envName] = true
+	}
+	if env := os.Getenv(envName); env != "" {
+		return env, "env"
+	}
+	if c != nil && c.values[envName] != "" {
+		return c.values[envName], "file"
+	}
+	return "", ""
+}
+
+// checkUnknown reports file keys no option looked up, which are most likely
+// typos that would otherwise be silently ignored.
+func (c *configFile) checkUnknown() error {
+	if c == nil {
+		return nil
+	}
+	var unknown []string
+	for envName := range c.values {
+		if !c.used[envName] {
+			unknown = append(unknown, configFileKey(envName))
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("config file %s: unknown keys: %s", c.path, strings.Join(unknown, ", "))
+}
+
+// configEnvName maps a config file key to the env var it stands in for. Keys
+// are the env var name without the CHAI_ prefix, in snake_case or with the
+// dashes used by flags: prompt_timeout and prompt-timeout both set
+// CHAI_PROMPT_TIMEOUT.
+func configEnvName(key string) string {
+	return "CHAI_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// configFileKey is the inverse of configEnvName, used in error messages.
+func configFileKey(envName string) string {
+	return strings.ToLower(strings.TrimPrefix(envName, "CHAI_"))
+}
+
+// loadConfigFile reads the -config file at path. Files ending in .json, or
+// whose content starts with '{', are parsed as a JSON object; anything else
+// as YAML.
+func loadConfigFile(path string) (*configFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	var raw map[string][]string
+	if strings.EqualFold(filepath.Ext(path), ".json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		raw, err = parseJSONConfig(data)
+	} else {
+		raw, err = parseYAMLConfig(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	c := &configFile{path: path, values: make(map[string]string, len(raw)), used: make(map[string]bool)}
+	for key, value := range raw {
+		envName := configEnvName(key)
+		if _, dup := c.values[envName]; dup {
+			return nil, fmt.Errorf("config file %s: key %q is set more than once", path, configFileKey(envName))
+		}
+		c.values[envName] = strings.Join(value, listSeparator(envName))
+	}
+	return c, nil
+}
+
+// spaceSeparatedLists are the list options whose env var separates items with
+// whitespace; every other list option's env var takes a comma-separated list.
+var spaceSeparatedLists = map[string]bool{
+	"CHAI_EXTRA_CLAUDE_ARGS": true,
+}
+
+// listSeparator is the separator a list written in a config file is joined
+// with, so it reads like the option's env var: "PATH, HOME" rather than the
+// single pattern "PATH HOME" for a comma list.
+func listSeparator(envName string) string {
+	if spaceSeparatedLists[envName] {
+		return " "
+	}
+	return ","
+}
+
+// parseJSONConfig flattens a JSON object into option values. Strings,
+// numbers and booleans become a single item, used as written; an array of
+// strings keeps its items, for loadConfigFile to join like the option's env var.
+func parseJSONConfig(data []byte) (map[string][]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	values := make(map[string][]string, len(obj))
+	for key, v := range obj {
+		switch v := v.(type) {
+		case string:
+			values[key] = []string{v}
+		case json.Number:
+			values[key] = []string{v.String()}
+		case bool:
+			values[key] = []string{strconv.FormatBool(v)}
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("key %q: list items must be strings", key)
+				}
+				items = append(items, s)
+			}
+			values[key] = items
+		default:
+			return nil, fmt.Errorf("key %q: value must be a string, number, boolean or list of strings", key)
+		}
+	}
+	return values, nil
+}
+
+// parseYAMLConfig reads the flat subset of YAML a config file needs:
+// "key: value" lines, # comments, single- or double-quoted scalars, and lists
+// written either inline ([a, b]) or as "- item" lines under an empty key.
+// Nested mappings, anchors and multi-line scalars are not supported. Values
+// are returned like parseJSONConfig's: a scalar is a single item.
+func parseYAMLConfig(data []byte) (map[string][]string, error) {
+	values := make(map[string][]string)
+	var listKey string
+	var list []string
+	flush := func() {
+		if listKey != "" {
+			values[listKey] = list
+			listKey, list = "", nil
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := stripYAMLComment(scanner.Text())
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(trimmed, "- "); ok || trimmed == "-" {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", lineNo)
+			}
+			s, err := unquoteYAML(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			list = append(list, s)
+			continue
+		}
+		flush()
+
+		if line != strings.TrimLeft(line, " \t") {
+			return nil, fmt.Errorf("line %d: nested values are not supported", lineNo)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("line %d: key %q is set more than once", lineNo, key)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			// Either an empty value or the start of a "- item" list.
+			values[key] = nil
+			listKey = key
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			var items []string
+			for _, item := range strings.Split(value[1:len(value)-1], ",") {
+				if item = strings.TrimSpace(item); item == "" {
+					continue
+				}
+				s, err := unquoteYAML(item)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %w", lineNo, err)
+				}
+				items = append(items, s)
+			}
+			values[key] = items
+		default:
+			s, err := unquoteYAML(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+			values[key] = []string{s}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return values, nil
+}
+
+// stripYAMLComment drops a trailing # comment that is outside quotes.
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquoteYAML returns a scalar's value, removing surrounding quotes. Double
+// quotes allow Go-style escapes; single quotes escape a quote by doubling it.
+func unquoteYAML(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %s", s)
+		}
+		return v, nil
+	}
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	if s[0] == '"' || s[0] == '\'' {
+		return "", fmt.Errorf("unterminated quoted value %s", s)
+	}
+	return s, nil
+}
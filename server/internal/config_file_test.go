@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseYAMLConfig(t *testing.T) {
+	data := `---
+# leading comment
+port: 8081 # trailing comment
+db: "/data/chai #1.db"
+workdir: '/it''s here'
+auth_token:
+extra_claude_args: [--verbose, "--model", claude-opus]
+persist-event-types:
+  - result
+  - assistant
+shutdown_mode: drain
+`
+	got, err := parseYAMLConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("parseYAMLConfig: %v", err)
+	}
+	want := map[string][]string{
+		"port":                {"8081"},
+		"db":                  {"/data/chai #1.db"},
+		"workdir":             {"/it's here"},
+		"auth_token":          nil,
+		"extra_claude_args":   {"--verbose", "--model", "claude-opus"},
+		"persist-event-types": {"result", "assistant"},
+		"shutdown_mode":       {"drain"},
+	}
+	if !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("parseYAMLConfig = %v, want %v", got, want)
+	}
+}
+
+func TestParseYAMLConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name, data, wantErr string
+	}{
+		{"missing colon", "port 8080", "line 1: expected"},
+		{"nested mapping", "server:\n  port: 8080", "line 2: nested values"},
+		{"orphan list item", "- result", "line 1: list item without a key"},
+		{"duplicate key", "port: 1\nport: 2", "line 2: key \"port\" is set more than once"},
+		{"unterminated quote", `db: "chai.db`, "line 1: unterminated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseYAMLConfig([]byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	got, err := parseJSONConfig([]byte(`{"port": 8081, "prompt_timeout": "10m", "unique_titles": true, "extra_claude_args": ["--verbose", "--debug"]}`))
+	if err != nil {
+		t.Fatalf("parseJSONConfig: %v", err)
+	}
+	want := map[string][]string{
+		"port":              {"8081"},
+		"prompt_timeout":    {"10m"},
+		"unique_titles":     {"true"},
+		"extra_claude_args": {"--verbose", "--debug"},
+	}
+	if !maps.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("parseJSONConfig = %v, want %v", got, want)
+	}
+
+	for _, data := range []string{`{"port": null}`, `{"server": {"port": 1}}`, `{"args": [1]}`, `[1]`} {
+		if _, err := parseJSONConfig([]byte(data)); err == nil {
+			t.Errorf("parseJSONConfig(%s) should fail", data)
+		}
+	}
+}
+
+func TestLoadConfigFile_KeyAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chai.yml")
+	if err := os.WriteFile(path, []byte("prompt_timeout: 1m\nprompt-timeout: 2m\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "set more than once") {
+		t.Errorf("err = %v, want a duplicate key error", err)
+	}
+}
+
+func TestLoadConfigFile_ListSeparators(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"chai.yml":  "session_env_deny: [PATH, HOME, LD_*]\npersist_event_types:\n  - result\n  - assistant\nextra_claude_args: [--model, claude-opus]\n",
+		"chai.json": `{"session_env_deny": ["PATH", "HOME", "LD_*"], "persist_event_types": ["result", "assistant"], "extra_claude_args": ["--model", "claude-opus"]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := loadConfigFile(path)
+			if err != nil {
+				t.Fatalf("loadConfigFile: %v", err)
+			}
+			want := map[string]string{
+				"CHAI_SESSION_ENV_DENY":    "PATH,HOME,LD_*",
+				"CHAI_PERSIST_EVENT_TYPES": "result,assistant",
+				"CHAI_EXTRA_CLAUDE_ARGS":   "--model claude-opus",
+			}
+			if !maps.Equal(c.values, want) {
+				t.Errorf("values = %v, want %v", c.values, want)
+			}
+			if policy := NewEnvPolicy("", c.values["CHAI_SESSION_ENV_DENY"]); policy.Allowed("LD_PRELOAD") || policy.Allowed("HOME") {
+				t.Errorf("deny list %q from a list value should reject HOME and LD_PRELOAD", c.values["CHAI_SESSION_ENV_DENY"])
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package internal
 import (
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -75,6 +77,13 @@ func TestLoadConfig_Defaults(t *testing.T) {
 	if cfg.ShutdownTimeout != 30*time.Second {
 		t.Errorf("ShutdownTimeout = %v, want 30s", cfg.ShutdownTimeout)
 	}
+	// New event types would reach clients that don't know them
+	if cfg.TextEvents {
+		t.Error("TextEvents = true, want false")
+	}
+	if cfg.ToolEvents {
+		t.Error("ToolEvents = true, want false")
+	}
 }
 
 func TestLoadConfig_EnvVars(t *testing.T) {
@@ -291,6 +300,498 @@ func TestLoadConfig_NegativeDuration(t *testing.T) {
 	}
 }
 
+func TestLoadConfig_AuthToken(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.AuthToken != "" {
+		t.Errorf("AuthToken = %q, want empty by default", cfg.AuthToken)
+	}
+
+	os.Setenv("CHAI_AUTH_TOKEN", "env-token")
+	cfg, err = loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.AuthToken != "env-token" {
+		t.Errorf("AuthToken = %q, want env-token", cfg.AuthToken)
+	}
+
+	flagToken := "flag-token"
+	f.authToken = &flagToken
+	cfg, err = loadConfigWithChecker(f, testOpts(), makeChecker("auth-token"))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.AuthToken != "flag-token" {
+		t.Errorf("AuthToken = %q, want flag-token (flag value)", cfg.AuthToken)
+	}
+}
+
+func TestLoadConfig_UniqueTitles(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.UniqueTitles {
+		t.Error("UniqueTitles should default to false")
+	}
+
+	os.Setenv("CHAI_UNIQUE_TITLES", "true")
+	cfg, err = loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.UniqueTitles {
+		t.Error("UniqueTitles = false, want true (env value)")
+	}
+
+	os.Setenv("CHAI_UNIQUE_TITLES", "sometimes")
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil {
+		t.Error("LoadConfig should fail with invalid CHAI_UNIQUE_TITLES")
+	}
+}
+
+func TestLoadConfig_CollapseErrors(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.CollapseErrors {
+		t.Error("CollapseErrors should default to true")
+	}
+
+	os.Setenv("CHAI_COLLAPSE_ERRORS", "false")
+	cfg, err = loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.CollapseErrors {
+		t.Error("CollapseErrors = true, want false (env value)")
+	}
+}
+
+func TestLoadConfig_ShutdownMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", ShutdownModeKill, false},
+		{"drain", "drain", ShutdownModeDrain, false},
+		{"kill", "kill", ShutdownModeKill, false},
+		{"unknown", "wait", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			if tt.env != "" {
+				os.Setenv("CHAI_SHUTDOWN_MODE", tt.env)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with CHAI_SHUTDOWN_MODE=%s", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.ShutdownMode != tt.want {
+				t.Errorf("ShutdownMode = %s, want %s", cfg.ShutdownMode, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_DBJournalMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", DefaultJournalMode, false},
+		{"delete", "DELETE", "DELETE", false},
+		{"lowercase", "truncate", "truncate", false},
+		{"unknown", "wal2", "", true},
+		{"injection", "WAL&_foreign_keys=off", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			if tt.env != "" {
+				os.Setenv("CHAI_DB_JOURNAL_MODE", tt.env)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with CHAI_DB_JOURNAL_MODE=%s", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.DBJournalMode != tt.want {
+				t.Errorf("DBJournalMode = %s, want %s", cfg.DBJournalMode, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_OrphanStreamStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", "idle", false},
+		{"completed", "completed", "completed", false},
+		{"streaming", "streaming", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			if tt.env != "" {
+				os.Setenv("CHAI_ORPHAN_STREAM_STATUS", tt.env)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with CHAI_ORPHAN_STREAM_STATUS=%s", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.OrphanStreamStatus != tt.want {
+				t.Errorf("OrphanStreamStatus = %s, want %s", cfg.OrphanStreamStatus, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_ClaudeLogStdin(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", "redacted", false},
+		{"full", "full", "full", false},
+		{"off", "off", "off", false},
+		{"unknown", "verbose", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			if tt.env != "" {
+				os.Setenv("CHAI_CLAUDE_LOG_STDIN", tt.env)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with CHAI_CLAUDE_LOG_STDIN=%s", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.ClaudeLogStdin != tt.want {
+				t.Errorf("ClaudeLogStdin = %s, want %s", cfg.ClaudeLogStdin, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_WebhookURL(t *testing.T) {
+	for _, tt := range []struct {
+		env     string
+		wantErr bool
+	}{
+		{"", false},
+		{"https://example.com/hook", false},
+		{"http://localhost:9000", false},
+		{"ftp://example.com", true},
+		{"example.com/hook", true},
+	} {
+		clearEnvVars()
+		if tt.env != "" {
+			os.Setenv("CHAI_WEBHOOK_URL", tt.env)
+		}
+		f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+		_, err := loadConfigWithChecker(f, testOpts(), neverSet)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("CHAI_WEBHOOK_URL=%q: err = %v, wantErr %t", tt.env, err, tt.wantErr)
+		}
+	}
+	clearEnvVars()
+}
+
+func TestLoadConfig_AllowRawArgsRequiresAuthToken(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	os.Setenv("CHAI_ALLOW_RAW_ARGS", "true")
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil {
+		t.Error("LoadConfig should fail with CHAI_ALLOW_RAW_ARGS and no auth token")
+	}
+
+	os.Setenv("CHAI_AUTH_TOKEN", "secret")
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !cfg.AllowRawArgs {
+		t.Error("AllowRawArgs = false, want true")
+	}
+}
+
+func TestLoadConfig_TLSPair(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	os.Setenv("CHAI_TLS_CERT", "/etc/chai/cert.pem")
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil {
+		t.Error("LoadConfig should fail with a certificate but no key")
+	}
+
+	os.Setenv("CHAI_TLS_KEY", "/etc/chai/key.pem")
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.TLSCertFile != "/etc/chai/cert.pem" || cfg.TLSKeyFile != "/etc/chai/key.pem" {
+		t.Errorf("TLS files = %q, %q", cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+}
+
+func TestLoadConfig_TLSAutocert(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	os.Setenv("CHAI_TLS_AUTOCERT_DOMAINS", "chai.example.com")
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.TLSAutocertDomains != "chai.example.com" || cfg.TLSAutocertCache != defaultTLSAutocertCache {
+		t.Errorf("Autocert domains = %q, cache = %q", cfg.TLSAutocertDomains, cfg.TLSAutocertCache)
+	}
+
+	// Certificates come from one place or the other
+	os.Setenv("CHAI_TLS_CERT", "/etc/chai/cert.pem")
+	os.Setenv("CHAI_TLS_KEY", "/etc/chai/key.pem")
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil || !strings.Contains(err.Error(), "cannot both be set") {
+		t.Errorf("err = %v, want autocert and a certificate file rejected together", err)
+	}
+}
+
+func TestLoadConfig_ExtraClaudeArgs(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.ExtraClaudeArgs) != 0 {
+		t.Errorf("ExtraClaudeArgs = %q, want none by default", cfg.ExtraClaudeArgs)
+	}
+
+	// Env is split on whitespace; commas stay inside an arg
+	os.Setenv("CHAI_EXTRA_CLAUDE_ARGS", " --allowedTools  Read,Write\t--verbose ")
+	cfg, _ = loadConfigWithChecker(f, testOpts(), neverSet)
+	if strings.Join(cfg.ExtraClaudeArgs, "|") != "--allowedTools|Read,Write|--verbose" {
+		t.Errorf("ExtraClaudeArgs = %q, want env args split on whitespace", cfg.ExtraClaudeArgs)
+	}
+
+	// Repeated flags win over env
+	f.extraClaudeArgs = &stringList{}
+	f.extraClaudeArgs.Set("--model")
+	f.extraClaudeArgs.Set("claude sonnet")
+	cfg, _ = loadConfigWithChecker(f, testOpts(), makeChecker("claude-arg"))
+	if strings.Join(cfg.ExtraClaudeArgs, "|") != "--model|claude sonnet" {
+		t.Errorf("ExtraClaudeArgs = %q, want the flag values", cfg.ExtraClaudeArgs)
+	}
+}
+
+func TestLoadConfig_SSEBufferSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{"default", "", defaultSSEBufferSize, false},
+		{"custom", "1024", 1024, false},
+		{"inline", "0", 0, false},
+		{"negative", "-1", 0, true},
+		{"not a number", "lots", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			if tt.env != "" {
+				os.Setenv("CHAI_SSE_BUFFER_SIZE", tt.env)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with CHAI_SSE_BUFFER_SIZE=%s", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.SSEBufferSize != tt.want {
+				t.Errorf("SSEBufferSize = %d, want %d", cfg.SSEBufferSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_SizeLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantLine int
+		wantMax  int
+		wantErr  bool
+	}{
+		{"defaults", nil, defaultMaxOutputLineBytes, defaultMaxPromptBytes, false},
+		{"custom", map[string]string{"CHAI_MAX_OUTPUT_LINE_BYTES": "8388608", "CHAI_MAX_PROMPT_BYTES": "4096"}, 8388608, 4096, false},
+		{"prompt limit disabled", map[string]string{"CHAI_MAX_PROMPT_BYTES": "0"}, defaultMaxOutputLineBytes, 0, false},
+		{"negative prompt limit", map[string]string{"CHAI_MAX_PROMPT_BYTES": "-1"}, 0, 0, true},
+		{"zero line limit", map[string]string{"CHAI_MAX_OUTPUT_LINE_BYTES": "0"}, 0, 0, true},
+		{"negative session limit", map[string]string{"CHAI_MAX_SESSIONS": "-1"}, 0, 0, true},
+		{"negative event limit", map[string]string{"CHAI_MAX_EVENTS_PER_PROMPT": "-1"}, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearEnvVars()
+			defer clearEnvVars()
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+			}
+
+			f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+			cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig should fail with %v", tt.env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if cfg.MaxOutputLineBytes != tt.wantLine {
+				t.Errorf("MaxOutputLineBytes = %d, want %d", cfg.MaxOutputLineBytes, tt.wantLine)
+			}
+			if cfg.MaxPromptBytes != tt.wantMax {
+				t.Errorf("MaxPromptBytes = %d, want %d", cfg.MaxPromptBytes, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_OrphanSweep(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	f := newTestFlags(defaultPort, defaultDBPath, defaultWorkDir, defaultClaudeCmd, defaultPromptTimeout, defaultShutdownTimeout)
+
+	cfg, err := loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.OrphanSweepInterval != time.Minute {
+		t.Errorf("OrphanSweepInterval = %v, want 1m", cfg.OrphanSweepInterval)
+	}
+	if cfg.OrphanStreamTimeout != 2*time.Minute {
+		t.Errorf("OrphanStreamTimeout = %v, want 2m", cfg.OrphanStreamTimeout)
+	}
+
+	// Zero disables the sweeper
+	os.Setenv("CHAI_ORPHAN_SWEEP_INTERVAL", "0")
+	cfg, err = loadConfigWithChecker(f, testOpts(), neverSet)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.OrphanSweepInterval != 0 {
+		t.Errorf("OrphanSweepInterval = %v, want 0", cfg.OrphanSweepInterval)
+	}
+
+	os.Setenv("CHAI_ORPHAN_SWEEP_INTERVAL", "-1m")
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil {
+		t.Error("LoadConfig should fail with negative CHAI_ORPHAN_SWEEP_INTERVAL")
+	}
+
+	os.Setenv("CHAI_ORPHAN_SWEEP_INTERVAL", "1m")
+	os.Setenv("CHAI_ORPHAN_STREAM_TIMEOUT", "0s")
+	if _, err := loadConfigWithChecker(f, testOpts(), neverSet); err == nil {
+		t.Error("LoadConfig should fail with zero CHAI_ORPHAN_STREAM_TIMEOUT")
+	}
+}
+
 func clearEnvVars() {
 	os.Unsetenv("CHAI_PORT")
 	os.Unsetenv("CHAI_DB")
@@ -298,4 +799,190 @@ func clearEnvVars() {
 	os.Unsetenv("CHAI_CLAUDE_CMD")
 	os.Unsetenv("CHAI_PROMPT_TIMEOUT")
 	os.Unsetenv("CHAI_SHUTDOWN_TIMEOUT")
+	os.Unsetenv("CHAI_AUTH_TOKEN")
+	os.Unsetenv("CHAI_UNIQUE_TITLES")
+	os.Unsetenv("CHAI_SSE_BUFFER_SIZE")
+	os.Unsetenv("CHAI_ORPHAN_SWEEP_INTERVAL")
+	os.Unsetenv("CHAI_ORPHAN_STREAM_TIMEOUT")
+	os.Unsetenv("CHAI_COLLAPSE_ERRORS")
+	os.Unsetenv("CHAI_MAX_PROMPT_BYTES")
+	os.Unsetenv("CHAI_MAX_OUTPUT_LINE_BYTES")
+	os.Unsetenv("CHAI_SHUTDOWN_MODE")
+	os.Unsetenv("CHAI_LOCK_WORKDIR")
+	os.Unsetenv("CHAI_SESSION_ENV_ALLOW")
+	os.Unsetenv("CHAI_SESSION_ENV_DENY")
+	os.Unsetenv("CHAI_PENDING_REQUEST_TTL")
+	os.Unsetenv("CHAI_MAX_PENDING_REQUESTS")
+	os.Unsetenv("CHAI_REQUEST_TIMEOUT")
+	os.Unsetenv("CHAI_ALLOW_RAW_ARGS")
+	os.Unsetenv("CHAI_PERSIST_SNAPSHOTS")
+	os.Unsetenv("CHAI_DELETED_RETENTION")
+	os.Unsetenv("CHAI_ENABLE_H2C")
+	os.Unsetenv("CHAI_EXTRA_CLAUDE_ARGS")
+	os.Unsetenv("CHAI_AUTO_ARCHIVE_AFTER")
+	os.Unsetenv("CHAI_TEXT_EVENTS")
+	os.Unsetenv("CHAI_STDIN_WRITE_TIMEOUT")
+	os.Unsetenv("CHAI_LONG_POLL_TIMEOUT")
+	os.Unsetenv("CHAI_BACKUP_DIR")
+	os.Unsetenv("CHAI_DB_MAINTENANCE_INTERVAL")
+	os.Unsetenv("CHAI_DB_VACUUM")
+	os.Unsetenv("CHAI_MAX_ATTACHMENTS")
+	os.Unsetenv("CHAI_MAX_ATTACHMENT_BYTES")
+	os.Unsetenv("CHAI_DB_READ_CONNS")
+	os.Unsetenv("CHAI_DB_BUSY_TIMEOUT")
+	os.Unsetenv("CHAI_DB_JOURNAL_MODE")
+	os.Unsetenv("CHAI_REQUIRE_CLAUDE")
+	os.Unsetenv("CHAI_CREATE_WORKDIR")
+	os.Unsetenv("CHAI_CONCURRENT_PROMPTS")
+	os.Unsetenv("CHAI_TOOL_EVENTS")
+	os.Unsetenv("CHAI_ORPHAN_STREAM_STATUS")
+	os.Unsetenv("CHAI_DATA_DIR")
+	os.Unsetenv("CHAI_WEBHOOK_URL")
+	os.Unsetenv("CHAI_WEBHOOK_SECRET")
+	os.Unsetenv("CHAI_PERSIST_EVENT_TYPES")
+	os.Unsetenv("CHAI_MAX_SESSIONS")
+	os.Unsetenv("CHAI_ARCHIVE_OLDEST_SESSIONS")
+	os.Unsetenv("CHAI_MAX_EVENTS_PER_PROMPT")
+	os.Unsetenv("CHAI_TLS_CERT")
+	os.Unsetenv("CHAI_TLS_KEY")
+	os.Unsetenv("CHAI_TLS_AUTOCERT_DOMAINS")
+	os.Unsetenv("CHAI_TLS_AUTOCERT_CACHE")
+	os.Unsetenv("CHAI_TLS_AUTOCERT_EMAIL")
+	os.Unsetenv("CHAI_LENIENT_TEMPLATES")
+	os.Unsetenv("CHAI_IDEMPOTENCY_WINDOW")
+	os.Unsetenv("CHAI_MAX_PROMPT_TIMEOUT")
+	os.Unsetenv("CHAI_COMPRESS_EVENTS")
+	os.Unsetenv("CHAI_CONFIG")
+	os.Unsetenv("CHAI_MAX_CONCURRENT_PROMPTS")
+	os.Unsetenv("CHAI_MAX_SSE_CONNECTIONS_PER_IP")
+	os.Unsetenv("CHAI_READ_ONLY")
+	os.Unsetenv("CHAI_CLAUDE_LOG_STDERR")
+	os.Unsetenv("CHAI_CLAUDE_LOG_STDIN")
+	os.Unsetenv("CHAI_CLAUDE_LOG_FILE")
+	os.Unsetenv("CHAI_CLAUDE_LOG_PREFIX")
+	os.Unsetenv("CHAI_BASE_PATH")
+	os.Unsetenv("CHAI_CLAUDE_CMD_ALLOW")
+	os.Unsetenv("CHAI_PERMISSION_TIMEOUT")
+	os.Unsetenv("CHAI_MAX_STREAM_DURATION")
+	os.Unsetenv("CHAI_RECONNECT_DELAY")
+	os.Unsetenv("CHAI_THINKING_EVENTS")
+	os.Unsetenv("CHAI_PERSIST_THINKING")
+}
+
+func TestLoadConfig_ConfigFile(t *testing.T) {
+	clearEnvVars()
+	defer clearEnvVars()
+
+	dir := t.TempDir()
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	yamlPath := writeFile("chai.yaml", `# chai settings
+port: 4000
+db: /file/chai.db
+prompt_timeout: 20m
+unique-titles: true
+extra_claude_args:
+  - --model
+  - "claude-opus"
+`)
+	jsonPath := writeFile("chai.json", `{"port": 4001, "prompt_timeout": "20m", "extra_claude_args": ["--verbose"]}`)
+
+	load := func(t *testing.T, configPath string, wasSet flagChecker) (*Config, error) {
+		t.Helper()
+		f := newTestFlags(9000, "/flag/chai.db", defaultWorkDir, defaultClaudeCmd, 15*time.Minute, defaultShutdownTimeout)
+		f.configFile = &configPath
+		return loadConfigWithChecker(f, testOpts(), wasSet)
+	}
+
+	t.Run("file only", func(t *testing.T) {
+		cfg, err := load(t, yamlPath, makeChecker("config"))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if cfg.Port != 4000 || cfg.DBPath != "/file/chai.db" || cfg.PromptTimeout != 20*time.Minute || !cfg.UniqueTitles {
+			t.Errorf("cfg = port %d, db %q, prompt timeout %v, unique titles %t; want the file's values",
+				cfg.Port, cfg.DBPath, cfg.PromptTimeout, cfg.UniqueTitles)
+		}
+		if got := strings.Join(cfg.ExtraClaudeArgs, "|"); got != "--model|claude-opus" {
+			t.Errorf("ExtraClaudeArgs = %q", got)
+		}
+		if cfg.ShutdownTimeout != defaultShutdownTimeout {
+			t.Errorf("ShutdownTimeout = %v, want default", cfg.ShutdownTimeout)
+		}
+	})
+
+	t.Run("json file named by env", func(t *testing.T) {
+		os.Setenv("CHAI_CONFIG", jsonPath)
+		defer os.Unsetenv("CHAI_CONFIG")
+		cfg, err := load(t, "", neverSet)
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if cfg.Port != 4001 || cfg.PromptTimeout != 20*time.Minute || cfg.ConfigFile != jsonPath {
+			t.Errorf("cfg = port %d, prompt timeout %v, config %q", cfg.Port, cfg.PromptTimeout, cfg.ConfigFile)
+		}
+		if len(cfg.ExtraClaudeArgs) != 1 || cfg.ExtraClaudeArgs[0] != "--verbose" {
+			t.Errorf("ExtraClaudeArgs = %q", cfg.ExtraClaudeArgs)
+		}
+	})
+
+	t.Run("file overridden by env", func(t *testing.T) {
+		os.Setenv("CHAI_PORT", "5000")
+		os.Setenv("CHAI_PROMPT_TIMEOUT", "30m")
+		defer clearEnvVars()
+		cfg, err := load(t, yamlPath, makeChecker("config"))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if cfg.Port != 5000 || cfg.PromptTimeout != 30*time.Minute {
+			t.Errorf("cfg = port %d, prompt timeout %v; want the env values", cfg.Port, cfg.PromptTimeout)
+		}
+		if cfg.DBPath != "/file/chai.db" {
+			t.Errorf("DBPath = %q, want the file value", cfg.DBPath)
+		}
+	})
+
+	t.Run("env overridden by flag", func(t *testing.T) {
+		os.Setenv("CHAI_PORT", "5000")
+		os.Setenv("CHAI_PROMPT_TIMEOUT", "30m")
+		defer clearEnvVars()
+		cfg, err := load(t, yamlPath, makeChecker("config", "port", "db", "prompt-timeout"))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %v", err)
+		}
+		if cfg.Port != 9000 || cfg.DBPath != "/flag/chai.db" || cfg.PromptTimeout != 15*time.Minute {
+			t.Errorf("cfg = port %d, db %q, prompt timeout %v; want the flag values", cfg.Port, cfg.DBPath, cfg.PromptTimeout)
+		}
+	})
+
+	t.Run("invalid values are validated", func(t *testing.T) {
+		tests := []struct {
+			name, content, wantErr string
+		}{
+			{"port out of range", "port: 70000\n", "from file"},
+			{"non-positive duration", "prompt_timeout: 0s\n", "must be positive"},
+			{"unparseable duration", "shutdown_timeout: soon\n", "CHAI_SHUTDOWN_TIMEOUT"},
+			{"unknown key", "port: 4000\nprompt_timout: 1m\n", "unknown keys: prompt_timout"},
+			{"malformed", "port 4000\n", "expected"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := load(t, writeFile("bad.yaml", tt.content), makeChecker("config"))
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+			})
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := load(t, filepath.Join(dir, "missing.yaml"), makeChecker("config")); err == nil {
+			t.Error("LoadConfig should fail when the config file does not exist")
+		}
+	})
 }
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EnvPolicy decides which environment variables a session may set for the
+// Claude CLI. Patterns are exact names or prefixes ending in "*". The denylist
+// wins over the allowlist; an empty allowlist allows every name not denied.
+type EnvPolicy struct {
+	Allow []string
+	Deny  []string
+}
+
+// NewEnvPolicy builds a policy from comma-separated allow and deny patterns.
+func NewEnvPolicy(allow, deny string) EnvPolicy {
+	return EnvPolicy{Allow: splitList(allow), Deny: splitList(deny)}
+}
+
+// Allowed reports whether a session may set the variable name.
+func (p EnvPolicy) Allowed(name string) bool {
+	if matchesAny(name, p.Deny) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchesAny(name, p.Allow)
+}
+
+// Check returns an error naming the first invalid or disallowed variable.
+func (p EnvPolicy) Check(env map[string]string) error {
+	for _, name := range sortedKeys(env) {
+		if name == "" || strings.ContainsAny(name, "=\x00") || strings.ContainsRune(env[name], 0) {
+			return fmt.Errorf("invalid env variable %q", name)
+		}
+		if !p.Allowed(name) {
+			return fmt.Errorf("env variable %q is not allowed", name)
+		}
+	}
+	return nil
+}
+
+// Filter returns the variables the policy allows. Sessions are checked when
+// created, but the policy may have been tightened since.
+func (p EnvPolicy) Filter(env map[string]string) map[string]string {
+	var allowed map[string]string
+	for name, value := range env {
+		if !p.Allowed(name) {
+			continue
+		}
+		if allowed == nil {
+			allowed = make(map[string]string, len(env))
+		}
+		allowed[name] = value
+	}
+	return allowed
+}
+
+// mergeEnv overlays env onto base, a list of "KEY=value" entries as returned by
+// os.Environ. Overridden entries are replaced in place; new ones are appended
+// in name order.
+func mergeEnv(base []string, env map[string]string) []string {
+	merged := make([]string, 0, len(base)+len(env))
+	seen := make(map[string]bool, len(env))
+	for _, kv := range base {
+		name, _, _ := strings.Cut(kv, "=")
+		if value, ok := env[name]; ok {
+			if !seen[name] {
+				merged = append(merged, name+"="+value)
+				seen[name] = true
+			}
+			continue
+		}
+		merged = append(merged, kv)
+	}
+	for _, name := range sortedKeys(env) {
+		if !seen[name] {
+			merged = append(merged, name+"="+env[name])
+		}
+	}
+	return merged
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
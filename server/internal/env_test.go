@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvPolicy_Allowed(t *testing.T) {
+	p := NewEnvPolicy("ANTHROPIC_*, MCP_CONFIG, CHAI_DEBUG", "PATH,CHAI_*")
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"ANTHROPIC_API_KEY", true},
+		{"MCP_CONFIG", true},
+		{"MCP_CONFIG_EXTRA", false},
+		{"PATH", false},
+		{"HOME", false},
+		{"CHAI_DEBUG", false}, // the denylist wins
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(tt.name); got != tt.want {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// An empty allowlist allows anything not denied
+	p = NewEnvPolicy("", "PATH")
+	if !p.Allowed("HOME") || p.Allowed("PATH") {
+		t.Error("Empty allowlist should allow everything except the denylist")
+	}
+}
+
+func TestEnvPolicy_Check(t *testing.T) {
+	p := NewEnvPolicy("", "PATH,CHAI_*")
+
+	if err := p.Check(map[string]string{"API_KEY": "x"}); err != nil {
+		t.Errorf("Check failed: %v", err)
+	}
+	if err := p.Check(nil); err != nil {
+		t.Errorf("Check(nil) failed: %v", err)
+	}
+
+	err := p.Check(map[string]string{"API_KEY": "x", "CHAI_AUTH_TOKEN": "y"})
+	if err == nil || !strings.Contains(err.Error(), "CHAI_AUTH_TOKEN") {
+		t.Errorf("Check error = %v, want CHAI_AUTH_TOKEN rejected", err)
+	}
+
+	for _, name := range []string{"", "A=B", "A\x00"} {
+		if err := p.Check(map[string]string{name: "x"}); err == nil {
+			t.Errorf("Check(%q) succeeded, want error", name)
+		}
+	}
+}
+
+func TestEnvPolicy_Filter(t *testing.T) {
+	p := NewEnvPolicy("", "PATH")
+
+	got := p.Filter(map[string]string{"PATH": "/tmp", "API_KEY": "x"})
+	if len(got) != 1 || got["API_KEY"] != "x" {
+		t.Errorf("Filter = %v, want only API_KEY", got)
+	}
+	if got := p.Filter(map[string]string{"PATH": "/tmp"}); got != nil {
+		t.Errorf("Filter = %v, want nil", got)
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	base := []string{"HOME=/root", "KEEP=1", "MALFORMED"}
+	got := mergeEnv(base, map[string]string{"HOME": "/home/chai", "B": "2", "A": "1"})
+
+	want := []string{"HOME=/home/chai", "KEEP=1", "MALFORMED", "A=1", "B=2"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("mergeEnv = %v, want %v", got, want)
+	}
+}
@@ -1,15 +1,25 @@
 package internal
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"maps"
 	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -17,28 +27,477 @@ import (
 
 // ClaudeRunner interface for dependency injection
 type ClaudeRunner interface {
-	RunPrompt(ctx context.Context, sessionID string, claudeSessionID *string, prompt string, workingDir *string, onEvent func(line []byte) error) (string, error)
-	SendPermissionResponse(sessionID, requestID, decision string) error
+	RunPrompt(ctx context.Context, sessionID string, claudeSessionID *string, prompt string, opts PromptOptions, onEvent func(line []byte) error) (string, error)
+	SendPermissionResponse(sessionID, requestID, decision, message string, interrupt bool) error
 	StorePendingRequest(sessionID, requestID string, toolInput map[string]any)
+	PendingRequestForSession(sessionID string) *PendingRequest
+	ListActive() []ActiveProcess
+	IsActive(sessionID string) bool
+	Command(claudeSessionID *string, opts PromptOptions) ClaudeCommand
+	ListActiveOlderThan(age time.Duration) []ActiveProcess
+	CancelPrompt(sessionID string) bool
+	CancelPromptByID(sessionID, promptID string) bool
 	KillProcess(sessionID string) error
+	KillPrompt(sessionID, promptID string) error
+	Draining() bool
+	Stats() ClaudeManagerStats
+	Version(ctx context.Context) (string, error)
+}
+
+// Pinger checks database connectivity
+type Pinger interface {
+	Ping() error
+}
+
+// Prompts are only admitted while the database answers a ping, so a prompt
+// never launches Claude only to fail persisting its events
+const (
+	admissionPingAttempts = 3
+	admissionPingDelay    = 50 * time.Millisecond
+)
+
+// HandlersOptions configures optional handler behavior.
+type HandlersOptions struct {
+	// SSEBufferSize is the number of events buffered per SSE client. When the
+	// buffer fills, the slow client is dropped while the prompt keeps running.
+	// Zero writes events inline, so a slow client back-pressures Claude.
+	SSEBufferSize int
+
+	// MaxStreamDuration closes a prompt's stream this long after the prompt
+	// was admitted, including time spent queued, waiting for a slot or
+	// following a replay, stopping Claude and ending with an error event.
+	// Zero disables the cap.
+	MaxStreamDuration time.Duration
+
+	// CollapseErrors persists consecutive identical error events within a
+	// prompt once, updating a "count" field instead of storing duplicates.
+	CollapseErrors bool
+
+	// MaxPromptBytes rejects prompts larger than this with 413. Zero disables
+	// the limit.
+	MaxPromptBytes int
+
+	// IdempotencyWindow is how long a prompt's Idempotency-Key is remembered.
+	// A request repeating a key within it replays the original prompt's
+	// events instead of starting another. Zero ignores the header.
+	IdempotencyWindow time.Duration
+
+	// MaxPromptTimeout bounds the timeout a session or prompt request may ask
+	// for in place of the server's. Zero rejects every override.
+	MaxPromptTimeout time.Duration
+
+	// LenientTemplates expands template references to variables missing from
+	// a prompt's "variables" to "" instead of rejecting the prompt with 400.
+	LenientTemplates bool
+
+	// LockWorkdir allows only one running prompt per working directory across
+	// sessions; WorkDir is the directory used by sessions without their own.
+	LockWorkdir bool
+	WorkDir     string
+
+	// EnvPolicy limits which environment variables sessions may set for the
+	// Claude CLI. The zero value allows any variable.
+	EnvPolicy EnvPolicy
+
+	// ClaudeCmdAllow lists the commands sessions may set as claude_cmd. Empty
+	// rejects per-session commands, so sessions can't run arbitrary programs.
+	ClaudeCmdAllow CommandAllowlist
+
+	// DeletedRetention keeps deleted sessions restorable in the recycle bin.
+	// Zero deletes sessions immediately.
+	DeletedRetention time.Duration
+
+	// PersistSnapshots saves each finished prompt's reconstructed reply and
+	// outcome to prompt_snapshots.
+	PersistSnapshots bool
+
+	// TextEvents emits a "text" event carrying each increment of assistant
+	// text alongside the raw claude frames, so clients need not parse
+	// Claude's stream-json schema.
+	TextEvents bool
+
+	// ThinkingEvents emits a "thinking" event carrying each increment of
+	// Claude's reasoning from thinking blocks, so clients can show or hide it
+	// apart from the answer text.
+	ThinkingEvents bool
+
+	// PersistThinking saves an assistant reply's reasoning with its message,
+	// separately from the answer text.
+	PersistThinking bool
+
+	// ToolEvents emits a "tool_call" event for each tool_use block Claude
+	// sends and a "tool_result" event for each result that comes back.
+	ToolEvents bool
+
+	// PersistEventTypes limits which Claude event types have their raw frames
+	// persisted for catch-up; every frame is still streamed. The zero value
+	// persists every type.
+	PersistEventTypes EventTypeFilter
+
+	// LongPollTimeout is the longest GetEvents blocks for ?wait=true before
+	// returning an empty page. Zero disables waiting.
+	LongPollTimeout time.Duration
+
+	// BackupDir is where POST /api/admin/backup writes database backups. Empty
+	// disables backups.
+	BackupDir string
+
+	// MaxAttachments and MaxAttachmentBytes limit the images a prompt may
+	// carry. Zero MaxAttachments rejects attachments.
+	MaxAttachments     int
+	MaxAttachmentBytes int
+
+	// AllowRawArgs lets prompts carrying AuthToken as a bearer token replace
+	// the Claude CLI args with raw_args, and such session creates add
+	// extra_args to every prompt.
+	AllowRawArgs bool
+	AuthToken    string
+
+	// CreateWorkDir creates a new session's working directory when it doesn't
+	// exist, instead of rejecting the session.
+	CreateWorkDir bool
+
+	// ConcurrentPrompts lets sessions created with concurrent_prompts run
+	// several prompts at once, each with its own Claude process and prompt_id.
+	// With it off, every session is single-flight.
+	ConcurrentPrompts bool
+
+	// MaxConcurrentPrompts caps how many prompts run Claude at once across
+	// all sessions. Zero is unlimited.
+	MaxConcurrentPrompts int
+
+	// ReadOnly starts the server in read-only mode, which the admin API can
+	// toggle at runtime.
+	ReadOnly bool
+
+	// Webhooks receives session lifecycle events. Nil disables webhooks.
+	Webhooks *WebhookDispatcher
+
+	// Info is reported by GET /api/info. The Claude CLI version is probed once
+	// at startup rather than per request.
+	Info InfoResponse
+}
+
+// EventTypeFilter is a set of Claude event types, e.g. "assistant" or
+// "content_block_delta". An empty filter allows every type.
+type EventTypeFilter []string
+
+// NewEventTypeFilter builds a filter from a comma-separated list of types.
+func NewEventTypeFilter(list string) EventTypeFilter {
+	return EventTypeFilter(splitList(list))
+}
+
+// Allows reports whether eventType passes the filter.
+func (f EventTypeFilter) Allows(eventType string) bool {
+	return len(f) == 0 || slices.Contains(f, eventType)
+}
+
+// CommandAllowlist is the set of executables sessions may run instead of the
+// server's Claude CLI command. An empty list allows no overrides.
+type CommandAllowlist []string
+
+// NewCommandAllowlist builds an allowlist from a comma-separated list of
+// commands.
+func NewCommandAllowlist(list string) CommandAllowlist {
+	return CommandAllowlist(splitList(list))
+}
+
+// Allows reports whether a session may run cmd. Commands are matched
+// exactly, so a wrapper must be listed by the path sessions will use.
+func (l CommandAllowlist) Allows(cmd string) bool {
+	return slices.Contains(l, cmd)
 }
 
 type Handlers struct {
 	repo          *Repository
+	db            Pinger
 	claude        ClaudeRunner
 	promptTimeout time.Duration
+	opts          HandlersOptions
+	queue         *PromptQueue
+	workdirs      *workdirLocks
+	slots         *promptSlots
+	readOnly      *atomic.Bool
+	streams       *StreamStats
+	openStreams   *streamRegistry
+	claudeHealth  claudeHealthCache
 }
 
-func NewHandlers(repo *Repository, claude ClaudeRunner, promptTimeout time.Duration) *Handlers {
-	return &Handlers{
+// NewHandlers creates the HTTP handlers. A nil opts uses the defaults.
+func NewHandlers(repo *Repository, claude ClaudeRunner, promptTimeout time.Duration, opts *HandlersOptions) *Handlers {
+	h := &Handlers{
 		repo:          repo,
+		db:            repo,
 		claude:        claude,
 		promptTimeout: promptTimeout,
+		queue:         NewPromptQueue(),
+		workdirs:      newWorkdirLocks(),
+		streams:       NewStreamStats(),
+		openStreams:   newStreamRegistry(),
 	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	h.slots = newPromptSlots(h.opts.MaxConcurrentPrompts)
+	h.readOnly = &atomic.Bool{}
+	h.readOnly.Store(h.opts.ReadOnly)
+	return h
+}
+
+// ReadOnly returns the read-only mode switch, for RejectWritesWhenReadOnly
+// to check and the admin API to toggle.
+func (h *Handlers) ReadOnly() *atomic.Bool {
+	return h.readOnly
+}
+
+// IsActive reports whether a session has a live Claude process or a prompt
+// holding or waiting for one of the MaxConcurrentPrompts slots. The orphan
+// stream sweeper uses it, since a waiting prompt keeps its session streaming
+// before any process starts.
+func (h *Handlers) IsActive(sessionID string) bool {
+	return h.slots.Active(sessionID) || h.claude.IsActive(sessionID)
 }
 
 // Helper functions
 
+// withCount adds a "count" field to a JSON object.
+func withCount(data []byte, count int) ([]byte, error) {
+	var obj map[string]any
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	obj["count"] = count
+	return json.Marshal(obj)
+}
+
+// openStream switches the response to SSE, or NDJSON for StreamFormatNDJSON,
+// flushing headers immediately. With StreamEventsText, only text and terminal
+// events are forwarded. Returns nil if the ResponseWriter can't stream.
+func (h *Handlers) openStream(w http.ResponseWriter, r *http.Request, format, events string) *eventStream {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil
+	}
+
+	ndjson := format == StreamFormatNDJSON
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher.Flush()
+
+	stream := newEventStream(w, flusher, h.opts.SSEBufferSize)
+	stream.ndjson = ndjson
+	stream.stats, stream.sessionID, stream.ctx = h.streams, chi.URLParam(r, "id"), r.Context()
+	h.openStreams.add(stream)
+	if events == StreamEventsText {
+		stream.only = textStreamEvents
+	}
+	return stream
+}
+
+// ReconnectReasonShutdown is the reason of reconnect events sent because the
+// server is shutting down
+const ReconnectReasonShutdown = "shutdown"
+
+// SendReconnect sends every open prompt stream a reconnect event suggesting
+// its client wait delay before reconnecting, so clients of a server that is
+// going away back off instead of retrying at once. Returns the number of
+// streams notified.
+func (h *Handlers) SendReconnect(delay time.Duration, reason string) int {
+	return h.openStreams.reconnect(delay, reason)
+}
+
+// maxIdempotencyKeyBytes caps the Idempotency-Key header on prompts
+const maxIdempotencyKeyBytes = 255
+
+// maxPromptLabelBytes caps a prompt's label
+const maxPromptLabelBytes = 255
+
+// replayPrompt answers a retried prompt request (a repeated Idempotency-Key)
+// by streaming the original prompt's persisted events, following it live
+// until it ends, instead of running the prompt again.
+func (h *Handlers) replayPrompt(w http.ResponseWriter, r *http.Request, format, events, sessionID, promptID string) {
+	log.Printf("Replaying prompt %s for a retried request on session %s", promptID, sessionID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	stream := h.openStream(w, r, format, events)
+	if stream == nil {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	defer stream.close()
+	h.followPrompt(r.Context(), stream, sessionID, promptID)
+}
+
+// followPrompt streams a prompt's persisted events, following it live until
+// it ends or ctx is done.
+func (h *Handlers) followPrompt(ctx context.Context, stream *eventStream, sessionID, promptID string) {
+	var since int64
+	for {
+		// Subscribe before reading so an event created in between still wakes us
+		changed := h.repo.EventsChanged(sessionID)
+
+		events, err := h.repo.GetEventsSince(sessionID, since, promptID, 100)
+		if err != nil {
+			data, _ := json.Marshal(PromptErrorEvent{Error: err.Error(), Terminal: true})
+			stream.send("error", data)
+			return
+		}
+		for _, e := range events {
+			if err := stream.send(e.EventType, e.Data); err != nil {
+				return
+			}
+			since = e.Sequence
+			// A terminal error ends the prompt too; on a concurrent session
+			// other prompts may keep the session streaming long after
+			if isFinalEvent(e.EventType, e.Data, false) {
+				return
+			}
+		}
+		if len(events) > 0 {
+			continue
+		}
+
+		// Caught up without a final event: keep following while the session
+		// streams
+		session, err := h.repo.GetSession(sessionID)
+		if err != nil || session.StreamStatus != StreamStatusStreaming {
+			return
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// errQueueCancelled is returned by waitForTurn when the session's queue was cancelled
+var errQueueCancelled = errors.New("queued prompt cancelled")
+
+// errPromptQueued is returned for a prompt whose Idempotency-Key belongs to
+// a prompt still waiting in the session's queue
+var errPromptQueued = errors.New("a prompt with this Idempotency-Key is already queued")
+
+// waitForTurn persists a queued prompt, tells the client its position, and
+// blocks until the prompt claims the session or ctx is done. Returns the new
+// prompt ID. The queued event is not persisted since no prompt ID exists yet.
+// A prompt with an idempotency key records it as it starts; if the key was
+// used by a prompt that started meanwhile, that prompt's ID is returned with
+// ErrDuplicatePrompt.
+func (h *Handlers) waitForTurn(ctx context.Context, stream *eventStream, sessionID, prompt, priority, key string) (string, error) {
+	queued, err := h.repo.EnqueuePrompt(sessionID, prompt, priority)
+	if err != nil {
+		return "", err
+	}
+
+	entry, position, duplicate := h.queue.EnqueueKeyed(sessionID, queued.ID, priority, key)
+	if duplicate != "" {
+		h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptCancelled)
+		return "", errPromptQueued
+	}
+	defer h.queue.Remove(sessionID, queued.ID)
+
+	data, _ := json.Marshal(map[string]any{
+		"session_id": sessionID,
+		"queue_id":   queued.ID,
+		"position":   position,
+		"priority":   priority,
+	})
+	if err := stream.send("queued", data); err != nil {
+		h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptCancelled)
+		return "", err
+	}
+
+	cancelled := func() (string, error) {
+		h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptCancelled)
+		data, _ := json.Marshal(map[string]string{"status": "cancelled", "queue_id": queued.ID})
+		stream.send("cancelled", data)
+		return "", errQueueCancelled
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptCancelled)
+			return "", ctx.Err()
+		case <-entry.cancelled:
+			return cancelled()
+		case <-entry.ready:
+		}
+
+		// A wake-up can race with cancellation; cancellation wins
+		select {
+		case <-entry.cancelled:
+			return cancelled()
+		default:
+		}
+
+		// The wake-up may be stale, sent before a higher priority prompt was
+		// queued ahead; that prompt is woken itself and goes first
+		if !h.queue.IsHead(sessionID, queued.ID) {
+			continue
+		}
+
+		var promptID string
+		if key != "" {
+			promptID, err = h.repo.StartKeyedPrompt(sessionID, false, key, h.opts.IdempotencyWindow)
+		} else {
+			promptID, err = h.repo.StartNewPrompt(sessionID)
+		}
+		if errors.Is(err, ErrSessionBusy) {
+			continue // another prompt is still running; wait for the next wake-up
+		}
+		if errors.Is(err, ErrDuplicatePrompt) {
+			h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptCancelled)
+			return promptID, err
+		}
+		if err != nil {
+			h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptFailed)
+			return "", err
+		}
+		if err := h.repo.UpdateQueuedPromptStatus(queued.ID, QueuedPromptStarted); err != nil {
+			log.Printf("Warning: failed to mark queued prompt %s started: %v", queued.ID, err)
+		}
+		return promptID, nil
+	}
+}
+
+// waitForSlot waits for one of the MaxConcurrentPrompts slots after sending
+// the client a waiting event with its place in line, so the prompt doesn't
+// look frozen. The event isn't persisted: a place in line means nothing on
+// replay, and leaving it out keeps connected and user_prompt the prompt's
+// first two events.
+func (h *Handlers) waitForSlot(ctx context.Context, stream *eventStream, sessionID, promptID string) error {
+	waiter, position := h.slots.Enqueue(sessionID)
+	giveUp := func(err error) error {
+		if !h.slots.Cancel(waiter) {
+			h.slots.Release(sessionID)
+		}
+		return err
+	}
+
+	data, _ := json.Marshal(map[string]any{
+		"session_id": sessionID,
+		"prompt_id":  promptID,
+		"position":   position,
+	})
+	if err := stream.send("waiting", data); err != nil {
+		return giveUp(err)
+	}
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		return giveUp(ctx.Err())
+	}
+}
+
 func writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -49,22 +508,241 @@ func writeError(w http.ResponseWriter, status int, message string) {
 	writeJSON(w, status, map[string]string{"error": message})
 }
 
-func parseJSON(r *http.Request, v any) error {
+// validator collects problems with a request's fields so a 400 reports all of
+// them at once instead of only the first.
+type validator struct {
+	fields map[string]string
+}
+
+// fail records a problem with field, keeping the first one found.
+func (v *validator) fail(field, problem string) {
+	if v.fields == nil {
+		v.fields = map[string]string{}
+	}
+	if _, ok := v.fields[field]; !ok {
+		v.fields[field] = problem
+	}
+}
+
+// check records problem for field unless ok holds.
+func (v *validator) check(ok bool, field, problem string) {
+	if !ok {
+		v.fail(field, problem)
+	}
+}
+
+// valid reports whether no problems were recorded.
+func (v *validator) valid() bool {
+	return len(v.fields) == 0
+}
+
+// write sends the recorded problems as a 400 ValidationError. The top-level
+// error lists every field for clients that only show a message.
+func (v *validator) write(w http.ResponseWriter) {
+	names := slices.Sorted(maps.Keys(v.fields))
+	problems := make([]string, len(names))
+	for i, name := range names {
+		problems[i] = name + ": " + v.fields[name]
+	}
+	writeJSON(w, http.StatusBadRequest, ValidationError{
+		Error:  "validation failed: " + strings.Join(problems, "; "),
+		Fields: v.fields,
+	})
+}
+
+// isSessionNotFound reports whether err means the session is gone, whichever
+// repository call noticed: a lookup finding no row, or a write rejected because
+// the session was deleted mid-request.
+func isSessionNotFound(err error) bool {
+	return errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrSessionNotFound)
+}
+
+// maxRequestBodyBytes caps request bodies other than prompts
+const maxRequestBodyBytes = 64 * 1024
+
+// parseJSON decodes the request body into v, failing with *http.MaxBytesError
+// once more than maxBytes are read. A maxBytes of zero or less reads without limit.
+func parseJSON(w http.ResponseWriter, r *http.Request, v any, maxBytes int64) error {
+	if maxBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+	}
 	return json.NewDecoder(r.Body).Decode(v)
 }
 
+// writeParseError responds to a parseJSON failure.
+func writeParseError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid JSON")
+}
+
+// promptBodyLimit bounds a prompt request body. JSON escaping can grow each
+// byte of a prompt to six (a \u00XX escape), so the body may be larger than
+// MaxPromptBytes itself; the decoded prompt is checked against the limit.
+func (h *Handlers) promptBodyLimit() int64 {
+	if h.opts.MaxPromptBytes <= 0 {
+		return 0
+	}
+	// Base64 inflates each attachment by a third
+	attachments := int64(h.opts.MaxAttachments) * (int64(h.opts.MaxAttachmentBytes)*4/3 + 4)
+	return 6*int64(h.opts.MaxPromptBytes) + attachments + maxRequestBodyBytes
+}
+
+// A deep health check runs `claude --version` at most once per
+// claudeHealthTTL, so frequent probes don't each spawn a process
+const (
+	claudeHealthTTL     = 30 * time.Second
+	claudeHealthTimeout = 5 * time.Second
+)
+
+// claudeHealthCache holds the Claude CLI's last deep health check result
+type claudeHealthCache struct {
+	mu        sync.Mutex // held while checking, so concurrent probes share one run
+	checkedAt time.Time
+	err       error
+}
+
+// checkClaude reports whether the Claude CLI answers --version, reusing a
+// result younger than claudeHealthTTL.
+func (h *Handlers) checkClaude(ctx context.Context) error {
+	c := &h.claudeHealth
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < claudeHealthTTL {
+		return c.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, claudeHealthTimeout)
+	defer cancel()
+	_, c.err = h.claude.Version(ctx)
+	c.checkedAt = time.Now()
+	if c.err != nil {
+		log.Printf("Health check: Claude CLI is not usable: %v", c.err)
+	}
+	return c.err
+}
+
 // Handlers
 
+// Health pings the database. With ?deep=true it also checks that the Claude
+// CLI runs, reporting each component as "ok" or "error".
 func (h *Handlers) Health(w http.ResponseWriter, r *http.Request) {
-	if err := h.repo.Ping(); err != nil {
-		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "error", "error": "database unavailable"})
+	deep := false
+	if v := r.URL.Query().Get("deep"); v != "" {
+		var err error
+		if deep, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid deep")
+			return
+		}
+	}
+
+	dbErr := h.repo.Ping()
+	if !deep {
+		if dbErr != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "error", "error": "database unavailable"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	}
+
+	resp := map[string]string{"status": "ok", "database": "ok", "claude": "ok"}
+	var problems []string
+	if dbErr != nil {
+		resp["database"] = "error"
+		problems = append(problems, "database unavailable")
+	}
+	if h.checkClaude(r.Context()) != nil {
+		// The CLI's output can carry paths and account details, so it is only
+		// logged, by checkClaude
+		resp["claude"] = "error"
+		problems = append(problems, "claude unavailable")
+	}
+	if len(problems) > 0 {
+		resp["status"], resp["error"] = "error", strings.Join(problems, "; ")
+		writeJSON(w, http.StatusServiceUnavailable, resp)
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Info reports the server version and the Claude CLI it was started with.
+func (h *Handlers) Info(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.opts.Info)
+}
+
+// parseSessionFilter reads include_archived, deleted, status, created_after,
+// updated_before, limit and offset from the query string.
+func parseSessionFilter(r *http.Request) (SessionFilter, error) {
+	q := r.URL.Query()
+	var filter SessionFilter
+	var err error
+
+	if v := q.Get("include_archived"); v != "" {
+		if filter.IncludeArchived, err = strconv.ParseBool(v); err != nil {
+			return filter, errors.New("invalid include_archived")
+		}
+	}
+	if v := q.Get("deleted"); v != "" {
+		if filter.Deleted, err = strconv.ParseBool(v); err != nil {
+			return filter, errors.New("invalid deleted")
+		}
+	}
+	if v := q.Get("status"); v != "" {
+		if filter.StreamStatus = StreamStatus(v); !IsValidStreamStatus(filter.StreamStatus) {
+			return filter, errors.New("invalid status: must be idle, streaming or completed")
+		}
+	}
+	if v := q.Get("created_after"); v != "" {
+		if filter.CreatedAfter, err = parseTimeParam(v); err != nil {
+			return filter, errors.New("invalid created_after: must be a unix timestamp or RFC 3339 time")
+		}
+	}
+	if v := q.Get("updated_before"); v != "" {
+		if filter.UpdatedBefore, err = parseTimeParam(v); err != nil {
+			return filter, errors.New("invalid updated_before: must be a unix timestamp or RFC 3339 time")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return filter, errors.New("invalid limit")
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			return filter, errors.New("invalid offset")
+		}
+	}
+	return filter, nil
+}
+
+// parseTimeParam parses a query parameter given as unix seconds or RFC 3339.
+func parseTimeParam(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
 }
 
+// ListSessions returns sessions, hiding archived ones unless include_archived=true.
+// limit and offset page the results; X-Total-Count carries the unpaged total.
 func (h *Handlers) ListSessions(w http.ResponseWriter, r *http.Request) {
-	sessions, err := h.repo.ListSessions()
+	filter, err := parseSessionFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sessions, err := h.repo.ListSessions(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	total, err := h.repo.countSessions(filter)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -73,30 +751,105 @@ func (h *Handlers) ListSessions(w http.ResponseWriter, r *http.Request) {
 	if sessions == nil {
 		sessions = []Session{}
 	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	writeJSON(w, http.StatusOK, sessions)
 }
 
+// CountSessions returns the number of sessions matching the list filters.
+func (h *Handlers) CountSessions(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseSessionFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	count, err := h.repo.countSessions(filter)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"count": count})
+}
+
 func (h *Handlers) CreateSession(w http.ResponseWriter, r *http.Request) {
 	var req CreateSessionRequest
-	if err := parseJSON(r, &req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON")
+	if err := parseJSON(w, r, &req, maxRequestBodyBytes); err != nil {
+		writeParseError(w, err)
+		return
+	}
+	// Session args reach every later prompt, so they need the same trust as raw_args
+	if !h.allowArgs(w, r, "extra_args", req.ExtraArgs) {
+		return
+	}
+	// So does skipping the approval flow for every later prompt
+	if req.PermissionMode == PermissionModeBypass && !h.allowTrusted(w, r, "permission_mode "+PermissionModeBypass) {
 		return
 	}
 
+	var v validator
+	var settings SessionSettings
+	if req.PermissionMode != "" {
+		v.check(IsValidPermissionMode(req.PermissionMode), "permission_mode", "invalid")
+		settings.PermissionMode = &req.PermissionMode
+	}
+	settings.QueuePrompts = req.QueuePrompts
+	if req.ConcurrentPrompts {
+		v.check(h.opts.ConcurrentPrompts, "concurrent_prompts", "disabled on this server")
+		v.check(!req.QueuePrompts, "concurrent_prompts", "cannot be combined with queue_prompts")
+		settings.ConcurrentPrompts = true
+	}
+	if err := h.opts.EnvPolicy.Check(req.Env); err != nil {
+		v.fail("env", err.Error())
+	}
+	settings.Env = req.Env
+	settings.ExtraArgs = req.ExtraArgs
+	if req.ClaudeCmd != "" {
+		if len(h.opts.ClaudeCmdAllow) == 0 {
+			v.fail("claude_cmd", "disabled on this server")
+		} else {
+			v.check(h.opts.ClaudeCmdAllow.Allows(req.ClaudeCmd), "claude_cmd", "not in the allowed commands")
+		}
+		settings.ClaudeCmd = &req.ClaudeCmd
+	}
+	if req.PromptTimeout != "" {
+		timeout, err := h.parsePromptTimeout(req.PromptTimeout)
+		if err != nil {
+			v.fail("prompt_timeout", err.Error())
+		}
+		settings.PromptTimeout = timeout
+	}
+
+	// The working directory is checked last since it may be created
 	var title, workDir *string
 	if req.Title != "" {
 		title = &req.Title
 	}
-	if req.WorkingDirectory != "" {
+	if req.WorkingDirectory != "" && v.valid() {
+		if err := checkWorkDir(req.WorkingDirectory, h.opts.CreateWorkDir); err != nil {
+			v.fail("working_directory", err.Error())
+		}
 		workDir = &req.WorkingDirectory
 	}
+	if !v.valid() {
+		v.write(w)
+		return
+	}
 
-	session, err := h.repo.CreateSession(title, workDir)
+	session, err := h.repo.CreateSessionWithSettings(title, workDir, settings)
+	if errors.Is(err, ErrTitleInUse) {
+		writeError(w, http.StatusConflict, "title already in use")
+		return
+	}
+	if errors.Is(err, ErrSessionLimit) {
+		writeError(w, http.StatusTooManyRequests, "session limit reached")
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	h.opts.Webhooks.Send(WebhookSessionCreated, session.ID, "", session)
 	writeJSON(w, http.StatusCreated, session)
 }
 
@@ -107,8 +860,8 @@ func (h *Handlers) GetSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := h.repo.GetSession(id)
-	if err == sql.ErrNoRows {
+	transcript, err := h.loadTranscript(id)
+	if isSessionNotFound(err) {
 		writeError(w, http.StatusNotFound, "session not found")
 		return
 	}
@@ -117,20 +870,68 @@ func (h *Handlers) GetSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	etag := transcriptETag(transcript)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, transcript)
+}
+
+// transcriptETag returns a weak ETag for a transcript. updated_at is bumped by
+// every message insert and stream status change; the message count and status
+// tell apart changes landing within the same second, and the event sequence
+// changes as a prompt streams.
+func transcriptETag(t *SessionResponse) string {
+	return fmt.Sprintf(`W/"%d-%d-%s-%d"`, t.Session.UpdatedAt.Unix(), len(t.Messages), t.Session.StreamStatus, t.LastEventSequence)
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using the
+// weak comparison required for GET
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTranscript builds the full transcript (session plus messages) for a session.
+// Returns sql.ErrNoRows if the session does not exist.
+func (h *Handlers) loadTranscript(id string) (*SessionResponse, error) {
+	session, err := h.repo.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+
 	messages, err := h.repo.GetSessionMessages(id)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+		return nil, err
 	}
 
 	if messages == nil {
 		messages = []Message{}
 	}
 
-	writeJSON(w, http.StatusOK, SessionResponse{
-		Session:  *session,
-		Messages: messages,
-	})
+	var lastSeq int64
+	if session.LastPromptID != "" {
+		if lastSeq, err = h.repo.GetLatestEventSequence(id, session.LastPromptID); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SessionResponse{
+		Session:           *session,
+		Messages:          messages,
+		LastEventSequence: lastSeq,
+	}, nil
 }
 
 func (h *Handlers) DeleteSession(w http.ResponseWriter, r *http.Request) {
@@ -140,10 +941,19 @@ func (h *Handlers) DeleteSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Kill any running process
+	// Cancel queued prompts and kill any running process
+	h.cancelQueue(id)
 	h.claude.KillProcess(id)
 
-	deleted, err := h.repo.DeleteSession(id)
+	// Sessions go to the recycle bin unless purged explicitly or retention is off
+	purge := r.URL.Query().Get("purge") == "true" || h.opts.DeletedRetention == 0
+	var deleted bool
+	var err error
+	if purge {
+		deleted, err = h.repo.DeleteSession(id)
+	} else {
+		deleted, err = h.repo.SoftDeleteSession(id)
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -157,213 +967,1489 @@ func (h *Handlers) DeleteSession(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (h *Handlers) Prompt(w http.ResponseWriter, r *http.Request) {
+// Restore brings a deleted session back from the recycle bin.
+func (h *Handlers) Restore(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	if id == "" {
 		writeError(w, http.StatusBadRequest, "missing session id")
 		return
 	}
 
-	var req PromptRequest
-	if err := parseJSON(r, &req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON")
-		return
-	}
-
-	if strings.TrimSpace(req.Prompt) == "" {
-		writeError(w, http.StatusBadRequest, "prompt is required")
+	restored, err := h.repo.RestoreSession(id)
+	if errors.Is(err, ErrTitleInUse) {
+		writeError(w, http.StatusConflict, "title already in use")
 		return
 	}
-
-	// Get session to check if it exists and get claude session ID
-	session, err := h.repo.GetSession(id)
-	if err == sql.ErrNoRows {
-		writeError(w, http.StatusNotFound, "session not found")
+	if errors.Is(err, ErrSessionLimit) {
+		writeError(w, http.StatusTooManyRequests, "session limit reached")
 		return
 	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Start new prompt - this handles concurrent request blocking atomically
-	promptID, err := h.repo.StartNewPrompt(id)
-	if err != nil {
-		if errors.Is(err, ErrSessionBusy) {
-			writeError(w, http.StatusConflict, "session is already streaming")
-			return
-		}
-		if errors.Is(err, ErrSessionNotFound) {
-			writeError(w, http.StatusNotFound, "session not found")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err.Error())
+	if !restored {
+		writeError(w, http.StatusNotFound, "deleted session not found")
 		return
 	}
 
-	// Save user message
-	if _, err := h.repo.CreateMessage(id, "user", req.Prompt, nil); err != nil {
-		h.repo.UpdateSessionStreamStatus(id, StreamStatusIdle)
+	session, err := h.repo.GetSession(id)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	writeJSON(w, http.StatusOK, session)
+}
 
-	// Set up SSE
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
+// Archive hides a session from the default session list without deleting it.
+func (h *Handlers) Archive(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, true)
+}
 
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		h.repo.UpdateSessionStreamStatus(id, StreamStatusIdle)
-		writeError(w, http.StatusInternalServerError, "streaming not supported")
+// Unarchive restores an archived session to the default session list.
+func (h *Handlers) Unarchive(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, false)
+}
+
+func (h *Handlers) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
 		return
 	}
 
-	// Flush headers immediately
-	flusher.Flush()
+	found, err := h.repo.SetSessionArchived(id, archived)
+	if errors.Is(err, ErrTitleInUse) {
+		writeError(w, http.StatusConflict, "title already in use")
+		return
+	}
+	if errors.Is(err, ErrSessionLimit) {
+		writeError(w, http.StatusTooManyRequests, "session limit reached")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	session, err := h.repo.GetSession(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// ForkSession creates a session from another's history, optionally cut off
+// after up_to_message_id. The fork keeps the source's settings and system
+// message but starts its own Claude session, so the two diverge from there.
+func (h *Handlers) ForkSession(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	// The body is optional: an empty one forks the whole history
+	var req ForkSessionRequest
+	if err := parseJSON(w, r, &req, maxRequestBodyBytes); err != nil && !errors.Is(err, io.EOF) {
+		writeParseError(w, err)
+		return
+	}
+	var title *string
+	if req.Title != "" {
+		title = &req.Title
+	}
+
+	session, err := h.repo.ForkSession(id, req.UpToMessageID, title)
+	if errors.Is(err, ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if errors.Is(err, ErrMessageNotFound) {
+		var v validator
+		v.fail("up_to_message_id", "not a message in this session")
+		v.write(w)
+		return
+	}
+	if errors.Is(err, ErrTitleInUse) {
+		writeError(w, http.StatusConflict, "title already in use")
+		return
+	}
+	if errors.Is(err, ErrSessionLimit) {
+		writeError(w, http.StatusTooManyRequests, "session limit reached")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	h.opts.Webhooks.Send(WebhookSessionCreated, session.ID, "", session)
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// forkPrompt inlines a forked session's copied messages ahead of prompt. The
+// system message is left out since it is sent separately.
+func forkPrompt(history []Message, prompt string) string {
+	var turns []transcriptTurn
+	for _, m := range history {
+		if m.Role != "system" {
+			turns = append(turns, transcriptTurn{m.Role, m.Content})
+		}
+	}
+	return inlineTranscript(turns, prompt)
+}
+
+// SetSystemMessage stores the session's system message, which is sent to
+// Claude with every prompt. It is only accepted before the session's first
+// message.
+func (h *Handlers) SetSystemMessage(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	var req SystemMessageRequest
+	if err := parseJSON(w, r, &req, h.promptBodyLimit()); err != nil {
+		writeParseError(w, err)
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeError(w, http.StatusBadRequest, "content is required")
+		return
+	}
+	if h.opts.MaxPromptBytes > 0 && len(req.Content) > h.opts.MaxPromptBytes {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("content exceeds %d bytes", h.opts.MaxPromptBytes))
+		return
+	}
+
+	msg, err := h.repo.CreateSystemMessage(id, req.Content)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if errors.Is(err, ErrSessionStarted) {
+		writeError(w, http.StatusConflict, "system message must be set before the first prompt")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, msg)
+}
+
+func (h *Handlers) Prompt(w http.ResponseWriter, r *http.Request) {
+	h.prompt(w, r, promptMode{})
+}
+
+// promptMode adjusts how prompt runs a request sent on the client's behalf
+type promptMode struct {
+	// continuation flags the user message, so transcripts can tell it apart
+	// from what the user typed
+	continuation bool
+	// retryOf is the user message of a failed turn the prompt replaces. The
+	// turn is deleted as the prompt starts, and the prompt never queues.
+	retryOf string
+}
+
+// prompt runs the prompt in r's body.
+func (h *Handlers) prompt(w http.ResponseWriter, r *http.Request, mode promptMode) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	var req PromptRequest
+	if err := parseJSON(w, r, &req, h.promptBodyLimit()); err != nil {
+		writeParseError(w, err)
+		return
+	}
+
+	var v validator
+	tooLarge := h.checkPromptText(&req, &v)
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = StreamFormatSSE
+	}
+	v.check(IsValidStreamFormat(format), "format", "must be sse or ndjson")
+
+	events := r.URL.Query().Get("events")
+	if events == "" {
+		events = StreamEventsAll
+	}
+	v.check(IsValidStreamEvents(events), "events", "must be all or text")
+
+	var idempotencyKey string
+	if h.opts.IdempotencyWindow > 0 {
+		idempotencyKey = r.Header.Get("Idempotency-Key")
+		v.check(len(idempotencyKey) <= maxIdempotencyKeyBytes, "Idempotency-Key", fmt.Sprintf("exceeds %d bytes", maxIdempotencyKeyBytes))
+	}
+
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = h.parsePromptTimeout(req.Timeout); err != nil {
+			v.fail("timeout", err.Error())
+		}
+	}
+
+	if req.Priority == "" {
+		req.Priority = PriorityNormal
+	}
+	v.check(IsValidPromptPriority(req.Priority), "priority", "must be low, normal or high")
+	v.check(len(req.Label) <= maxPromptLabelBytes, "label", fmt.Sprintf("exceeds %d bytes", maxPromptLabelBytes))
+
+	if !v.valid() {
+		v.write(w)
+		return
+	}
+
+	if tooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("prompt exceeds %d bytes", h.opts.MaxPromptBytes))
+		return
+	}
+
+	if !h.allowArgs(w, r, "raw_args", req.RawArgs) {
+		return
+	}
+	if req.RawArgs != nil {
+		// Only the count: raw args can carry prompts, keys or paths
+		log.Printf("Running prompt for session %s with %d raw args", id, len(req.RawArgs))
+	}
+
+	if h.claude.Draining() {
+		writeError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+
+	if err := retry(admissionPingAttempts, admissionPingDelay, h.db.Ping); err != nil {
+		log.Printf("Rejecting prompt for session %s: database unavailable: %v", id, err)
+		writeError(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+
+	// Get session to check if it exists and get claude session ID
+	session, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	systemPrompt, err := h.repo.GetSystemPrompt(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Load and check attachments before the prompt takes the session
+	var images []ImageSource
+	var attachmentInfos []AttachmentInfo
+	if len(req.Attachments) > 0 {
+		images, attachmentInfos, err = resolveAttachments(req.Attachments, h.sessionWorkDir(session), h.opts.MaxAttachments, h.opts.MaxAttachmentBytes)
+		if errors.Is(err, ErrAttachmentTooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v (limit %d bytes)", err, h.opts.MaxAttachmentBytes))
+			return
+		}
+		if err != nil {
+			v.fail("attachments", err.Error())
+			v.write(w)
+			return
+		}
+	}
+
+	// Cap how long the connection stays open from here on, whatever Claude
+	// is doing; its stream then closes with an error event
+	if h.opts.MaxStreamDuration > 0 {
+		ctx, cancel := context.WithTimeoutCause(r.Context(), h.opts.MaxStreamDuration, ErrStreamDurationExceeded)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	// Start new prompt - this handles concurrent request blocking atomically.
+	// Sessions that queue prompts go to the back of a non-empty queue so newcomers
+	// can't jump ahead of prompts already waiting. Concurrent sessions never
+	// block; each prompt runs in its own Claude process keyed by its prompt ID.
+	concurrent := h.opts.ConcurrentPrompts && session.ConcurrentPrompts
+	var promptID string
+	switch {
+	case mode.retryOf != "":
+		promptID, err = h.repo.StartRetryPrompt(id, concurrent, mode.retryOf)
+	case !concurrent && session.QueuePrompts && h.queue.Len(id) > 0:
+		err = ErrSessionBusy
+		// A retry of a prompt that has since started still finds it
+		if idempotencyKey != "" {
+			if original, lookupErr := h.repo.GetKeyedPrompt(id, idempotencyKey, h.opts.IdempotencyWindow); lookupErr == nil && original != "" {
+				promptID, err = original, ErrDuplicatePrompt
+			} else if h.queue.Keyed(id, idempotencyKey) != "" {
+				err = errPromptQueued
+			}
+		}
+	case idempotencyKey != "":
+		promptID, err = h.repo.StartKeyedPrompt(id, concurrent, idempotencyKey, h.opts.IdempotencyWindow)
+	case concurrent:
+		promptID, err = h.repo.StartConcurrentPrompt(id)
+	default:
+		promptID, err = h.repo.StartNewPrompt(id)
+	}
+
+	if errors.Is(err, ErrDuplicatePrompt) {
+		h.replayPrompt(w, r, format, events, id, promptID)
+		return
+	}
+	if errors.Is(err, errPromptQueued) {
+		writeJSON(w, http.StatusConflict, map[string]string{
+			"error": err.Error(),
+			"code":  "prompt_queued",
+		})
+		return
+	}
+
+	var stream *eventStream
+	if errors.Is(err, ErrSessionBusy) && session.QueuePrompts && mode.retryOf == "" {
+		stream = h.openStream(w, r, format, events)
+		if stream == nil {
+			writeError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		defer stream.close()
+
+		promptID, err = h.waitForTurn(r.Context(), stream, id, req.Prompt, req.Priority, idempotencyKey)
+		if errors.Is(err, ErrDuplicatePrompt) {
+			log.Printf("Replaying prompt %s for a retried request on session %s", promptID, id)
+			h.followPrompt(r.Context(), stream, id, promptID)
+			return
+		}
+		if err != nil {
+			// A cancelled wait already sent its cancelled event
+			if r.Context().Err() == nil && !errors.Is(err, errQueueCancelled) {
+				data, _ := json.Marshal(PromptErrorEvent{Error: err.Error(), Terminal: true})
+				stream.send("error", data)
+			}
+			return
+		}
+		defer h.queue.Notify(id)
+
+		// The prompt ahead of us may have set the Claude session ID, or the
+		// session may have been deleted while we waited
+		if session, err = h.repo.GetSession(id); err != nil {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			if isSessionNotFound(err) {
+				err = ErrSessionNotFound
+			}
+			data, _ := json.Marshal(PromptErrorEvent{Error: err.Error(), Terminal: true})
+			stream.send("error", data)
+			return
+		}
+	} else if err != nil {
+		if errors.Is(err, ErrSessionBusy) {
+			// A session paused on a permission decision is busy too, but the client
+			// needs to know it must approve/deny before sending another prompt
+			if pending := h.claude.PendingRequestForSession(id); pending != nil {
+				writeJSON(w, http.StatusConflict, map[string]string{
+					"error":       "session is awaiting a permission decision",
+					"code":        "awaiting_permission",
+					"tool_use_id": pending.RequestID,
+				})
+				return
+			}
+			writeError(w, http.StatusConflict, "session is already streaming")
+			return
+		}
+		if isSessionNotFound(err) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		// Another retry got to the failed turn first
+		if errors.Is(err, ErrMessageNotFound) {
+			writeError(w, http.StatusConflict, "no prompt to retry")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else {
+		defer h.queue.Notify(id)
+	}
+
+	// Serialize prompts across sessions that share a working directory. A
+	// concurrent session's own prompts share its hold on the lock.
+	if h.opts.LockWorkdir {
+		dir := resolveWorkDir(h.sessionWorkDir(session))
+
+		holder, ok := h.workdirs.TryLock(dir, id)
+		if !ok {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			resp := map[string]any{
+				"error":      "working directory is in use by another session",
+				"code":       "workdir_busy",
+				"session_id": holder,
+			}
+			if stream != nil {
+				resp["terminal"] = true
+				data, _ := json.Marshal(resp)
+				stream.send("error", data)
+				return
+			}
+			writeJSON(w, http.StatusConflict, resp)
+			return
+		}
+		defer h.workdirs.Unlock(dir)
+	}
+
+	// Wait for a slot under MaxConcurrentPrompts, on an open stream so the
+	// client hears that it is waiting
+	if !h.slots.TryAcquire(id) {
+		if stream == nil {
+			if stream = h.openStream(w, r, format, events); stream == nil {
+				h.repo.EndPrompt(id, StreamStatusIdle)
+				writeError(w, http.StatusInternalServerError, "streaming not supported")
+				return
+			}
+			defer stream.close()
+		}
+		if err := h.waitForSlot(r.Context(), stream, id, promptID); err != nil {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			return
+		}
+	}
+	defer h.slots.Release(id)
+
+	claudePrompt := h.claudePrompt(session, req.Prompt)
+
+	// Save user message
+	userMsg, err := h.repo.CreateMessage(id, "user", req.Prompt, nil)
+	if err != nil {
+		h.repo.EndPrompt(id, StreamStatusIdle)
+		if stream != nil {
+			data, _ := json.Marshal(PromptErrorEvent{Error: err.Error(), Terminal: true})
+			stream.send("error", data)
+			return
+		}
+		if isSessionNotFound(err) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(attachmentInfos) > 0 {
+		if err := h.repo.SetMessageAttachments(userMsg.ID, attachmentInfos); err != nil {
+			log.Printf("Warning: failed to record attachments for session %s: %v", id, err)
+		}
+	}
+	if mode.continuation {
+		if err := h.repo.MarkMessageContinuation(userMsg.ID); err != nil {
+			log.Printf("Warning: failed to mark continuation for session %s: %v", id, err)
+		}
+	}
+
+	if stream == nil {
+		stream = h.openStream(w, r, format, events)
+		if stream == nil {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			writeError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		defer stream.close()
+	}
+
+	// Kept so a retry of the prompt is sent the same way, or refused if it
+	// can't be; the label is recorded with the connected event
+	if req.Priority != PriorityNormal || timeout > 0 || req.RawArgs != nil {
+		if err := h.repo.SetPromptSettings(id, promptID, req.Priority, timeout, req.RawArgs != nil); err != nil {
+			log.Printf("Warning: failed to save settings for prompt %s: %v", promptID, err)
+		}
+	}
+
+	if timeout == 0 {
+		timeout = h.sessionPromptTimeout(session)
+	}
+	outcome, _ := h.runPrompt(r.Context(), promptRun{
+		session:      session,
+		promptID:     promptID,
+		concurrent:   concurrent,
+		prompt:       req.Prompt,
+		claudePrompt: claudePrompt,
+		label:        req.Label,
+		timeout:      timeout,
+		opts:         h.promptOptions(session, systemPrompt, req.RawArgs, images, concurrentPromptID(concurrent, promptID)),
+		// A text-only client gets text events even when they're disabled
+		textEvents: h.opts.TextEvents || events == StreamEventsText,
+		send:       stream.send,
+	})
+	if outcome != nil {
+		stream.send(outcome.EventType, outcome.EventData)
+	}
+}
+
+// unanswerablePermissionMessage is sent to Claude when a permission request is
+// denied because the prompt's client has no way to answer it
+const unanswerablePermissionMessage = "Permission requests can't be answered for this prompt"
+
+// promptRun is a prompt ready for runPrompt: it holds its session, and its
+// user message is saved.
+type promptRun struct {
+	session      *Session
+	promptID     string
+	concurrent   bool
+	prompt       string // the user's prompt, as saved
+	claudePrompt string // the text Claude receives
+	label        string
+	timeout      time.Duration
+	opts         PromptOptions
+	textEvents   bool // send text events as the reply grows
+
+	// send, when set, delivers each event to the client once it's persisted;
+	// Claude's own events arrive as "claude" with the CLI's raw line
+	send func(eventType string, data []byte) error
+	// onText, when set, is called with each new piece of the reply's text
+	onText func(delta string) error
+	// denyPermissions denies permission requests as they arrive, for clients
+	// with no way to answer them
+	denyPermissions bool
+}
+
+// runPrompt runs a prompt through Claude, persisting its events and sending
+// them on, and records how it ended. The outcome carries the final event for
+// the client; it is nil, with the prompt already ended, when the client went
+// away before Claude started. The error is Claude's, as disconnectErr reports it.
+func (h *Handlers) runPrompt(ctx context.Context, run promptRun) (*PromptOutcome, error) {
+	id, promptID := run.session.ID, run.promptID
+
+	// Consecutive identical error events collapse into the first one persisted
+	var lastError []byte
+	var lastErrorSeq int64
+	var errorCount int
+
+	send := func(eventType string, data []byte) error {
+		if run.send == nil {
+			return nil
+		}
+		return run.send(eventType, data)
+	}
 
-	// Helper to persist and send SSE events
+	// Helper to persist and send events
 	sendEvent := func(eventType string, data any) error {
 		jsonData, err := json.Marshal(data)
 		if err != nil {
 			return err
 		}
 
+		if eventType == "error" && lastError != nil && bytes.Equal(jsonData, lastError) {
+			errorCount++
+			collapsed, err := withCount(jsonData, errorCount)
+			if err != nil {
+				return err
+			}
+			if err := h.repo.UpdateEventData(id, promptID, lastErrorSeq, collapsed); err != nil {
+				log.Printf("Warning: failed to update collapsed error event for session %s: %v", id, err)
+			}
+			return send(eventType, collapsed)
+		}
+		lastError = nil
+
 		// Persist the event first
-		if _, err := h.repo.CreateEvent(id, promptID, eventType, jsonData); err != nil {
+		event, err := h.repo.CreateEvent(id, promptID, eventType, jsonData)
+		if err != nil {
 			log.Printf("Warning: failed to persist event for session %s: %v", id, err)
 			// Continue even if persistence fails - client should still get the event
 		}
+		if eventType == "error" && h.opts.CollapseErrors && event != nil {
+			lastError, lastErrorSeq, errorCount = jsonData, event.Sequence, 1
+		}
 
-		// Send to client
-		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, jsonData)
-		if err != nil {
-			return err
+		return send(eventType, jsonData)
+	}
+
+	// Send initial connected event with prompt_id for reconnection
+	connected := map[string]string{"session_id": id, "prompt_id": promptID}
+	if run.label != "" {
+		if err := h.repo.SetPromptLabel(id, promptID, run.label); err != nil {
+			log.Printf("Warning: failed to save label for prompt %s: %v", promptID, err)
 		}
-		flusher.Flush()
-		return nil
+		connected["label"] = run.label
+	}
+	if err := sendEvent("connected", connected); err != nil {
+		log.Printf("Failed to send connected event: %v", err)
+		h.repo.EndPrompt(id, StreamStatusIdle)
+		return nil, err
+	}
+
+	// The user's side of the turn, so a client replaying events alone can
+	// render the whole exchange. It always follows connected as sequence 2.
+	if err := sendEvent("user_prompt", map[string]string{"prompt": run.prompt}); err != nil {
+		log.Printf("Failed to send user_prompt event: %v", err)
+		h.repo.EndPrompt(id, StreamStatusIdle)
+		return nil, err
+	}
+
+	log.Printf("Starting Claude CLI for session %s, prompt %s", id, promptID)
+	h.opts.Webhooks.Send(WebhookPromptStarted, id, promptID, nil)
+
+	// Accumulate assistant content for saving
+	var reply promptAccumulator
+
+	runCtx, cancel := context.WithTimeout(ctx, run.timeout)
+	defer cancel()
+	defer h.killOnDisconnect(ctx, id, concurrentPromptID(run.concurrent, promptID))()
+
+	// A permission request nobody answered was denied so Claude can move on;
+	// tell the client why the tool didn't run
+	run.opts.OnPermissionTimeout = func(pending *PendingRequest) {
+		if err := sendEvent("permission_timeout", map[string]any{
+			"request_id": pending.RequestID,
+			"tool_name":  pending.ToolName,
+			"decision":   "deny",
+		}); err != nil {
+			log.Printf("Warning: failed to send permission_timeout event for session %s: %v", id, err)
+		}
+	}
+
+	// Run prompt with streaming
+	claudeSessionID, runErr := h.claude.RunPrompt(
+		runCtx,
+		id,
+		run.session.ClaudeSessionID,
+		run.claudePrompt,
+		run.opts,
+		func(line []byte) error {
+			// Parse event type
+			var event ClaudeEvent
+			if err := json.Unmarshal(line, &event); err != nil {
+				return sendEvent("error", map[string]string{"error": "invalid JSON from Claude"})
+			}
+
+			// Persist and forward the raw event directly (bypassing sendEvent helper).
+			// We bypass sendEvent because claude events arrive as raw JSON from the CLI,
+			// and sendEvent would re-marshal them, causing double-encoding. Instead, we
+			// persist and write the raw JSON line directly.
+			lastError = nil
+			if h.opts.PersistEventTypes.Allows(event.Type) {
+				if _, err := h.repo.CreateEvent(id, promptID, "claude", line); err != nil {
+					log.Printf("Warning: failed to persist claude event for session %s: %v", id, err)
+				}
+			}
+
+			// Debug: log event type being forwarded
+			log.Printf("Forwarding claude event type=%s, len=%d", event.Type, len(line))
+
+			// Send raw JSON to client (no re-marshaling needed)
+			if err := send("claude", line); err != nil {
+				return err
+			}
+
+			// Accumulate content for assistant message
+			before, beforeThinking := len(reply.text()), len(reply.thinkingText())
+			reply.addClaudeEvent(event.Type, line)
+			if delta := reply.text()[before:]; delta != "" {
+				if run.textEvents {
+					if err := sendEvent("text", map[string]string{"text": delta}); err != nil {
+						return err
+					}
+				}
+				if run.onText != nil {
+					if err := run.onText(delta); err != nil {
+						return err
+					}
+				}
+			}
+			if h.opts.ThinkingEvents {
+				if delta := reply.thinkingText()[beforeThinking:]; delta != "" {
+					if err := sendEvent("thinking", map[string]string{"thinking": delta}); err != nil {
+						return err
+					}
+				}
+			}
+
+			if h.opts.ToolEvents {
+				calls, results := toolActivity(event.Type, line)
+				for _, call := range calls {
+					if err := sendEvent("tool_call", call); err != nil {
+						return err
+					}
+				}
+				for _, result := range results {
+					if err := sendEvent("tool_result", result); err != nil {
+						return err
+					}
+				}
+			}
+
+			// The runner stores control_requests for Approve; tell the client a
+			// decision is needed without making it parse Claude's schema
+			if event.Type == "control_request" {
+				var ctrlReq ControlRequest
+				if err := json.Unmarshal(line, &ctrlReq); err == nil && ctrlReq.Request.Subtype == "can_use_tool" {
+					permission := map[string]any{
+						"request_id": ctrlReq.RequestID,
+						"tool_name":  ctrlReq.Request.ToolName,
+						"input":      ctrlReq.Request.Input,
+					}
+					if run.denyPermissions {
+						if err := h.claude.SendPermissionResponse(id, ctrlReq.RequestID, "deny", unanswerablePermissionMessage, false); err != nil {
+							log.Printf("Warning: failed to deny permission request %s for session %s: %v", ctrlReq.RequestID, id, err)
+						}
+						permission["decision"] = "deny"
+						return sendEvent("permission_denied", permission)
+					}
+					h.opts.Webhooks.Send(WebhookPermissionRequested, id, promptID, permission)
+					if err := sendEvent("permission_request", permission); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		},
+	)
+
+	log.Printf("Claude CLI finished for session %s, claudeSessionID=%s, err=%v", id, claudeSessionID, runErr)
+	runErr = disconnectErr(ctx, runErr)
+
+	outcome := h.finalizePrompt(id, promptID, &reply, claudeSessionID, runErr)
+	return &outcome, runErr
+}
+
+// ErrClientDisconnected is a prompt's error when its client went away mid-stream
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// ErrStreamDurationExceeded is a prompt's error when its stream was open for
+// MaxStreamDuration
+var ErrStreamDurationExceeded = errors.New("stream exceeded its maximum duration")
+
+// killOnDisconnect kills a prompt's Claude process as soon as the client's
+// request context ends, rather than when the next write to the client fails,
+// so nobody pays for output no one reads. Killing through the manager also
+// drops the prompt's pending permission requests. processPromptID is the
+// prompt's key in the manager ("" for single-flight sessions). Returns a
+// function that stops watching.
+func (h *Handlers) killOnDisconnect(ctx context.Context, sessionID, processPromptID string) func() bool {
+	return context.AfterFunc(ctx, func() {
+		if errors.Is(context.Cause(ctx), ErrStreamDurationExceeded) {
+			log.Printf("Stream for session %s reached its maximum duration, stopping Claude", sessionID)
+		} else {
+			log.Printf("Client disconnected from session %s, stopping Claude", sessionID)
+		}
+		h.claude.KillPrompt(sessionID, processPromptID)
+	})
+}
+
+// disconnectErr reports a prompt that failed because its client disconnected
+// as ErrClientDisconnected, and one cut off by MaxStreamDuration as
+// ErrStreamDurationExceeded.
+func disconnectErr(ctx context.Context, runErr error) error {
+	if runErr == nil || errors.Is(runErr, ErrPromptCancelled) {
+		return runErr
+	}
+	if errors.Is(context.Cause(ctx), ErrStreamDurationExceeded) {
+		return ErrStreamDurationExceeded
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ErrClientDisconnected
+	}
+	return runErr
+}
+
+// Codes in a failed prompt's error event, telling clients why it was cut off
+// and so whether retrying may help
+const (
+	PromptErrorTimeout     = "timeout"      // the prompt ran past its timeout, or its stream past MaxStreamDuration
+	PromptErrorCancelled   = "cancelled"    // the client went away or the prompt was cancelled
+	PromptErrorInterrupted = "interrupted"  // Claude was killed, e.g. by an admin kill or shutdown
+	PromptErrorClaudeError = "claude_error" // Claude failed: missing CLI, non-zero exit, unreadable output
+)
+
+// promptErrorCode classifies a RunPrompt error for the error event
+func promptErrorCode(runErr error) string {
+	var exitErr *ClaudeExitError
+	switch {
+	case errors.Is(runErr, ErrClaudeTimeout), errors.Is(runErr, context.DeadlineExceeded), errors.Is(runErr, ErrStreamDurationExceeded):
+		return PromptErrorTimeout
+	case errors.Is(runErr, ErrClientDisconnected), errors.Is(runErr, ErrPromptCancelled), errors.Is(runErr, context.Canceled):
+		return PromptErrorCancelled
+	case errors.As(runErr, &exitErr) && exitErr.Code < 0:
+		// Exit code -1 means a signal ended the process rather than Claude itself
+		return PromptErrorInterrupted
+	default:
+		return PromptErrorClaudeError
+	}
+}
+
+// checkPromptText expands a prompt sent with variables and checks the result
+// isn't empty, recording problems on v. Only prompts sent with variables are
+// templates, so a literal "{{" in a plain prompt is left alone. The expanded
+// prompt is what Claude sees and what is saved as the user message. It
+// reports whether the prompt is larger than MaxPromptBytes, expanded or not,
+// which callers answer with 413 once the request is otherwise valid.
+func (h *Handlers) checkPromptText(req *PromptRequest, v *validator) (tooLarge bool) {
+	if req.Variables != nil {
+		expanded, err := expandPrompt(req.Prompt, req.Variables, !h.opts.LenientTemplates, h.opts.MaxPromptBytes)
+		switch {
+		case errors.Is(err, errExpandedPromptTooLarge):
+			return true
+		case err != nil:
+			v.fail("variables", err.Error())
+		default:
+			req.Prompt = expanded
+		}
+	}
+	if v.valid() {
+		v.check(strings.TrimSpace(req.Prompt) != "", "prompt", "required")
+	}
+	return h.opts.MaxPromptBytes > 0 && len(req.Prompt) > h.opts.MaxPromptBytes
+}
+
+// allowArgs checks that a request sending Claude CLI args in field (raw_args
+// on a prompt, extra_args on a session) may do so, writing a 403 or 401 when
+// it may not. Requests without args are always allowed.
+func (h *Handlers) allowArgs(w http.ResponseWriter, r *http.Request, field string, args []string) bool {
+	if args == nil {
+		return true
+	}
+	return h.allowTrusted(w, r, field)
+}
+
+// allowTrusted reports whether r may use a setting reserved for trusted
+// callers: the server must allow raw args and r must carry the auth token.
+// Otherwise it writes 403 or 401 and returns false.
+func (h *Handlers) allowTrusted(w http.ResponseWriter, r *http.Request, field string) bool {
+	if !h.opts.AllowRawArgs {
+		writeError(w, http.StatusForbidden, field+" not allowed")
+		return false
+	}
+	if !hasBearerToken(r, h.opts.AuthToken) {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+// claudePrompt returns the prompt text Claude receives. A fork's history was
+// copied without its Claude session, so it is inlined ahead of the prompt
+// until the fork has a Claude session of its own.
+func (h *Handlers) claudePrompt(session *Session, prompt string) string {
+	if session.ForkedFrom == nil || session.ClaudeSessionID != nil {
+		return prompt
+	}
+	history, err := h.repo.GetSessionMessages(session.ID)
+	if err != nil {
+		log.Printf("Warning: failed to load history for forked session %s: %v", session.ID, err)
+	}
+	return forkPrompt(history, prompt)
+}
+
+// promptOptions builds the Claude run options for a prompt on session.
+func (h *Handlers) promptOptions(session *Session, systemPrompt string, rawArgs []string, images []ImageSource, promptID string) PromptOptions {
+	return PromptOptions{
+		WorkingDir:     session.WorkingDirectory,
+		ClaudeCmd:      h.claudeCmd(session),
+		PermissionMode: h.permissionMode(session),
+		SystemPrompt:   systemPrompt,
+		Env:            h.opts.EnvPolicy.Filter(session.Env),
+		ExtraArgs:      h.extraArgs(session),
+		RawArgs:        rawArgs,
+		Images:         images,
+		PromptID:       promptID,
+	}
+}
+
+// claudeCmd returns the session's command override if the allowlist still
+// permits it, so removing a command from the list applies to existing
+// sessions. Otherwise prompts fall back to the server's command.
+func (h *Handlers) claudeCmd(session *Session) string {
+	if session.ClaudeCmd == nil || *session.ClaudeCmd == "" {
+		return ""
+	}
+	if !h.opts.ClaudeCmdAllow.Allows(*session.ClaudeCmd) {
+		log.Printf("Warning: session %s claude_cmd %q is no longer allowed, using the server's command", session.ID, *session.ClaudeCmd)
+		return ""
+	}
+	return *session.ClaudeCmd
+}
+
+// extraArgs returns the session's extra Claude CLI args while the server
+// still allows them, so turning off AllowRawArgs applies to existing sessions.
+func (h *Handlers) extraArgs(session *Session) []string {
+	if len(session.ExtraArgs) == 0 {
+		return nil
+	}
+	if !h.opts.AllowRawArgs {
+		log.Printf("Warning: session %s extra_args are no longer allowed, ignoring them", session.ID)
+		return nil
+	}
+	return session.ExtraArgs
+}
+
+// permissionMode returns the session's permission mode, dropping
+// bypassPermissions once AllowRawArgs is off, as extraArgs does for args.
+func (h *Handlers) permissionMode(session *Session) *string {
+	if session.PermissionMode != nil && *session.PermissionMode == PermissionModeBypass && !h.opts.AllowRawArgs {
+		log.Printf("Warning: session %s permission_mode %s is no longer allowed, ignoring it", session.ID, PermissionModeBypass)
+		return nil
+	}
+	return session.PermissionMode
+}
+
+// argValue returns the value of the last --name flag in args, written either
+// as "--name value" or "--name=value", or "" if it isn't there.
+func argValue(args []string, name string) string {
+	var value string
+	for i, arg := range args {
+		if arg == name && i+1 < len(args) {
+			value = args[i+1]
+		} else if v, ok := strings.CutPrefix(arg, name+"="); ok {
+			value = v
+		}
+	}
+	return value
+}
+
+// PromptPreflight handles POST /api/sessions/{id}/prompt/preflight. It
+// validates a prompt request like Prompt and returns the Claude command it
+// would run (args, working directory, model, system prompt) and the prompt
+// text Claude would receive, without starting anything or taking the session.
+func (h *Handlers) PromptPreflight(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	var req PromptRequest
+	if err := parseJSON(w, r, &req, h.promptBodyLimit()); err != nil {
+		writeParseError(w, err)
+		return
+	}
+
+	var v validator
+	tooLarge := h.checkPromptText(&req, &v)
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = h.parsePromptTimeout(req.Timeout); err != nil {
+			v.fail("timeout", err.Error())
+		}
+	}
+	if !v.valid() {
+		v.write(w)
+		return
+	}
+
+	if tooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("prompt exceeds %d bytes", h.opts.MaxPromptBytes))
+		return
+	}
+	if !h.allowArgs(w, r, "raw_args", req.RawArgs) {
+		return
+	}
+
+	session, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	systemPrompt, err := h.repo.GetSystemPrompt(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if timeout == 0 {
+		timeout = h.sessionPromptTimeout(session)
+	}
+	cmd := h.claude.Command(session.ClaudeSessionID, h.promptOptions(session, systemPrompt, req.RawArgs, nil, ""))
+	writeJSON(w, http.StatusOK, PreflightResponse{
+		ClaudeCommand:   cmd,
+		Model:           argValue(cmd.Args, "--model"),
+		PermissionMode:  h.permissionMode(session),
+		SystemPrompt:    systemPrompt,
+		ResumeSessionID: session.ClaudeSessionID,
+		Prompt:          h.claudePrompt(session, req.Prompt),
+		Timeout:         timeout.String(),
+	})
+}
+
+// RetryFailed re-runs a session's last prompt when it ended in an error, with
+// the label, priority, timeout and continuation flag it was sent with. It
+// streams exactly as from POST .../prompt, and the failed turn, its user
+// message and any partial reply, is removed as the retry starts, so the
+// transcript keeps a single copy of it. If the last prompt didn't fail there
+// is nothing to retry and the request gets 409.
+func (h *Handlers) RetryFailed(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	session, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session.StreamStatus == StreamStatusStreaming {
+		writeError(w, http.StatusConflict, "session is already streaming")
+		return
+	}
+
+	terminal, err := h.repo.GetLastPromptTerminalEvent(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if terminal != "error" {
+		writeError(w, http.StatusConflict, "last prompt did not fail")
+		return
+	}
+
+	messages, err := h.repo.GetSessionMessages(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var failed *Message
+	for i := len(messages) - 1; i >= 0 && failed == nil; i-- {
+		if messages[i].Role == "user" {
+			failed = &messages[i]
+		}
+	}
+	if failed == nil {
+		writeError(w, http.StatusConflict, "no prompt to retry")
+		return
+	}
+	// Only attachment metadata is stored, so the images can't be sent again
+	if len(failed.Attachments) > 0 {
+		writeError(w, http.StatusConflict, "failed prompt had attachments; send it again with them")
+		return
+	}
+
+	// Send it again as it was sent. A timeout above a since-lowered cap is
+	// clamped to the cap.
+	settings, err := h.repo.GetPromptSettings(id, session.LastPromptID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Raw args aren't stored, as they may carry secrets, so they can't be
+	// sent again either
+	if settings.RawArgs {
+		writeError(w, http.StatusConflict, "failed prompt had raw_args; send it again with them")
+		return
+	}
+	retryReq := PromptRequest{Prompt: failed.Content, Label: settings.Label, Priority: settings.Priority}
+	if settings.Timeout > 0 && h.opts.MaxPromptTimeout > 0 {
+		retryReq.Timeout = min(settings.Timeout, h.opts.MaxPromptTimeout).String()
+	}
+	log.Printf("Retrying failed prompt for session %s", id)
+
+	// The failed turn is deleted only once the retry has started, so a retry
+	// that is rejected leaves it in place
+	body, _ := json.Marshal(retryReq)
+	retry := r.Clone(r.Context())
+	retry.Body = io.NopCloser(bytes.NewReader(body))
+	retry.ContentLength = int64(len(body))
+	retry.Header.Set("Content-Type", "application/json")
+	h.prompt(w, retry, promptMode{continuation: failed.Continuation, retryOf: failed.ID})
+}
+
+// continuationPrompt is sent to Claude to pick up where its last reply
+// stopped, e.g. after hitting the output token limit.
+const continuationPrompt = "continue"
+
+// Continue asks Claude to keep going from where its last reply stopped by
+// sending a continuation prompt, streamed like any other prompt. The session
+// needs a Claude session to resume, or a fork's copied history, so there is
+// something to continue; otherwise it gets 409.
+func (h *Handlers) Continue(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+
+	session, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session.ClaudeSessionID == nil && session.ForkedFrom == nil {
+		writeError(w, http.StatusConflict, "nothing to continue")
+		return
+	}
+
+	body, _ := json.Marshal(PromptRequest{Prompt: continuationPrompt})
+	cont := r.Clone(r.Context())
+	cont.Body = io.NopCloser(bytes.NewReader(body))
+	cont.ContentLength = int64(len(body))
+	cont.Header.Set("Content-Type", "application/json")
+	h.prompt(w, cont, promptMode{continuation: true})
+}
+
+// concurrentPromptID returns the prompt ID that keys a concurrent prompt's
+// Claude process, or "" for single-flight sessions.
+func concurrentPromptID(concurrent bool, promptID string) string {
+	if !concurrent {
+		return ""
+	}
+	return promptID
+}
+
+// finalizePrompt records how a prompt turn ended: the assistant reply (flagged
+// truncated when the prompt was cancelled mid-reply), the final done, error or
+// cancelled event, and the session's stream status are committed together.
+// The returned outcome carries the final event for the client.
+func (h *Handlers) finalizePrompt(sessionID, promptID string, reply *promptAccumulator, claudeSessionID string, runErr error) PromptOutcome {
+	outcome := PromptOutcome{
+		Reply:           reply.text(),
+		ToolCalls:       reply.toolCallsJSON(),
+		Blocks:          reply.blocksJSON(),
+		ClaudeSessionID: claudeSessionID,
+		Usage:           reply.usage(),
+	}
+	if h.opts.PersistThinking {
+		outcome.Thinking = reply.thinkingText()
+	}
+
+	var data any
+	var webhook string
+	switch {
+	case errors.Is(runErr, ErrPromptCancelled):
+		h.saveSnapshot(sessionID, promptID, reply, PromptStatusCancelled, "")
+		outcome.Truncated = true
+		outcome.EventType, data = "cancelled", map[string]string{"status": "cancelled"}
+		outcome.Status = StreamStatusIdle
+		webhook = WebhookPromptCancelled
+	case runErr != nil:
+		errEvent := PromptErrorEvent{Error: runErr.Error(), Code: promptErrorCode(runErr), Terminal: true}
+		var exitErr *ClaudeExitError
+		if errors.As(runErr, &exitErr) {
+			errEvent.ExitCode, errEvent.ExitSignal = &exitErr.Code, exitErr.Signal
+			log.Printf("Claude CLI error for session %s: exit_code=%d signal=%q: %v", sessionID, exitErr.Code, exitErr.Signal, runErr)
+		} else {
+			log.Printf("Claude CLI error: %v", runErr)
+		}
+		h.saveSnapshot(sessionID, promptID, reply, PromptStatusError, runErr.Error())
+		outcome.EventType, data = "error", errEvent
+		outcome.Status = StreamStatusIdle
+		webhook = WebhookPromptFailed
+	default:
+		h.saveSnapshot(sessionID, promptID, reply, PromptStatusComplete, "")
+		outcome.EventType, data = "done", reply.doneEvent()
+		outcome.Status = StreamStatusCompleted
+		webhook = WebhookPromptCompleted
+	}
+	outcome.EventData, _ = json.Marshal(data)
+	h.opts.Webhooks.Send(webhook, sessionID, promptID, data)
+
+	if _, _, err := h.repo.FinalizePrompt(sessionID, promptID, outcome); err != nil {
+		log.Printf("Warning: failed to finalize prompt %s for session %s: %v", promptID, sessionID, err)
+		h.repo.EndPrompt(sessionID, StreamStatusIdle)
+	}
+	return outcome
+}
+
+// parsePromptTimeout reads a requested prompt timeout, rejecting values that
+// aren't positive durations or exceed MaxPromptTimeout, and every value when
+// MaxPromptTimeout is zero
+func (h *Handlers) parsePromptTimeout(v string) (time.Duration, error) {
+	if h.opts.MaxPromptTimeout <= 0 {
+		return 0, errors.New("per-prompt timeout overrides are disabled")
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New(`must be a positive duration such as "30m"`)
+	}
+	if timeout > h.opts.MaxPromptTimeout {
+		return 0, fmt.Errorf("exceeds the maximum of %s", h.opts.MaxPromptTimeout)
+	}
+	return timeout, nil
+}
+
+// sessionPromptTimeout returns the timeout for a session's prompts: its own
+// override, clamped to MaxPromptTimeout in case the cap was lowered since the
+// session was created, or the server default when it has none or overrides
+// have been disabled.
+func (h *Handlers) sessionPromptTimeout(session *Session) time.Duration {
+	if session.PromptTimeoutMS <= 0 || h.opts.MaxPromptTimeout <= 0 {
+		return h.promptTimeout
+	}
+	return min(time.Duration(session.PromptTimeoutMS)*time.Millisecond, h.opts.MaxPromptTimeout)
+}
+
+// checkWorkDir makes sure a new session's working directory exists, creating
+// it when create is set, so a bad path fails at creation rather than as a
+// chdir error on the first prompt.
+func checkWorkDir(dir string, create bool) error {
+	info, err := os.Stat(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		if !create {
+			return fmt.Errorf("working directory does not exist: %s", dir)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("cannot create working directory: %v", err)
+		}
+		log.Printf("Created working directory %s", dir)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot access working directory: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("working directory is not a directory: %s", dir)
+	}
+	return nil
+}
+
+// sessionWorkDir returns the directory a session's prompts run in
+func (h *Handlers) sessionWorkDir(session *Session) string {
+	if session.WorkingDirectory != nil && *session.WorkingDirectory != "" {
+		return *session.WorkingDirectory
+	}
+	return h.opts.WorkDir
+}
+
+// saveSnapshot persists a finished prompt's reply and outcome when snapshots are enabled
+func (h *Handlers) saveSnapshot(sessionID, promptID string, reply *promptAccumulator, status PromptStatus, errMsg string) {
+	if !h.opts.PersistSnapshots {
+		return
+	}
+	snap := &PromptSnapshot{
+		PromptID:  promptID,
+		SessionID: sessionID,
+		Status:    status,
+		Text:      reply.text(),
+		ToolCalls: reply.toolCallsJSON(),
+		Result:    reply.result,
+		Error:     errMsg,
+		CreatedAt: time.Now(),
+	}
+	if err := h.repo.SavePromptSnapshot(snap); err != nil {
+		log.Printf("Warning: failed to save snapshot for prompt %s: %v", promptID, err)
+	}
+}
+
+// GetPromptSnapshot returns the snapshot saved when a prompt finished
+func (h *Handlers) GetPromptSnapshot(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	promptID := chi.URLParam(r, "promptId")
+	if id == "" || promptID == "" {
+		writeError(w, http.StatusBadRequest, "missing session or prompt id")
+		return
+	}
+
+	snap, err := h.repo.GetPromptSnapshot(id, promptID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "snapshot not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// Bookmark size limits
+const (
+	maxBookmarkClientIDBytes = 255
+	maxBookmarkCursorBytes   = 4096
+)
+
+// bookmarkClientID reads the optional ?client_id= that keeps bookmarks of
+// several clients of one session apart.
+func bookmarkClientID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	clientID := r.URL.Query().Get("client_id")
+	if len(clientID) > maxBookmarkClientIDBytes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("client_id exceeds %d bytes", maxBookmarkClientIDBytes))
+		return "", false
+	}
+	return clientID, true
+}
+
+// SetBookmark saves where a client left off reading a session's events, so a
+// client that lost its own state can resume with GetEvents from there
+func (h *Handlers) SetBookmark(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+	clientID, ok := bookmarkClientID(w, r)
+	if !ok {
+		return
+	}
+
+	var req BookmarkRequest
+	if err := parseJSON(w, r, &req, maxRequestBodyBytes); err != nil {
+		writeParseError(w, err)
+		return
+	}
+	var v validator
+	v.check(req.Sequence != nil || req.Cursor != "", "sequence", "sequence or cursor is required")
+	v.check(req.Sequence == nil || *req.Sequence >= 0, "sequence", "must not be negative")
+	v.check(req.PromptID == "" || req.Sequence != nil, "prompt_id", "requires sequence")
+	v.check(len(req.Cursor) <= maxBookmarkCursorBytes, "cursor", fmt.Sprintf("exceeds %d bytes", maxBookmarkCursorBytes))
+	if !v.valid() {
+		v.write(w)
+		return
+	}
+
+	if _, err := h.repo.GetSession(id); isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	bookmark := &ClientBookmark{
+		SessionID: id,
+		ClientID:  clientID,
+		PromptID:  req.PromptID,
+		Sequence:  req.Sequence,
+		Cursor:    req.Cursor,
+	}
+	if err := h.repo.SetClientBookmark(bookmark); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+	writeJSON(w, http.StatusOK, bookmark)
+}
 
-	// Send initial connected event with prompt_id for reconnection
-	if err := sendEvent("connected", map[string]string{"session_id": id, "prompt_id": promptID}); err != nil {
-		log.Printf("Failed to send connected event: %v", err)
-		h.repo.UpdateSessionStreamStatus(id, StreamStatusIdle)
+// GetBookmark returns the reading position a client saved with SetBookmark
+func (h *Handlers) GetBookmark(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+	clientID, ok := bookmarkClientID(w, r)
+	if !ok {
 		return
 	}
 
-	log.Printf("Starting Claude CLI for session %s, prompt %s", id, promptID)
-
-	// Accumulate assistant content for saving
-	var assistantContent strings.Builder
-	var toolCalls []json.RawMessage
-
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(r.Context(), h.promptTimeout)
-	defer cancel()
-
-	// Run prompt with streaming
-	claudeSessionID, runErr := h.claude.RunPrompt(
-		ctx,
-		id,
-		session.ClaudeSessionID,
-		req.Prompt,
-		session.WorkingDirectory,
-		func(line []byte) error {
-			// Parse event type
-			var event ClaudeEvent
-			if err := json.Unmarshal(line, &event); err != nil {
-				return sendEvent("error", map[string]string{"error": "invalid JSON from Claude"})
-			}
+	if _, err := h.repo.GetSession(id); isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-			// Persist and forward the raw event directly (bypassing sendEvent helper).
-			// We bypass sendEvent because claude events arrive as raw JSON from the CLI,
-			// and sendEvent would re-marshal them, causing double-encoding. Instead, we
-			// persist and write the raw JSON line directly.
-			if _, err := h.repo.CreateEvent(id, promptID, "claude", line); err != nil {
-				log.Printf("Warning: failed to persist claude event for session %s: %v", id, err)
-			}
+	bookmark, err := h.repo.GetClientBookmark(id, clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "bookmark not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, bookmark)
+}
 
-			// Debug: log event type being forwarded
-			log.Printf("Forwarding claude event type=%s, len=%d", event.Type, len(line))
+// GetSessionStats reports the cost and token usage of a session's prompts
+func (h *Handlers) GetSessionStats(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
 
-			// Send raw JSON to client (no re-marshaling needed)
-			_, writeErr := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", "claude", line)
-			if writeErr != nil {
-				return writeErr
-			}
-			flusher.Flush()
-
-			// Accumulate content for assistant message and track control_requests
-			switch event.Type {
-			case "assistant":
-				var msg AssistantMessage
-				if err := json.Unmarshal(line, &msg); err == nil {
-					for _, block := range msg.Message.Content {
-						if block.Type == "text" {
-							assistantContent.WriteString(block.Text)
-						} else if block.Type == "tool_use" {
-							toolCalls = append(toolCalls, line)
-						}
-					}
-				}
-			case "content_block_delta":
-				var delta ContentBlockDelta
-				if err := json.Unmarshal(line, &delta); err == nil {
-					if delta.Delta.Type == "text_delta" {
-						assistantContent.WriteString(delta.Delta.Text)
-					}
-				}
-			case "control_request":
-				// Parse control_request and store for later response
-				var ctrlReq struct {
-					RequestID string `json:"request_id"`
-					Request   struct {
-						Input map[string]any `json:"input"`
-					} `json:"request"`
-				}
-				if err := json.Unmarshal(line, &ctrlReq); err == nil {
-					log.Printf("Storing pending control_request: request_id=%s", ctrlReq.RequestID)
-					h.claude.StorePendingRequest(id, ctrlReq.RequestID, ctrlReq.Request.Input)
-				}
-			}
+	_, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
 
-			return nil
-		},
-	)
+	stats, err := h.repo.GetSessionStats(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
 
-	log.Printf("Claude CLI finished for session %s, claudeSessionID=%s, err=%v", id, claudeSessionID, runErr)
+// Cancel aborts the running prompt for a session, including one that is paused
+// waiting on a permission decision. The prompt's SSE stream emits a "cancelled"
+// event and the session returns to idle.
+func (h *Handlers) Cancel(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
 
-	// Save assistant message if we got content
-	if assistantContent.Len() > 0 {
-		var toolCallsJSON json.RawMessage
-		if len(toolCalls) > 0 {
-			data, _ := json.Marshal(toolCalls)
-			toolCallsJSON = data
-		}
-		if _, err := h.repo.CreateMessage(id, "assistant", assistantContent.String(), toolCallsJSON); err != nil {
-			log.Printf("Warning: failed to save assistant message for session %s: %v", id, err)
-		}
+	_, err := h.repo.GetSession(id)
+	if isSessionNotFound(err) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	// Update Claude session ID if we got a new one
-	if claudeSessionID != "" && (session.ClaudeSessionID == nil || *session.ClaudeSessionID != claudeSessionID) {
-		if err := h.repo.UpdateSessionClaudeID(id, claudeSessionID); err != nil {
-			log.Printf("Warning: failed to update Claude session ID for session %s: %v", id, err)
+	// ?prompt_id= cancels one prompt of a concurrent session, leaving the rest
+	if promptID := r.URL.Query().Get("prompt_id"); promptID != "" {
+		if !h.claude.CancelPromptByID(id, promptID) {
+			writeError(w, http.StatusConflict, "prompt is not running")
+			return
 		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "cancelled", "queued_cancelled": 0})
+		return
 	}
 
-	// Handle errors and send final event
-	if runErr != nil {
-		log.Printf("Claude CLI error: %v", runErr)
-		sendEvent("error", map[string]string{"error": runErr.Error()})
-		h.repo.UpdateSessionStreamStatus(id, StreamStatusIdle)
+	// Cancel queued prompts first so none of them starts once the running one stops
+	queued := h.cancelQueue(id)
+	running := h.claude.CancelPrompt(id)
+	if !running && queued == 0 {
+		writeError(w, http.StatusConflict, "session has no running prompt")
 		return
 	}
 
-	sendEvent("done", map[string]string{"status": "complete"})
-	h.repo.UpdateSessionStreamStatus(id, StreamStatusCompleted)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "cancelled", "queued_cancelled": queued})
+}
+
+// cancelQueue cancels every prompt queued on a session, including persisted
+// ones with no live waiter. Each live waiter gets a cancelled event.
+// Returns the number of prompts cancelled.
+func (h *Handlers) cancelQueue(sessionID string) int {
+	waiters := h.queue.CancelAll(sessionID)
+	persisted, err := h.repo.CancelQueuedPrompts(sessionID)
+	if err != nil {
+		log.Printf("Warning: failed to cancel queued prompts for session %s: %v", sessionID, err)
+	}
+	return max(waiters, int(persisted))
 }
 
 func (h *Handlers) Approve(w http.ResponseWriter, r *http.Request) {
@@ -374,22 +2460,28 @@ func (h *Handlers) Approve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req ApproveRequest
-	if err := parseJSON(r, &req); err != nil {
-		writeError(w, http.StatusBadRequest, "invalid JSON")
-		return
-	}
-
-	if req.ToolUseID == "" {
-		writeError(w, http.StatusBadRequest, "tool_use_id is required")
+	if err := parseJSON(w, r, &req, maxRequestBodyBytes); err != nil {
+		writeParseError(w, err)
 		return
 	}
 
-	if req.Decision != "allow" && req.Decision != "deny" {
-		writeError(w, http.StatusBadRequest, "decision must be 'allow' or 'deny'")
+	var v validator
+	v.check(req.ToolUseID != "", "tool_use_id", "required")
+	v.check(req.Decision == "allow" || req.Decision == "deny", "decision", "must be 'allow' or 'deny'")
+	if !v.valid() {
+		v.write(w)
 		return
 	}
 
-	if err := h.claude.SendPermissionResponse(id, req.ToolUseID, req.Decision); err != nil {
+	if err := h.claude.SendPermissionResponse(id, req.ToolUseID, req.Decision, req.Message, req.Interrupt); err != nil {
+		if errors.Is(err, ErrPermissionRequestNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if errors.Is(err, ErrStdinWriteTimeout) {
+			writeError(w, http.StatusGatewayTimeout, err.Error())
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -403,6 +2495,8 @@ func (h *Handlers) Approve(w http.ResponseWriter, r *http.Request) {
 //   - since_sequence: Return events after this sequence number
 //   - prompt_id: Filter to specific prompt (recommended for catch-up)
 //   - limit: Max events to return (default 100, max 1000)
+//   - wait: If "true" and the session is streaming with no new events, block
+//     until events arrive or the stream ends, up to LongPollTimeout
 //
 // Note: For accurate catch-up after reconnection, specify prompt_id. Sequence
 // numbers are per-prompt, so omitting prompt_id may return events from multiple
@@ -418,6 +2512,12 @@ func (h *Handlers) GetEvents(w http.ResponseWriter, r *http.Request) {
 	sinceSeq, _ := strconv.ParseInt(r.URL.Query().Get("since_sequence"), 10, 64)
 	promptID := r.URL.Query().Get("prompt_id")
 
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "raw" && format != "summary" {
+		writeError(w, http.StatusBadRequest, "invalid format")
+		return
+	}
+
 	// Validate limit (default 100, max 1000)
 	limit := 100
 	if l := r.URL.Query().Get("limit"); l != "" {
@@ -432,22 +2532,52 @@ func (h *Handlers) GetEvents(w http.ResponseWriter, r *http.Request) {
 		limit = 1000
 	}
 
-	// Verify session exists
-	session, err := h.repo.GetSession(id)
-	if err == sql.ErrNoRows {
-		writeError(w, http.StatusNotFound, "session not found")
-		return
-	}
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+	// With wait=true, a request that finds nothing new while the session is
+	// streaming blocks until an event arrives, the stream ends or the timeout
+	wait := r.URL.Query().Get("wait") == "true" && h.opts.LongPollTimeout > 0
+	var deadline <-chan time.Time
+	if wait {
+		timer := time.NewTimer(h.opts.LongPollTimeout)
+		defer timer.Stop()
+		deadline = timer.C
 	}
 
-	// Fetch events (request limit+1 to detect has_more)
-	events, err := h.repo.GetEventsSince(id, sinceSeq, promptID, limit+1)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
-		return
+	var session *Session
+	var events []SessionEvent
+	for {
+		// Subscribe before reading so an event created in between still wakes us
+		changed := h.repo.EventsChanged(id)
+
+		// Verify session exists
+		var err error
+		session, err = h.repo.GetSession(id)
+		if isSessionNotFound(err) {
+			writeError(w, http.StatusNotFound, "session not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Fetch events (request limit+1 to detect has_more)
+		events, err = h.repo.GetEventsSince(id, sinceSeq, promptID, limit+1)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if !wait || len(events) > 0 || session.StreamStatus != StreamStatusStreaming {
+			break
+		}
+		select {
+		case <-changed:
+			continue
+		case <-deadline:
+		case <-r.Context().Done():
+			return
+		}
+		break
 	}
 
 	hasMore := len(events) > limit
@@ -455,8 +2585,9 @@ func (h *Handlers) GetEvents(w http.ResponseWriter, r *http.Request) {
 		events = events[:limit]
 	}
 
-	var lastSeq int64
+	var firstSeq, lastSeq int64
 	if len(events) > 0 {
+		firstSeq = events[0].Sequence
 		lastSeq = events[len(events)-1].Sequence
 	}
 
@@ -465,10 +2596,301 @@ func (h *Handlers) GetEvents(w http.ResponseWriter, r *http.Request) {
 		events = []SessionEvent{}
 	}
 
-	writeJSON(w, http.StatusOK, GetEventsResponse{
-		Events:       events,
-		LastSequence: lastSeq,
-		HasMore:      hasMore,
-		StreamStatus: session.StreamStatus,
+	if format == "summary" {
+		writeJSON(w, http.StatusOK, GetEventsSummaryResponse{
+			Prompts:      summarizeEvents(events),
+			LastSequence: lastSeq,
+			HasMore:      hasMore,
+			StreamStatus: session.StreamStatus,
+		})
+		return
+	}
+
+	resp := GetEventsResponse{
+		Events:        events,
+		FirstSequence: firstSeq,
+		LastSequence:  lastSeq,
+		HasMore:       hasMore,
+		StreamStatus:  session.StreamStatus,
+	}
+	if r.URL.Query().Get("include_total") == "true" {
+		total, err := h.repo.CountEventsSince(id, sinceSeq, promptID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.TotalPending = &total
+	}
+	// Events from all prompts come back interleaved by prompt, so say where
+	// each prompt's run starts and ends
+	if promptID == "" {
+		prompts, err := h.repo.GetPromptSummaries(id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		resp.Prompts = prompts
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// DeleteEvents purges the event log of one prompt (?prompt_id=), for privacy
+// or storage, while keeping the messages it produced. A prompt that is still
+// streaming is refused with 409.
+func (h *Handlers) DeleteEvents(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+	promptID := r.URL.Query().Get("prompt_id")
+	if promptID == "" {
+		writeError(w, http.StatusBadRequest, "missing prompt_id")
+		return
+	}
+
+	deleted, err := h.repo.DeleteEventsForPrompt(id, promptID)
+	if errors.Is(err, ErrSessionNotFound) {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if errors.Is(err, ErrPromptStreaming) {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+}
+
+// ListActive returns the sessions that currently have a running Claude process
+// along with how long each has been running.
+func (h *Handlers) ListActive(w http.ResponseWriter, r *http.Request) {
+	age, err := parseRunningLongerThan(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	active := h.claude.ListActiveOlderThan(age)
+
+	resp := make([]ActiveProcessResponse, 0, len(active))
+	for _, p := range active {
+		resp = append(resp, ActiveProcessResponse{
+			SessionID: p.SessionID,
+			PromptID:  p.PromptID,
+			StartedAt: p.StartedAt,
+			RunningMS: now.Sub(p.StartedAt).Milliseconds(),
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// StatsResponse is the admin stats endpoint's body: the Claude manager's
+// counters plus prompt stream connections by outcome
+type StatsResponse struct {
+	ClaudeManagerStats
+	Streams map[string]StreamOutcomeStats `json:"streams"`
+}
+
+// Stats reports the Claude manager's in-memory map sizes and cleanup counters,
+// and what prompt streams have sent to clients
+func (h *Handlers) Stats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, StatsResponse{
+		ClaudeManagerStats: h.claude.Stats(),
+		Streams:            h.streams.Snapshot(),
+	})
+}
+
+// Backup writes a timestamped copy of the database to the backup directory
+func (h *Handlers) Backup(w http.ResponseWriter, r *http.Request) {
+	if h.opts.BackupDir == "" {
+		writeError(w, http.StatusNotFound, "backups not configured")
+		return
+	}
+	if err := os.MkdirAll(h.opts.BackupDir, 0o755); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	path := filepath.Join(h.opts.BackupDir, fmt.Sprintf("chai-backup-%s.db", now.Format("20060102-150405.000")))
+	if err := h.repo.Backup(path); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	log.Printf("Wrote database backup %s (%d bytes)", path, info.Size())
+	writeJSON(w, http.StatusCreated, BackupResponse{
+		Path:      path,
+		SizeBytes: info.Size(),
+		CreatedAt: now,
 	})
 }
+
+// GetReadOnly reports whether the server is in read-only mode.
+func (h *Handlers) GetReadOnly(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ReadOnlyResponse{ReadOnly: h.readOnly.Load()})
+}
+
+// SetReadOnly turns read-only mode on or off without a restart, e.g. around
+// a backup or migration.
+func (h *Handlers) SetReadOnly(w http.ResponseWriter, r *http.Request) {
+	var req ReadOnlyRequest
+	if err := parseJSON(w, r, &req, maxRequestBodyBytes); err != nil {
+		writeParseError(w, err)
+		return
+	}
+	var v validator
+	v.check(req.Enabled != nil, "enabled", "is required")
+	if !v.valid() {
+		v.write(w)
+		return
+	}
+
+	if h.readOnly.Swap(*req.Enabled) != *req.Enabled {
+		log.Printf("Read-only mode set to %t", *req.Enabled)
+	}
+	writeJSON(w, http.StatusOK, ReadOnlyResponse{ReadOnly: *req.Enabled})
+}
+
+// KillActive forcibly terminates the Claude processes for a session, or with
+// ?prompt_id= just that prompt's. The streaming prompt handler observes the
+// failure and resets the session status.
+func (h *Handlers) KillActive(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session id")
+		return
+	}
+	promptID := r.URL.Query().Get("prompt_id")
+
+	found := false
+	for _, p := range h.claude.ListActive() {
+		if p.SessionID == id && (promptID == "" || p.PromptID == promptID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "no active process for session")
+		return
+	}
+
+	kill := func() error { return h.claude.KillProcess(id) }
+	if promptID != "" {
+		kill = func() error { return h.claude.KillPrompt(id, promptID) }
+	}
+	if err := kill(); err != nil {
+		if errors.Is(err, ErrProcessNotFound) {
+			// Exited since it was listed
+			writeError(w, http.StatusNotFound, "no active process for session")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "killed"})
+}
+
+// KillActiveOlderThan kills every Claude process running for longer than
+// ?running_longer_than=, for a watchdog to reap stuck prompts in one call.
+func (h *Handlers) KillActiveOlderThan(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("running_longer_than") == "" {
+		writeError(w, http.StatusBadRequest, "running_longer_than is required")
+		return
+	}
+	age, err := parseRunningLongerThan(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := BulkKillResponse{SessionIDs: []string{}}
+	for _, p := range h.claude.ListActiveOlderThan(age) {
+		if err := h.claude.KillPrompt(p.SessionID, p.PromptID); err != nil {
+			// ErrProcessNotFound: it exited since it was listed
+			if !errors.Is(err, ErrProcessNotFound) {
+				log.Printf("Failed to kill Claude process for session %s: %v", p.SessionID, err)
+			}
+			continue
+		}
+		resp.SessionIDs = append(resp.SessionIDs, p.SessionID)
+	}
+	resp.Killed = len(resp.SessionIDs)
+
+	if resp.Killed > 0 {
+		log.Printf("Killed %d Claude processes running longer than %s", resp.Killed, age)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// parseRunningLongerThan reads the ?running_longer_than= duration filter.
+// An absent filter matches every process.
+func parseRunningLongerThan(r *http.Request) (time.Duration, error) {
+	v := r.URL.Query().Get("running_longer_than")
+	if v == "" {
+		return 0, nil
+	}
+	age, err := time.ParseDuration(v)
+	if err != nil || age < 0 {
+		return 0, errors.New("invalid running_longer_than")
+	}
+	return age, nil
+}
+
+// ExportAll streams a zip archive containing one JSON transcript per session.
+// Transcripts are loaded and written one at a time to bound memory use.
+func (h *Handlers) ExportAll(w http.ResponseWriter, r *http.Request) {
+	sessions, err := h.repo.ListSessions(SessionFilter{IncludeArchived: true})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	filename := fmt.Sprintf("chai-export-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+
+	// On failure the response is aborted rather than finished with a central
+	// directory, so the client sees a broken transfer instead of a
+	// well-formed archive missing sessions
+	zw := zip.NewWriter(w)
+	abort := func(sessionID string, err error) {
+		log.Printf("Export failed for session %s: %v", sessionID, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	for _, s := range sessions {
+		transcript, err := h.loadTranscript(s.ID)
+		if isSessionNotFound(err) {
+			continue // deleted while exporting
+		}
+		if err != nil {
+			abort(s.ID, err)
+		}
+
+		f, err := zw.Create("sessions/" + s.ID + ".json")
+		if err != nil {
+			abort(s.ID, err)
+		}
+		if err := json.NewEncoder(f).Encode(transcript); err != nil {
+			abort(s.ID, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Export failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// NewHTTPServer creates the API server. With enableH2C it also accepts
+// HTTP/2 over plaintext connections (h2c with prior knowledge), so a proxy or
+// client can multiplex many SSE streams over one connection instead of
+// holding a connection per stream.
+func NewHTTPServer(addr string, handler http.Handler, enableH2C bool) *http.Server {
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		IdleTimeout: 10 * time.Minute,
+	}
+	if enableH2C {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		// Setting Protocols replaces the defaults, so keep HTTP/2 over TLS too
+		protocols.SetHTTP2(true)
+		server.Protocols = &protocols
+	}
+	return server
+}
+
+// Serve accepts connections on ln until the server is shut down, speaking
+// HTTPS when certFile and keyFile are set or the server's TLSConfig supplies
+// certificates itself (as with autocert), and plain HTTP otherwise. Like
+// http.Server.Serve, it returns http.ErrServerClosed after Shutdown.
+func Serve(server *http.Server, ln net.Listener, certFile, keyFile string) error {
+	if certFile != "" && keyFile != "" {
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+	if server.TLSConfig != nil && server.TLSConfig.GetCertificate != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+// NewAutocertManager obtains and renews certificates for the comma-separated
+// domains from Let's Encrypt, caching them in cacheDir so restarts don't request new ones.
+// Install it with server.TLSConfig = m.TLSConfig(). Challenges are answered
+// over TLS-ALPN on the HTTPS listener itself, so the domains must reach the
+// server on port 443; no port 80 listener is needed. Requests for any other
+// host name get no certificate.
+func NewAutocertManager(domains, cacheDir, email string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(splitList(domains)...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
+
+// WithBasePath serves handler under basePath, such as "/chai" when a reverse
+// proxy mounts the server there alongside other services. The prefix is
+// stripped, so routes and path-based middleware see the same paths as without
+// one, and requests outside it get 404. An empty base path, or "/", returns
+// handler unchanged.
+func WithBasePath(basePath string, handler http.Handler) http.Handler {
+	basePath = strings.TrimSuffix(basePath, "/")
+	if basePath == "" {
+		return handler
+	}
+	stripped := http.StripPrefix(basePath, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// "/chai" and "/chai/..." are under the prefix, "/chaiX" is not
+		rest, ok := strings.CutPrefix(r.URL.Path, basePath)
+		if !ok || (rest != "" && rest[0] != '/') {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// PromptDrainer stops running Claude prompts at shutdown; ClaudeManager is one.
+type PromptDrainer interface {
+	// Drain rejects new prompts and waits up to timeout for running ones,
+	// reporting whether they all finished
+	Drain(timeout time.Duration) bool
+	// Shutdown kills the prompts still running
+	Shutdown()
+}
+
+// ShutdownOptions configures Shutdown.
+type ShutdownOptions struct {
+	Mode           string        // ShutdownModeKill or ShutdownModeDrain
+	Timeout        time.Duration // for draining prompts, then again for HTTP shutdown
+	ReconnectDelay time.Duration // suggested to open prompt streams, 0 for no hint
+}
+
+// Shutdown stops the server. In drain mode running prompts first get
+// opts.Timeout to finish. Only then are the streams still open sent a
+// reconnect hint, since a client that follows one disconnects and so stops
+// its prompt; then the remaining Claude processes are killed and the HTTP
+// server shut down.
+func Shutdown(server *http.Server, handlers *Handlers, claude PromptDrainer, opts ShutdownOptions) {
+	// In drain mode, running prompts get the shutdown timeout to finish
+	// while new prompts are rejected
+	if opts.Mode == ShutdownModeDrain {
+		log.Printf("Draining running prompts (up to %s)...", opts.Timeout)
+		if !claude.Drain(opts.Timeout) {
+			log.Printf("Drain timed out, killing remaining Claude processes")
+		}
+	}
+
+	// Ask clients of open prompt streams to back off before reconnecting
+	if opts.ReconnectDelay > 0 {
+		if n := handlers.SendReconnect(opts.ReconnectDelay, ReconnectReasonShutdown); n > 0 {
+			log.Printf("Sent reconnect hints to %d prompt streams", n)
+		}
+	}
+
+	// Kill all (remaining) Claude processes
+	claude.Shutdown()
+
+	// Graceful HTTP shutdown with timeout
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("HTTP server shutdown error: %v", err)
+	}
+}
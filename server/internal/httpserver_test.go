@@ -0,0 +1,409 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// startHTTPServer serves handler on a loopback port and returns its base URL.
+func startHTTPServer(t *testing.T, handler http.Handler, enableH2C bool) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := NewHTTPServer(ln.Addr().String(), handler, enableH2C)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return "http://" + ln.Addr().String()
+}
+
+// h2cClient only speaks HTTP/2 over plaintext, so requests fail unless the
+// server accepts h2c.
+func h2cClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+func TestNewHTTPServer_H2CStreamsSSE(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+
+		fmt.Fprintf(w, "event: first\ndata: %s\n\n", r.Proto)
+		flusher.Flush()
+
+		// The second event is only written once the client has read the first,
+		// so this deadlocks unless the first frame was flushed through HTTP/2
+		<-release
+		fmt.Fprint(w, "event: second\ndata: {}\n\n")
+		flusher.Flush()
+	})
+	url := startHTTPServer(t, handler, true)
+
+	resp, err := h2cClient().Get(url + "/api/sessions/abc/prompt")
+	if err != nil {
+		t.Fatalf("HTTP/2 request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Proto = %s, want HTTP/2", resp.Proto)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() string {
+		t.Helper()
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if line == "\n" {
+				return strings.Join(lines, "")
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if got := readEvent(); got != "event: first\ndata: HTTP/2.0\n" {
+		t.Errorf("First event = %q", got)
+	}
+	close(release)
+	if got := readEvent(); got != "event: second\ndata: {}\n" {
+		t.Errorf("Second event = %q", got)
+	}
+}
+
+func TestNewHTTPServer_H2CDisabled(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	url := startHTTPServer(t, handler, false)
+
+	if resp, err := h2cClient().Get(url + "/health"); err == nil {
+		resp.Body.Close()
+		t.Errorf("HTTP/2 request succeeded with %s, want h2c rejected", resp.Proto)
+	}
+
+	// HTTP/1.1 keeps working either way
+	resp, err := http.Get(url + "/health")
+	if err != nil {
+		t.Fatalf("HTTP/1.1 request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 1 {
+		t.Errorf("Proto = %s, want HTTP/1.1", resp.Proto)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key,
+// returning their paths and a pool trusting the certificate.
+func writeTestCert(t *testing.T) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "chai test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServe(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+		enableH2C         bool
+		scheme            string
+		wantProto         string
+	}{
+		{"plain", "", "", false, "http", "HTTP/1.1"},
+		{"cert without key", certFile, "", false, "http", "HTTP/1.1"},
+		{"tls", certFile, keyFile, false, "https", "HTTP/2.0"},
+		{"tls with h2c", certFile, keyFile, true, "https", "HTTP/2.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			server := NewHTTPServer(ln.Addr().String(), handler, tt.enableH2C)
+			served := make(chan error, 1)
+			go func() { served <- Serve(server, ln, tt.certFile, tt.keyFile) }()
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool},
+				ForceAttemptHTTP2: true,
+			}}
+			resp, err := client.Get(tt.scheme + "://" + ln.Addr().String() + "/health")
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			body := make([]byte, 64)
+			n, _ := resp.Body.Read(body)
+			resp.Body.Close()
+			if got := string(body[:n]); got != tt.wantProto {
+				t.Errorf("Proto = %q, want %q", got, tt.wantProto)
+			}
+
+			// Graceful shutdown works the same in either mode
+			if err := server.Shutdown(context.Background()); err != nil {
+				t.Fatalf("Shutdown failed: %v", err)
+			}
+			if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+				t.Errorf("Serve returned %v, want http.ErrServerClosed", err)
+			}
+		})
+	}
+}
+
+func TestServe_TLSConfigCertificates(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	server := NewHTTPServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}), false)
+	// Certificates supplied by the TLS config, as autocert's are
+	server.TLSConfig = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &cert, nil
+	}}
+	served := make(chan error, 1)
+	go func() { served <- Serve(server, ln, "", "") }()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/health")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0" {
+		t.Errorf("Proto = %q, want HTTP/2.0", body)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Serve returned %v, want http.ErrServerClosed", err)
+	}
+}
+
+func TestNewAutocertManager(t *testing.T) {
+	cacheDir := t.TempDir()
+	m := NewAutocertManager("chai.example.com, api.example.com", cacheDir, "ops@example.com")
+
+	for _, host := range []string{"chai.example.com", "api.example.com"} {
+		if err := m.HostPolicy(context.Background(), host); err != nil {
+			t.Errorf("HostPolicy(%s) = %v, want allowed", host, err)
+		}
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("HostPolicy should reject hosts outside the configured domains")
+	}
+	if m.Email != "ops@example.com" || m.Cache == nil {
+		t.Errorf("Manager email = %q, cache = %v", m.Email, m.Cache)
+	}
+	// TLS-ALPN challenges are answered on the HTTPS listener
+	if !slices.Contains(m.TLSConfig().NextProtos, "acme-tls/1") {
+		t.Errorf("NextProtos = %v, want acme-tls/1 for TLS-ALPN challenges", m.TLSConfig().NextProtos)
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	r := chi.NewRouter()
+	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	r.Route("/api", func(r chi.Router) {
+		r.Get("/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+			// Path-based checks see the path without the prefix
+			writeJSON(w, http.StatusOK, map[string]any{"id": chi.URLParam(r, "id"), "path": r.URL.Path, "admin": IsAdminRequest(r)})
+		})
+	})
+
+	for _, basePath := range []string{"/chai", "/chai/"} {
+		url := startHTTPServer(t, WithBasePath(basePath, r), false)
+
+		tests := []struct {
+			path       string
+			wantStatus int
+		}{
+			{"/chai/health", http.StatusOK},
+			{"/chai/api/sessions/abc", http.StatusOK},
+			{"/health", http.StatusNotFound},
+			{"/chaiX/health", http.StatusNotFound},
+			{"/other/chai/health", http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			resp, err := http.Get(url + tt.path)
+			if err != nil {
+				t.Fatalf("GET %s failed: %v", tt.path, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("base path %q: GET %s status = %d, want %d", basePath, tt.path, resp.StatusCode, tt.wantStatus)
+			}
+			if tt.path == "/chai/api/sessions/abc" && string(body) != `{"admin":false,"id":"abc","path":"/api/sessions/abc"}`+"\n" {
+				t.Errorf("base path %q: body = %s, want the route to see /api/sessions/abc", basePath, body)
+			}
+		}
+	}
+
+	// Without a base path the handler is served as is
+	url := startHTTPServer(t, WithBasePath("", r), false)
+	resp, err := http.Get(url + "/health")
+	if err != nil {
+		t.Fatalf("GET /health failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /health status = %d, want %d without a base path", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// fakeDrainer stands in for ClaudeManager at shutdown; drain runs as Drain.
+type fakeDrainer struct {
+	drain    func() bool
+	shutdown bool
+}
+
+func (d *fakeDrainer) Drain(time.Duration) bool { return d.drain() }
+func (d *fakeDrainer) Shutdown()                { d.shutdown = true }
+
+func TestShutdown_DrainBeforeReconnect(t *testing.T) {
+	repo, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	mock := &mockClaudeManager{
+		block:  make(chan struct{}),
+		events: []string{`{"type":"result","subtype":"success","result":"hi"}`},
+	}
+	handlers.claude = mock
+
+	startPrompt := func() (*httptest.ResponseRecorder, chan struct{}) {
+		session, _ := repo.CreateSession(nil, nil)
+		req := httptest.NewRequest("POST", "/api/sessions/"+session.ID+"/prompt", strings.NewReader(`{"prompt":"hi"}`))
+		req = withURLParam(req, "id", session.ID)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		started := mock.promptCount() + 1
+		done := make(chan struct{})
+		go func() {
+			handlers.Prompt(w, req)
+			close(done)
+		}()
+		// Wait until Claude is running, as it would be when the server shuts down
+		deadline := time.Now().Add(5 * time.Second)
+		for mock.promptCount() < started {
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the prompt to start")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return w, done
+	}
+	eventTypes := func(w *httptest.ResponseRecorder) []string {
+		var types []string
+		for _, e := range parseSSEEvents(strings.NewReader(w.Body.String())) {
+			types = append(types, e.Event)
+		}
+		return types
+	}
+
+	// A prompt that finishes while draining is never told to go away, so
+	// its client stays connected to the end
+	w, done := startPrompt()
+	drainer := &fakeDrainer{drain: func() bool {
+		close(mock.block)
+		<-done
+		return true
+	}}
+	opts := ShutdownOptions{Mode: ShutdownModeDrain, Timeout: time.Second, ReconnectDelay: time.Second}
+	Shutdown(&http.Server{}, handlers, drainer, opts)
+	if types := eventTypes(w); slices.Contains(types, "reconnect") || types[len(types)-1] != "done" {
+		t.Errorf("Drained prompt events = %v, want it to finish without a reconnect hint", types)
+	}
+	if !drainer.shutdown {
+		t.Error("Shutdown should kill the remaining Claude processes")
+	}
+
+	// A stream still open once the drain times out gets the hint
+	mock.block = make(chan struct{})
+	w, done = startPrompt()
+	Shutdown(&http.Server{}, handlers, &fakeDrainer{drain: func() bool { return false }}, opts)
+	close(mock.block)
+	<-done
+	if types := eventTypes(w); !slices.Contains(types, "reconnect") {
+		t.Errorf("Straggler events = %v, want a reconnect hint", types)
+	}
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RequireAuthToken returns middleware that rejects requests without a matching
+// "Authorization: Bearer <token>" header. An empty token disables the check so
+// deployments without auth configured keep working unchanged.
+func RequireAuthToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if token == "" {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !hasBearerToken(r, token) {
+				writeError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// hasBearerToken reports whether r carries "Authorization: Bearer <token>".
+// An empty token never matches.
+func hasBearerToken(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// requestTimeoutBody is the JSON error written when a request times out
+const requestTimeoutBody = `{"error":"request timed out"}` + "\n"
+
+// RequestTimeout returns middleware that answers 503 with a JSON error when a
+// request runs longer than timeout, and cancels the request's context. Requests
+// for which skip returns true, such as the streaming prompt route, run without
+// a deadline. A zero timeout disables the middleware.
+func RequestTimeout(timeout time.Duration, skip func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		timed := http.TimeoutHandler(next, timeout, requestTimeoutBody)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if skip != nil && skip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// TimeoutHandler replaces this with the handler's own headers when it
+			// finishes in time, so it only sticks to the timeout response
+			w.Header().Set("Content-Type", "application/json")
+			timed.ServeHTTP(w, r)
+		})
+	}
+}
+
+// LimitConnectionsPerIP returns middleware that caps how many requests for
+// which match returns true each remote IP may have in flight, answering 429
+// beyond that. It is meant for long-lived streams, where the harm is in
+// connections held open rather than request rate. A limit of 0 disables it.
+// Every handler wrapped by the returned middleware shares one count per IP,
+// so the same cap can cover routes registered in different groups.
+func LimitConnectionsPerIP(limit int, match func(*http.Request) bool) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	open := make(map[string]int) // remote IP -> requests in flight
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if match != nil && !match(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ip := remoteIP(r)
+			mu.Lock()
+			if open[ip] >= limit {
+				mu.Unlock()
+				writeError(w, http.StatusTooManyRequests, "too many open connections")
+				return
+			}
+			open[ip]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				if open[ip]--; open[ip] <= 0 {
+					delete(open, ip)
+				}
+				mu.Unlock()
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// remoteIP returns the IP part of r.RemoteAddr, or the whole address if it
+// has no port.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// readOnlyMessage is the error returned for writes rejected in read-only mode
+const readOnlyMessage = "server is in read-only mode"
+
+// RejectWritesWhenReadOnly returns middleware that answers 503 to requests
+// that may change state, anything but GET, HEAD and OPTIONS, while readOnly
+// is set. Reads keep working, so maintenance such as a backup can run against
+// a live server. Requests for which skip returns true, such as the admin
+// routes that turn the mode back off, always pass.
+func RejectWritesWhenReadOnly(readOnly *atomic.Bool, skip func(*http.Request) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if readOnly.Load() && (skip == nil || !skip(r)) {
+					writeError(w, http.StatusServiceUnavailable, readOnlyMessage)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IsAdminRequest reports whether r targets the admin API.
+func IsAdminRequest(r *http.Request) bool {
+	return r.URL.Path == "/api/admin" || strings.HasPrefix(r.URL.Path, "/api/admin/")
+}
+
+// IsPromptRequest reports whether r targets one of the streaming prompt
+// routes: a session's /prompt, /retry-failed or /continue, or the
+// OpenAI-compatible /v1/chat/completions.
+func IsPromptRequest(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	return r.Method == http.MethodPost && (strings.HasSuffix(path, "/prompt") ||
+		strings.HasSuffix(path, "/retry-failed") || strings.HasSuffix(path, "/continue") ||
+		path == "/v1/chat/completions")
+}
+
+// IsBulkExportRequest reports whether r targets GET /api/admin/export-all or
+// POST /api/admin/backup, which stream or copy the whole database and so may
+// take longer than any fixed request timeout.
+func IsBulkExportRequest(r *http.Request) bool {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	return (r.Method == http.MethodGet && path == "/api/admin/export-all") ||
+		(r.Method == http.MethodPost && path == "/api/admin/backup")
+}
+
+// IsLongPollRequest reports whether r is a GetEvents request waiting for new
+// events, which is bounded by its own long-poll timeout.
+func IsLongPollRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.URL.Query().Get("wait") == "true" &&
+		strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/events")
+}
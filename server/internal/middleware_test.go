@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequireAuthToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		token      string
+		header     string
+		wantStatus int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"wrong scheme", "secret", "Basic secret", http.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/admin/active", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			RequireAuthToken(tt.token)(ok).ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "done"})
+	})
+	handler := RequestTimeout(20*time.Millisecond, IsPromptRequest)(slow)
+
+	// A slow non-streaming request is cut off with a JSON 503
+	req := httptest.NewRequest("GET", "/api/sessions", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Invalid JSON body: %v", err)
+	}
+	if body["error"] != "request timed out" {
+		t.Errorf("error = %q, want %q", body["error"], "request timed out")
+	}
+
+	// The streaming prompt route runs past the timeout
+	req = httptest.NewRequest("POST", "/api/sessions/abc/prompt", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Prompt status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRequestTimeout_FastRequest(t *testing.T) {
+	fast := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Total-Count", "3")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, timeout := range []time.Duration{time.Second, 0} {
+		req := httptest.NewRequest("DELETE", "/api/sessions/abc", nil)
+		w := httptest.NewRecorder()
+		RequestTimeout(timeout, IsPromptRequest)(fast).ServeHTTP(w, req)
+
+		if w.Code != http.StatusNoContent {
+			t.Errorf("timeout %s: status = %d, want %d", timeout, w.Code, http.StatusNoContent)
+		}
+		if w.Header().Get("X-Total-Count") != "3" {
+			t.Errorf("timeout %s: handler headers were not kept", timeout)
+		}
+	}
+}
+
+func TestLimitConnectionsPerIP(t *testing.T) {
+	const limit = 2
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := LimitConnectionsPerIP(limit, IsPromptRequest)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Streams from the test client stay open until released
+		if remoteIP(r) == "127.0.0.1" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	post := func() int {
+		resp, err := http.Post(srv.URL+"/api/sessions/abc/prompt", "application/json", nil)
+		if err != nil {
+			t.Errorf("POST failed: %v", err)
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Hold the limit's worth of streams open from this client
+	statuses := make(chan int, limit+1)
+	for range limit {
+		go func() { statuses <- post() }()
+	}
+	for range limit {
+		<-started
+	}
+
+	// One more from the same IP is turned away without reaching the handler
+	if status := post(); status != http.StatusTooManyRequests {
+		t.Errorf("Status = %d, want %d beyond the limit", status, http.StatusTooManyRequests)
+	}
+
+	// Another IP has its own allowance
+	req := httptest.NewRequest("POST", "/api/sessions/abc/prompt", nil)
+	req.RemoteAddr = "192.0.2.7:5000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Status = %d, want %d for another IP", w.Code, http.StatusOK)
+	}
+
+	// Closing a stream frees its place for the next one
+	release <- struct{}{}
+	if status := <-statuses; status != http.StatusOK {
+		t.Errorf("Status = %d, want %d for a held stream", status, http.StatusOK)
+	}
+	go func() { statuses <- post() }()
+	<-started
+	close(release)
+	for range limit {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("Status = %d, want %d after a stream closed", status, http.StatusOK)
+		}
+	}
+}
+
+func TestLimitConnectionsPerIP_Unmatched(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	// A limit of 0 disables the cap and other routes are never counted
+	for _, handler := range []http.Handler{
+		LimitConnectionsPerIP(0, IsPromptRequest)(ok),
+		LimitConnectionsPerIP(1, IsPromptRequest)(ok),
+	} {
+		req := httptest.NewRequest("GET", "/api/sessions", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestLimitConnectionsPerIP_SharedAcrossRoutes(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	held := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// One middleware wrapping two route groups counts them together
+	limit := LimitConnectionsPerIP(1, IsPromptRequest)
+	api, chat := limit(held), limit(ok)
+
+	go api.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/sessions/abc/prompt", nil))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		chat.ServeHTTP(w, httptest.NewRequest("POST", "/v1/chat/completions", nil))
+		if w.Code == http.StatusTooManyRequests {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("A chat completion was let through while a prompt stream held the IP's only slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRejectWritesWhenReadOnly(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	var readOnly atomic.Bool
+	handler := RejectWritesWhenReadOnly(&readOnly, IsAdminRequest)(ok)
+
+	tests := []struct {
+		method, path string
+		wantReadOnly int
+	}{
+		{"GET", "/api/sessions", http.StatusOK},
+		{"GET", "/api/sessions/abc/events", http.StatusOK},
+		{"HEAD", "/api/sessions/abc", http.StatusOK},
+		{"POST", "/api/sessions", http.StatusServiceUnavailable},
+		{"POST", "/api/sessions/abc/prompt", http.StatusServiceUnavailable},
+		{"POST", "/api/sessions/abc/approve", http.StatusServiceUnavailable},
+		{"DELETE", "/api/sessions/abc", http.StatusServiceUnavailable},
+		{"POST", "/v1/chat/completions", http.StatusServiceUnavailable},
+		{"POST", "/api/admin/readonly", http.StatusOK},
+	}
+	for _, enabled := range []bool{false, true} {
+		// Toggled in place, as the admin API does at runtime
+		readOnly.Store(enabled)
+		for _, tt := range tests {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+
+			want := http.StatusOK
+			if enabled {
+				want = tt.wantReadOnly
+			}
+			if w.Code != want {
+				t.Errorf("read-only %t: %s %s status = %d, want %d", enabled, tt.method, tt.path, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestIsPromptRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"POST", "/api/sessions/abc/prompt", true},
+		{"POST", "/api/sessions/abc/prompt/", true},
+		{"POST", "/api/sessions/abc/retry-failed", true},
+		{"POST", "/api/sessions/abc/continue", true},
+		{"POST", "/v1/chat/completions", true},
+		{"GET", "/api/sessions/abc/prompt", false},
+		{"GET", "/v1/chat/completions", false},
+		{"POST", "/api/sessions/abc/approve", false},
+		{"GET", "/api/sessions", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := IsPromptRequest(req); got != tt.want {
+			t.Errorf("IsPromptRequest(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsBulkExportRequest(t *testing.T) {
+	tests := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/api/admin/export-all", true},
+		{"GET", "/api/admin/export-all/", true},
+		{"POST", "/api/admin/backup", true},
+		{"GET", "/api/admin/backup", false},
+		{"POST", "/api/admin/export-all", false},
+		{"GET", "/api/admin/stats", false},
+		{"GET", "/api/sessions/abc/export-all", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if got := IsBulkExportRequest(req); got != tt.want {
+			t.Errorf("IsBulkExportRequest(%s %s) = %v, want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestIsLongPollRequest(t *testing.T) {
+	tests := []struct {
+		method, target string
+		want           bool
+	}{
+		{"GET", "/api/sessions/abc/events?wait=true", true},
+		{"GET", "/api/sessions/abc/events/?since_sequence=3&wait=true", true},
+		{"GET", "/api/sessions/abc/events", false},
+		{"GET", "/api/sessions/abc/events?wait=false", false},
+		{"POST", "/api/sessions/abc/events?wait=true", false},
+		{"GET", "/api/sessions?wait=true", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if got := IsLongPollRequest(req); got != tt.want {
+			t.Errorf("IsLongPollRequest(%s %s) = %v, want %v", tt.method, tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package internal
+
+import "sync"
+
+// eventNotifier wakes goroutines waiting for a session's events to change.
+// Each waiter gets a channel that is closed on the session's next notify, so
+// any number of long-polls wake at once without a goroutine per waiter.
+type eventNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{} // session ID -> channel closed on next change
+}
+
+func newEventNotifier() *eventNotifier {
+	return &eventNotifier{waiters: make(map[string]chan struct{})}
+}
+
+// wait returns a channel that is closed the next time sessionID is notified.
+// Callers subscribe before reading state so a change in between isn't missed.
+func (n *eventNotifier) wait(sessionID string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ch, ok := n.waiters[sessionID]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[sessionID] = ch
+	}
+	return ch
+}
+
+// notify wakes every waiter for sessionID.
+func (n *eventNotifier) notify(sessionID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if ch, ok := n.waiters[sessionID]; ok {
+		close(ch)
+		delete(n.waiters, sessionID)
+	}
+}
@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestEventNotifier(t *testing.T) {
+	n := newEventNotifier()
+
+	first := n.wait("session-1")
+	second := n.wait("session-1")
+	other := n.wait("session-2")
+
+	n.notify("session-1")
+	if !isClosed(first) || !isClosed(second) {
+		t.Error("Waiters not woken by notify")
+	}
+	if isClosed(other) {
+		t.Error("Waiter for another session woken")
+	}
+
+	// A notify only wakes waiters already subscribed
+	next := n.wait("session-1")
+	if isClosed(next) {
+		t.Error("New waiter woken by an earlier notify")
+	}
+	n.notify("session-1")
+	select {
+	case <-next:
+	case <-time.After(time.Second):
+		t.Error("Second notify did not wake the new waiter")
+	}
+}
+
+func TestEventNotifier_NotifyWithoutWaiters(t *testing.T) {
+	n := newEventNotifier()
+	n.notify("session-1")
+	if len(n.waiters) != 0 {
+		t.Errorf("Waiters = %d, want 0", len(n.waiters))
+	}
+}
@@ -0,0 +1,427 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAI-compatible chat completions adapter. A request runs as a prompt on a
+// chai session: an ephemeral one deleted afterwards, or an existing session
+// named by chai_session_id. Claude's events are persisted and accumulated
+// exactly as for /prompt, so /events and the transcript stay consistent.
+
+// defaultChatModel is reported when a request doesn't name a model. The model
+// field is echoed back only; the Claude CLI's configured model answers.
+const defaultChatModel = "claude"
+
+// ChatCompletionRequest is the subset of OpenAI's chat completion request chai understands
+type ChatCompletionRequest struct {
+	Model    string        `json:"model"`
+	Messages []ChatMessage `json:"messages"`
+	Stream   bool          `json:"stream"`
+	// ChaiSessionID runs the prompt on an existing session, which keeps it and
+	// its history, instead of an ephemeral one
+	ChaiSessionID string `json:"chai_session_id,omitempty"`
+}
+
+// ChatMessage is one message of an OpenAI chat
+type ChatMessage struct {
+	Role    string      `json:"role"` // "system", "user", "assistant"
+	Content ChatContent `json:"content"`
+}
+
+// ChatContent is a message's text. OpenAI allows either a string or an array
+// of content parts; the text parts are joined.
+type ChatContent string
+
+func (c *ChatContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = ChatContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or an array of content parts")
+	}
+	var texts []string
+	for _, p := range parts {
+		if p.Type != "text" {
+			return fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+		texts = append(texts, p.Text)
+	}
+	*c = ChatContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// ChatCompletion is the non-streaming response
+type ChatCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"` // "chat.completion"
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatUsage             `json:"usage,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+// ChatUsage reports token counts from Claude's result event
+type ChatUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	TotalTokens      int64 `json:"total_tokens"`
+}
+
+// ChatCompletionChunk is one streamed `data:` frame
+type ChatCompletionChunk struct {
+	ID      string                      `json:"id"`
+	Object  string                      `json:"object"` // "chat.completion.chunk"
+	Created int64                       `json:"created"`
+	Model   string                      `json:"model"`
+	Choices []ChatCompletionChunkChoice `json:"choices"`
+}
+
+type ChatCompletionChunkChoice struct {
+	Index        int       `json:"index"`
+	Delta        ChatDelta `json:"delta"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type ChatDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// Finish reasons. "cancelled" is chai's own, for prompts stopped via /cancel.
+const (
+	finishReasonStop      = "stop"
+	finishReasonCancelled = "cancelled"
+)
+
+// writeOpenAIError responds with OpenAI's error shape so its client libraries
+// surface the message.
+func writeOpenAIError(w http.ResponseWriter, status int, message, errType string) {
+	writeJSON(w, status, map[string]any{
+		"error": map[string]string{"message": message, "type": errType},
+	})
+}
+
+// chatPrompt turns a chat into the prompt sent to Claude. The last message must
+// come from the user. A continued chai session already holds the earlier
+// turns, so only that message is sent; otherwise earlier messages are inlined
+// as a transcript ahead of it.
+func chatPrompt(messages []ChatMessage, continued bool) (string, error) {
+	if len(messages) == 0 {
+		return "", errors.New("messages is required")
+	}
+	last := messages[len(messages)-1]
+	if last.Role != "user" {
+		return "", errors.New("the last message must have role user")
+	}
+	if strings.TrimSpace(string(last.Content)) == "" {
+		return "", errors.New("the last message has no content")
+	}
+	if continued || len(messages) == 1 {
+		return string(last.Content), nil
+	}
+
+	turns := make([]transcriptTurn, 0, len(messages)-1)
+	for _, m := range messages[:len(messages)-1] {
+		switch m.Role {
+		case "system", "user", "assistant":
+		default:
+			return "", fmt.Errorf("unsupported message role %q", m.Role)
+		}
+		turns = append(turns, transcriptTurn{m.Role, string(m.Content)})
+	}
+	return inlineTranscript(turns, string(last.Content)), nil
+}
+
+// transcriptTurn is an earlier message inlined ahead of a prompt
+type transcriptTurn struct {
+	role, content string
+}
+
+// inlineTranscript prefixes prompt with earlier turns of the conversation, for
+// a Claude session that doesn't hold them.
+func inlineTranscript(turns []transcriptTurn, prompt string) string {
+	if len(turns) == 0 {
+		return prompt
+	}
+	var b strings.Builder
+	b.WriteString("Earlier messages in this conversation:\n\n")
+	for _, t := range turns {
+		fmt.Fprintf(&b, "[%s]\n%s\n\n", t.role, t.content)
+	}
+	b.WriteString("Reply to this message:\n\n")
+	b.WriteString(prompt)
+	return b.String()
+}
+
+// ChatCompletions serves POST /v1/chat/completions.
+func (h *Handlers) ChatCompletions(w http.ResponseWriter, r *http.Request) {
+	var req ChatCompletionRequest
+	if err := parseJSON(w, r, &req, h.promptBodyLimit()); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeOpenAIError(w, http.StatusRequestEntityTooLarge, "request body too large", "invalid_request_error")
+			return
+		}
+		writeOpenAIError(w, http.StatusBadRequest, "invalid JSON: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if req.Model == "" {
+		req.Model = defaultChatModel
+	}
+
+	prompt, err := chatPrompt(req.Messages, req.ChaiSessionID != "")
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+	if h.opts.MaxPromptBytes > 0 && len(prompt) > h.opts.MaxPromptBytes {
+		writeOpenAIError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("prompt exceeds %d bytes", h.opts.MaxPromptBytes), "invalid_request_error")
+		return
+	}
+
+	if h.claude.Draining() {
+		writeOpenAIError(w, http.StatusServiceUnavailable, "server is shutting down", "server_error")
+		return
+	}
+	if err := retry(admissionPingAttempts, admissionPingDelay, h.db.Ping); err != nil {
+		writeOpenAIError(w, http.StatusServiceUnavailable, "database unavailable", "server_error")
+		return
+	}
+
+	var session *Session
+	if req.ChaiSessionID != "" {
+		session, err = h.repo.GetSession(req.ChaiSessionID)
+		if isSessionNotFound(err) {
+			writeOpenAIError(w, http.StatusNotFound, "session not found", "invalid_request_error")
+			return
+		}
+	} else {
+		session, err = h.repo.CreateSession(nil, nil)
+		if err == nil {
+			defer h.deleteEphemeralSession(session.ID)
+		}
+	}
+	if errors.Is(err, ErrSessionLimit) {
+		writeOpenAIError(w, http.StatusTooManyRequests, "session limit reached", "rate_limit_exceeded")
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "server_error")
+		return
+	}
+	id := session.ID
+
+	// A session continued here may have a system message set via the API
+	systemPrompt, err := h.repo.GetSystemPrompt(id)
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "server_error")
+		return
+	}
+
+	concurrent := h.opts.ConcurrentPrompts && session.ConcurrentPrompts
+	var promptID string
+	if concurrent {
+		promptID, err = h.repo.StartConcurrentPrompt(id)
+	} else {
+		promptID, err = h.repo.StartNewPrompt(id)
+	}
+	if errors.Is(err, ErrSessionBusy) {
+		writeOpenAIError(w, http.StatusConflict, "session is already streaming", "invalid_request_error")
+		return
+	}
+	if isSessionNotFound(err) {
+		writeOpenAIError(w, http.StatusNotFound, "session not found", "invalid_request_error")
+		return
+	}
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "server_error")
+		return
+	}
+	defer h.queue.Notify(id)
+
+	if h.opts.LockWorkdir {
+		dir := resolveWorkDir(h.sessionWorkDir(session))
+		if _, ok := h.workdirs.TryLock(dir, id); !ok {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			writeOpenAIError(w, http.StatusConflict, "working directory is in use by another session", "invalid_request_error")
+			return
+		}
+		defer h.workdirs.Unlock(dir)
+	}
+
+	// Wait for a slot under MaxConcurrentPrompts. The OpenAI format has no
+	// waiting event, so the request simply blocks until its turn.
+	if err := h.slots.Acquire(r.Context(), id); err != nil {
+		h.repo.EndPrompt(id, StreamStatusIdle)
+		return
+	}
+	defer h.slots.Release(id)
+
+	claudePrompt := h.claudePrompt(session, prompt)
+
+	if _, err := h.repo.CreateMessage(id, "user", prompt, nil); err != nil {
+		h.repo.EndPrompt(id, StreamStatusIdle)
+		if isSessionNotFound(err) {
+			writeOpenAIError(w, http.StatusNotFound, "session not found", "invalid_request_error")
+			return
+		}
+		writeOpenAIError(w, http.StatusInternalServerError, err.Error(), "server_error")
+		return
+	}
+
+	completionID := "chatcmpl-" + promptID
+	created := time.Now().Unix()
+
+	// Streamed chunks are written inline: unlike /prompt frames they are not
+	// replayable, so a slow client should slow Claude rather than lose text
+	var flusher http.Flusher
+	writeChunk := func(delta ChatDelta, finishReason *string) error {
+		data, err := json.Marshal(ChatCompletionChunk{
+			ID:      completionID,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []ChatCompletionChunkChoice{{Delta: delta, FinishReason: finishReason}},
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if req.Stream {
+		var ok bool
+		if flusher, ok = w.(http.Flusher); !ok {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			writeOpenAIError(w, http.StatusInternalServerError, "streaming not supported", "server_error")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		if err := writeChunk(ChatDelta{Role: "assistant"}, nil); err != nil {
+			h.repo.EndPrompt(id, StreamStatusIdle)
+			return
+		}
+	}
+
+	// Nobody can answer a permission request over this API, so each is denied
+	// as it arrives rather than left to stall Claude until the prompt times out
+	outcome, runErr := h.runPrompt(r.Context(), promptRun{
+		session:      session,
+		promptID:     promptID,
+		concurrent:   concurrent,
+		prompt:       prompt,
+		claudePrompt: claudePrompt,
+		timeout:      h.sessionPromptTimeout(session),
+		opts:         h.promptOptions(session, systemPrompt, nil, nil, concurrentPromptID(concurrent, promptID)),
+		onText: func(delta string) error {
+			if !req.Stream {
+				return nil
+			}
+			return writeChunk(ChatDelta{Content: delta}, nil)
+		},
+		denyPermissions: true,
+	})
+	if outcome == nil {
+		return
+	}
+
+	finishReason := finishReasonStop
+	switch {
+	case errors.Is(runErr, ErrPromptCancelled):
+		finishReason = finishReasonCancelled
+	case runErr != nil:
+		if req.Stream {
+			data, _ := json.Marshal(map[string]any{
+				"error": map[string]string{"message": runErr.Error(), "type": "server_error"},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		status := http.StatusBadGateway
+		if errors.Is(runErr, ErrClaudeTimeout) {
+			status = http.StatusGatewayTimeout
+		}
+		writeOpenAIError(w, status, runErr.Error(), "server_error")
+		return
+	}
+
+	if req.Stream {
+		if writeChunk(ChatDelta{}, &finishReason) == nil {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			flusher.Flush()
+		}
+		return
+	}
+
+	resp := ChatCompletion{
+		ID:      completionID,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   req.Model,
+		Choices: []ChatCompletionChoice{{
+			Message:      ChatMessage{Role: "assistant", Content: ChatContent(outcome.Reply)},
+			FinishReason: finishReason,
+		}},
+		Usage: chatUsage(outcome),
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// chatUsage converts the done event's token counts, or returns nil when
+// Claude reported none. Cached input counts as prompt tokens.
+func chatUsage(outcome *PromptOutcome) *ChatUsage {
+	var done DoneEvent
+	if outcome.EventType != "done" || json.Unmarshal(outcome.EventData, &done) != nil {
+		return nil
+	}
+	if done.InputTokens == nil || done.OutputTokens == nil {
+		return nil
+	}
+	prompt := *done.InputTokens
+	if done.CacheCreationInputTokens != nil {
+		prompt += *done.CacheCreationInputTokens
+	}
+	if done.CacheReadInputTokens != nil {
+		prompt += *done.CacheReadInputTokens
+	}
+	return &ChatUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: *done.OutputTokens,
+		TotalTokens:      prompt + *done.OutputTokens,
+	}
+}
+
+// deleteEphemeralSession removes the session created for a chat completion
+// without a chai_session_id once the request is done.
+func (h *Handlers) deleteEphemeralSession(id string) {
+	if _, err := h.repo.DeleteSession(id); err != nil {
+		log.Printf("Warning: failed to delete ephemeral chat session %s: %v", id, err)
+	}
+}
@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChatContent_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{`"hello"`, "hello", false},
+		{`[{"type":"text","text":"a"},{"type":"text","text":"b"}]`, "a\nb", false},
+		{`[{"type":"image_url","image_url":{"url":"x"}}]`, "", true},
+		{`42`, "", true},
+	}
+	for _, tt := range tests {
+		var c ChatContent
+		err := json.Unmarshal([]byte(tt.data), &c)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) error = %v, wantErr %v", tt.data, err, tt.wantErr)
+			continue
+		}
+		if string(c) != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.data, c, tt.want)
+		}
+	}
+}
+
+func TestChatPrompt(t *testing.T) {
+	chat := []ChatMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello!"},
+		{Role: "user", Content: "What's 2+2?"},
+	}
+
+	prompt, err := chatPrompt(chat, false)
+	if err != nil {
+		t.Fatalf("chatPrompt failed: %v", err)
+	}
+	for _, want := range []string{"[system]\nBe brief.", "[assistant]\nHello!", "What's 2+2?"} {
+		if !strings.Contains(prompt, want) {
+			t.Errorf("Prompt %q missing %q", prompt, want)
+		}
+	}
+	if !strings.HasSuffix(prompt, "What's 2+2?") {
+		t.Errorf("Prompt should end with the last user message, got %q", prompt)
+	}
+
+	// A continued session already has the earlier turns
+	if prompt, _ := chatPrompt(chat, true); prompt != "What's 2+2?" {
+		t.Errorf("Continued prompt = %q, want only the last message", prompt)
+	}
+	if prompt, _ := chatPrompt(chat[1:2], false); prompt != "Hi" {
+		t.Errorf("Single-message prompt = %q, want %q", prompt, "Hi")
+	}
+
+	for _, bad := range [][]ChatMessage{
+		nil,
+		{{Role: "assistant", Content: "Hi"}},
+		{{Role: "user", Content: "  "}},
+		{{Role: "tool", Content: "x"}, {Role: "user", Content: "Hi"}},
+	} {
+		if _, err := chatPrompt(bad, false); err == nil {
+			t.Errorf("chatPrompt(%+v) should fail", bad)
+		}
+	}
+}
+
+var chatTestEvents = []string{
+	`{"type":"assistant","message":{"content":[{"type":"text","text":"Hello "}]}}`,
+	`{"type":"content_block_delta","delta":{"type":"text_delta","text":"world"}}`,
+	`{"type":"result","subtype":"success","session_id":"claude-1","usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":2}}`,
+}
+
+func postChat(handlers *Handlers, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handlers.ChatCompletions(w, req)
+	return w
+}
+
+func TestHandlers_ChatCompletions(t *testing.T) {
+	repo, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	mock := &mockClaudeManager{events: chatTestEvents, sessionID: "claude-1"}
+	handlers.claude = mock
+
+	w := postChat(handlers, `{"model":"gpt-4o","messages":[{"role":"user","content":"Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var resp ChatCompletion
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Object != "chat.completion" || resp.Model != "gpt-4o" || !strings.HasPrefix(resp.ID, "chatcmpl-") {
+		t.Errorf("Response = %+v, want a chat.completion echoing the model", resp)
+	}
+	if len(resp.Choices) != 1 || resp.Choices[0].Message.Content != "Hello world" || resp.Choices[0].FinishReason != "stop" {
+		t.Errorf("Choices = %+v, want one stopped reply %q", resp.Choices, "Hello world")
+	}
+	if resp.Usage == nil || resp.Usage.PromptTokens != 12 || resp.Usage.CompletionTokens != 5 || resp.Usage.TotalTokens != 17 {
+		t.Errorf("Usage = %+v, want 12 prompt and 5 completion tokens", resp.Usage)
+	}
+	if len(mock.prompts) != 1 || mock.prompts[0] != "Hi" {
+		t.Errorf("Prompts = %q, want [Hi]", mock.prompts)
+	}
+
+	// The ephemeral session is gone
+	if n, _ := repo.CountSessions(true); n != 0 {
+		t.Errorf("Got %d sessions after the request, want 0", n)
+	}
+}
+
+func TestHandlers_ChatCompletions_Stream(t *testing.T) {
+	_, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	handlers.claude = &mockClaudeManager{events: chatTestEvents}
+
+	w := postChat(handlers, `{"messages":[{"role":"user","content":"Hi"}],"stream":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var frames []string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			frames = append(frames, data)
+		}
+	}
+	if len(frames) == 0 || frames[len(frames)-1] != "[DONE]" {
+		t.Fatalf("Frames = %q, want a trailing [DONE]", frames)
+	}
+
+	var text strings.Builder
+	var role, finish string
+	for _, frame := range frames[:len(frames)-1] {
+		var chunk ChatCompletionChunk
+		if err := json.Unmarshal([]byte(frame), &chunk); err != nil {
+			t.Fatalf("Invalid chunk %q: %v", frame, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || chunk.Model != defaultChatModel {
+			t.Errorf("Chunk = %+v, want a chat.completion.chunk for the default model", chunk)
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Role != "" {
+			role = delta.Role
+		}
+		text.WriteString(delta.Content)
+		if fr := chunk.Choices[0].FinishReason; fr != nil {
+			finish = *fr
+		}
+	}
+	if role != "assistant" || text.String() != "Hello world" || finish != "stop" {
+		t.Errorf("Streamed role %q, text %q, finish %q; want assistant, %q, stop", role, text.String(), finish, "Hello world")
+	}
+}
+
+func TestHandlers_ChatCompletions_ExistingSession(t *testing.T) {
+	repo, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	mock := &mockClaudeManager{events: chatTestEvents, sessionID: "claude-1"}
+	handlers.claude = mock
+	session, _ := repo.CreateSession(nil, nil)
+
+	w := postChat(handlers, `{"chai_session_id":"`+session.ID+`","messages":[{"role":"user","content":"Hi"},{"role":"assistant","content":"Hello"},{"role":"user","content":"Again"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// Only the new message is sent, and the exchange is kept on the session
+	if mock.prompts[0] != "Again" {
+		t.Errorf("Prompt = %q, want %q", mock.prompts[0], "Again")
+	}
+	messages, _ := repo.GetSessionMessages(session.ID)
+	if len(messages) != 2 || messages[0].Content != "Again" || messages[1].Content != "Hello world" {
+		t.Errorf("Messages = %+v, want the prompt and reply", messages)
+	}
+	updated, _ := repo.GetSession(session.ID)
+	if updated.ClaudeSessionID == nil || *updated.ClaudeSessionID != "claude-1" || updated.StreamStatus != StreamStatusCompleted {
+		t.Errorf("Session = %+v, want Claude session ID set and stream completed", updated)
+	}
+	events, _ := repo.GetEventsSince(session.ID, 0, "", 100)
+	if len(events) == 0 || events[len(events)-1].EventType != "done" {
+		t.Errorf("Events = %+v, want them persisted ending in done", events)
+	}
+}
+
+func TestHandlers_ChatCompletions_DeniesPermissions(t *testing.T) {
+	repo, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	mock := &mockClaudeManager{events: append([]string{
+		`{"type":"control_request","request_id":"req-1","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{"command":"ls"}}}`,
+	}, chatTestEvents...)}
+	handlers.claude = mock
+	session, _ := repo.CreateSession(nil, nil)
+
+	w := postChat(handlers, `{"chai_session_id":"`+session.ID+`","messages":[{"role":"user","content":"Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// Nobody can approve over this API, so the request is denied at once
+	if want := []string{"req-1:deny"}; !slices.Equal(mock.decisions, want) {
+		t.Errorf("Permission decisions = %q, want %q", mock.decisions, want)
+	}
+	events, _ := repo.GetEventsSince(session.ID, 0, "", 100)
+	var denied bool
+	for _, e := range events {
+		if e.EventType == "permission_request" {
+			t.Error("A permission_request was recorded for a request nobody can answer")
+		}
+		denied = denied || e.EventType == "permission_denied"
+	}
+	if !denied {
+		t.Errorf("Events = %+v, want a permission_denied event", events)
+	}
+}
+
+func TestHandlers_ChatCompletions_Errors(t *testing.T) {
+	repo, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	handlers.claude = &mockClaudeManager{events: chatTestEvents}
+	busy, _ := repo.CreateSession(nil, nil)
+	repo.StartNewPrompt(busy.ID)
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"invalid JSON", `{`, http.StatusBadRequest},
+		{"no messages", `{"messages":[]}`, http.StatusBadRequest},
+		{"last not user", `{"messages":[{"role":"assistant","content":"Hi"}]}`, http.StatusBadRequest},
+		{"unknown session", `{"chai_session_id":"nope","messages":[{"role":"user","content":"Hi"}]}`, http.StatusNotFound},
+		{"busy session", `{"chai_session_id":"` + busy.ID + `","messages":[{"role":"user","content":"Hi"}]}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := postChat(handlers, tt.body)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+				Type    string `json:"type"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Error.Message == "" || body.Error.Type == "" {
+			t.Errorf("%s: body %q is not an OpenAI error", tt.name, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the OpenAPI specification GET /openapi.json follows
+const openAPIVersion = "3.0.3"
+
+// schema is a literal OpenAPI schema object, for the few bodies that aren't a
+// named type, such as {"count": 3}
+type schema map[string]any
+
+// apiParam is a query parameter of an API operation
+type apiParam struct {
+	Name        string
+	Type        string // "string", "integer" or "boolean"
+	Description string
+}
+
+// apiOperation describes one route for the OpenAPI spec. Request and Response
+// are zero values of the body types, whose schemas are derived from their
+// fields and json tags, or schema literals. Path parameters come from the
+// {name} placeholders in Path.
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Query    []apiParam
+	Request  any // JSON request body; nil for none
+	Status   int // status of a successful response
+	Response any // JSON response body; nil for none
+	Stream   bool
+}
+
+// Query parameters shared by the session list and count
+var sessionFilterParams = []apiParam{
+	{"include_archived", "boolean", "Include archived sessions"},
+	{"deleted", "boolean", "List the recycle bin instead"},
+	{"status", "string", "Only sessions with this stream status"},
+	{"created_after", "string", "Unix seconds or RFC3339"},
+	{"updated_before", "string", "Unix seconds or RFC3339"},
+}
+
+// Query parameters of the streaming prompt routes
+var streamParams = []apiParam{
+	{"format", "string", `"sse" (default) or "ndjson"`},
+	{"events", "string", `"all" (default) or "text"`},
+}
+
+var statusSchema = schema{"type": "object", "properties": map[string]any{"status": map[string]any{"type": "string"}}}
+
+// apiOperations lists every route the server serves. Keep it in step with the
+// router in cmd/server/main.go.
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/health", Summary: "Health check",
+		Query:    []apiParam{{"deep", "boolean", "Also run the Claude CLI"}},
+		Status:   http.StatusOK,
+		Response: schema{"type": "object", "properties": map[string]any{"status": map[string]any{"type": "string"}, "database": map[string]any{"type": "string"}, "claude": map[string]any{"type": "string"}, "error": map[string]any{"type": "string"}}}},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Status: http.StatusOK, Response: schema{"type": "object"}},
+	{Method: "POST", Path: "/v1/chat/completions", Summary: "OpenAI-compatible chat completion; streams chunks when stream is true",
+		Request: ChatCompletionRequest{}, Status: http.StatusOK, Response: ChatCompletion{}},
+	{Method: "GET", Path: "/api/info", Summary: "Server version and Claude CLI", Status: http.StatusOK, Response: InfoResponse{}},
+
+	{Method: "GET", Path: "/api/sessions", Summary: "List sessions",
+		Query:  append(sessionFilterParams, apiParam{"limit", "integer", "Page size"}, apiParam{"offset", "integer", "Page offset"}),
+		Status: http.StatusOK, Response: []Session{}},
+	{Method: "POST", Path: "/api/sessions", Summary: "Create a session", Request: CreateSessionRequest{}, Status: http.StatusCreated, Response: Session{}},
+	{Method: "GET", Path: "/api/sessions/count", Summary: "Count sessions", Query: sessionFilterParams,
+		Status: http.StatusOK, Response: schema{"type": "object", "properties": map[string]any{"count": map[string]any{"type": "integer"}}}},
+	{Method: "GET", Path: "/api/sessions/{id}", Summary: "Get a session and its messages", Status: http.StatusOK, Response: SessionResponse{}},
+	{Method: "DELETE", Path: "/api/sessions/{id}", Summary: "Move a session to the recycle bin",
+		Query: []apiParam{{"purge", "boolean", "Delete it permanently"}}, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/api/sessions/{id}/system", Summary: "Set the session's system message", Request: SystemMessageRequest{}, Status: http.StatusCreated, Response: Message{}},
+	{Method: "POST", Path: "/api/sessions/{id}/fork", Summary: "Fork a session", Request: ForkSessionRequest{}, Status: http.StatusCreated, Response: Session{}},
+	{Method: "POST", Path: "/api/sessions/{id}/prompt", Summary: "Run a prompt, streaming its events",
+		Query: streamParams, Request: PromptRequest{}, Status: http.StatusOK, Stream: true},
+	{Method: "POST", Path: "/api/sessions/{id}/prompt/preflight", Summary: "Check a prompt without running it", Request: PromptRequest{}, Status: http.StatusOK, Response: PreflightResponse{}},
+	{Method: "POST", Path: "/api/sessions/{id}/retry-failed", Summary: "Rerun the last prompt if it failed", Query: streamParams, Status: http.StatusOK, Stream: true},
+	{Method: "POST", Path: "/api/sessions/{id}/continue", Summary: "Continue the conversation without a new prompt", Query: streamParams, Status: http.StatusOK, Stream: true},
+	{Method: "POST", Path: "/api/sessions/{id}/approve", Summary: "Answer a permission request", Request: ApproveRequest{}, Status: http.StatusOK, Response: statusSchema},
+	{Method: "POST", Path: "/api/sessions/{id}/cancel", Summary: "Cancel the running prompt and any queued ones", Status: http.StatusOK,
+		Response: schema{"type": "object", "properties": map[string]any{"status": map[string]any{"type": "string"}, "queued_cancelled": map[string]any{"type": "integer"}}}},
+	{Method: "POST", Path: "/api/sessions/{id}/archive", Summary: "Archive a session", Status: http.StatusOK, Response: Session{}},
+	{Method: "POST", Path: "/api/sessions/{id}/unarchive", Summary: "Unarchive a session", Status: http.StatusOK, Response: Session{}},
+	{Method: "POST", Path: "/api/sessions/{id}/restore", Summary: "Restore a session from the recycle bin", Status: http.StatusOK, Response: Session{}},
+	{Method: "GET", Path: "/api/sessions/{id}/events", Summary: "Stored prompt events, for catching up; format=summary returns GetEventsSummaryResponse",
+		Query: []apiParam{
+			{"since_sequence", "integer", "Only events after this sequence"},
+			{"prompt_id", "string", "Only this prompt's events"},
+			{"limit", "integer", "Page size"},
+			{"wait", "integer", "Seconds to long-poll for new events"},
+			{"format", "string", `"summary" to reconstruct prompts`},
+			{"include_total", "boolean", "Count all matching events"},
+		},
+		Status: http.StatusOK, Response: GetEventsResponse{}},
+	{Method: "DELETE", Path: "/api/sessions/{id}/events", Summary: "Purge one prompt's events, keeping its messages",
+		Query: []apiParam{{"prompt_id", "string", "The prompt"}}, Status: http.StatusOK,
+		Response: schema{"type": "object", "properties": map[string]any{"deleted": map[string]any{"type": "integer"}}}},
+	{Method: "GET", Path: "/api/sessions/{id}/bookmark", Summary: "Get a client's reconnection bookmark",
+		Query: []apiParam{{"client_id", "string", "The client"}}, Status: http.StatusOK, Response: ClientBookmark{}},
+	{Method: "PUT", Path: "/api/sessions/{id}/bookmark", Summary: "Save a client's reconnection bookmark",
+		Query: []apiParam{{"client_id", "string", "The client"}}, Request: BookmarkRequest{}, Status: http.StatusOK, Response: ClientBookmark{}},
+	{Method: "GET", Path: "/api/sessions/{id}/prompts/{promptId}/snapshot", Summary: "A prompt's state, rebuilt from its events", Status: http.StatusOK, Response: PromptSnapshot{}},
+	{Method: "GET", Path: "/api/sessions/{id}/stats", Summary: "Usage totals for a session", Status: http.StatusOK, Response: SessionStats{}},
+
+	{Method: "GET", Path: "/api/admin/active", Summary: "List running Claude processes", Status: http.StatusOK, Response: []ActiveProcessResponse{}},
+	{Method: "POST", Path: "/api/admin/active/kill", Summary: "Kill processes running longer than a duration",
+		Query: []apiParam{{"running_longer_than", "string", "A Go duration such as 10m"}}, Status: http.StatusOK, Response: BulkKillResponse{}},
+	{Method: "POST", Path: "/api/admin/active/{id}/kill", Summary: "Kill a session's process",
+		Query: []apiParam{{"prompt_id", "string", "Only this concurrent prompt"}}, Status: http.StatusOK, Response: statusSchema},
+	{Method: "GET", Path: "/api/admin/export-all", Summary: "Export every session as a zip archive", Status: http.StatusOK},
+	{Method: "GET", Path: "/api/admin/stats", Summary: "Process and stream statistics", Status: http.StatusOK, Response: StatsResponse{}},
+	{Method: "POST", Path: "/api/admin/backup", Summary: "Back up the database", Status: http.StatusOK, Response: BackupResponse{}},
+	{Method: "GET", Path: "/api/admin/readonly", Summary: "Whether the server is read-only", Status: http.StatusOK, Response: ReadOnlyResponse{}},
+	{Method: "POST", Path: "/api/admin/readonly", Summary: "Turn read-only mode on or off", Request: ReadOnlyRequest{}, Status: http.StatusOK, Response: ReadOnlyResponse{}},
+}
+
+// streamEvents are the events a prompt stream may send, with their payloads
+var streamEvents = []struct {
+	Name    string
+	Payload any
+}{
+	{"connected", schema{"type": "object", "properties": map[string]any{"session_id": map[string]any{"type": "string"}, "prompt_id": map[string]any{"type": "string"}, "label": map[string]any{"type": "string"}}}},
+	{"queued", schema{"type": "object", "properties": map[string]any{"session_id": map[string]any{"type": "string"}, "queue_id": map[string]any{"type": "string"}, "position": map[string]any{"type": "integer"}, "priority": map[string]any{"type": "string"}}}},
+	{"waiting", schema{"type": "object", "properties": map[string]any{"session_id": map[string]any{"type": "string"}, "prompt_id": map[string]any{"type": "string"}, "position": map[string]any{"type": "integer"}}}},
+	{"user_prompt", schema{"type": "object", "properties": map[string]any{"prompt": map[string]any{"type": "string"}}}},
+	{"claude", schema{"description": "A line of the Claude CLI's stream-json output, as sent"}},
+	{"text", schema{"type": "object", "properties": map[string]any{"text": map[string]any{"type": "string"}}}},
+	{"thinking", schema{"type": "object", "properties": map[string]any{"thinking": map[string]any{"type": "string"}}}},
+	{"tool_call", ToolCallEvent{}},
+	{"tool_result", ToolResultEvent{}},
+	{"permission_request", schema{"type": "object", "properties": map[string]any{"request_id": map[string]any{"type": "string"}, "tool_name": map[string]any{"type": "string"}, "input": map[string]any{"type": "object"}}}},
+	{"permission_timeout", schema{"type": "object", "properties": map[string]any{"request_id": map[string]any{"type": "string"}, "tool_name": map[string]any{"type": "string"}, "decision": map[string]any{"type": "string"}}}},
+	{"permission_denied", schema{"type": "object", "properties": map[string]any{"request_id": map[string]any{"type": "string"}, "tool_name": map[string]any{"type": "string"}, "input": map[string]any{"type": "object"}, "decision": map[string]any{"type": "string"}}}},
+	{"reconnect", schema{"type": "object", "properties": map[string]any{"delay_ms": map[string]any{"type": "integer"}, "reason": map[string]any{"type": "string"}}}},
+	{"error", PromptErrorEvent{}},
+	{"cancelled", schema{"type": "object", "properties": map[string]any{"status": map[string]any{"type": "string"}, "queue_id": map[string]any{"type": "string"}}}},
+	{"done", DoneEvent{}},
+}
+
+// schemaEnums lists the values of the string types that are enumerations
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeFor[StreamStatus]():       {string(StreamStatusIdle), string(StreamStatusStreaming), string(StreamStatusCompleted)},
+	reflect.TypeFor[PromptStatus]():       {string(PromptStatusStreaming), string(PromptStatusComplete), string(PromptStatusCancelled), string(PromptStatusError)},
+	reflect.TypeFor[QueuedPromptStatus](): {string(QueuedPromptWaiting), string(QueuedPromptStarted), string(QueuedPromptCancelled), string(QueuedPromptFailed)},
+}
+
+// schemaBuilder derives OpenAPI schemas from Go types the way encoding/json
+// marshals them. Named struct types become components referenced by name.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+func (b *schemaBuilder) schemaFor(v any) map[string]any {
+	if s, ok := v.(schema); ok {
+		return s
+	}
+	return b.schema(reflect.TypeOf(v))
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case reflect.TypeFor[time.Time]():
+		return map[string]any{"type": "string", "format": "date-time"}
+	case reflect.TypeFor[json.RawMessage]():
+		return map[string]any{"description": "Any JSON value"}
+	case reflect.TypeFor[ChatContent]():
+		return map[string]any{"oneOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": map[string]any{"type": "object", "properties": map[string]any{"type": map[string]any{"type": "string"}, "text": map[string]any{"type": "string"}}}},
+		}}
+	}
+	if values, ok := schemaEnums[t]; ok {
+		return map[string]any{"type": "string", "enum": values}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schema(t.Elem())
+		if _, isRef := s["$ref"]; isRef {
+			return s
+		}
+		nullable := make(map[string]any, len(s)+1)
+		for k, v := range s {
+			nullable[k] = v
+		}
+		nullable["nullable"] = true
+		return nullable
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			b.components[t.Name()] = nil // reserve the name so recursive types terminate
+			b.components[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// interfaces: any JSON value
+		return map[string]any{}
+	}
+}
+
+// object builds the schema of a struct's JSON object. Embedded structs
+// without a json name have their fields promoted, as encoding/json does.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				addFields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = b.schema(f.Type)
+			if !strings.Contains(","+opts+",", ",omitempty,") {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+
+	s := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// openAPISpec builds the OpenAPI document for apiOperations.
+func openAPISpec(version string) map[string]any {
+	b := &schemaBuilder{components: map[string]any{}}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content": map[string]any{"application/json": map[string]any{"schema": map[string]any{
+			"oneOf": []any{
+				schema{"type": "object", "properties": map[string]any{"error": map[string]any{"type": "string"}}, "required": []string{"error"}},
+				b.schema(reflect.TypeFor[ValidationError]()),
+			},
+		}}},
+	}
+
+	paths := map[string]any{}
+	for _, op := range apiOperations {
+		var params []any
+		for _, m := range pathParamPattern.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]any{"type": q.Type}})
+		}
+
+		success := map[string]any{"description": http.StatusText(op.Status)}
+		switch {
+		case op.Stream:
+			success["description"] = "A stream of prompt events, as SSE frames or NDJSON lines; see x-events for each event's payload"
+			success["content"] = b.streamContent()
+		case op.Response != nil:
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": b.schemaFor(op.Response)}}
+		case op.Path == "/api/admin/export-all":
+			success["content"] = map[string]any{"application/zip": map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		}
+		if op.Path == "/v1/chat/completions" {
+			success["content"].(map[string]any)["text/event-stream"] = map[string]any{"schema": map[string]any{
+				"type":        "string",
+				"description": "data: frames carrying ChatCompletionChunk objects, ending with data: [DONE]",
+			}, "x-chunk": b.schema(reflect.TypeFor[ChatCompletionChunk]())}
+		}
+
+		operation := map[string]any{
+			"summary":     op.Summary,
+			"operationId": operationID(op),
+			"responses": map[string]any{
+				strconv.Itoa(op.Status): success,
+				"default":               errorResponse,
+			},
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": b.schemaFor(op.Request)}},
+			}
+		}
+
+		item, _ := paths[op.Path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": openAPIVersion,
+		"info": map[string]any{
+			"title":   "chai",
+			"version": version,
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": b.components},
+	}
+}
+
+// streamContent describes a prompt stream in both of its formats.
+func (b *schemaBuilder) streamContent() map[string]any {
+	events := map[string]any{}
+	var names []string
+	for _, e := range streamEvents {
+		events[e.Name] = b.schemaFor(e.Payload)
+		names = append(names, e.Name)
+	}
+	sort.Strings(names)
+	return map[string]any{
+		"text/event-stream": map[string]any{
+			"schema":   map[string]any{"type": "string", "description": "event: <type>\\ndata: <json>\\n\\n frames"},
+			"x-events": events,
+		},
+		"application/x-ndjson": map[string]any{
+			"schema": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"type": map[string]any{"type": "string", "enum": names},
+					"data": map[string]any{"description": "The event's payload, as in x-events"},
+				},
+			},
+			"x-events": events,
+		},
+	}
+}
+
+// operationID names an operation after its method and path, e.g.
+// post_api_sessions_id_prompt.
+func operationID(op apiOperation) string {
+	return strings.ToLower(op.Method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_", ".", "_").Replace(op.Path)
+}
+
+// OpenAPI serves an OpenAPI 3 description of the API, derived from the
+// request and response types.
+func (h *Handlers) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	version := h.opts.Info.Version
+	if version == "" {
+		version = "dev"
+	}
+	writeJSON(w, http.StatusOK, openAPISpec(version))
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// getOpenAPISpec fetches the spec and decodes it as plain JSON, as a client would.
+func getOpenAPISpec(t *testing.T) map[string]any {
+	t.Helper()
+	_, handlers, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	handlers.OpenAPI(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status = %d, want 200", w.Code)
+	}
+	var spec map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Spec is not JSON: %v", err)
+	}
+	return spec
+}
+
+func TestHandlers_OpenAPI(t *testing.T) {
+	spec := getOpenAPISpec(t)
+
+	if v, _ := spec["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		t.Errorf("openapi = %v, want a 3.x version", spec["openapi"])
+	}
+	info, _ := spec["info"].(map[string]any)
+	if info["title"] == "" || info["version"] == "" {
+		t.Errorf("info = %v, want a title and version", info)
+	}
+	schemas, _ := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	// Every $ref must resolve to a component schema
+	var checkRefs func(v any)
+	checkRefs = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			if ref, ok := v["$ref"].(string); ok {
+				name, found := strings.CutPrefix(ref, "#/components/schemas/")
+				if _, exists := schemas[name]; !found || !exists {
+					t.Errorf("$ref %q does not resolve", ref)
+				}
+			}
+			for _, child := range v {
+				checkRefs(child)
+			}
+		case []any:
+			for _, child := range v {
+				checkRefs(child)
+			}
+		}
+	}
+	checkRefs(spec)
+
+	methods := []string{"get", "put", "post", "delete", "patch", "head", "options", "trace"}
+	placeholder := regexp.MustCompile(`\{([^}]+)\}`)
+	paths, _ := spec["paths"].(map[string]any)
+	for path, item := range paths {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("Path %q must start with /", path)
+		}
+		for method, op := range item.(map[string]any) {
+			if !slices.Contains(methods, method) {
+				t.Errorf("%s has unknown method %q", path, method)
+				continue
+			}
+			op := op.(map[string]any)
+			if responses, _ := op["responses"].(map[string]any); len(responses) == 0 {
+				t.Errorf("%s %s has no responses", method, path)
+			}
+
+			// Each {placeholder} must be a required path parameter
+			declared := map[string]bool{}
+			params, _ := op["parameters"].([]any)
+			for _, p := range params {
+				p := p.(map[string]any)
+				if p["in"] == "path" && p["required"] == true {
+					declared[p["name"].(string)] = true
+				}
+			}
+			for _, m := range placeholder.FindAllStringSubmatch(path, -1) {
+				if !declared[m[1]] {
+					t.Errorf("%s %s does not declare path parameter %q", method, path, m[1])
+				}
+			}
+		}
+	}
+
+	for _, route := range []struct{ method, path string }{
+		{"get", "/api/sessions"},
+		{"post", "/api/sessions"},
+		{"post", "/api/sessions/{id}/prompt"},
+		{"put", "/api/sessions/{id}/bookmark"},
+		{"get", "/api/sessions/{id}/prompts/{promptId}/snapshot"},
+		{"get", "/api/admin/stats"},
+	} {
+		if item, _ := paths[route.path].(map[string]any); item == nil || item[route.method] == nil {
+			t.Errorf("Spec is missing %s %s", route.method, route.path)
+		}
+	}
+}
+
+func TestHandlers_OpenAPI_Schemas(t *testing.T) {
+	spec := getOpenAPISpec(t)
+	schemas := spec["components"].(map[string]any)["schemas"].(map[string]any)
+
+	// Properties follow the json tags; omitempty fields aren't required
+	session := schemas["Session"].(map[string]any)
+	properties := session["properties"].(map[string]any)
+	for _, name := range []string{"id", "title", "stream_status", "created_at"} {
+		if properties[name] == nil {
+			t.Errorf("Session is missing property %q", name)
+		}
+	}
+	if properties["PromptSequence"] != nil || properties["prompt_sequence"] != nil {
+		t.Error("Session exposes a json:\"-\" field")
+	}
+	required, _ := session["required"].([]any)
+	if !slices.Contains(required, any("id")) || slices.Contains(required, any("title")) {
+		t.Errorf("Session required = %v, want id but not title", required)
+	}
+	if status := properties["stream_status"].(map[string]any); len(status["enum"].([]any)) != 3 {
+		t.Errorf("stream_status = %v, want its three values", status)
+	}
+	if created := properties["created_at"].(map[string]any); created["format"] != "date-time" {
+		t.Errorf("created_at = %v, want a date-time string", created)
+	}
+
+	// Embedded structs are flattened, as encoding/json does
+	stats := schemas["StatsResponse"].(map[string]any)["properties"].(map[string]any)
+	if stats["streams"] == nil || len(stats) < 2 {
+		t.Errorf("StatsResponse properties = %v, want the embedded stats and streams", stats)
+	}
+
+	// The prompt stream documents its events
+	prompt := spec["paths"].(map[string]any)["/api/sessions/{id}/prompt"].(map[string]any)["post"].(map[string]any)
+	content := prompt["responses"].(map[string]any)["200"].(map[string]any)["content"].(map[string]any)
+	events := content["text/event-stream"].(map[string]any)["x-events"].(map[string]any)
+	for _, name := range []string{"connected", "claude", "done", "error", "reconnect"} {
+		if events[name] == nil {
+			t.Errorf("Prompt stream is missing event %q", name)
+		}
+	}
+	if content["application/x-ndjson"] == nil {
+		t.Error("Prompt stream is missing its NDJSON form")
+	}
+}
@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"sync"
+)
+
+// promptSlots caps how many prompts run Claude at once across all sessions.
+// Prompts that find every slot taken wait in arrival order, and a released
+// slot goes straight to the longest waiter so newcomers can't jump the line.
+// A limit of 0 or less means unlimited, in which case nothing is tracked.
+type promptSlots struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	holders map[string]int // sessionID -> slots held by its prompts
+	waiters []*slotWaiter  // head first
+}
+
+type slotWaiter struct {
+	sessionID string
+	ready     chan struct{} // closed once the waiter has been handed a slot
+}
+
+func newPromptSlots(limit int) *promptSlots {
+	return &promptSlots{limit: limit, holders: make(map[string]int)}
+}
+
+// TryAcquire takes a free slot for sessionID unless every slot is taken or
+// other prompts are already waiting for one.
+func (s *promptSlots) TryAcquire(sessionID string) bool {
+	if s.limit <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running >= s.limit || len(s.waiters) > 0 {
+		return false
+	}
+	s.take(sessionID)
+	return true
+}
+
+// Enqueue joins the line for a slot and returns the waiter with its 1-based
+// position. The waiter's ready channel is closed when it is handed a slot.
+func (s *promptSlots) Enqueue(sessionID string) (*slotWaiter, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := &slotWaiter{sessionID: sessionID, ready: make(chan struct{})}
+	s.waiters = append(s.waiters, w)
+	position := len(s.waiters)
+	// A slot may have come free since TryAcquire failed
+	s.handOff()
+	return w, position
+}
+
+// Acquire takes a slot, waiting in line for one until ctx is done.
+func (s *promptSlots) Acquire(ctx context.Context, sessionID string) error {
+	if s.TryAcquire(sessionID) {
+		return nil
+	}
+	w, _ := s.Enqueue(sessionID)
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		if !s.Cancel(w) {
+			s.Release(sessionID)
+		}
+		return ctx.Err()
+	}
+}
+
+// Cancel takes a waiter out of line. It returns false if the waiter was handed
+// a slot first, which the caller must then Release.
+func (s *promptSlots) Cancel(w *slotWaiter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, waiter := range s.waiters {
+		if waiter == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Release frees a slot held by sessionID, handing it to the longest waiter.
+func (s *promptSlots) Release(sessionID string) {
+	if s.limit <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if s.holders[sessionID]--; s.holders[sessionID] <= 0 {
+		delete(s.holders, sessionID)
+	}
+	s.handOff()
+}
+
+// Active reports whether sessionID holds or is waiting for a slot.
+func (s *promptSlots) Active(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holders[sessionID] > 0 {
+		return true
+	}
+	for _, w := range s.waiters {
+		if w.sessionID == sessionID {
+			return true
+		}
+	}
+	return false
+}
+
+// take records a slot as held by sessionID. Callers hold s.mu.
+func (s *promptSlots) take(sessionID string) {
+	s.running++
+	s.holders[sessionID]++
+}
+
+// handOff gives free slots to waiters at the head of the line. Callers hold s.mu.
+func (s *promptSlots) handOff() {
+	for len(s.waiters) > 0 && s.running < s.limit {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		s.take(w.sessionID)
+		close(w.ready)
+	}
+}
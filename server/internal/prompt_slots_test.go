@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPromptSlots(t *testing.T) {
+	s := newPromptSlots(2)
+	if !s.TryAcquire("a") || !s.TryAcquire("b") {
+		t.Fatal("TryAcquire should take the free slots")
+	}
+	if s.TryAcquire("c") {
+		t.Fatal("TryAcquire should fail with every slot taken")
+	}
+
+	c, pos := s.Enqueue("c")
+	if pos != 1 {
+		t.Errorf("position = %d, want 1", pos)
+	}
+	d, pos := s.Enqueue("d")
+	if pos != 2 {
+		t.Errorf("position = %d, want 2", pos)
+	}
+	if !s.Active("a") || !s.Active("c") || s.Active("e") {
+		t.Error("Active should report holders and waiters only")
+	}
+
+	// A released slot goes to the head of the line, not a newcomer
+	s.Release("a")
+	select {
+	case <-c.ready:
+	default:
+		t.Fatal("the head waiter should get the released slot")
+	}
+	if s.TryAcquire("e") {
+		t.Error("TryAcquire should not jump ahead of waiters")
+	}
+	if s.Active("a") {
+		t.Error("a released its only slot")
+	}
+
+	// A waiter that gives up leaves the line
+	if !s.Cancel(d) {
+		t.Error("Cancel should remove a waiter still in line")
+	}
+	s.Release("b")
+	if !s.TryAcquire("e") {
+		t.Error("the freed slot should be available once nobody waits")
+	}
+
+	// A waiter handed a slot before cancelling must release it instead
+	f, _ := s.Enqueue("f")
+	s.Release("c")
+	<-f.ready
+	if s.Cancel(f) {
+		t.Error("Cancel should report a waiter that already got a slot")
+	}
+}
+
+func TestPromptSlots_Acquire(t *testing.T) {
+	s := newPromptSlots(1)
+	if err := s.Acquire(context.Background(), "a"); err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire = %v, want the context's error", err)
+	}
+	if s.Active("b") {
+		t.Error("a waiter that timed out should leave the line")
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Acquire(context.Background(), "c") }()
+	time.Sleep(10 * time.Millisecond)
+	s.Release("a")
+	if err := <-done; err != nil {
+		t.Errorf("Acquire after release: %v", err)
+	}
+}
+
+func TestPromptSlots_Unlimited(t *testing.T) {
+	s := newPromptSlots(0)
+	for range 100 {
+		if !s.TryAcquire("a") {
+			t.Fatal("an unlimited limiter should never refuse")
+		}
+	}
+	s.Release("a")
+	if s.Active("a") {
+		t.Error("an unlimited limiter doesn't track holders")
+	}
+}
@@ -0,0 +1,187 @@
+package internal
+
+import "sync"
+
+// Prompt priorities accepted in PromptRequest.Priority
+const (
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// promptPriorities ranks priorities; higher ranks are dequeued first
+var promptPriorities = map[string]int{
+	PriorityLow:    0,
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+}
+
+// IsValidPromptPriority reports whether priority is a known prompt priority
+func IsValidPromptPriority(priority string) bool {
+	_, ok := promptPriorities[priority]
+	return ok
+}
+
+// PromptQueue orders prompts waiting for a busy session. It only decides whose
+// turn it is; callers still claim the session with Repository.StartNewPrompt,
+// so a waiter that loses a race simply keeps waiting at the head.
+type PromptQueue struct {
+	mu      sync.Mutex
+	waiting map[string][]*queueEntry // sessionID -> waiters, head first
+}
+
+type queueEntry struct {
+	id        string
+	key       string // the prompt's Idempotency-Key, if any
+	rank      int
+	ready     chan struct{} // signalled when the waiter should try to start
+	cancelled chan struct{} // closed when the session's queue is cancelled
+}
+
+// NewPromptQueue creates an empty queue.
+func NewPromptQueue() *PromptQueue {
+	return &PromptQueue{waiting: make(map[string][]*queueEntry)}
+}
+
+// Enqueue adds a waiter behind every waiter of the same or higher priority and
+// returns its entry and 1-based position. The entry's ready channel is
+// signalled whenever the waiter is at the head and should try to start its
+// prompt. Unknown priorities are treated as normal.
+func (q *PromptQueue) Enqueue(sessionID, id, priority string) (*queueEntry, int) {
+	entry, pos, _ := q.EnqueueKeyed(sessionID, id, priority, "")
+	return entry, pos
+}
+
+// EnqueueKeyed is Enqueue for a prompt sent with an Idempotency-Key. If a
+// waiter with the same key is already on the session's queue, nothing is
+// enqueued and it returns that waiter's ID with a nil entry. An empty key
+// never matches.
+func (q *PromptQueue) EnqueueKeyed(sessionID, id, priority, key string) (*queueEntry, int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if queued := q.keyedLocked(sessionID, key); queued != "" {
+		return nil, 0, queued
+	}
+
+	rank, ok := promptPriorities[priority]
+	if !ok {
+		rank = promptPriorities[PriorityNormal]
+	}
+	entry := &queueEntry{
+		id:        id,
+		key:       key,
+		rank:      rank,
+		ready:     make(chan struct{}, 1),
+		cancelled: make(chan struct{}),
+	}
+
+	entries := q.waiting[sessionID]
+	pos := len(entries)
+	for pos > 0 && entries[pos-1].rank < rank {
+		pos--
+	}
+	entries = append(entries, nil)
+	copy(entries[pos+1:], entries[pos:])
+	entries[pos] = entry
+	q.waiting[sessionID] = entries
+
+	if pos == 0 {
+		// The session may already be idle, so a new head always gets one attempt
+		entry.ready <- struct{}{}
+	}
+	return entry, pos + 1, ""
+}
+
+// Keyed returns the ID of the waiter on the session's queue that was sent
+// with key, or "" if there is none.
+func (q *PromptQueue) Keyed(sessionID, key string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.keyedLocked(sessionID, key)
+}
+
+func (q *PromptQueue) keyedLocked(sessionID, key string) string {
+	if key == "" {
+		return ""
+	}
+	for _, entry := range q.waiting[sessionID] {
+		if entry.key == key {
+			return entry.id
+		}
+	}
+	return ""
+}
+
+// Remove drops a waiter from the session's queue, waking the new head if the
+// removed waiter was first in line.
+func (q *PromptQueue) Remove(sessionID, id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := q.waiting[sessionID]
+	for i, entry := range entries {
+		if entry.id != id {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(q.waiting, sessionID)
+			return
+		}
+		q.waiting[sessionID] = entries
+		if i == 0 {
+			signal(entries[0].ready)
+		}
+		return
+	}
+}
+
+// CancelAll removes every waiter on a session and closes their cancelled
+// channels. Returns the number of waiters cancelled.
+func (q *PromptQueue) CancelAll(sessionID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := q.waiting[sessionID]
+	delete(q.waiting, sessionID)
+	for _, entry := range entries {
+		close(entry.cancelled)
+	}
+	return len(entries)
+}
+
+// Notify wakes the head of the session's queue. Call it when a prompt finishes.
+func (q *PromptQueue) Notify(sessionID string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if entries := q.waiting[sessionID]; len(entries) > 0 {
+		signal(entries[0].ready)
+	}
+}
+
+// IsHead reports whether id is first in line on the session's queue. A waiter
+// can be woken while at the head and be passed by a higher priority waiter
+// before it acts on the wake-up, so it checks before starting.
+func (q *PromptQueue) IsHead(sessionID, id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entries := q.waiting[sessionID]
+	return len(entries) > 0 && entries[0].id == id
+}
+
+// Len returns the number of prompts waiting on a session.
+func (q *PromptQueue) Len(sessionID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting[sessionID])
+}
+
+// signal does a non-blocking send; a pending signal is as good as a new one.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
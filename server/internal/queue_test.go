@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func isReady(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPromptQueue_EnqueuePositions(t *testing.T) {
+	q := NewPromptQueue()
+
+	first, pos1 := q.Enqueue("s1", "a", PriorityNormal)
+	second, pos2 := q.Enqueue("s1", "b", PriorityNormal)
+	_, other := q.Enqueue("s2", "c", PriorityNormal)
+
+	if pos1 != 1 || pos2 != 2 || other != 1 {
+		t.Errorf("Positions = %d, %d, %d, want 1, 2, 1", pos1, pos2, other)
+	}
+
+	// Only the head gets an initial attempt
+	if !isReady(first.ready) {
+		t.Error("Head was not signalled on enqueue")
+	}
+	if isReady(second.ready) {
+		t.Error("Second waiter was signalled before its turn")
+	}
+}
+
+func TestPromptQueue_NotifyWakesHead(t *testing.T) {
+	q := NewPromptQueue()
+
+	first, _ := q.Enqueue("s1", "a", PriorityNormal)
+	second, _ := q.Enqueue("s1", "b", PriorityNormal)
+	<-first.ready
+
+	q.Notify("s1")
+	if !isReady(first.ready) {
+		t.Error("Notify did not wake the head")
+	}
+	if isReady(second.ready) {
+		t.Error("Notify woke a waiter behind the head")
+	}
+
+	// Repeated notifications collapse into one pending signal
+	q.Notify("s1")
+	q.Notify("s1")
+	if !isReady(first.ready) || isReady(first.ready) {
+		t.Error("Expected exactly one pending signal")
+	}
+}
+
+func TestPromptQueue_RemoveHeadWakesNext(t *testing.T) {
+	q := NewPromptQueue()
+
+	first, _ := q.Enqueue("s1", "a", PriorityNormal)
+	second, _ := q.Enqueue("s1", "b", PriorityNormal)
+	third, _ := q.Enqueue("s1", "c", PriorityNormal)
+	<-first.ready
+
+	// Removing from the middle doesn't change whose turn it is
+	q.Remove("s1", "b")
+	if isReady(third.ready) {
+		t.Error("Removing a non-head waiter woke another waiter")
+	}
+
+	q.Remove("s1", "a")
+	if !isReady(third.ready) {
+		t.Error("New head was not signalled")
+	}
+	if isReady(second.ready) {
+		t.Error("Removed waiter was signalled")
+	}
+
+	q.Remove("s1", "c")
+	if q.Len("s1") != 0 {
+		t.Errorf("Len = %d, want 0", q.Len("s1"))
+	}
+
+	// Unknown IDs are ignored
+	q.Remove("s1", "missing")
+}
+
+func TestPromptQueue_Priority(t *testing.T) {
+	q := NewPromptQueue()
+
+	q.Enqueue("s1", "low", PriorityLow)
+	q.Enqueue("s1", "normal1", PriorityNormal)
+	_, pos := q.Enqueue("s1", "high", PriorityHigh)
+	if pos != 1 {
+		t.Errorf("High priority position = %d, want 1", pos)
+	}
+	_, pos = q.Enqueue("s1", "normal2", PriorityNormal)
+	if pos != 3 {
+		t.Errorf("Second normal position = %d, want 3 (behind earlier normal)", pos)
+	}
+
+	var order []string
+	for _, entry := range q.waiting["s1"] {
+		order = append(order, entry.id)
+	}
+	want := "high,normal1,normal2,low"
+	if got := strings.Join(order, ","); got != want {
+		t.Errorf("Queue order = %s, want %s", got, want)
+	}
+}
+
+func TestPromptQueue_IsHead(t *testing.T) {
+	q := NewPromptQueue()
+
+	low, _ := q.Enqueue("s1", "low", PriorityLow)
+	high, _ := q.Enqueue("s1", "high", PriorityHigh)
+
+	// Both were woken on reaching the head, but only the current head may start
+	for _, entry := range []*queueEntry{low, high} {
+		select {
+		case <-entry.ready:
+		default:
+			t.Errorf("%s was not woken when it became the head", entry.id)
+		}
+	}
+	if q.IsHead("s1", "low") {
+		t.Error("IsHead(low) = true after a high priority prompt was queued ahead")
+	}
+	if !q.IsHead("s1", "high") {
+		t.Error("IsHead(high) = false, want true")
+	}
+
+	q.Remove("s1", "high")
+	if !q.IsHead("s1", "low") {
+		t.Error("IsHead(low) = false once it is first in line")
+	}
+	if q.IsHead("s2", "low") {
+		t.Error("IsHead on another session's queue = true")
+	}
+}
+
+func TestIsValidPromptPriority(t *testing.T) {
+	for _, p := range []string{PriorityLow, PriorityNormal, PriorityHigh} {
+		if !IsValidPromptPriority(p) {
+			t.Errorf("IsValidPromptPriority(%q) = false, want true", p)
+		}
+	}
+	for _, p := range []string{"", "urgent", "HIGH"} {
+		if IsValidPromptPriority(p) {
+			t.Errorf("IsValidPromptPriority(%q) = true, want false", p)
+		}
+	}
+}
+
+func TestPromptQueue_CancelAll(t *testing.T) {
+	q := NewPromptQueue()
+
+	first, _ := q.Enqueue("s1", "a", PriorityNormal)
+	second, _ := q.Enqueue("s1", "b", PriorityNormal)
+	other, _ := q.Enqueue("s2", "c", PriorityNormal)
+
+	if n := q.CancelAll("s1"); n != 2 {
+		t.Errorf("CancelAll = %d, want 2", n)
+	}
+	for _, entry := range []*queueEntry{first, second} {
+		select {
+		case <-entry.cancelled:
+		default:
+			t.Errorf("Waiter %s was not cancelled", entry.id)
+		}
+	}
+	select {
+	case <-other.cancelled:
+		t.Error("Waiter on another session was cancelled")
+	default:
+	}
+
+	if q.Len("s1") != 0 {
+		t.Errorf("Len = %d, want 0", q.Len("s1"))
+	}
+	// Removing an already cancelled waiter is a no-op
+	q.Remove("s1", "a")
+	if n := q.CancelAll("s1"); n != 0 {
+		t.Errorf("Second CancelAll = %d, want 0", n)
+	}
+}
+
+func TestPromptQueue_EnqueueKeyed(t *testing.T) {
+	q := NewPromptQueue()
+
+	if _, _, dup := q.EnqueueKeyed("s1", "a", PriorityNormal, "key-1"); dup != "" {
+		t.Fatalf("First keyed waiter reported duplicate %q", dup)
+	}
+	entry, _, dup := q.EnqueueKeyed("s1", "b", PriorityNormal, "key-1")
+	if entry != nil || dup != "a" {
+		t.Errorf("EnqueueKeyed with a queued key = %v, %q, want nil, a", entry, dup)
+	}
+	if _, _, dup := q.EnqueueKeyed("s2", "c", PriorityNormal, "key-1"); dup != "" {
+		t.Errorf("Key on another session reported duplicate %q", dup)
+	}
+	if q.Keyed("s1", "key-1") != "a" || q.Keyed("s1", "") != "" {
+		t.Errorf("Keyed = %q, %q, want a and none", q.Keyed("s1", "key-1"), q.Keyed("s1", ""))
+	}
+
+	q.Remove("s1", "a")
+	if got := q.Keyed("s1", "key-1"); got != "" {
+		t.Errorf("Keyed after removal = %q, want none", got)
+	}
+}
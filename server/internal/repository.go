@@ -1,16 +1,22 @@
 package internal
 
 import (
+	"bytes"
+	"compress/gzip"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -18,14 +24,108 @@ var (
 	ErrSessionBusy = errors.New("session is busy")
 	// ErrSessionNotFound is returned when a session does not exist
 	ErrSessionNotFound = errors.New("session not found")
+	// ErrTitleInUse is returned when unique titles are enforced and another session already has the title
+	ErrTitleInUse = errors.New("title already in use")
+	// ErrSessionLimit is returned when creating a session would exceed MaxSessions
+	ErrSessionLimit = errors.New("session limit reached")
+	// ErrDuplicatePrompt is returned, with the original prompt's ID, when a
+	// prompt's idempotency key was already used on the session
+	ErrDuplicatePrompt = errors.New("duplicate prompt")
+	// ErrInvalidRole is returned when creating a message with an unknown role
+	ErrInvalidRole = errors.New("invalid message role")
+	// ErrSessionStarted is returned when adding a system message to a session that already has messages
+	ErrSessionStarted = errors.New("session already has messages")
+	// ErrMessageNotFound is returned when a message ID doesn't belong to the session
+	ErrMessageNotFound = errors.New("message not found")
+	// ErrPromptStreaming is returned when deleting the events of a prompt that is still running
+	ErrPromptStreaming = errors.New("prompt is still streaming")
+)
+
+// messageRoles are the roles a stored message may have
+var messageRoles = map[string]bool{
+	"user":      true,
+	"assistant": true,
+	"system":    true,
+}
+
+// IsValidMessageRole reports whether role is a known message role
+func IsValidMessageRole(role string) bool {
+	return messageRoles[role]
+}
+
+// isForeignKeyViolation reports whether err is SQLite rejecting a row whose
+// parent no longer exists, such as a message for a deleted session.
+func isForeignKeyViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+// RepositoryOptions configures the behavior of NewRepository.
+type RepositoryOptions struct {
+	// UniqueTitles rejects creating a session with a title already used by another session.
+	UniqueTitles bool
+	// BusyTimeout is how long a connection waits for a lock held by another
+	// connection before failing with SQLITE_BUSY. Zero uses DefaultBusyTimeout.
+	BusyTimeout time.Duration
+	// JournalMode is SQLite's journal_mode. Empty uses DefaultJournalMode.
+	JournalMode string
+	// ReadConns opens a separate pool of up to this many read-only connections
+	// for queries. Zero keeps reads on the single writer connection, so a read
+	// waits behind any write in progress. Readers only run alongside the
+	// writer in WAL mode; other journal modes make them wait on the busy timeout.
+	ReadConns int
+	// MaxSessions caps live (not archived or deleted) sessions; creating one
+	// more fails with ErrSessionLimit. Zero is unlimited.
+	MaxSessions int
+	// ArchiveOldestOnLimit makes room at MaxSessions by archiving the least
+	// recently updated idle sessions instead of failing.
+	ArchiveOldestOnLimit bool
+	// MaxEventsPerPrompt keeps only each prompt's most recent events, plus its
+	// first two (connected and user_prompt), trimming the rest as new ones are
+	// inserted. Zero is unlimited.
+	MaxEventsPerPrompt int
+	// CompressEvents gzips event data before storing it, when that makes it
+	// smaller. Reads handle compressed and uncompressed rows either way.
+	CompressEvents bool
+}
+
+// Database defaults used when RepositoryOptions leaves them zero
+const (
+	DefaultBusyTimeout = 5 * time.Second
+	DefaultJournalMode = "WAL"
 )
 
 type Repository struct {
-	db *sql.DB
+	db       *sql.DB // single writer connection
+	reader   *sql.DB // read pool; the same as db unless ReadConns is set
+	opts     RepositoryOptions
+	notifier *eventNotifier
 }
 
-func NewRepository(dbPath string) (*Repository, error) {
-	db, err := sql.Open("sqlite3", dbPath+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+// NewRepository opens the SQLite database at dbPath and runs migrations.
+// A nil opts uses the defaults.
+func NewRepository(dbPath string, opts *RepositoryOptions) (*Repository, error) {
+	repo := &Repository{notifier: newEventNotifier()}
+	if opts != nil {
+		repo.opts = *opts
+	}
+	busyTimeout := repo.opts.BusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = DefaultBusyTimeout
+	}
+	journalMode := repo.opts.JournalMode
+	if journalMode == "" {
+		journalMode = DefaultJournalMode
+	}
+	// Create the database's directory on first run, e.g. for /var/lib/chai/chai.db
+	if dbPath != ":memory:" && !strings.HasPrefix(dbPath, "file:") {
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0o755); err != nil {
+			return nil, fmt.Errorf("create database directory: %w", err)
+		}
+	}
+	dsn := fmt.Sprintf("%s?_foreign_keys=on&_journal_mode=%s&_busy_timeout=%d", dbPath, journalMode, busyTimeout.Milliseconds())
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -33,17 +133,42 @@ func NewRepository(dbPath string) (*Repository, error) {
 	// Limit connections to 1 for writes to avoid SQLite lock contention
 	// SQLite handles concurrent reads well but only allows one writer at a time
 	db.SetMaxOpenConns(1)
+	repo.db = db
+	repo.reader = db
 
-	repo := &Repository{db: db}
 	if err := repo.migrate(); err != nil {
 		db.Close()
 		return nil, err
 	}
 
+	// The in-memory queue and the clients waiting on it don't survive a
+	// restart, so prompts still marked queued never run
+	if n, err := repo.cancelStaleQueuedPrompts(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cancel stale queued prompts: %w", err)
+	} else if n > 0 {
+		log.Printf("Cancelled %d queued prompts left over from a previous run", n)
+	}
+
+	// Readers are opened after migrating so they see the final schema
+	if repo.opts.ReadConns > 0 {
+		reader, err := sql.Open("sqlite3", dsn+"&_query_only=on")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		reader.SetMaxOpenConns(repo.opts.ReadConns)
+		reader.SetMaxIdleConns(repo.opts.ReadConns)
+		repo.reader = reader
+	}
+
 	return repo, nil
 }
 
 func (r *Repository) Close() error {
+	if r.reader != r.db {
+		r.reader.Close()
+	}
 	return r.db.Close()
 }
 
@@ -52,6 +177,35 @@ func (r *Repository) Ping() error {
 	return r.db.Ping()
 }
 
+// Checkpoint copies the WAL into the main database file and truncates the WAL
+// to zero bytes. It fails if another connection kept the checkpoint from
+// completing.
+func (r *Repository) Checkpoint() error {
+	var busy, logFrames, checkpointed int
+	if err := r.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("checkpoint incomplete: %d of %d WAL frames checkpointed", checkpointed, logFrames)
+	}
+	return nil
+}
+
+// Vacuum rebuilds the database to reclaim pages freed by deleted rows. In WAL
+// mode the file only shrinks once the rebuilt pages are checkpointed.
+func (r *Repository) Vacuum() error {
+	_, err := r.db.Exec(`VACUUM`)
+	return err
+}
+
+// Backup writes a consistent copy of the database to destPath while the server
+// keeps running. VACUUM INTO reads through the live connection, so committed
+// transactions still in the WAL are included. destPath must not already exist.
+func (r *Repository) Backup(destPath string) error {
+	_, err := r.db.Exec(`VACUUM INTO ?`, destPath)
+	return err
+}
+
 func (r *Repository) migrate() error {
 	schema := `
 	CREATE TABLE IF NOT EXISTS sessions (
@@ -61,6 +215,17 @@ func (r *Repository) migrate() error {
 		working_directory TEXT,
 		stream_status TEXT DEFAULT 'idle',
 		prompt_sequence INTEGER DEFAULT 0,
+		permission_mode TEXT,
+		queue_prompts INTEGER DEFAULT 0,
+		concurrent_prompts INTEGER DEFAULT 0,
+		active_prompts INTEGER NOT NULL DEFAULT 0,
+		env TEXT,
+		extra_args TEXT,
+		claude_cmd TEXT,
+		prompt_timeout_ms INTEGER NOT NULL DEFAULT 0,
+		forked_from TEXT,
+		archived_at INTEGER,
+		deleted_at INTEGER,
 		created_at INTEGER NOT NULL,
 		updated_at INTEGER NOT NULL
 	);
@@ -71,6 +236,11 @@ func (r *Repository) migrate() error {
 		role TEXT NOT NULL,
 		content TEXT NOT NULL,
 		tool_calls TEXT,
+		blocks TEXT,
+		thinking TEXT,
+		truncated INTEGER NOT NULL DEFAULT 0,
+		continuation INTEGER NOT NULL DEFAULT 0,
+		attachments TEXT,
 		created_at INTEGER NOT NULL,
 		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
 	);
@@ -84,6 +254,7 @@ func (r *Repository) migrate() error {
 		sequence INTEGER NOT NULL,
 		event_type TEXT NOT NULL,
 		data TEXT NOT NULL,
+		compressed INTEGER NOT NULL DEFAULT 0,
 		created_at INTEGER NOT NULL,
 		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
 	);
@@ -96,234 +267,1177 @@ func (r *Repository) migrate() error {
 		ON session_events(session_id, sequence);
 	CREATE INDEX IF NOT EXISTS idx_session_events_created
 		ON session_events(created_at);
+
+	CREATE TABLE IF NOT EXISTS queued_prompts (
+		id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		prompt TEXT NOT NULL,
+		priority TEXT NOT NULL DEFAULT 'normal',
+		status TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_queued_prompts_session
+		ON queued_prompts(session_id, status);
+
+	CREATE TABLE IF NOT EXISTS prompt_snapshots (
+		prompt_id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		text TEXT NOT NULL,
+		tool_calls TEXT,
+		result TEXT,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_prompt_snapshots_session
+		ON prompt_snapshots(session_id);
+
+	CREATE TABLE IF NOT EXISTS prompt_stats (
+		prompt_id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		cost_usd REAL NOT NULL DEFAULT 0,
+		input_tokens INTEGER NOT NULL DEFAULT 0,
+		output_tokens INTEGER NOT NULL DEFAULT 0,
+		cache_creation_input_tokens INTEGER NOT NULL DEFAULT 0,
+		cache_read_input_tokens INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_prompt_stats_session
+		ON prompt_stats(session_id);
+
+	CREATE TABLE IF NOT EXISTS prompt_idempotency_keys (
+		session_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		prompt_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (session_id, key),
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_prompt_idempotency_keys_created
+		ON prompt_idempotency_keys(created_at);
+
+	CREATE TABLE IF NOT EXISTS prompt_labels (
+		prompt_id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		label TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS prompt_settings (
+		prompt_id TEXT PRIMARY KEY,
+		session_id TEXT NOT NULL,
+		priority TEXT NOT NULL DEFAULT 'normal',
+		timeout_ms INTEGER NOT NULL DEFAULT 0,
+		raw_args INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS client_bookmarks (
+		session_id TEXT NOT NULL,
+		client_id TEXT NOT NULL,
+		prompt_id TEXT,
+		sequence INTEGER,
+		cursor TEXT,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (session_id, client_id),
+		FOREIGN KEY (session_id) REFERENCES sessions(id) ON DELETE CASCADE
+	);
 	`
 	if _, err := r.db.Exec(schema); err != nil {
 		return err
 	}
 
-	// Add columns to existing sessions table (for existing DBs created before this migration)
-	// Only "duplicate column" errors are expected and ignored; other errors are logged
-	if _, err := r.db.Exec(`ALTER TABLE sessions ADD COLUMN stream_status TEXT DEFAULT 'idle'`); err != nil {
-		if !strings.Contains(err.Error(), "duplicate column") {
-			log.Printf("Warning: migration error adding stream_status column: %v", err)
-		}
-	}
-	if _, err := r.db.Exec(`ALTER TABLE sessions ADD COLUMN prompt_sequence INTEGER DEFAULT 0`); err != nil {
-		if !strings.Contains(err.Error(), "duplicate column") {
-			log.Printf("Warning: migration error adding prompt_sequence column: %v", err)
+	// Add columns to tables created before they existed. Only "duplicate
+	// column" errors are expected, from databases that already have them;
+	// anything else means the database is broken and is returned.
+	for _, col := range []struct{ table, name, definition string }{
+		{"sessions", "stream_status", "TEXT DEFAULT 'idle'"},
+		{"sessions", "prompt_sequence", "INTEGER DEFAULT 0"},
+		{"sessions", "permission_mode", "TEXT"},
+		{"sessions", "queue_prompts", "INTEGER DEFAULT 0"},
+		{"sessions", "concurrent_prompts", "INTEGER DEFAULT 0"},
+		{"sessions", "active_prompts", "INTEGER NOT NULL DEFAULT 0"},
+		{"sessions", "env", "TEXT"},
+		{"sessions", "extra_args", "TEXT"},
+		{"sessions", "claude_cmd", "TEXT"},
+		{"sessions", "prompt_timeout_ms", "INTEGER NOT NULL DEFAULT 0"},
+		{"sessions", "forked_from", "TEXT"},
+		{"sessions", "archived_at", "INTEGER"},
+		{"sessions", "deleted_at", "INTEGER"},
+		{"messages", "truncated", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "continuation", "INTEGER NOT NULL DEFAULT 0"},
+		{"messages", "attachments", "TEXT"},
+		{"messages", "blocks", "TEXT"},
+		{"messages", "thinking", "TEXT"},
+		{"session_events", "compressed", "INTEGER NOT NULL DEFAULT 0"},
+		{"queued_prompts", "priority", "TEXT NOT NULL DEFAULT 'normal'"},
+		{"prompt_settings", "raw_args", "INTEGER NOT NULL DEFAULT 0"},
+	} {
+		if err := r.addColumn(col.table, col.name, col.definition); err != nil {
+			return err
 		}
 	}
 
 	// Backfill existing sessions with default values
-	r.db.Exec(`UPDATE sessions SET stream_status = 'idle', prompt_sequence = 0 WHERE stream_status IS NULL`)
+	if _, err := r.db.Exec(`UPDATE sessions SET stream_status = 'idle', prompt_sequence = 0 WHERE stream_status IS NULL`); err != nil {
+		return fmt.Errorf("backfill sessions: %w", err)
+	}
 
 	return nil
 }
 
-// Session operations
-
-func (r *Repository) CreateSession(title, workingDir *string) (*Session, error) {
-	now := time.Now()
-	session := &Session{
-		ID:               uuid.New().String(),
-		Title:            title,
-		WorkingDirectory: workingDir,
-		StreamStatus:     StreamStatusIdle,
-		PromptSequence:   0,
-		CreatedAt:        now,
-		UpdatedAt:        now,
+// addColumn adds a column to table, succeeding if it is already there.
+func (r *Repository) addColumn(table, name, definition string) error {
+	_, err := r.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, name, definition))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return fmt.Errorf("add %s.%s column: %w", table, name, err)
 	}
+	return nil
+}
 
-	_, err := r.db.Exec(
-		`INSERT INTO sessions (id, claude_session_id, title, working_directory, stream_status, prompt_sequence, created_at, updated_at)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		session.ID, session.ClaudeSessionID, session.Title, session.WorkingDirectory,
-		string(session.StreamStatus), session.PromptSequence,
-		session.CreatedAt.Unix(), session.UpdatedAt.Unix(),
-	)
-	if err != nil {
-		return nil, err
-	}
+// Session operations
 
-	return session, nil
-}
+// sessionColumns is the column list shared by session queries, in scanSession order.
+const sessionColumns = `id, claude_session_id, title, working_directory, stream_status, prompt_sequence,
+	permission_mode, queue_prompts, concurrent_prompts, env, extra_args, claude_cmd, prompt_timeout_ms, forked_from, archived_at, deleted_at, created_at, updated_at`
 
-func (r *Repository) GetSession(id string) (*Session, error) {
-	row := r.db.QueryRow(
-		`SELECT id, claude_session_id, title, working_directory, stream_status, prompt_sequence, created_at, updated_at
-		 FROM sessions WHERE id = ?`, id,
-	)
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanSession scans a row selected with sessionColumns.
+func scanSession(row rowScanner) (*Session, error) {
 	var session Session
 	var streamStatus string
+	var env, extraArgs sql.NullString
+	var archivedAt, deletedAt sql.NullInt64
 	var createdAt, updatedAt int64
 	err := row.Scan(
 		&session.ID, &session.ClaudeSessionID, &session.Title,
 		&session.WorkingDirectory, &streamStatus, &session.PromptSequence,
-		&createdAt, &updatedAt,
+		&session.PermissionMode, &session.QueuePrompts, &session.ConcurrentPrompts, &env, &extraArgs, &session.ClaudeCmd, &session.PromptTimeoutMS, &session.ForkedFrom, &archivedAt, &deletedAt, &createdAt, &updatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
 
+	if env.Valid && env.String != "" {
+		if err := json.Unmarshal([]byte(env.String), &session.Env); err != nil {
+			return nil, fmt.Errorf("decode session env: %w", err)
+		}
+	}
+	if len(session.Env) > 0 {
+		session.EnvNames = sortedKeys(session.Env)
+	}
+	if extraArgs.Valid && extraArgs.String != "" {
+		if err := json.Unmarshal([]byte(extraArgs.String), &session.ExtraArgs); err != nil {
+			return nil, fmt.Errorf("decode session extra_args: %w", err)
+		}
+	}
+
+	if archivedAt.Valid {
+		t := time.Unix(archivedAt.Int64, 0)
+		session.ArchivedAt = &t
+	}
+	if deletedAt.Valid {
+		t := time.Unix(deletedAt.Int64, 0)
+		session.DeletedAt = &t
+	}
+
+	if session.PromptSequence > 0 {
+		session.LastPromptID = promptIDFor(session.ID, session.PromptSequence)
+	}
 	session.StreamStatus = StreamStatus(streamStatus)
 	session.CreatedAt = time.Unix(createdAt, 0)
 	session.UpdatedAt = time.Unix(updatedAt, 0)
 	return &session, nil
 }
 
-func (r *Repository) ListSessions() ([]Session, error) {
-	rows, err := r.db.Query(
-		`SELECT id, claude_session_id, title, working_directory, stream_status, prompt_sequence, created_at, updated_at
-		 FROM sessions ORDER BY updated_at DESC`,
-	)
+// CreateSession creates a session with default settings.
+func (r *Repository) CreateSession(title, workingDir *string) (*Session, error) {
+	return r.CreateSessionWithSettings(title, workingDir, SessionSettings{})
+}
+
+// CreateSessionWithSettings creates a session with per-session overrides.
+func (r *Repository) CreateSessionWithSettings(title, workingDir *string, settings SessionSettings) (*Session, error) {
+	now := time.Now()
+	session := &Session{
+		ID:                uuid.New().String(),
+		Title:             title,
+		WorkingDirectory:  workingDir,
+		StreamStatus:      StreamStatusIdle,
+		PromptSequence:    0,
+		PermissionMode:    settings.PermissionMode,
+		QueuePrompts:      settings.QueuePrompts,
+		ConcurrentPrompts: settings.ConcurrentPrompts,
+		Env:               settings.Env,
+		ExtraArgs:         settings.ExtraArgs,
+		ClaudeCmd:         settings.ClaudeCmd,
+		PromptTimeoutMS:   settings.PromptTimeout.Milliseconds(),
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+
+	tx, err := r.db.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	sessions := []Session{} // Initialize as empty slice, not nil
-	for rows.Next() {
-		var s Session
-		var streamStatus string
-		var createdAt, updatedAt int64
-		if err := rows.Scan(
-			&s.ID, &s.ClaudeSessionID, &s.Title,
-			&s.WorkingDirectory, &streamStatus, &s.PromptSequence,
-			&createdAt, &updatedAt,
-		); err != nil {
-			return nil, err
-		}
-		s.StreamStatus = StreamStatus(streamStatus)
-		s.CreatedAt = time.Unix(createdAt, 0)
-		s.UpdatedAt = time.Unix(updatedAt, 0)
-		sessions = append(sessions, s)
+	if err := r.insertSession(tx, session); err != nil {
+		return nil, err
 	}
 
-	return sessions, rows.Err()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return session, nil
 }
 
-func (r *Repository) UpdateSessionClaudeID(id, claudeSessionID string) error {
-	_, err := r.db.Exec(
-		`UPDATE sessions SET claude_session_id = ?, updated_at = ? WHERE id = ?`,
-		claudeSessionID, time.Now().Unix(), id,
+// insertSession writes a new session within tx, enforcing unique titles and
+// the session cap.
+func (r *Repository) insertSession(tx *sql.Tx, session *Session) error {
+	// Check and insert in one transaction so concurrent creates can't both claim a title
+	if err := r.admitLiveSession(tx, session.ID, session.Title, session.CreatedAt); err != nil {
+		return err
+	}
+
+	var env *string
+	if len(session.Env) > 0 {
+		session.EnvNames = sortedKeys(session.Env)
+		data, err := json.Marshal(session.Env)
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		env = &s
+	}
+	var extraArgs *string
+	if len(session.ExtraArgs) > 0 {
+		data, err := json.Marshal(session.ExtraArgs)
+		if err != nil {
+			return err
+		}
+		s := string(data)
+		extraArgs = &s
+	}
+
+	_, err := tx.Exec(
+		`INSERT INTO sessions (`+sessionColumns+`)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.ClaudeSessionID, session.Title, session.WorkingDirectory,
+		string(session.StreamStatus), session.PromptSequence, session.PermissionMode,
+		session.QueuePrompts, session.ConcurrentPrompts, env, extraArgs, session.ClaudeCmd, session.PromptTimeoutMS,
+		session.ForkedFrom, nil, nil, session.CreatedAt.Unix(), session.UpdatedAt.Unix(),
 	)
 	return err
 }
 
-func (r *Repository) DeleteSession(id string) (bool, error) {
-	result, err := r.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+// ForkSession creates a session that branches from sourceID: a copy of its
+// messages, up to and including upToMessageID when set, and its settings, but
+// not its Claude session, so the fork continues independently. Returns
+// ErrSessionNotFound if the source doesn't exist and ErrMessageNotFound if
+// upToMessageID isn't one of its messages.
+func (r *Repository) ForkSession(sourceID, upToMessageID string, title *string) (*Session, error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	source, err := scanSession(tx.QueryRow(
+		`SELECT `+sessionColumns+` FROM sessions WHERE id = ? AND deleted_at IS NULL`, sourceID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, ErrSessionNotFound
 	}
-	rows, err := result.RowsAffected()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	return rows > 0, nil
-}
 
-// Message operations
-
-func (r *Repository) CreateMessage(sessionID, role, content string, toolCalls json.RawMessage) (*Message, error) {
-	now := time.Now()
-	msg := &Message{
-		ID:        uuid.New().String(),
-		SessionID: sessionID,
-		Role:      role,
-		Content:   content,
-		ToolCalls: toolCalls,
-		CreatedAt: now,
+	// Messages are ordered by (created_at, rowid), so the cut-off is a position
+	// in that order rather than a timestamp alone
+	cutoff := `1`
+	args := []any{sourceID}
+	if upToMessageID != "" {
+		var createdAt, rowid int64
+		err := tx.QueryRow(
+			`SELECT created_at, rowid FROM messages WHERE id = ? AND session_id = ?`, upToMessageID, sourceID,
+		).Scan(&createdAt, &rowid)
+		if err == sql.ErrNoRows {
+			return nil, ErrMessageNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		cutoff = `(created_at < ? OR (created_at = ? AND rowid <= ?))`
+		args = append(args, createdAt, createdAt, rowid)
 	}
 
-	var toolCallsStr *string
-	if toolCalls != nil {
-		s := string(toolCalls)
-		toolCallsStr = &s
+	type copied struct {
+		role, content     string
+		toolCalls, blocks *string
+		thinking          *string
+		attachments       *string
+		truncated         bool
+		continuation      bool
+		createdAt         int64
 	}
-
-	_, err := r.db.Exec(
-		`INSERT INTO messages (id, session_id, role, content, tool_calls, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		msg.ID, msg.SessionID, msg.Role, msg.Content, toolCallsStr, msg.CreatedAt.Unix(),
+	rows, err := tx.Query(
+		`SELECT role, content, tool_calls, blocks, thinking, truncated, continuation, attachments, created_at
+		 FROM messages WHERE session_id = ? AND `+cutoff+`
+		 ORDER BY created_at ASC, rowid ASC`, args...,
 	)
 	if err != nil {
 		return nil, err
 	}
+	var messages []copied
+	for rows.Next() {
+		var m copied
+		if err := rows.Scan(&m.role, &m.content, &m.toolCalls, &m.blocks, &m.thinking, &m.truncated, &m.continuation, &m.attachments, &m.createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	// Update session's updated_at
-	if _, err := r.db.Exec(`UPDATE sessions SET updated_at = ? WHERE id = ?`, now.Unix(), sessionID); err != nil {
-		log.Printf("Warning: failed to update session updated_at for session %s: %v", sessionID, err)
+	now := time.Now()
+	session := &Session{
+		ID:                uuid.New().String(),
+		Title:             title,
+		WorkingDirectory:  source.WorkingDirectory,
+		StreamStatus:      StreamStatusIdle,
+		PermissionMode:    source.PermissionMode,
+		QueuePrompts:      source.QueuePrompts,
+		ConcurrentPrompts: source.ConcurrentPrompts,
+		Env:               source.Env,
+		ExtraArgs:         source.ExtraArgs,
+		ClaudeCmd:         source.ClaudeCmd,
+		PromptTimeoutMS:   source.PromptTimeoutMS,
+		ForkedFrom:        &source.ID,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if err := r.insertSession(tx, session); err != nil {
+		return nil, err
 	}
 
-	return msg, nil
+	for _, m := range messages {
+		_, err := tx.Exec(
+			`INSERT INTO messages (id, session_id, role, content, tool_calls, blocks, thinking, truncated, continuation, attachments, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			uuid.New().String(), session.ID, m.role, m.content, m.toolCalls, m.blocks, m.thinking, m.truncated, m.continuation, m.attachments, m.createdAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return session, nil
 }
 
-func (r *Repository) GetSessionMessages(sessionID string) ([]Message, error) {
-	rows, err := r.db.Query(
-		`SELECT id, session_id, role, content, tool_calls, created_at
-		 FROM messages WHERE session_id = ? ORDER BY created_at ASC`, sessionID,
+// GetSession returns a session, or sql.ErrNoRows if it doesn't exist or is in
+// the recycle bin.
+func (r *Repository) GetSession(id string) (*Session, error) {
+	row := r.reader.QueryRow(
+		`SELECT `+sessionColumns+`
+		 FROM sessions WHERE id = ? AND deleted_at IS NULL`, id,
 	)
+	return scanSession(row)
+}
+
+// SessionFilter narrows ListSessions and CountSessions.
+type SessionFilter struct {
+	IncludeArchived bool
+	Deleted         bool         // list the recycle bin instead of live sessions
+	StreamStatus    StreamStatus // "" for any
+	CreatedAfter    time.Time    // zero for no bound
+	UpdatedBefore   time.Time    // zero for no bound
+	Limit           int          // 0 for no limit
+	Offset          int
+}
+
+// where returns the WHERE clause (possibly empty) and its arguments.
+func (f SessionFilter) where() (string, []any) {
+	var conds []string
+	var args []any
+	if f.Deleted {
+		conds = append(conds, "deleted_at IS NOT NULL")
+	} else {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if !f.IncludeArchived {
+		conds = append(conds, "archived_at IS NULL")
+	}
+	if f.StreamStatus != "" {
+		conds = append(conds, "stream_status = ?")
+		args = append(args, f.StreamStatus)
+	}
+	if !f.CreatedAfter.IsZero() {
+		conds = append(conds, "created_at > ?")
+		args = append(args, f.CreatedAfter.Unix())
+	}
+	if !f.UpdatedBefore.IsZero() {
+		conds = append(conds, "updated_at < ?")
+		args = append(args, f.UpdatedBefore.Unix())
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// ListSessions returns sessions matching filter, most recently updated first.
+func (r *Repository) ListSessions(filter SessionFilter) ([]Session, error) {
+	where, args := filter.where()
+	query := `SELECT ` + sessionColumns + ` FROM sessions` + where + ` ORDER BY updated_at DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := r.reader.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	messages := []Message{} // Initialize as empty slice, not nil
+	sessions := []Session{} // Initialize as empty slice, not nil
 	for rows.Next() {
-		var m Message
-		var toolCallsStr *string
-		var createdAt int64
-		if err := rows.Scan(&m.ID, &m.SessionID, &m.Role, &m.Content, &toolCallsStr, &createdAt); err != nil {
+		s, err := scanSession(rows)
+		if err != nil {
 			return nil, err
 		}
-		m.CreatedAt = time.Unix(createdAt, 0)
-		if toolCallsStr != nil {
-			m.ToolCalls = json.RawMessage(*toolCallsStr)
-		}
-		messages = append(messages, m)
+		sessions = append(sessions, *s)
 	}
 
-	return messages, rows.Err()
+	return sessions, rows.Err()
 }
 
-// Event operations for mobile backgrounding resilience
-//
-// Performance note: Each event is persisted in its own transaction to ensure
-// atomic sequence generation. While this adds overhead, it's acceptable because:
-// 1. SQLite with WAL mode handles small writes efficiently
-// 2. SetMaxOpenConns(1) serializes writes, preventing lock contention
-// 3. Events arrive sequentially from Claude CLI, not in bursts
-// 4. Mobile catch-up requires complete event replay for UI reconstruction
-//
-// If performance becomes an issue with high-frequency events, consider:
-// - Batching events (persist every N events or every Xms)
-// - Using auto-increment ID as sequence instead of SELECT MAX + 1
+// CountSessions returns the number of sessions, optionally including archived ones.
+func (r *Repository) CountSessions(includeArchived bool) (int, error) {
+	return r.countSessions(SessionFilter{IncludeArchived: includeArchived})
+}
 
-// UpdateSessionStreamStatus updates the streaming status of a session
-func (r *Repository) UpdateSessionStreamStatus(id string, status StreamStatus) error {
-	_, err := r.db.Exec(
-		`UPDATE sessions SET stream_status = ?, updated_at = ? WHERE id = ?`,
-		string(status), time.Now().Unix(), id,
-	)
-	return err
+// countSessions counts the sessions matching filter, ignoring Limit and Offset.
+func (r *Repository) countSessions(filter SessionFilter) (int, error) {
+	where, args := filter.where()
+	var count int
+	err := r.reader.QueryRow(`SELECT COUNT(*) FROM sessions`+where, args...).Scan(&count)
+	return count, err
 }
 
-// StartNewPrompt atomically starts a new prompt for a session.
+// admitLiveSession checks, within tx, that the session id may become live
+// (neither archived nor deleted) with title: UniqueTitles must find no other
+// live session with it, and MaxSessions must have room, see makeRoomForSession.
+// Archived and deleted sessions release their titles, so a session coming
+// back must be checked like a new one.
+func (r *Repository) admitLiveSession(tx *sql.Tx, id string, title *string, now time.Time) error {
+	if r.opts.UniqueTitles && title != nil {
+		var exists int
+		err := tx.QueryRow(
+			`SELECT 1 FROM sessions WHERE title = ? AND id != ? AND archived_at IS NULL AND deleted_at IS NULL LIMIT 1`,
+			*title, id,
+		).Scan(&exists)
+		if err == nil {
+			return ErrTitleInUse
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+	}
+
+	return r.makeRoomForSession(tx, now)
+}
+
+// SetSessionArchived archives or unarchives a session. Archived sessions are
+// retained but hidden from ListSessions by default. Unarchiving is checked
+// like creating a session, so it fails with ErrTitleInUse or ErrSessionLimit.
+// Returns false if the session does not exist.
+func (r *Repository) SetSessionArchived(id string, archived bool) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var title *string
+	var archivedAt *int64
+	err = tx.QueryRow(
+		`SELECT title, archived_at FROM sessions WHERE id = ? AND deleted_at IS NULL`, id,
+	).Scan(&title, &archivedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	var newArchivedAt any
+	switch {
+	case archived:
+		newArchivedAt = now.Unix()
+	case archivedAt != nil:
+		if err := r.admitLiveSession(tx, id, title, now); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET archived_at = ? WHERE id = ?`, newArchivedAt, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// makeRoomForSession checks MaxSessions within the tx of anything making a
+// session live: a create or fork, an unarchive or a restore, all through
+// admitLiveSession. When the cap is reached it archives the oldest idle
+// sessions if ArchiveOldestOnLimit is set, or fails with ErrSessionLimit.
+func (r *Repository) makeRoomForSession(tx *sql.Tx, now time.Time) error {
+	if r.opts.MaxSessions <= 0 {
+		return nil
+	}
+	var live int
+	if err := tx.QueryRow(
+		`SELECT COUNT(*) FROM sessions WHERE archived_at IS NULL AND deleted_at IS NULL`,
+	).Scan(&live); err != nil {
+		return err
+	}
+	excess := live - r.opts.MaxSessions + 1
+	if excess <= 0 {
+		return nil
+	}
+	if !r.opts.ArchiveOldestOnLimit {
+		return ErrSessionLimit
+	}
+
+	result, err := tx.Exec(
+		`UPDATE sessions SET archived_at = ? WHERE id IN (
+			SELECT id FROM sessions
+			WHERE archived_at IS NULL AND deleted_at IS NULL AND stream_status != ?
+			ORDER BY updated_at ASC, created_at ASC LIMIT ?)`,
+		now.Unix(), string(StreamStatusStreaming), excess,
+	)
+	if err != nil {
+		return err
+	}
+	archived, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	// Too many sessions are streaming to make room
+	if archived < int64(excess) {
+		return ErrSessionLimit
+	}
+	return nil
+}
+
+// ArchiveInactiveSessions archives live sessions that aren't streaming and
+// haven't been updated within olderThan. Returns the number archived.
+func (r *Repository) ArchiveInactiveSessions(olderThan time.Duration) (int64, error) {
+	now := time.Now()
+	result, err := r.db.Exec(
+		`UPDATE sessions SET archived_at = ?
+		 WHERE archived_at IS NULL AND deleted_at IS NULL
+		   AND stream_status != ? AND updated_at < ?`,
+		now.Unix(), string(StreamStatusStreaming), now.Add(-olderThan).Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *Repository) UpdateSessionClaudeID(id, claudeSessionID string) error {
+	_, err := r.db.Exec(
+		`UPDATE sessions SET claude_session_id = ?, updated_at = ? WHERE id = ?`,
+		claudeSessionID, time.Now().Unix(), id,
+	)
+	return err
+}
+
+// SoftDeleteSession moves a session to the recycle bin, hiding it from
+// GetSession and lists until it is restored or purged. Returns false if the
+// session doesn't exist or is already deleted.
+func (r *Repository) SoftDeleteSession(id string) (bool, error) {
+	result, err := r.db.Exec(
+		`UPDATE sessions SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`,
+		time.Now().Unix(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// RestoreSession takes a session out of the recycle bin. A session that
+// wasn't archived is checked like a new one, so restoring it fails with
+// ErrTitleInUse or ErrSessionLimit. Returns false if the session isn't in the
+// recycle bin.
+func (r *Repository) RestoreSession(id string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var title *string
+	var archivedAt *int64
+	err = tx.QueryRow(
+		`SELECT title, archived_at FROM sessions WHERE id = ? AND deleted_at IS NOT NULL`, id,
+	).Scan(&title, &archivedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if archivedAt == nil {
+		if err := r.admitLiveSession(tx, id, title, time.Now()); err != nil {
+			return false, err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET deleted_at = NULL WHERE id = ?`, id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// PurgeDeletedSessions permanently deletes sessions that have been in the
+// recycle bin longer than olderThan, cascading to their messages and events.
+// Returns the number of sessions purged.
+func (r *Repository) PurgeDeletedSessions(olderThan time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-olderThan).Unix()
+	result, err := r.db.Exec(`DELETE FROM sessions WHERE deleted_at IS NOT NULL AND deleted_at <= ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteSession permanently deletes a session, including one in the recycle
+// bin, cascading to its messages and events.
+func (r *Repository) DeleteSession(id string) (bool, error) {
+	result, err := r.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// Message operations
+
+func (r *Repository) CreateMessage(sessionID, role, content string, toolCalls json.RawMessage) (*Message, error) {
+	if !IsValidMessageRole(role) {
+		return nil, fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+
+	now := time.Now()
+	msg := &Message{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		Role:      role,
+		Content:   content,
+		ToolCalls: toolCalls,
+		CreatedAt: now,
+	}
+
+	var toolCallsStr *string
+	if toolCalls != nil {
+		s := string(toolCalls)
+		toolCallsStr = &s
+	}
+
+	_, err := r.db.Exec(
+		`INSERT INTO messages (id, session_id, role, content, tool_calls, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.SessionID, msg.Role, msg.Content, toolCallsStr, msg.CreatedAt.Unix(),
+	)
+	if isForeignKeyViolation(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Update session's updated_at
+	if _, err := r.db.Exec(`UPDATE sessions SET updated_at = ? WHERE id = ?`, now.Unix(), sessionID); err != nil {
+		log.Printf("Warning: failed to update session updated_at for session %s: %v", sessionID, err)
+	}
+
+	return msg, nil
+}
+
+// CreateSystemMessage stores the session's system message. It must come
+// first, so it fails with ErrSessionStarted once the session has any messages,
+// including an earlier system message.
+func (r *Repository) CreateSystemMessage(sessionID, content string) (*Message, error) {
+	now := time.Now()
+	msg := &Message{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		Role:      "system",
+		Content:   content,
+		CreatedAt: now,
+	}
+
+	result, err := r.db.Exec(
+		`INSERT INTO messages (id, session_id, role, content, created_at)
+		 SELECT ?, ?, ?, ?, ?
+		 WHERE NOT EXISTS (SELECT 1 FROM messages WHERE session_id = ?)`,
+		msg.ID, msg.SessionID, msg.Role, msg.Content, now.Unix(), sessionID,
+	)
+	if isForeignKeyViolation(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrSessionStarted
+	}
+
+	if _, err := r.db.Exec(`UPDATE sessions SET updated_at = ? WHERE id = ?`, now.Unix(), sessionID); err != nil {
+		log.Printf("Warning: failed to update session updated_at for session %s: %v", sessionID, err)
+	}
+
+	return msg, nil
+}
+
+// GetSystemPrompt returns the content of the session's system message, or ""
+// when it has none.
+func (r *Repository) GetSystemPrompt(sessionID string) (string, error) {
+	var content string
+	err := r.reader.QueryRow(
+		`SELECT content FROM messages WHERE session_id = ? AND role = 'system'
+		 ORDER BY created_at ASC, rowid ASC LIMIT 1`, sessionID,
+	).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return content, err
+}
+
+// MarkMessageTruncated flags a message whose content was cut short, such as an
+// assistant reply saved when its prompt was cancelled mid-response.
+func (r *Repository) MarkMessageTruncated(id string) error {
+	_, err := r.db.Exec(`UPDATE messages SET truncated = 1 WHERE id = ?`, id)
+	return err
+}
+
+// MarkMessageContinuation flags a user message sent by /continue rather than
+// typed by the user.
+func (r *Repository) MarkMessageContinuation(id string) error {
+	_, err := r.db.Exec(`UPDATE messages SET continuation = 1 WHERE id = ?`, id)
+	return err
+}
+
+// DeleteTurn removes a prompt's turn from a session's transcript: the user
+// message with the given ID and every message after it. Returns
+// ErrMessageNotFound if the message isn't in the session.
+func (r *Repository) DeleteTurn(sessionID, userMessageID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteTurn(tx, sessionID, userMessageID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteTurn(tx *sql.Tx, sessionID, userMessageID string) error {
+	result, err := tx.Exec(
+		`DELETE FROM messages
+		 WHERE session_id = ?
+		 AND rowid >= (SELECT rowid FROM messages WHERE id = ? AND session_id = ?)`,
+		sessionID, userMessageID, sessionID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// SetMessageAttachments records the attachments sent with a user message.
+func (r *Repository) SetMessageAttachments(id string, attachments []AttachmentInfo) error {
+	data, err := json.Marshal(attachments)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(`UPDATE messages SET attachments = ? WHERE id = ?`, string(data), id)
+	return err
+}
+
+func (r *Repository) GetSessionMessages(sessionID string) ([]Message, error) {
+	rows, err := r.reader.Query(
+		`SELECT id, session_id, role, content, tool_calls, blocks, thinking, truncated, continuation, attachments, created_at
+		 FROM messages WHERE session_id = ? ORDER BY created_at ASC, rowid ASC`, sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{} // Initialize as empty slice, not nil
+	for rows.Next() {
+		var m Message
+		var toolCallsStr, blocksStr, thinkingStr, attachmentsStr *string
+		var createdAt int64
+		if err := rows.Scan(&m.ID, &m.SessionID, &m.Role, &m.Content, &toolCallsStr, &blocksStr, &thinkingStr, &m.Truncated, &m.Continuation, &attachmentsStr, &createdAt); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(createdAt, 0)
+		if toolCallsStr != nil {
+			m.ToolCalls = json.RawMessage(*toolCallsStr)
+		}
+		if blocksStr != nil {
+			m.Blocks = json.RawMessage(*blocksStr)
+		}
+		if thinkingStr != nil {
+			m.Thinking = *thinkingStr
+		}
+		if attachmentsStr != nil {
+			if err := json.Unmarshal([]byte(*attachmentsStr), &m.Attachments); err != nil {
+				log.Printf("Warning: invalid attachments for message %s: %v", m.ID, err)
+			}
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, rows.Err()
+}
+
+// Client bookmark operations
+
+// SetClientBookmark saves a client's reading position in a session, replacing
+// the one it saved before, and sets b.UpdatedAt.
+func (r *Repository) SetClientBookmark(b *ClientBookmark) error {
+	var promptID, cursor *string
+	if b.PromptID != "" {
+		promptID = &b.PromptID
+	}
+	if b.Cursor != "" {
+		cursor = &b.Cursor
+	}
+
+	b.UpdatedAt = time.Now()
+	_, err := r.db.Exec(
+		`INSERT INTO client_bookmarks (session_id, client_id, prompt_id, sequence, cursor, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (session_id, client_id) DO UPDATE SET
+		   prompt_id = excluded.prompt_id, sequence = excluded.sequence,
+		   cursor = excluded.cursor, updated_at = excluded.updated_at`,
+		b.SessionID, b.ClientID, promptID, b.Sequence, cursor, b.UpdatedAt.Unix(),
+	)
+	return err
+}
+
+// GetClientBookmark returns a client's saved reading position, or
+// sql.ErrNoRows if it never saved one.
+func (r *Repository) GetClientBookmark(sessionID, clientID string) (*ClientBookmark, error) {
+	b := ClientBookmark{SessionID: sessionID, ClientID: clientID}
+	var promptID, cursor sql.NullString
+	var updatedAt int64
+	err := r.reader.QueryRow(
+		`SELECT prompt_id, sequence, cursor, updated_at
+		 FROM client_bookmarks WHERE session_id = ? AND client_id = ?`,
+		sessionID, clientID,
+	).Scan(&promptID, &b.Sequence, &cursor, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	b.PromptID, b.Cursor = promptID.String, cursor.String
+	b.UpdatedAt = time.Unix(updatedAt, 0)
+	return &b, nil
+}
+
+// Prompt snapshot operations
+
+// SavePromptSnapshot stores the final state of a prompt, replacing any earlier
+// snapshot for the same prompt.
+func (r *Repository) SavePromptSnapshot(snap *PromptSnapshot) error {
+	var toolCalls, result *string
+	if snap.ToolCalls != nil {
+		s := string(snap.ToolCalls)
+		toolCalls = &s
+	}
+	if snap.Result != nil {
+		s := string(snap.Result)
+		result = &s
+	}
+
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO prompt_snapshots
+		 (prompt_id, session_id, status, text, tool_calls, result, error, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		snap.PromptID, snap.SessionID, string(snap.Status), snap.Text,
+		toolCalls, result, snap.Error, snap.CreatedAt.Unix(),
+	)
+	return err
+}
+
+// GetPromptSnapshot returns a prompt's snapshot, or sql.ErrNoRows if none was saved.
+func (r *Repository) GetPromptSnapshot(sessionID, promptID string) (*PromptSnapshot, error) {
+	var snap PromptSnapshot
+	var status string
+	var toolCalls, result *string
+	var createdAt int64
+	err := r.reader.QueryRow(
+		`SELECT prompt_id, session_id, status, text, tool_calls, result, error, created_at
+		 FROM prompt_snapshots WHERE session_id = ? AND prompt_id = ?`,
+		sessionID, promptID,
+	).Scan(&snap.PromptID, &snap.SessionID, &status, &snap.Text, &toolCalls, &result, &snap.Error, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+
+	snap.Status = PromptStatus(status)
+	if toolCalls != nil {
+		snap.ToolCalls = json.RawMessage(*toolCalls)
+	}
+	if result != nil {
+		snap.Result = json.RawMessage(*result)
+	}
+	snap.CreatedAt = time.Unix(createdAt, 0)
+	return &snap, nil
+}
+
+// GetSessionStats returns the usage recorded for each of a session's prompts,
+// oldest first, and their totals
+func (r *Repository) GetSessionStats(sessionID string) (*SessionStats, error) {
+	rows, err := r.reader.Query(
+		`SELECT prompt_id, cost_usd, input_tokens, output_tokens,
+		        cache_creation_input_tokens, cache_read_input_tokens, created_at
+		 FROM prompt_stats WHERE session_id = ?
+		 ORDER BY created_at ASC, rowid ASC`,
+		sessionID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &SessionStats{SessionID: sessionID, PerPrompt: []PromptUsage{}}
+	for rows.Next() {
+		var u PromptUsage
+		var createdAt int64
+		if err := rows.Scan(&u.PromptID, &u.CostUSD, &u.InputTokens, &u.OutputTokens,
+			&u.CacheCreationInputTokens, &u.CacheReadInputTokens, &createdAt); err != nil {
+			return nil, err
+		}
+		u.CreatedAt = time.Unix(createdAt, 0)
+		stats.Prompts++
+		stats.CostUSD += u.CostUSD
+		stats.InputTokens += u.InputTokens
+		stats.OutputTokens += u.OutputTokens
+		stats.CacheCreationInputTokens += u.CacheCreationInputTokens
+		stats.CacheReadInputTokens += u.CacheReadInputTokens
+		stats.PerPrompt = append(stats.PerPrompt, u)
+	}
+	return stats, rows.Err()
+}
+
+// Event operations for mobile backgrounding resilience
+//
+// Performance note: Each event is persisted in its own transaction to ensure
+// atomic sequence generation. While this adds overhead, it's acceptable because:
+// 1. SQLite with WAL mode handles small writes efficiently
+// 2. SetMaxOpenConns(1) serializes writes, preventing lock contention
+// 3. Events arrive sequentially from Claude CLI, not in bursts
+// 4. Mobile catch-up requires complete event replay for UI reconstruction
+//
+// If performance becomes an issue with high-frequency events, consider:
+// - Batching events (persist every N events or every Xms)
+// - Using auto-increment ID as sequence instead of SELECT MAX + 1
+
+// UpdateSessionStreamStatus updates the streaming status of a session
+func (r *Repository) UpdateSessionStreamStatus(id string, status StreamStatus) error {
+	_, err := r.db.Exec(
+		`UPDATE sessions SET stream_status = ?, updated_at = ? WHERE id = ?`,
+		string(status), time.Now().Unix(), id,
+	)
+	if err == nil {
+		r.notifier.notify(id)
+	}
+	return err
+}
+
+// EventsChanged returns a channel that is closed the next time an event is
+// created or updated for the session, or its stream status changes.
+func (r *Repository) EventsChanged(sessionID string) <-chan struct{} {
+	return r.notifier.wait(sessionID)
+}
+
+// staleStreamingCondition matches sessions marked streaming with neither a
+// session update nor an event since the cutoff, given twice as placeholders.
+const staleStreamingCondition = `stream_status = 'streaming' AND updated_at < ?
+	AND NOT EXISTS (SELECT 1 FROM session_events e WHERE e.session_id = sessions.id AND e.created_at >= ?)`
+
+// ListStaleStreamingSessions returns the IDs of sessions marked streaming with
+// no update and no new event for longer than olderThan.
+func (r *Repository) ListStaleStreamingSessions(olderThan time.Duration) ([]string, error) {
+	cutoff := time.Now().Add(-olderThan).Unix()
+	rows, err := r.reader.Query(
+		`SELECT id FROM sessions WHERE `+staleStreamingCondition,
+		cutoff, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ResetStaleStreamingSession flips a session from streaming to status (idle or
+// completed), but only if it is still streaming and has had no update or event
+// since olderThan. Returns whether the session was reset, so a prompt that
+// started or made progress in the meantime is left alone.
+func (r *Repository) ResetStaleStreamingSession(id string, olderThan time.Duration, status StreamStatus) (bool, error) {
+	now := time.Now()
+	cutoff := now.Add(-olderThan).Unix()
+	result, err := r.db.Exec(
+		`UPDATE sessions SET stream_status = ?, active_prompts = 0, updated_at = ?
+		 WHERE id = ? AND `+staleStreamingCondition,
+		string(status), now.Unix(), id, cutoff, cutoff)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// StartNewPrompt atomically starts a new prompt for a session.
 // Returns the prompt ID (format: sessionID-sequence) or ErrSessionBusy if already streaming.
 func (r *Repository) StartNewPrompt(sessionID string) (string, error) {
+	return r.startPrompt(sessionID, false, "", 0, "")
+}
+
+// StartConcurrentPrompt starts a prompt alongside any already streaming on the
+// session. The session stays streaming until EndPrompt or FinalizePrompt has
+// been called for every prompt started.
+func (r *Repository) StartConcurrentPrompt(sessionID string) (string, error) {
+	return r.startPrompt(sessionID, true, "", 0, "")
+}
+
+// StartKeyedPrompt is StartNewPrompt, or StartConcurrentPrompt when
+// concurrent, that also records an idempotency key for the prompt. If the key
+// was recorded on the session within window, no prompt is started and it
+// returns the original prompt's ID with ErrDuplicatePrompt, even while that
+// prompt is still streaming.
+func (r *Repository) StartKeyedPrompt(sessionID string, concurrent bool, key string, window time.Duration) (string, error) {
+	return r.startPrompt(sessionID, concurrent, key, window, "")
+}
+
+// StartRetryPrompt is StartNewPrompt, or StartConcurrentPrompt when
+// concurrent, for a prompt sent again in place of a failed one: the turn
+// starting at userMessageID is deleted in the same transaction, so it is only
+// gone once its replacement has started. Returns ErrMessageNotFound if the
+// message isn't in the session.
+func (r *Repository) StartRetryPrompt(sessionID string, concurrent bool, userMessageID string) (string, error) {
+	return r.startPrompt(sessionID, concurrent, "", 0, userMessageID)
+}
+
+// GetKeyedPrompt returns the ID of the prompt started with key on the session
+// within window, or "" if there is none.
+func (r *Repository) GetKeyedPrompt(sessionID, key string, window time.Duration) (string, error) {
+	var promptID string
+	err := r.reader.QueryRow(
+		`SELECT prompt_id FROM prompt_idempotency_keys
+		 WHERE session_id = ? AND key = ? AND created_at >= ?`,
+		sessionID, key, time.Now().Add(-window).Unix(),
+	).Scan(&promptID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return promptID, err
+}
+
+func (r *Repository) startPrompt(sessionID string, concurrent bool, key string, window time.Duration, replacesMessageID string) (string, error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return "", err
 	}
 	defer tx.Rollback()
 
-	// Atomic update: only succeeds if not already streaming
-	result, err := tx.Exec(
-		`UPDATE sessions SET stream_status = 'streaming',
+	// Checked in the same transaction as the start, so two requests racing
+	// with one key can't both start a prompt
+	now := time.Now()
+	if key != "" {
+		var promptID string
+		err := tx.QueryRow(
+			`SELECT prompt_id FROM prompt_idempotency_keys
+			 WHERE session_id = ? AND key = ? AND created_at >= ?`,
+			sessionID, key, now.Add(-window).Unix(),
+		).Scan(&promptID)
+		if err == nil {
+			return promptID, ErrDuplicatePrompt
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	// Atomic update: only succeeds if not already streaming, unless concurrent
+	query := `UPDATE sessions SET stream_status = 'streaming', active_prompts = 1,
+		 prompt_sequence = prompt_sequence + 1, updated_at = ?
+		 WHERE id = ? AND stream_status != 'streaming' AND deleted_at IS NULL`
+	if concurrent {
+		query = `UPDATE sessions SET stream_status = 'streaming',
+		 active_prompts = CASE WHEN stream_status = 'streaming' THEN active_prompts + 1 ELSE 1 END,
 		 prompt_sequence = prompt_sequence + 1, updated_at = ?
-		 WHERE id = ? AND stream_status != 'streaming'`,
-		time.Now().Unix(), sessionID)
+		 WHERE id = ? AND deleted_at IS NULL`
+	}
+	result, err := tx.Exec(query, now.Unix(), sessionID)
 	if err != nil {
 		return "", err
 	}
@@ -333,12 +1447,15 @@ func (r *Repository) StartNewPrompt(sessionID string) (string, error) {
 		return "", err
 	}
 	if rows == 0 {
-		// Check if session exists
+		// Check if session exists; one in the recycle bin counts as missing
 		var exists int
-		err = tx.QueryRow(`SELECT 1 FROM sessions WHERE id = ?`, sessionID).Scan(&exists)
+		err = tx.QueryRow(`SELECT 1 FROM sessions WHERE id = ? AND deleted_at IS NULL`, sessionID).Scan(&exists)
 		if err == sql.ErrNoRows {
 			return "", ErrSessionNotFound
 		}
+		if err != nil {
+			return "", err
+		}
 		return "", ErrSessionBusy
 	}
 
@@ -346,11 +1463,148 @@ func (r *Repository) StartNewPrompt(sessionID string) (string, error) {
 	if err := tx.QueryRow(`SELECT prompt_sequence FROM sessions WHERE id = ?`, sessionID).Scan(&seq); err != nil {
 		return "", err
 	}
+	promptID := promptIDFor(sessionID, seq)
+
+	if key != "" {
+		// Expired keys are dropped as new ones are recorded
+		if _, err := tx.Exec(`DELETE FROM prompt_idempotency_keys WHERE created_at < ?`, now.Add(-window).Unix()); err != nil {
+			return "", err
+		}
+		if _, err := tx.Exec(
+			`INSERT OR REPLACE INTO prompt_idempotency_keys (session_id, key, prompt_id, created_at)
+			 VALUES (?, ?, ?, ?)`,
+			sessionID, key, promptID, now.Unix(),
+		); err != nil {
+			return "", err
+		}
+	}
+
+	if replacesMessageID != "" {
+		if err := deleteTurn(tx, sessionID, replacesMessageID); err != nil {
+			return "", err
+		}
+	}
 
 	if err := tx.Commit(); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%s-%d", sessionID, seq), nil
+	return promptID, nil
+}
+
+// promptIDFor returns the ID of a session's seq-th prompt
+func promptIDFor(sessionID string, seq int64) string {
+	return fmt.Sprintf("%s-%d", sessionID, seq)
+}
+
+// EndPrompt records that a prompt started with StartNewPrompt or
+// StartConcurrentPrompt ended without being finalized. The session is set to
+// status once no other prompt is still streaming on it.
+func (r *Repository) EndPrompt(sessionID string, status StreamStatus) error {
+	_, err := r.db.Exec(
+		`UPDATE sessions SET stream_status = `+endPromptStatus+`,
+		 active_prompts = MAX(active_prompts - 1, 0), updated_at = ? WHERE id = ?`,
+		string(status), time.Now().Unix(), sessionID,
+	)
+	if err == nil {
+		r.notifier.notify(sessionID)
+	}
+	return err
+}
+
+// endPromptStatus keeps a session streaming while other concurrent prompts are
+// still running; its placeholder is the status to set when the last one ends.
+const endPromptStatus = `CASE WHEN active_prompts <= 1 THEN ? ELSE stream_status END`
+
+// Queued prompt operations
+
+// EnqueuePrompt persists a prompt waiting for the session's current prompt to finish.
+func (r *Repository) EnqueuePrompt(sessionID, prompt, priority string) (*QueuedPrompt, error) {
+	now := time.Now()
+	qp := &QueuedPrompt{
+		ID:        uuid.New().String(),
+		SessionID: sessionID,
+		Prompt:    prompt,
+		Priority:  priority,
+		Status:    QueuedPromptWaiting,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	_, err := r.db.Exec(
+		`INSERT INTO queued_prompts (id, session_id, prompt, priority, status, created_at, updated_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		qp.ID, qp.SessionID, qp.Prompt, qp.Priority, string(qp.Status), now.Unix(), now.Unix(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return qp, nil
+}
+
+// UpdateQueuedPromptStatus records a queued prompt leaving the queue.
+func (r *Repository) UpdateQueuedPromptStatus(id string, status QueuedPromptStatus) error {
+	_, err := r.db.Exec(
+		`UPDATE queued_prompts SET status = ?, updated_at = ? WHERE id = ?`,
+		string(status), time.Now().Unix(), id,
+	)
+	return err
+}
+
+// CancelQueuedPrompts marks every prompt still waiting on a session cancelled.
+func (r *Repository) CancelQueuedPrompts(sessionID string) (int64, error) {
+	result, err := r.db.Exec(
+		`UPDATE queued_prompts SET status = ?, updated_at = ? WHERE session_id = ? AND status = ?`,
+		string(QueuedPromptCancelled), time.Now().Unix(), sessionID, string(QueuedPromptWaiting),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// cancelStaleQueuedPrompts marks every prompt still waiting, on any session,
+// cancelled. It runs once when the database is opened.
+func (r *Repository) cancelStaleQueuedPrompts() (int64, error) {
+	result, err := r.db.Exec(
+		`UPDATE queued_prompts SET status = ?, updated_at = ? WHERE status = ?`,
+		string(QueuedPromptCancelled), time.Now().Unix(), string(QueuedPromptWaiting),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ListQueuedPrompts returns the prompts still waiting on a session in dequeue
+// order: highest priority first, oldest first within a priority.
+func (r *Repository) ListQueuedPrompts(sessionID string) ([]QueuedPrompt, error) {
+	rows, err := r.reader.Query(
+		`SELECT id, session_id, prompt, priority, status, created_at, updated_at
+		 FROM queued_prompts WHERE session_id = ? AND status = ?
+		 ORDER BY CASE priority WHEN 'high' THEN 2 WHEN 'low' THEN 0 ELSE 1 END DESC,
+		 created_at ASC, rowid ASC`,
+		sessionID, string(QueuedPromptWaiting),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prompts := []QueuedPrompt{}
+	for rows.Next() {
+		var qp QueuedPrompt
+		var status string
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&qp.ID, &qp.SessionID, &qp.Prompt, &qp.Priority, &status, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		qp.Status = QueuedPromptStatus(status)
+		qp.CreatedAt = time.Unix(createdAt, 0)
+		qp.UpdatedAt = time.Unix(updatedAt, 0)
+		prompts = append(prompts, qp)
+	}
+
+	return prompts, rows.Err()
 }
 
 // CreateEvent persists a single event with atomic sequence generation.
@@ -362,20 +1616,39 @@ func (r *Repository) CreateEvent(sessionID, promptID, eventType string, data []b
 	}
 	defer tx.Rollback()
 
+	event, err := r.insertEvent(tx, sessionID, promptID, eventType, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.trimEvents(tx, sessionID, promptID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	r.notifier.notify(sessionID)
+
+	return event, nil
+}
+
+// insertEvent appends an event to a prompt within tx, assigning it the next sequence.
+func (r *Repository) insertEvent(tx *sql.Tx, sessionID, promptID, eventType string, data []byte) (*SessionEvent, error) {
 	// Get next sequence atomically
 	var seq int64
-	err = tx.QueryRow(
+	err := tx.QueryRow(
 		`SELECT COALESCE(MAX(sequence), 0) + 1 FROM session_events
 		 WHERE session_id = ? AND prompt_id = ?`, sessionID, promptID).Scan(&seq)
 	if err != nil {
 		return nil, err
 	}
 
+	stored, compressed := r.encodeEventData(data)
 	now := time.Now()
 	result, err := tx.Exec(
-		`INSERT INTO session_events (session_id, prompt_id, sequence, event_type, data, created_at)
-		 VALUES (?, ?, ?, ?, ?, ?)`,
-		sessionID, promptID, seq, eventType, string(data), now.Unix())
+		`INSERT INTO session_events (session_id, prompt_id, sequence, event_type, data, compressed, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sessionID, promptID, seq, eventType, stored, compressed, now.Unix())
 	if err != nil {
 		return nil, err
 	}
@@ -385,10 +1658,6 @@ func (r *Repository) CreateEvent(sessionID, promptID, eventType string, data []b
 		return nil, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		return nil, err
-	}
-
 	return &SessionEvent{
 		ID:        id,
 		SessionID: sessionID,
@@ -400,6 +1669,181 @@ func (r *Repository) CreateEvent(sessionID, promptID, eventType string, data []b
 	}, nil
 }
 
+// encodeEventData returns event data as it is stored: gzipped when
+// CompressEvents is set and that saves space, otherwise as JSON text.
+// Short events like {"status":"cancelled"} grow under gzip's header, so they
+// stay as text.
+func (r *Repository) encodeEventData(data []byte) (any, bool) {
+	if r.opts.CompressEvents {
+		var buf bytes.Buffer
+		zw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(zw)
+		zw.Reset(&buf)
+		if _, err := zw.Write(data); err == nil && zw.Close() == nil && buf.Len() < len(data) {
+			return buf.Bytes(), true
+		}
+	}
+	return string(data), false
+}
+
+// gzipWriters reuses compressors across events; each holds several hundred
+// KB of state that would otherwise be allocated per event.
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// decodeEventData reverses encodeEventData for a stored row.
+func decodeEventData(stored []byte, compressed bool) (json.RawMessage, error) {
+	if !compressed {
+		return json.RawMessage(stored), nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, fmt.Errorf("decompress event data: %w", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompress event data: %w", err)
+	}
+	return json.RawMessage(data), nil
+}
+
+// keptLeadingEvents is how many of a prompt's first events trimEvents never
+// deletes: connected and user_prompt, which catch-up clients expect at
+// sequences 1 and 2.
+const keptLeadingEvents = 2
+
+// trimEvents deletes a prompt's oldest events beyond MaxEventsPerPrompt
+// within tx, keeping the most recent for catch-up and the leading ones that
+// open the prompt. Other prompts of the session are untouched.
+func (r *Repository) trimEvents(tx *sql.Tx, sessionID, promptID string) error {
+	if r.opts.MaxEventsPerPrompt <= 0 {
+		return nil
+	}
+	_, err := tx.Exec(
+		`DELETE FROM session_events WHERE session_id = ? AND prompt_id = ? AND sequence > ? AND sequence <= (
+			SELECT sequence FROM session_events WHERE session_id = ? AND prompt_id = ?
+			ORDER BY sequence DESC LIMIT 1 OFFSET ?)`,
+		sessionID, promptID, keptLeadingEvents, sessionID, promptID, r.opts.MaxEventsPerPrompt,
+	)
+	return err
+}
+
+// PromptOutcome is the end of a prompt turn, committed by FinalizePrompt.
+type PromptOutcome struct {
+	Reply           string          // assistant reply; no message is saved when empty
+	ToolCalls       json.RawMessage // tool calls made in the reply
+	Blocks          json.RawMessage // the reply's ordered content blocks
+	Thinking        string          // the reply's reasoning; not saved when empty
+	Truncated       bool            // the reply was cut short by a cancel
+	ClaudeSessionID string          // recorded on the session when non-empty
+	EventType       string          // final event: "done", "error" or "cancelled"
+	EventData       []byte
+	Status          StreamStatus // stream status the session is left in
+	Usage           *PromptUsage // recorded in prompt_stats when non-nil
+}
+
+// FinalizePrompt saves a prompt's assistant reply, its final event and the
+// session's stream status in one transaction. A crash before it commits leaves
+// none of them written, so the prompt still reads as streaming until the
+// orphan sweeper resets it, rather than as finished with its reply missing.
+// Returns ErrSessionNotFound if the session was deleted during the prompt.
+func (r *Repository) FinalizePrompt(sessionID, promptID string, outcome PromptOutcome) (*Message, *SessionEvent, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var msg *Message
+	if outcome.Reply != "" {
+		msg = &Message{
+			ID:        uuid.New().String(),
+			SessionID: sessionID,
+			Role:      "assistant",
+			Content:   outcome.Reply,
+			ToolCalls: outcome.ToolCalls,
+			Blocks:    outcome.Blocks,
+			Thinking:  outcome.Thinking,
+			Truncated: outcome.Truncated,
+			CreatedAt: now,
+		}
+		var toolCallsStr, blocksStr, thinkingStr *string
+		if outcome.ToolCalls != nil {
+			s := string(outcome.ToolCalls)
+			toolCallsStr = &s
+		}
+		if outcome.Blocks != nil {
+			s := string(outcome.Blocks)
+			blocksStr = &s
+		}
+		if outcome.Thinking != "" {
+			thinkingStr = &outcome.Thinking
+		}
+		_, err := tx.Exec(
+			`INSERT INTO messages (id, session_id, role, content, tool_calls, blocks, thinking, truncated, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			msg.ID, sessionID, msg.Role, msg.Content, toolCallsStr, blocksStr, thinkingStr, msg.Truncated, now.Unix(),
+		)
+		if isForeignKeyViolation(err) {
+			return nil, nil, ErrSessionNotFound
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	event, err := r.insertEvent(tx, sessionID, promptID, outcome.EventType, outcome.EventData)
+	if isForeignKeyViolation(err) {
+		return nil, nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.trimEvents(tx, sessionID, promptID); err != nil {
+		return nil, nil, err
+	}
+
+	if u := outcome.Usage; u != nil {
+		_, err := tx.Exec(
+			`INSERT OR REPLACE INTO prompt_stats
+			 (prompt_id, session_id, cost_usd, input_tokens, output_tokens,
+			  cache_creation_input_tokens, cache_read_input_tokens, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			promptID, sessionID, u.CostUSD, u.InputTokens, u.OutputTokens,
+			u.CacheCreationInputTokens, u.CacheReadInputTokens, now.Unix(),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var claudeSessionID *string
+	if outcome.ClaudeSessionID != "" {
+		claudeSessionID = &outcome.ClaudeSessionID
+	}
+	result, err := tx.Exec(
+		`UPDATE sessions SET stream_status = `+endPromptStatus+`, active_prompts = MAX(active_prompts - 1, 0),
+		 claude_session_id = COALESCE(?, claude_session_id), updated_at = ?
+		 WHERE id = ?`,
+		string(outcome.Status), claudeSessionID, now.Unix(), sessionID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, nil, err
+	} else if n == 0 {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	r.notifier.notify(sessionID)
+
+	return msg, event, nil
+}
+
 // GetEventsSince retrieves events after a given sequence number.
 // If promptID is empty, returns events for all prompts in the session.
 //
@@ -414,16 +1858,16 @@ func (r *Repository) GetEventsSince(sessionID string, sinceSequence int64, promp
 	var err error
 
 	if promptID != "" {
-		rows, err = r.db.Query(
-			`SELECT id, session_id, prompt_id, sequence, event_type, data, created_at
+		rows, err = r.reader.Query(
+			`SELECT id, session_id, prompt_id, sequence, event_type, data, compressed, created_at
 			 FROM session_events
 			 WHERE session_id = ? AND prompt_id = ? AND sequence > ?
 			 ORDER BY sequence ASC
 			 LIMIT ?`,
 			sessionID, promptID, sinceSequence, limit)
 	} else {
-		rows, err = r.db.Query(
-			`SELECT id, session_id, prompt_id, sequence, event_type, data, created_at
+		rows, err = r.reader.Query(
+			`SELECT id, session_id, prompt_id, sequence, event_type, data, compressed, created_at
 			 FROM session_events
 			 WHERE session_id = ? AND sequence > ?
 			 ORDER BY prompt_id, sequence ASC
@@ -438,12 +1882,15 @@ func (r *Repository) GetEventsSince(sessionID string, sinceSequence int64, promp
 	events := []SessionEvent{} // Initialize as empty slice, not nil
 	for rows.Next() {
 		var e SessionEvent
-		var dataStr string
+		var stored []byte
+		var compressed bool
 		var createdAt int64
-		if err := rows.Scan(&e.ID, &e.SessionID, &e.PromptID, &e.Sequence, &e.EventType, &dataStr, &createdAt); err != nil {
+		if err := rows.Scan(&e.ID, &e.SessionID, &e.PromptID, &e.Sequence, &e.EventType, &stored, &compressed, &createdAt); err != nil {
+			return nil, err
+		}
+		if e.Data, err = decodeEventData(stored, compressed); err != nil {
 			return nil, err
 		}
-		e.Data = json.RawMessage(dataStr)
 		e.CreatedAt = time.Unix(createdAt, 0)
 		events = append(events, e)
 	}
@@ -451,6 +1898,160 @@ func (r *Repository) GetEventsSince(sessionID string, sinceSequence int64, promp
 	return events, rows.Err()
 }
 
+// CountEventsSince counts the events GetEventsSince would return without a
+// limit.
+func (r *Repository) CountEventsSince(sessionID string, sinceSequence int64, promptID string) (int64, error) {
+	var count int64
+	var err error
+	if promptID != "" {
+		err = r.reader.QueryRow(
+			`SELECT COUNT(*) FROM session_events
+			 WHERE session_id = ? AND prompt_id = ? AND sequence > ?`,
+			sessionID, promptID, sinceSequence).Scan(&count)
+	} else {
+		err = r.reader.QueryRow(
+			`SELECT COUNT(*) FROM session_events
+			 WHERE session_id = ? AND sequence > ?`,
+			sessionID, sinceSequence).Scan(&count)
+	}
+	return count, err
+}
+
+// SetPromptLabel records the label a client gave a prompt.
+func (r *Repository) SetPromptLabel(sessionID, promptID, label string) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO prompt_labels (prompt_id, session_id, label, created_at)
+		 VALUES (?, ?, ?, ?)`,
+		promptID, sessionID, label, time.Now().Unix(),
+	)
+	if isForeignKeyViolation(err) {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// PromptSettings are the options a prompt was sent with, kept so that a
+// failed prompt can be retried the same way
+type PromptSettings struct {
+	Label    string
+	Priority string
+	Timeout  time.Duration // zero when the prompt used the session's timeout
+	RawArgs  bool          // the prompt replaced the Claude CLI args; the args aren't kept
+}
+
+// SetPromptSettings records the priority and timeout a prompt was sent with,
+// and whether it was sent with raw args. Its label is recorded by SetPromptLabel.
+func (r *Repository) SetPromptSettings(sessionID, promptID, priority string, timeout time.Duration, rawArgs bool) error {
+	_, err := r.db.Exec(
+		`INSERT OR REPLACE INTO prompt_settings (prompt_id, session_id, priority, timeout_ms, raw_args, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		promptID, sessionID, priority, timeout.Milliseconds(), rawArgs, time.Now().Unix(),
+	)
+	if isForeignKeyViolation(err) {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+// GetPromptSettings returns the label, priority and timeout a prompt was sent
+// with, and whether it had raw args. A prompt with none recorded gets normal
+// priority and no label, timeout or raw args.
+func (r *Repository) GetPromptSettings(sessionID, promptID string) (PromptSettings, error) {
+	settings := PromptSettings{Priority: PriorityNormal}
+	var timeoutMS int64
+	err := r.reader.QueryRow(
+		`SELECT priority, timeout_ms, raw_args FROM prompt_settings WHERE prompt_id = ? AND session_id = ?`,
+		promptID, sessionID,
+	).Scan(&settings.Priority, &timeoutMS, &settings.RawArgs)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+	settings.Timeout = time.Duration(timeoutMS) * time.Millisecond
+
+	err = r.reader.QueryRow(
+		`SELECT label FROM prompt_labels WHERE prompt_id = ? AND session_id = ?`,
+		promptID, sessionID,
+	).Scan(&settings.Label)
+	if err != nil && err != sql.ErrNoRows {
+		return settings, err
+	}
+	return settings, nil
+}
+
+// GetPromptSummaries returns the sequence range, event count and label of
+// each prompt in a session, ordered by prompt ID like GetEventsSince's
+// results for all prompts.
+func (r *Repository) GetPromptSummaries(sessionID string) ([]PromptEventRange, error) {
+	rows, err := r.reader.Query(
+		`SELECT e.prompt_id, MIN(e.sequence), MAX(e.sequence), COUNT(*), l.label
+		 FROM session_events e
+		 LEFT JOIN prompt_labels l ON l.prompt_id = e.prompt_id
+		 WHERE e.session_id = ?
+		 GROUP BY e.prompt_id
+		 ORDER BY e.prompt_id`,
+		sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ranges := []PromptEventRange{}
+	for rows.Next() {
+		var pr PromptEventRange
+		var label *string
+		if err := rows.Scan(&pr.PromptID, &pr.FirstSequence, &pr.LastSequence, &pr.EventCount, &label); err != nil {
+			return nil, err
+		}
+		if label != nil {
+			pr.Label = *label
+		}
+		ranges = append(ranges, pr)
+	}
+	return ranges, rows.Err()
+}
+
+// GetLastPromptTerminalEvent returns the type of the event that ended a
+// session's most recent prompt: "done", "error" or "cancelled". It returns ""
+// when the session has had no prompt or the prompt's events are gone. A
+// running prompt may have sent a mid-stream error, so callers check the
+// session isn't streaming first.
+func (r *Repository) GetLastPromptTerminalEvent(sessionID string) (string, error) {
+	var seq int64
+	err := r.reader.QueryRow(
+		`SELECT prompt_sequence FROM sessions WHERE id = ? AND deleted_at IS NULL`, sessionID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return "", ErrSessionNotFound
+	}
+	if err != nil || seq == 0 {
+		return "", err
+	}
+
+	var eventType string
+	err = r.reader.QueryRow(
+		`SELECT event_type FROM session_events
+		 WHERE session_id = ? AND prompt_id = ? AND event_type IN ('done', 'error', 'cancelled')
+		 ORDER BY sequence DESC
+		 LIMIT 1`,
+		sessionID, promptIDFor(sessionID, seq)).Scan(&eventType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return eventType, err
+}
+
+// UpdateEventData replaces the data of an already persisted event.
+func (r *Repository) UpdateEventData(sessionID, promptID string, sequence int64, data []byte) error {
+	stored, compressed := r.encodeEventData(data)
+	_, err := r.db.Exec(
+		`UPDATE session_events SET data = ?, compressed = ? WHERE session_id = ? AND prompt_id = ? AND sequence = ?`,
+		stored, compressed, sessionID, promptID, sequence,
+	)
+	if err == nil {
+		r.notifier.notify(sessionID)
+	}
+	return err
+}
+
 // GetLatestEventSequence returns the highest sequence number for a session/prompt.
 // If promptID is empty, returns the highest sequence across all prompts.
 func (r *Repository) GetLatestEventSequence(sessionID, promptID string) (int64, error) {
@@ -458,11 +2059,11 @@ func (r *Repository) GetLatestEventSequence(sessionID, promptID string) (int64,
 	var err error
 
 	if promptID != "" {
-		err = r.db.QueryRow(
+		err = r.reader.QueryRow(
 			`SELECT MAX(sequence) FROM session_events WHERE session_id = ? AND prompt_id = ?`,
 			sessionID, promptID).Scan(&maxSeq)
 	} else {
-		err = r.db.QueryRow(
+		err = r.reader.QueryRow(
 			`SELECT MAX(sequence) FROM session_events WHERE session_id = ?`,
 			sessionID).Scan(&maxSeq)
 	}
@@ -476,6 +2077,73 @@ func (r *Repository) GetLatestEventSequence(sessionID, promptID string) (int64,
 	return maxSeq.Int64, nil
 }
 
+// DeleteEventsForPrompt deletes the persisted events of one prompt, keeping
+// the messages it produced, and returns how many were deleted. A prompt is
+// still streaming while its session is and its last event isn't the final
+// done, cancelled or terminal error event; its events can't be deleted then
+// (ErrPromptStreaming).
+func (r *Repository) DeleteEventsForPrompt(sessionID, promptID string) (int64, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`SELECT stream_status FROM sessions WHERE id = ? AND deleted_at IS NULL`, sessionID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return 0, ErrSessionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if StreamStatus(status) == StreamStatusStreaming {
+		var eventType string
+		var stored []byte
+		var compressed bool
+		err := tx.QueryRow(
+			`SELECT event_type, data, compressed FROM session_events
+			 WHERE session_id = ? AND prompt_id = ?
+			 ORDER BY sequence DESC
+			 LIMIT 1`,
+			sessionID, promptID).Scan(&eventType, &stored, &compressed)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if err == nil && !isFinalEvent(eventType, stored, compressed) {
+			return 0, ErrPromptStreaming
+		}
+	}
+
+	result, err := tx.Exec(`DELETE FROM session_events WHERE session_id = ? AND prompt_id = ?`, sessionID, promptID)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+// isFinalEvent reports whether a stored event ended its prompt. Error events
+// are only final when terminal; others are mid-stream errors from Claude.
+func isFinalEvent(eventType string, stored []byte, compressed bool) bool {
+	switch eventType {
+	case "done", "cancelled":
+		return true
+	case "error":
+		data, err := decodeEventData(stored, compressed)
+		if err != nil {
+			return false
+		}
+		var event PromptErrorEvent
+		return json.Unmarshal(data, &event) == nil && event.Terminal
+	}
+	return false
+}
+
 // DeleteEventsForCompletedSessions deletes events for sessions that have completed streaming
 // and are older than the specified duration.
 func (r *Repository) DeleteEventsForCompletedSessions(olderThan time.Duration) (int64, error) {
@@ -497,11 +2165,14 @@ func (r *Repository) DeleteEventsForCompletedSessions(olderThan time.Duration) (
 // StartEventCleanup starts a background goroutine that periodically cleans up old events.
 // Returns a function to stop the cleanup routine.
 // Events older than maxAge from completed/idle sessions are deleted every interval.
-func (r *Repository) StartEventCleanup(interval, maxAge time.Duration) func() {
+// A pass that deletes events is followed by DB maintenance, at most once per
+// maint.Interval, so the freed pages and WAL growth are reclaimed.
+func (r *Repository) StartEventCleanup(interval, maxAge time.Duration, maint DBMaintenance) func() {
 	ticker := time.NewTicker(interval)
 	done := make(chan struct{})
 
 	go func() {
+		var lastMaintenance time.Time
 		for {
 			select {
 			case <-ticker.C:
@@ -510,6 +2181,12 @@ func (r *Repository) StartEventCleanup(interval, maxAge time.Duration) func() {
 					log.Printf("Event cleanup error: %v", err)
 				} else if deleted > 0 {
 					log.Printf("Event cleanup: deleted %d old events", deleted)
+					if maint.Interval > 0 && time.Since(lastMaintenance) >= maint.Interval {
+						lastMaintenance = time.Now()
+						if err := RunDBMaintenance(r, maint.Vacuum); err != nil {
+							log.Printf("DB maintenance error: %v", err)
+						}
+					}
 				}
 			case <-done:
 				ticker.Stop()
@@ -1,7 +1,14 @@
 package internal
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -9,6 +16,11 @@ import (
 
 func setupTestRepo(t *testing.T) (*Repository, func()) {
 	t.Helper()
+	return setupTestRepoWithOptions(t, nil)
+}
+
+func setupTestRepoWithOptions(t testing.TB, opts *RepositoryOptions) (*Repository, func()) {
+	t.Helper()
 
 	f, err := os.CreateTemp("", "chai-test-*.db")
 	if err != nil {
@@ -16,7 +28,7 @@ func setupTestRepo(t *testing.T) (*Repository, func()) {
 	}
 	f.Close()
 
-	repo, err := NewRepository(f.Name())
+	repo, err := NewRepository(f.Name(), opts)
 	if err != nil {
 		os.Remove(f.Name())
 		t.Fatalf("Failed to create repository: %v", err)
@@ -63,12 +75,101 @@ func TestRepository_CreateAndGetSession(t *testing.T) {
 	}
 }
 
+func TestRepository_CreateSessionWithSettings(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	mode := "plan"
+	session, err := repo.CreateSessionWithSettings(nil, nil, SessionSettings{PermissionMode: &mode, QueuePrompts: true, PromptTimeout: 30 * time.Minute})
+	if err != nil {
+		t.Fatalf("CreateSessionWithSettings failed: %v", err)
+	}
+
+	got, err := repo.GetSession(session.ID)
+	if err != nil {
+		t.Fatalf("GetSession failed: %v", err)
+	}
+	if got.PermissionMode == nil || *got.PermissionMode != "plan" {
+		t.Errorf("PermissionMode = %v, want plan", got.PermissionMode)
+	}
+	if !got.QueuePrompts {
+		t.Error("QueuePrompts = false, want true")
+	}
+	if got.PromptTimeoutMS != (30 * time.Minute).Milliseconds() {
+		t.Errorf("PromptTimeoutMS = %d, want 30m", got.PromptTimeoutMS)
+	}
+
+	sessions, _ := repo.ListSessions(SessionFilter{})
+	if len(sessions) != 1 || sessions[0].PermissionMode == nil || *sessions[0].PermissionMode != "plan" {
+		t.Errorf("ListSessions did not return the permission mode")
+	}
+}
+
+func TestRepository_CreateSession_UniqueTitles(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{UniqueTitles: true})
+	defer cleanup()
+
+	title := "Refactor"
+	if _, err := repo.CreateSession(&title, nil); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+
+	_, err := repo.CreateSession(&title, nil)
+	if !errors.Is(err, ErrTitleInUse) {
+		t.Errorf("Expected ErrTitleInUse, got %v", err)
+	}
+
+	// Untitled sessions and different titles are unaffected
+	if _, err := repo.CreateSession(nil, nil); err != nil {
+		t.Errorf("CreateSession without title failed: %v", err)
+	}
+	if _, err := repo.CreateSession(nil, nil); err != nil {
+		t.Errorf("Second CreateSession without title failed: %v", err)
+	}
+	other := "Refactor 2"
+	if _, err := repo.CreateSession(&other, nil); err != nil {
+		t.Errorf("CreateSession with different title failed: %v", err)
+	}
+}
+
+func TestRepository_CreateSession_UniqueTitlesIgnoresArchived(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{UniqueTitles: true})
+	defer cleanup()
+
+	title := "Refactor"
+	old, _ := repo.CreateSession(&title, nil)
+	repo.SetSessionArchived(old.ID, true)
+
+	if _, err := repo.CreateSession(&title, nil); err != nil {
+		t.Errorf("Title of an archived session should be reusable, got %v", err)
+	}
+
+	// The archived session can't come back while another one holds its title
+	if _, err := repo.SetSessionArchived(old.ID, false); !errors.Is(err, ErrTitleInUse) {
+		t.Errorf("Unarchive with a taken title error = %v, want ErrTitleInUse", err)
+	}
+	if s, _ := repo.GetSession(old.ID); s.ArchivedAt == nil {
+		t.Error("Session should stay archived after a failed unarchive")
+	}
+}
+
+func TestRepository_CreateSession_DuplicateTitlesAllowedByDefault(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Refactor"
+	repo.CreateSession(&title, nil)
+	if _, err := repo.CreateSession(&title, nil); err != nil {
+		t.Errorf("Duplicate title should be allowed by default, got %v", err)
+	}
+}
+
 func TestRepository_ListSessions(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
 
 	// Initially empty
-	sessions, err := repo.ListSessions()
+	sessions, err := repo.ListSessions(SessionFilter{})
 	if err != nil {
 		t.Fatalf("ListSessions failed: %v", err)
 	}
@@ -82,7 +183,7 @@ func TestRepository_ListSessions(t *testing.T) {
 	repo.CreateSession(&title1, nil)
 	repo.CreateSession(&title2, nil)
 
-	sessions, err = repo.ListSessions()
+	sessions, err = repo.ListSessions(SessionFilter{})
 	if err != nil {
 		t.Fatalf("ListSessions failed: %v", err)
 	}
@@ -91,6 +192,134 @@ func TestRepository_ListSessions(t *testing.T) {
 	}
 }
 
+func TestRepository_CountSessions(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	const n = 5
+	var ids []string
+	for i := 0; i < n; i++ {
+		s, _ := repo.CreateSession(nil, nil)
+		ids = append(ids, s.ID)
+	}
+
+	count, err := repo.CountSessions(false)
+	if err != nil {
+		t.Fatalf("CountSessions failed: %v", err)
+	}
+	if count != n {
+		t.Errorf("CountSessions = %d, want %d", count, n)
+	}
+
+	// Archived sessions only count when included
+	repo.SetSessionArchived(ids[0], true)
+	repo.SetSessionArchived(ids[1], true)
+
+	if count, _ := repo.CountSessions(false); count != n-2 {
+		t.Errorf("CountSessions(false) = %d, want %d", count, n-2)
+	}
+	if count, _ := repo.CountSessions(true); count != n {
+		t.Errorf("CountSessions(true) = %d, want %d", count, n)
+	}
+}
+
+func TestRepository_ListSessions_Filter(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	for i := 0; i < 5; i++ {
+		repo.CreateSession(nil, nil)
+	}
+	archived, _ := repo.CreateSession(nil, nil)
+	if found, err := repo.SetSessionArchived(archived.ID, true); err != nil || !found {
+		t.Fatalf("SetSessionArchived = (%v, %v), want (true, nil)", found, err)
+	}
+
+	sessions, _ := repo.ListSessions(SessionFilter{})
+	if len(sessions) != 5 {
+		t.Errorf("Got %d sessions, want 5 (archived hidden)", len(sessions))
+	}
+	sessions, _ = repo.ListSessions(SessionFilter{IncludeArchived: true})
+	if len(sessions) != 6 {
+		t.Errorf("Got %d sessions, want 6 with archived", len(sessions))
+	}
+
+	page, _ := repo.ListSessions(SessionFilter{Limit: 2, Offset: 4})
+	if len(page) != 1 {
+		t.Errorf("Got %d sessions on last page, want 1", len(page))
+	}
+
+	got, _ := repo.GetSession(archived.ID)
+	if got.ArchivedAt == nil {
+		t.Error("ArchivedAt should be set")
+	}
+
+	repo.SetSessionArchived(archived.ID, false)
+	got, _ = repo.GetSession(archived.ID)
+	if got.ArchivedAt != nil {
+		t.Error("ArchivedAt should be cleared after unarchiving")
+	}
+
+	if found, _ := repo.SetSessionArchived("nonexistent", true); found {
+		t.Error("SetSessionArchived reported a nonexistent session as found")
+	}
+}
+
+func TestRepository_ListSessions_StatusAndDates(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	day := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	create := func(status StreamStatus, created, updated time.Time) string {
+		s, _ := repo.CreateSession(nil, nil)
+		repo.UpdateSessionStreamStatus(s.ID, status)
+		repo.db.Exec(`UPDATE sessions SET created_at = ?, updated_at = ? WHERE id = ?`, created.Unix(), updated.Unix(), s.ID)
+		return s.ID
+	}
+	old := create(StreamStatusIdle, day.Add(-48*time.Hour), day.Add(-24*time.Hour))
+	streaming := create(StreamStatusStreaming, day.Add(time.Hour), day.Add(2*time.Hour))
+	completed := create(StreamStatusCompleted, day.Add(-time.Hour), day.Add(3*time.Hour))
+
+	tests := []struct {
+		name   string
+		filter SessionFilter
+		want   []string
+	}{
+		{"status", SessionFilter{StreamStatus: StreamStatusStreaming}, []string{streaming}},
+		{"created after", SessionFilter{CreatedAfter: day}, []string{streaming}},
+		{"updated before", SessionFilter{UpdatedBefore: day}, []string{old}},
+		{"created after and status", SessionFilter{CreatedAfter: day.Add(-2 * time.Hour), StreamStatus: StreamStatusCompleted}, []string{completed}},
+		{"empty range", SessionFilter{CreatedAfter: day, UpdatedBefore: day}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sessions, err := repo.ListSessions(tt.filter)
+			if err != nil {
+				t.Fatalf("ListSessions failed: %v", err)
+			}
+			var got []string
+			for _, s := range sessions {
+				got = append(got, s.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Sessions = %v, want %v", got, tt.want)
+			}
+			if count, _ := repo.countSessions(tt.filter); count != len(tt.want) {
+				t.Errorf("Count = %d, want %d", count, len(tt.want))
+			}
+		})
+	}
+
+	// The new filters narrow the archived filter rather than replace it
+	repo.SetSessionArchived(streaming, true)
+	if sessions, _ := repo.ListSessions(SessionFilter{StreamStatus: StreamStatusStreaming}); len(sessions) != 0 {
+		t.Errorf("Got %d streaming sessions, want the archived one hidden", len(sessions))
+	}
+	if sessions, _ := repo.ListSessions(SessionFilter{StreamStatus: StreamStatusStreaming, IncludeArchived: true}); len(sessions) != 1 {
+		t.Errorf("Got %d streaming sessions with archived, want 1", len(sessions))
+	}
+}
+
 func TestRepository_DeleteSession(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -121,6 +350,118 @@ func TestRepository_DeleteSession(t *testing.T) {
 	}
 }
 
+func TestRepository_SoftDeleteSession(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Binned"
+	session, _ := repo.CreateSession(&title, nil)
+	repo.CreateMessage(session.ID, "user", "hello", nil)
+
+	deleted, err := repo.SoftDeleteSession(session.ID)
+	if err != nil || !deleted {
+		t.Fatalf("SoftDeleteSession = %v, %v; want true", deleted, err)
+	}
+	if again, _ := repo.SoftDeleteSession(session.ID); again {
+		t.Error("Deleting twice should report false")
+	}
+
+	// Hidden from GetSession and lists, but kept in the recycle bin
+	if _, err := repo.GetSession(session.ID); err != sql.ErrNoRows {
+		t.Errorf("GetSession error = %v, want sql.ErrNoRows", err)
+	}
+	if live, _ := repo.ListSessions(SessionFilter{}); len(live) != 0 {
+		t.Errorf("Got %d live sessions, want 0", len(live))
+	}
+	bin, _ := repo.ListSessions(SessionFilter{Deleted: true})
+	if len(bin) != 1 || bin[0].DeletedAt == nil {
+		t.Fatalf("Recycle bin = %+v, want the deleted session", bin)
+	}
+
+	restored, err := repo.RestoreSession(session.ID)
+	if err != nil || !restored {
+		t.Fatalf("RestoreSession = %v, %v; want true", restored, err)
+	}
+	got, err := repo.GetSession(session.ID)
+	if err != nil {
+		t.Fatalf("GetSession after restore failed: %v", err)
+	}
+	if got.DeletedAt != nil {
+		t.Error("DeletedAt should be cleared after restore")
+	}
+	if msgs, _ := repo.GetSessionMessages(session.ID); len(msgs) != 1 {
+		t.Errorf("Got %d messages after restore, want 1", len(msgs))
+	}
+	if again, _ := repo.RestoreSession(session.ID); again {
+		t.Error("Restoring a live session should report false")
+	}
+}
+
+func TestRepository_RestoreSession_Checked(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{UniqueTitles: true, MaxSessions: 2})
+	defer cleanup()
+
+	title := "Refactor"
+	deleted, _ := repo.CreateSession(&title, nil)
+	repo.SoftDeleteSession(deleted.ID)
+	taken, _ := repo.CreateSession(&title, nil)
+
+	if _, err := repo.RestoreSession(deleted.ID); !errors.Is(err, ErrTitleInUse) {
+		t.Errorf("Restore with a taken title error = %v, want ErrTitleInUse", err)
+	}
+
+	repo.SoftDeleteSession(taken.ID)
+	repo.CreateSession(nil, nil)
+	repo.CreateSession(nil, nil)
+	if _, err := repo.RestoreSession(deleted.ID); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Restore at the cap error = %v, want ErrSessionLimit", err)
+	}
+	if _, err := repo.GetSession(deleted.ID); err == nil {
+		t.Error("Session should stay in the recycle bin after a failed restore")
+	}
+
+	// An archived session comes back archived, taking neither a title nor a slot
+	repo.db.Exec(`UPDATE sessions SET archived_at = ? WHERE id = ?`, time.Now().Unix(), deleted.ID)
+	if restored, err := repo.RestoreSession(deleted.ID); err != nil || !restored {
+		t.Errorf("Restore of an archived session = (%v, %v), want (true, nil)", restored, err)
+	}
+}
+
+func TestRepository_PurgeDeletedSessions(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	old, _ := repo.CreateSession(nil, nil)
+	recent, _ := repo.CreateSession(nil, nil)
+	live, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(old.ID, "user", "hello", nil)
+
+	repo.SoftDeleteSession(old.ID)
+	repo.SoftDeleteSession(recent.ID)
+	repo.db.Exec(`UPDATE sessions SET deleted_at = ? WHERE id = ?`, time.Now().Add(-2*time.Hour).Unix(), old.ID)
+
+	n, err := repo.PurgeDeletedSessions(time.Hour)
+	if err != nil {
+		t.Fatalf("PurgeDeletedSessions failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Purged %d sessions, want 1", n)
+	}
+
+	if restored, _ := repo.RestoreSession(old.ID); restored {
+		t.Error("Purged session should not be restorable")
+	}
+	if msgs, _ := repo.GetSessionMessages(old.ID); len(msgs) != 0 {
+		t.Errorf("Got %d messages for purged session, want 0", len(msgs))
+	}
+	if restored, _ := repo.RestoreSession(recent.ID); !restored {
+		t.Error("Recently deleted session should still be restorable")
+	}
+	if _, err := repo.GetSession(live.ID); err != nil {
+		t.Errorf("Live session was affected: %v", err)
+	}
+}
+
 func TestRepository_UpdateSessionClaudeID(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -140,6 +481,230 @@ func TestRepository_UpdateSessionClaudeID(t *testing.T) {
 	}
 }
 
+func TestRepository_Backup(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	// Written after open, so it is still only in the WAL when the backup runs
+	title := "Backed up"
+	session, _ := repo.CreateSession(&title, nil)
+	repo.CreateMessage(session.ID, "user", "Hello", nil)
+
+	dest := filepath.Join(t.TempDir(), "backup.db")
+	if err := repo.Backup(dest); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+
+	// An existing file is never overwritten
+	if err := repo.Backup(dest); err == nil {
+		t.Error("Backup over an existing file succeeded, want error")
+	}
+
+	restored, err := NewRepository(dest, nil)
+	if err != nil {
+		t.Fatalf("Opening backup failed: %v", err)
+	}
+	defer restored.Close()
+
+	got, err := restored.GetSession(session.ID)
+	if err != nil {
+		t.Fatalf("GetSession from backup failed: %v", err)
+	}
+	if got.Title == nil || *got.Title != title {
+		t.Errorf("Title = %v, want %q", got.Title, title)
+	}
+	messages, _ := restored.GetSessionMessages(session.ID)
+	if len(messages) != 1 || messages[0].Content != "Hello" {
+		t.Errorf("Messages = %+v, want the backed up message", messages)
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat %s failed: %v", path, err)
+	}
+	return info.Size()
+}
+
+func TestRepository_ReadConnsDontWaitForWriter(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{ReadConns: 4})
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(session.ID, "user", "Hello", nil)
+
+	// Hold the only writer connection inside an uncommitted write
+	tx, err := repo.db.Begin()
+	if err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE sessions SET title = 'pending' WHERE id = ?`, session.ID); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+
+	done := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			s, err := repo.GetSession(session.ID)
+			if err == nil && s.Title != nil {
+				err = errors.New("read saw the uncommitted title")
+			}
+			if err == nil {
+				_, err = repo.GetSessionMessages(session.ID)
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Read failed: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Reads blocked behind the write in progress")
+		}
+	}
+
+	// The read pool rejects writes
+	if _, err := repo.reader.Exec(`DELETE FROM sessions`); err == nil {
+		t.Error("Write through the read pool should fail")
+	}
+}
+
+func TestRepository_SharedConnWithoutReadConns(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	if repo.reader != repo.db {
+		t.Error("Without ReadConns, reads should share the writer connection")
+	}
+}
+
+func TestRepository_JournalMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode string
+		want string
+	}{
+		{"", "wal"},
+		{"DELETE", "delete"},
+	} {
+		repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{JournalMode: tt.mode})
+		var got string
+		if err := repo.db.QueryRow(`PRAGMA journal_mode`).Scan(&got); err != nil {
+			t.Fatalf("PRAGMA journal_mode failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("JournalMode %q: journal_mode = %q, want %q", tt.mode, got, tt.want)
+		}
+		cleanup()
+	}
+}
+
+func TestNewRepository_CreatesDirectory(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "var", "lib", "chai", "chai.db")
+	repo, err := NewRepository(dbPath, nil)
+	if err != nil {
+		t.Fatalf("NewRepository failed: %v", err)
+	}
+	defer repo.Close()
+
+	if _, err := repo.CreateSession(nil, nil); err != nil {
+		t.Fatalf("CreateSession failed: %v", err)
+	}
+	if _, err := os.Stat(dbPath); err != nil {
+		t.Errorf("Database file not created: %v", err)
+	}
+
+	// A parent that is a file can't be created over
+	blocker := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(blocker, nil, 0o644)
+	if _, err := NewRepository(filepath.Join(blocker, "chai.db"), nil); err == nil {
+		t.Error("NewRepository should fail when the directory can't be created")
+	}
+}
+
+func TestRepository_AddColumn(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	// Re-running a migration finds the column already there
+	if err := repo.addColumn("messages", "blocks", "TEXT"); err != nil {
+		t.Errorf("addColumn on an existing column = %v, want nil", err)
+	}
+
+	// Any other failure means a broken database and is returned
+	err := repo.addColumn("no_such_table", "blocks", "TEXT")
+	if err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Errorf("addColumn on a missing table = %v, want the SQLite error", err)
+	}
+}
+
+func TestRepository_MigrateAddsMissingColumns(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	// A database from before the column existed
+	if _, err := repo.db.Exec(`ALTER TABLE messages DROP COLUMN continuation`); err != nil {
+		t.Fatalf("DROP COLUMN failed: %v", err)
+	}
+	if err := repo.migrate(); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	session, _ := repo.CreateSession(nil, nil)
+	msg, _ := repo.CreateMessage(session.ID, "user", "continue", nil)
+	if err := repo.MarkMessageContinuation(msg.ID); err != nil {
+		t.Errorf("MarkMessageContinuation after migrate = %v, want the column restored", err)
+	}
+}
+
+func TestRepository_CheckpointAndVacuum(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "chai.db")
+	repo, err := NewRepository(dbPath, nil)
+	if err != nil {
+		t.Fatalf("NewRepository failed: %v", err)
+	}
+	defer repo.Close()
+
+	session, _ := repo.CreateSession(nil, nil)
+	payload := []byte(`{"text":"` + strings.Repeat("x", 4096) + `"}`)
+	for i := 0; i < 500; i++ {
+		if _, err := repo.CreateEvent(session.ID, session.ID+"-1", "claude", payload); err != nil {
+			t.Fatalf("CreateEvent failed: %v", err)
+		}
+	}
+
+	if err := repo.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if size := fileSize(t, dbPath+"-wal"); size != 0 {
+		t.Errorf("WAL size after checkpoint = %d, want 0", size)
+	}
+	full := fileSize(t, dbPath)
+
+	// Deleting rows only frees pages; the file keeps its size until a vacuum
+	if _, err := repo.DeleteSession(session.ID); err != nil {
+		t.Fatalf("DeleteSession failed: %v", err)
+	}
+	repo.Checkpoint()
+	if size := fileSize(t, dbPath); size < full {
+		t.Fatalf("File shrank to %d before vacuum, want %d", size, full)
+	}
+
+	if err := repo.Vacuum(); err != nil {
+		t.Fatalf("Vacuum failed: %v", err)
+	}
+	if err := repo.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint after vacuum failed: %v", err)
+	}
+	if size := fileSize(t, dbPath); size >= full/4 {
+		t.Errorf("File size after vacuum = %d, want well under %d", size, full)
+	}
+}
+
 func TestRepository_Messages(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -181,24 +746,651 @@ func TestRepository_Messages(t *testing.T) {
 	}
 }
 
-func TestRepository_CreateEvent(t *testing.T) {
+func TestRepository_CreateMessage_InvalidRole(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
 
-	title := "Test"
-	session, _ := repo.CreateSession(&title, nil)
-	promptID := session.ID + "-1"
+	session, _ := repo.CreateSession(nil, nil)
+	for _, role := range []string{"", "tool", "User"} {
+		if _, err := repo.CreateMessage(session.ID, role, "Hello", nil); !errors.Is(err, ErrInvalidRole) {
+			t.Errorf("CreateMessage(role %q) error = %v, want ErrInvalidRole", role, err)
+		}
+	}
+	for _, role := range []string{"user", "assistant", "system"} {
+		if _, err := repo.CreateMessage(session.ID, role, "Hello", nil); err != nil {
+			t.Errorf("CreateMessage(role %q) failed: %v", role, err)
+		}
+	}
+}
 
-	// Create first event
-	event1, err := repo.CreateEvent(session.ID, promptID, "connected", []byte(`{"session_id":"test"}`))
+func TestRepository_ForkSession(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	mode := "plan"
+	source, _ := repo.CreateSessionWithSettings(nil, nil, SessionSettings{
+		PermissionMode: &mode,
+		ExtraArgs:      []string{"--model", "opus"},
+		PromptTimeout:  30 * time.Minute,
+	})
+	repo.UpdateSessionClaudeID(source.ID, "claude-1")
+	repo.CreateSystemMessage(source.ID, "Be brief")
+	repo.CreateMessage(source.ID, "user", "one", nil)
+	cutoff, _ := repo.CreateMessage(source.ID, "assistant", "two", nil)
+	repo.CreateMessage(source.ID, "user", "three", nil)
+
+	title := "Branch"
+	fork, err := repo.ForkSession(source.ID, cutoff.ID, &title)
 	if err != nil {
-		t.Fatalf("CreateEvent failed: %v", err)
+		t.Fatalf("ForkSession failed: %v", err)
 	}
-	if event1.Sequence != 1 {
-		t.Errorf("Sequence = %d, want 1", event1.Sequence)
+
+	got, _ := repo.GetSession(fork.ID)
+	if got.ID == source.ID || got.ClaudeSessionID != nil {
+		t.Errorf("Fork = %s with Claude session %v, want a new session without one", got.ID, got.ClaudeSessionID)
 	}
-	if event1.EventType != "connected" {
-		t.Errorf("EventType = %s, want connected", event1.EventType)
+	if got.ForkedFrom == nil || *got.ForkedFrom != source.ID || got.Title == nil || *got.Title != "Branch" {
+		t.Errorf("Fork forked_from = %v, title = %v; want %s, Branch", got.ForkedFrom, got.Title, source.ID)
+	}
+	if got.PermissionMode == nil || *got.PermissionMode != "plan" || strings.Join(got.ExtraArgs, " ") != "--model opus" || got.PromptTimeoutMS != source.PromptTimeoutMS {
+		t.Errorf("Fork settings = %+v, want the source's", got)
+	}
+	if prompt, _ := repo.GetSystemPrompt(fork.ID); prompt != "Be brief" {
+		t.Errorf("Fork system prompt = %q, want the source's", prompt)
+	}
+
+	contents := func(sessionID string) string {
+		messages, _ := repo.GetSessionMessages(sessionID)
+		var parts []string
+		for _, m := range messages {
+			if m.SessionID != sessionID {
+				t.Errorf("Message %s belongs to %s, want %s", m.ID, m.SessionID, sessionID)
+			}
+			parts = append(parts, m.Role+":"+m.Content)
+		}
+		return strings.Join(parts, ",")
+	}
+	if c := contents(fork.ID); c != "system:Be brief,user:one,assistant:two" {
+		t.Errorf("Fork messages = %s, want the prefix up to the cut-off", c)
+	}
+
+	// The two sessions diverge independently
+	repo.CreateMessage(fork.ID, "user", "fork only", nil)
+	if c := contents(source.ID); c != "system:Be brief,user:one,assistant:two,user:three" {
+		t.Errorf("Source messages = %s, want them unchanged", c)
+	}
+	repo.DeleteSession(source.ID)
+	if c := contents(fork.ID); c != "system:Be brief,user:one,assistant:two,user:fork only" {
+		t.Errorf("Fork messages after deleting the source = %s", c)
+	}
+
+	// Without a cut-off everything is copied
+	other, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(other.ID, "user", "a", nil)
+	repo.CreateMessage(other.ID, "assistant", "b", nil)
+	whole, err := repo.ForkSession(other.ID, "", nil)
+	if err != nil || contents(whole.ID) != "user:a,assistant:b" {
+		t.Errorf("Whole fork = %v, %s", err, contents(whole.ID))
+	}
+
+	if _, err := repo.ForkSession(other.ID, cutoff.ID, nil); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("Fork at another session's message error = %v, want ErrMessageNotFound", err)
+	}
+	if _, err := repo.ForkSession("missing", "", nil); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Fork of a missing session error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_CreateSystemMessage(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	if prompt, err := repo.GetSystemPrompt(session.ID); err != nil || prompt != "" {
+		t.Fatalf("GetSystemPrompt = %q, %v; want empty before one is set", prompt, err)
+	}
+
+	msg, err := repo.CreateSystemMessage(session.ID, "Be terse")
+	if err != nil {
+		t.Fatalf("CreateSystemMessage failed: %v", err)
+	}
+	if msg.Role != "system" {
+		t.Errorf("Role = %q, want system", msg.Role)
+	}
+	if _, err := repo.CreateSystemMessage(session.ID, "Be verbose"); !errors.Is(err, ErrSessionStarted) {
+		t.Errorf("Second system message error = %v, want ErrSessionStarted", err)
+	}
+
+	// Messages in the same second keep their insertion order, system first
+	repo.CreateMessage(session.ID, "user", "Hello", nil)
+	repo.CreateMessage(session.ID, "assistant", "Hi", nil)
+	messages, _ := repo.GetSessionMessages(session.ID)
+	var roles []string
+	for _, m := range messages {
+		roles = append(roles, m.Role)
+	}
+	if strings.Join(roles, ",") != "system,user,assistant" {
+		t.Errorf("Roles = %v, want [system user assistant]", roles)
+	}
+
+	if prompt, _ := repo.GetSystemPrompt(session.ID); prompt != "Be terse" {
+		t.Errorf("GetSystemPrompt = %q, want Be terse", prompt)
+	}
+
+	// Too late once the conversation has started
+	started, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(started.ID, "user", "Hello", nil)
+	if _, err := repo.CreateSystemMessage(started.ID, "Be terse"); !errors.Is(err, ErrSessionStarted) {
+		t.Errorf("CreateSystemMessage after a prompt error = %v, want ErrSessionStarted", err)
+	}
+
+	if _, err := repo.CreateSystemMessage("nonexistent", "Be terse"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("CreateSystemMessage for a missing session error = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_MarkMessageTruncated(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	complete, _ := repo.CreateMessage(session.ID, "assistant", "Full reply", nil)
+	partial, _ := repo.CreateMessage(session.ID, "assistant", "Partial", nil)
+
+	if err := repo.MarkMessageTruncated(partial.ID); err != nil {
+		t.Fatalf("MarkMessageTruncated failed: %v", err)
+	}
+
+	messages, _ := repo.GetSessionMessages(session.ID)
+	truncated := map[string]bool{}
+	for _, m := range messages {
+		truncated[m.ID] = m.Truncated
+	}
+	if truncated[complete.ID] {
+		t.Error("Untouched message reported truncated")
+	}
+	if !truncated[partial.ID] {
+		t.Error("Marked message not reported truncated")
+	}
+}
+
+func TestRepository_MarkMessageContinuation(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(session.ID, "user", "Write a story", nil)
+	cont, _ := repo.CreateMessage(session.ID, "user", "continue", nil)
+
+	if err := repo.MarkMessageContinuation(cont.ID); err != nil {
+		t.Fatalf("MarkMessageContinuation failed: %v", err)
+	}
+
+	messages, _ := repo.GetSessionMessages(session.ID)
+	if len(messages) != 2 || messages[0].Continuation || !messages[1].Continuation {
+		t.Errorf("Messages = %+v, want only %s flagged as a continuation", messages, cont.ID)
+	}
+
+	// Forks keep the flag
+	fork, err := repo.ForkSession(session.ID, "", nil)
+	if err != nil {
+		t.Fatalf("ForkSession failed: %v", err)
+	}
+	messages, _ = repo.GetSessionMessages(fork.ID)
+	if len(messages) != 2 || messages[0].Continuation || !messages[1].Continuation {
+		t.Errorf("Forked messages = %+v, want the continuation flag copied", messages)
+	}
+}
+
+func TestRepository_MaxSessions(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{MaxSessions: 2})
+	defer cleanup()
+
+	first, _ := repo.CreateSession(nil, nil)
+	if _, err := repo.CreateSession(nil, nil); err != nil {
+		t.Fatalf("CreateSession under the cap failed: %v", err)
+	}
+	if _, err := repo.CreateSession(nil, nil); !errors.Is(err, ErrSessionLimit) {
+		t.Fatalf("CreateSession at the cap error = %v, want ErrSessionLimit", err)
+	}
+
+	// Archived sessions don't count
+	repo.SetSessionArchived(first.ID, true)
+	if _, err := repo.CreateSession(nil, nil); err != nil {
+		t.Errorf("CreateSession after archiving failed: %v", err)
+	}
+
+	// ...until they are unarchived, which the cap holds back too
+	if _, err := repo.SetSessionArchived(first.ID, false); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("Unarchive at the cap error = %v, want ErrSessionLimit", err)
+	}
+	if found, err := repo.SetSessionArchived(first.ID, true); err != nil || !found {
+		t.Errorf("Archiving an archived session at the cap = (%v, %v), want (true, nil)", found, err)
+	}
+}
+
+func TestRepository_MaxSessions_ArchiveOldest(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{MaxSessions: 2, ArchiveOldestOnLimit: true})
+	defer cleanup()
+
+	oldest, _ := repo.CreateSession(nil, nil)
+	newer, _ := repo.CreateSession(nil, nil)
+	repo.db.Exec(`UPDATE sessions SET updated_at = updated_at - 60 WHERE id = ?`, oldest.ID)
+
+	third, err := repo.CreateSession(nil, nil)
+	if err != nil {
+		t.Fatalf("CreateSession at the cap failed: %v", err)
+	}
+	if s, _ := repo.GetSession(oldest.ID); s.ArchivedAt == nil {
+		t.Error("Oldest session should be archived to make room")
+	}
+	if s, _ := repo.GetSession(newer.ID); s.ArchivedAt != nil {
+		t.Error("Newer session should stay live")
+	}
+
+	// Streaming sessions are never archived; with none idle the cap holds
+	repo.StartNewPrompt(newer.ID)
+	repo.StartNewPrompt(third.ID)
+	if _, err := repo.CreateSession(nil, nil); !errors.Is(err, ErrSessionLimit) {
+		t.Errorf("CreateSession with only streaming sessions error = %v, want ErrSessionLimit", err)
+	}
+}
+
+func TestRepository_MaxSessions_EveryPathBack(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{MaxSessions: 2, ArchiveOldestOnLimit: true})
+	defer cleanup()
+
+	archived, _ := repo.CreateSession(nil, nil)
+	deleted, _ := repo.CreateSession(nil, nil)
+	repo.SetSessionArchived(archived.ID, true)
+	repo.SoftDeleteSession(deleted.ID)
+	first, _ := repo.CreateSession(nil, nil)
+	repo.CreateSession(nil, nil)
+	repo.db.Exec(`UPDATE sessions SET updated_at = updated_at - 60 WHERE id = ?`, first.ID)
+
+	live := func() int {
+		n, _ := repo.CountSessions(false)
+		return n
+	}
+
+	// Each session coming back makes room like a new one would
+	if _, err := repo.SetSessionArchived(archived.ID, false); err != nil {
+		t.Fatalf("Unarchive at the cap failed: %v", err)
+	}
+	if n := live(); n != 2 {
+		t.Errorf("Live sessions after unarchive = %d, want 2", n)
+	}
+	if s, _ := repo.GetSession(first.ID); s.ArchivedAt == nil {
+		t.Error("Oldest session should be archived to make room for the unarchived one")
+	}
+
+	if _, err := repo.RestoreSession(deleted.ID); err != nil {
+		t.Fatalf("Restore at the cap failed: %v", err)
+	}
+	if n := live(); n != 2 {
+		t.Errorf("Live sessions after restore = %d, want 2", n)
+	}
+	if s, _ := repo.GetSession(deleted.ID); s.ArchivedAt != nil {
+		t.Error("Restored session should be live")
+	}
+}
+
+func TestRepository_CompressEvents(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{CompressEvents: true})
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID := session.ID + "-1"
+
+	// A row written before compression existed
+	legacy := `{"type":"assistant","message":{"content":[{"type":"text","text":"legacy"}]}}`
+	if _, err := repo.db.Exec(
+		`INSERT INTO session_events (session_id, prompt_id, sequence, event_type, data, created_at) VALUES (?, ?, 1, 'claude', ?, ?)`,
+		session.ID, promptID, legacy, time.Now().Unix(),
+	); err != nil {
+		t.Fatalf("Failed to insert legacy row: %v", err)
+	}
+
+	large := `{"type":"assistant","message":{"content":[{"type":"text","text":"` + strings.Repeat("all work and no play ", 50) + `"}]}}`
+	small := `{"status":"cancelled"}`
+	repo.CreateEvent(session.ID, promptID, "claude", []byte(large))
+	repo.CreateEvent(session.ID, promptID, "cancelled", []byte(small))
+
+	compressed := func(seq int) bool {
+		var c bool
+		repo.db.QueryRow(`SELECT compressed FROM session_events WHERE prompt_id = ? AND sequence = ?`, promptID, seq).Scan(&c)
+		return c
+	}
+	if compressed(1) || !compressed(2) || compressed(3) {
+		t.Errorf("compressed = %v/%v/%v, want only the large event compressed", compressed(1), compressed(2), compressed(3))
+	}
+
+	check := func(want ...string) {
+		t.Helper()
+		events, err := repo.GetEventsSince(session.ID, 0, promptID, 100)
+		if err != nil {
+			t.Fatalf("GetEventsSince failed: %v", err)
+		}
+		if len(events) != len(want) {
+			t.Fatalf("Got %d events, want %d", len(events), len(want))
+		}
+		for i, e := range events {
+			if string(e.Data) != want[i] {
+				t.Errorf("Event %d data = %.60s..., want %.60s...", e.Sequence, e.Data, want[i])
+			}
+		}
+	}
+	check(legacy, large, small)
+
+	// Rewrites are compressed too, and rows stay readable with compression off
+	updated := strings.Replace(large, "play", "rest", -1)
+	repo.UpdateEventData(session.ID, promptID, 2, []byte(updated))
+	if !compressed(2) {
+		t.Error("Updated event should stay compressed")
+	}
+	repo.opts.CompressEvents = false
+	repo.CreateEvent(session.ID, promptID, "claude", []byte(large))
+	if compressed(4) {
+		t.Error("Event written with compression off should be stored as text")
+	}
+	check(legacy, updated, small, large)
+}
+
+// realisticEventStream is a prompt's persisted events: mostly text deltas,
+// with the assembled assistant message and a tool round trip.
+func realisticEventStream() [][]byte {
+	var events [][]byte
+	words := strings.Fields("Let me look at the repository structure first so I can find where the handlers are registered and how errors are returned")
+	for _, w := range words {
+		events = append(events, []byte(`{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"`+w+` "}},"session_id":"9f1c2e4a-7b3d-4c5e-8f6a-1b2c3d4e5f60","parent_tool_use_id":null,"uuid":"3e4f5a6b-7c8d-4e9f-a0b1-c2d3e4f5a6b7"}`))
+	}
+	events = append(events,
+		[]byte(`{"type":"assistant","message":{"id":"msg_01ABCDEF","type":"message","role":"assistant","model":"claude-sonnet","content":[{"type":"text","text":"`+strings.Join(words, " ")+`"},{"type":"tool_use","id":"toolu_01XYZ","name":"Read","input":{"file_path":"/srv/app/internal/handlers.go"}}],"usage":{"input_tokens":1200,"output_tokens":85}},"session_id":"9f1c2e4a-7b3d-4c5e-8f6a-1b2c3d4e5f60"}`),
+		[]byte(`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_01XYZ","content":"`+strings.Repeat(`func (h *Handlers) Get(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+}
+`, 20)+`"}]},"session_id":"9f1c2e4a-7b3d-4c5e-8f6a-1b2c3d4e5f60"}`),
+	)
+	return events
+}
+
+// BenchmarkEventStorage reports the stored bytes per event of a realistic
+// stream with and without CompressEvents.
+func BenchmarkEventStorage(b *testing.B) {
+	stream := realisticEventStream()
+	var raw int
+	for _, e := range stream {
+		raw += len(e)
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := "uncompressed"
+		if compress {
+			name = "gzip"
+		}
+		b.Run(name, func(b *testing.B) {
+			repo, cleanup := setupTestRepoWithOptions(b, &RepositoryOptions{CompressEvents: compress})
+			defer cleanup()
+			session, _ := repo.CreateSession(nil, nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				e := stream[i%len(stream)]
+				if _, err := repo.CreateEvent(session.ID, session.ID+"-1", "claude", e); err != nil {
+					b.Fatalf("CreateEvent failed: %v", err)
+				}
+			}
+			b.StopTimer()
+
+			var stored int64
+			repo.db.QueryRow(`SELECT SUM(LENGTH(data)) FROM session_events`).Scan(&stored)
+			b.ReportMetric(float64(stored)/float64(b.N), "stored-B/event")
+			b.ReportMetric(float64(raw)/float64(len(stream)), "raw-B/event")
+		})
+	}
+}
+
+func TestRepository_MaxEventsPerPrompt(t *testing.T) {
+	repo, cleanup := setupTestRepoWithOptions(t, &RepositoryOptions{MaxEventsPerPrompt: 3})
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	other, _ := repo.CreateSession(nil, nil)
+	repo.CreateEvent(other.ID, promptIDFor(other.ID, 1), "text", []byte(`{}`))
+
+	eventsOf := func(promptID string) []string {
+		events, _ := repo.GetEventsSince(session.ID, 0, promptID, 100)
+		var got []string
+		for _, e := range events {
+			got = append(got, fmt.Sprintf("%d:%s", e.Sequence, e.Data))
+		}
+		return got
+	}
+
+	first, _ := repo.StartConcurrentPrompt(session.ID)
+	repo.CreateEvent(session.ID, first, "connected", []byte(`"c"`))
+	repo.CreateEvent(session.ID, first, "user_prompt", []byte(`"u"`))
+	for i := 1; i <= 5; i++ {
+		repo.CreateEvent(session.ID, first, "text", []byte(fmt.Sprintf(`%d`, i)))
+	}
+
+	// The oldest are trimmed, but never the prompt's opening events, which
+	// catch-up clients expect at sequences 1 and 2
+	want := []string{`1:"c"`, `2:"u"`, `5:3`, `6:4`, `7:5`}
+	if got := eventsOf(first); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Events = %v, want %v", got, want)
+	}
+
+	// Another prompt's events, including the running prompt's opening ones,
+	// are untouched by this prompt's inserts
+	second, _ := repo.StartConcurrentPrompt(session.ID)
+	repo.CreateEvent(session.ID, second, "connected", []byte(`"c"`))
+	repo.CreateEvent(session.ID, second, "user_prompt", []byte(`"u"`))
+	for i := 1; i <= 3; i++ {
+		repo.CreateEvent(session.ID, first, "text", []byte(fmt.Sprintf(`%d`, i+5)))
+	}
+	repo.FinalizePrompt(session.ID, second, PromptOutcome{
+		EventType: "done",
+		EventData: []byte(`"d"`),
+		Status:    StreamStatusIdle,
+	})
+	want = []string{`1:"c"`, `2:"u"`, `3:"d"`}
+	if got := eventsOf(second); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Second prompt events = %v, want %v", got, want)
+	}
+	want = []string{`1:"c"`, `2:"u"`, `8:6`, `9:7`, `10:8`}
+	if got := eventsOf(first); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("First prompt events = %v, want %v", got, want)
+	}
+
+	// Other sessions are untouched
+	if events, _ := repo.GetEventsSince(other.ID, 0, "", 100); len(events) != 1 {
+		t.Errorf("Other session has %d events, want 1", len(events))
+	}
+}
+
+func TestRepository_StartKeyedPrompt(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	first, err := repo.StartKeyedPrompt(session.ID, false, "key-1", time.Minute)
+	if err != nil {
+		t.Fatalf("StartKeyedPrompt failed: %v", err)
+	}
+
+	// A repeat returns the original, whether it is streaming or has ended
+	if id, err := repo.StartKeyedPrompt(session.ID, false, "key-1", time.Minute); !errors.Is(err, ErrDuplicatePrompt) || id != first {
+		t.Errorf("Repeat while streaming = %q, %v; want %q, ErrDuplicatePrompt", id, err, first)
+	}
+	repo.EndPrompt(session.ID, StreamStatusIdle)
+	if id, err := repo.StartKeyedPrompt(session.ID, false, "key-1", time.Minute); !errors.Is(err, ErrDuplicatePrompt) || id != first {
+		t.Errorf("Repeat after the prompt = %q, %v; want %q, ErrDuplicatePrompt", id, err, first)
+	}
+	if id, _ := repo.GetKeyedPrompt(session.ID, "key-1", time.Minute); id != first {
+		t.Errorf("GetKeyedPrompt = %q, want %q", id, first)
+	}
+
+	// Keys are per session
+	other, _ := repo.CreateSession(nil, nil)
+	if _, err := repo.StartKeyedPrompt(other.ID, false, "key-1", time.Minute); err != nil {
+		t.Errorf("Same key on another session failed: %v", err)
+	}
+
+	// A new key starts a new prompt; busy still applies
+	second, err := repo.StartKeyedPrompt(session.ID, false, "key-2", time.Minute)
+	if err != nil || second == first {
+		t.Fatalf("New key = %q, %v; want a new prompt", second, err)
+	}
+	if _, err := repo.StartKeyedPrompt(session.ID, false, "key-3", time.Minute); !errors.Is(err, ErrSessionBusy) {
+		t.Errorf("New key while streaming error = %v, want ErrSessionBusy", err)
+	}
+	repo.EndPrompt(session.ID, StreamStatusIdle)
+
+	// Keys outside the window are forgotten
+	repo.db.Exec(`UPDATE prompt_idempotency_keys SET created_at = created_at - 120 WHERE key = 'key-1'`)
+	if id, _ := repo.GetKeyedPrompt(session.ID, "key-1", time.Minute); id != "" {
+		t.Errorf("GetKeyedPrompt for an expired key = %q, want none", id)
+	}
+	if id, err := repo.StartKeyedPrompt(session.ID, false, "key-1", time.Minute); err != nil || id == first {
+		t.Errorf("Expired key = %q, %v; want a new prompt", id, err)
+	}
+}
+
+func TestRepository_FinalizePrompt(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID, _ := repo.StartNewPrompt(session.ID)
+
+	msg, event, err := repo.FinalizePrompt(session.ID, promptID, PromptOutcome{
+		Reply:           "Partial",
+		Blocks:          json.RawMessage(`[{"type":"text","text":"Partial"}]`),
+		Truncated:       true,
+		ClaudeSessionID: "claude-1",
+		EventType:       "cancelled",
+		EventData:       []byte(`{"status":"cancelled"}`),
+		Status:          StreamStatusIdle,
+	})
+	if err != nil {
+		t.Fatalf("FinalizePrompt failed: %v", err)
+	}
+	if msg == nil || event == nil || event.Sequence != 1 {
+		t.Fatalf("FinalizePrompt returned message %+v, event %+v", msg, event)
+	}
+
+	messages, _ := repo.GetSessionMessages(session.ID)
+	if len(messages) != 1 || messages[0].Content != "Partial" || !messages[0].Truncated {
+		t.Errorf("Messages = %+v, want the truncated reply", messages)
+	}
+	if len(messages) == 1 && string(messages[0].Blocks) != `[{"type":"text","text":"Partial"}]` {
+		t.Errorf("Blocks = %s, want the reply's blocks", messages[0].Blocks)
+	}
+	events, _ := repo.GetEventsSince(session.ID, 0, promptID, 100)
+	if len(events) != 1 || events[0].EventType != "cancelled" {
+		t.Errorf("Events = %+v, want the cancelled event", events)
+	}
+	got, _ := repo.GetSession(session.ID)
+	if got.StreamStatus != StreamStatusIdle || got.ClaudeSessionID == nil || *got.ClaudeSessionID != "claude-1" {
+		t.Errorf("Session = %+v, want idle with Claude session ID set", got)
+	}
+
+	// Without a reply or Claude session ID, only the event and status change
+	promptID, _ = repo.StartNewPrompt(session.ID)
+	msg, _, err = repo.FinalizePrompt(session.ID, promptID, PromptOutcome{
+		EventType: "done",
+		EventData: []byte(`{"status":"complete"}`),
+		Status:    StreamStatusCompleted,
+	})
+	if err != nil || msg != nil {
+		t.Fatalf("FinalizePrompt without reply = %+v, %v", msg, err)
+	}
+	got, _ = repo.GetSession(session.ID)
+	if got.StreamStatus != StreamStatusCompleted || *got.ClaudeSessionID != "claude-1" {
+		t.Errorf("Session = %+v, want completed keeping its Claude session ID", got)
+	}
+	if messages, _ := repo.GetSessionMessages(session.ID); len(messages) != 1 {
+		t.Errorf("Got %d messages, want no new message", len(messages))
+	}
+}
+
+func TestRepository_FinalizePrompt_AllOrNothing(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID, _ := repo.StartNewPrompt(session.ID)
+	repo.CreateMessage(session.ID, "user", "hi", nil)
+
+	// Fail the last write of the finalize, as a crash before commit would
+	if _, err := repo.db.Exec(`CREATE TRIGGER fail_finalize BEFORE UPDATE OF stream_status ON sessions
+		BEGIN SELECT RAISE(ABORT, 'simulated failure'); END`); err != nil {
+		t.Fatalf("Creating trigger failed: %v", err)
+	}
+
+	_, _, err := repo.FinalizePrompt(session.ID, promptID, PromptOutcome{
+		Reply:     "Hello",
+		EventType: "done",
+		EventData: []byte(`{"status":"complete"}`),
+		Status:    StreamStatusCompleted,
+	})
+	if err == nil {
+		t.Fatal("FinalizePrompt should fail")
+	}
+
+	// Neither the reply nor the done event was written
+	messages, _ := repo.GetSessionMessages(session.ID)
+	if len(messages) != 1 || messages[0].Role != "user" {
+		t.Errorf("Messages = %+v, want only the user message", messages)
+	}
+	if events, _ := repo.GetEventsSince(session.ID, 0, promptID, 100); len(events) != 0 {
+		t.Errorf("Events = %+v, want none", events)
+	}
+	if got, _ := repo.GetSession(session.ID); got.StreamStatus != StreamStatusStreaming {
+		t.Errorf("StreamStatus = %s, want still streaming for the sweeper to reset", got.StreamStatus)
+	}
+}
+
+func TestRepository_FinalizePrompt_SessionDeleted(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID, _ := repo.StartNewPrompt(session.ID)
+	repo.DeleteSession(session.ID)
+
+	for _, reply := range []string{"Hello", ""} {
+		_, _, err := repo.FinalizePrompt(session.ID, promptID, PromptOutcome{
+			Reply:     reply,
+			EventType: "done",
+			EventData: []byte(`{}`),
+			Status:    StreamStatusCompleted,
+		})
+		if !errors.Is(err, ErrSessionNotFound) {
+			t.Errorf("FinalizePrompt(reply %q) error = %v, want ErrSessionNotFound", reply, err)
+		}
+	}
+}
+
+func TestRepository_CreateEvent(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Test"
+	session, _ := repo.CreateSession(&title, nil)
+	promptID := session.ID + "-1"
+
+	// Create first event
+	event1, err := repo.CreateEvent(session.ID, promptID, "connected", []byte(`{"session_id":"test"}`))
+	if err != nil {
+		t.Fatalf("CreateEvent failed: %v", err)
+	}
+	if event1.Sequence != 1 {
+		t.Errorf("Sequence = %d, want 1", event1.Sequence)
+	}
+	if event1.EventType != "connected" {
+		t.Errorf("EventType = %s, want connected", event1.EventType)
 	}
 
 	// Create second event - sequence should auto-increment
@@ -220,112 +1412,371 @@ func TestRepository_CreateEvent(t *testing.T) {
 	}
 }
 
-func TestRepository_CreateEvent_Concurrent(t *testing.T) {
+func TestRepository_CreateEvent_Concurrent(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Test"
+	session, _ := repo.CreateSession(&title, nil)
+	promptID := session.ID + "-1"
+
+	// Launch goroutines to create events concurrently
+	// Using moderate concurrency (3 workers) to test sequence uniqueness
+	// without overwhelming SQLite's transaction handling
+	const numGoroutines = 3
+	const eventsPerGoroutine = 3
+	totalEvents := numGoroutines * eventsPerGoroutine
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, totalEvents)
+	seqCh := make(chan int64, totalEvents)
+
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < eventsPerGoroutine; j++ {
+				event, err := repo.CreateEvent(session.ID, promptID, "claude", []byte(`{}`))
+				if err != nil {
+					errCh <- err
+					return
+				}
+				seqCh <- event.Sequence
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errCh)
+	close(seqCh)
+
+	// Check for errors
+	for err := range errCh {
+		t.Fatalf("CreateEvent failed: %v", err)
+	}
+
+	// Collect all sequences
+	sequences := make(map[int64]bool)
+	for seq := range seqCh {
+		if sequences[seq] {
+			t.Errorf("Duplicate sequence number: %d", seq)
+		}
+		sequences[seq] = true
+	}
+
+	// Verify all sequences are present (1 to N)
+	if len(sequences) != totalEvents {
+		t.Errorf("Expected %d unique sequences, got %d", totalEvents, len(sequences))
+	}
+
+	// Verify sequences are contiguous from 1 to N
+	for i := int64(1); i <= int64(totalEvents); i++ {
+		if !sequences[i] {
+			t.Errorf("Missing sequence number: %d", i)
+		}
+	}
+}
+
+func TestRepository_GetEventsSince(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Test"
+	session, _ := repo.CreateSession(&title, nil)
+	promptID := session.ID + "-1"
+
+	// Create events
+	repo.CreateEvent(session.ID, promptID, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, promptID, "claude", []byte(`{}`))
+	repo.CreateEvent(session.ID, promptID, "done", []byte(`{}`))
+
+	// Get all events
+	events, err := repo.GetEventsSince(session.ID, 0, promptID, 100)
+	if err != nil {
+		t.Fatalf("GetEventsSince failed: %v", err)
+	}
+	if len(events) != 3 {
+		t.Errorf("Got %d events, want 3", len(events))
+	}
+
+	// Get events since sequence 1
+	events, err = repo.GetEventsSince(session.ID, 1, promptID, 100)
+	if err != nil {
+		t.Fatalf("GetEventsSince failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Got %d events, want 2", len(events))
+	}
+	if events[0].Sequence != 2 {
+		t.Errorf("First event sequence = %d, want 2", events[0].Sequence)
+	}
+
+	// Test limit
+	events, err = repo.GetEventsSince(session.ID, 0, promptID, 2)
+	if err != nil {
+		t.Fatalf("GetEventsSince failed: %v", err)
+	}
+	if len(events) != 2 {
+		t.Errorf("Got %d events, want 2 (limited)", len(events))
+	}
+}
+
+func TestRepository_GetPromptSummaries(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Test"
+	session, _ := repo.CreateSession(&title, nil)
+
+	ranges, err := repo.GetPromptSummaries(session.ID)
+	if err != nil {
+		t.Fatalf("GetPromptSummaries failed: %v", err)
+	}
+	if ranges == nil || len(ranges) != 0 {
+		t.Errorf("GetPromptSummaries = %v, want an empty slice for a session without events", ranges)
+	}
+
+	prompt1, prompt2 := session.ID+"-1", session.ID+"-2"
+	repo.CreateEvent(session.ID, prompt1, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt1, "claude", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt1, "done", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "done", []byte(`{}`))
+
+	ranges, err = repo.GetPromptSummaries(session.ID)
+	if err != nil {
+		t.Fatalf("GetPromptSummaries failed: %v", err)
+	}
+	want := []PromptEventRange{
+		{PromptID: prompt1, FirstSequence: 1, LastSequence: 3, EventCount: 3},
+		{PromptID: prompt2, FirstSequence: 1, LastSequence: 2, EventCount: 2},
+	}
+	if !slices.Equal(ranges, want) {
+		t.Errorf("GetPromptSummaries = %+v, want %+v", ranges, want)
+	}
+}
+
+func TestRepository_PromptLabels(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	prompt1, prompt2 := session.ID+"-1", session.ID+"-2"
+	repo.CreateEvent(session.ID, prompt1, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "connected", []byte(`{}`))
+
+	if err := repo.SetPromptLabel(session.ID, prompt1, "Auth refactor"); err != nil {
+		t.Fatalf("SetPromptLabel failed: %v", err)
+	}
+	ranges, err := repo.GetPromptSummaries(session.ID)
+	if err != nil {
+		t.Fatalf("GetPromptSummaries failed: %v", err)
+	}
+	if len(ranges) != 2 || ranges[0].Label != "Auth refactor" || ranges[1].Label != "" {
+		t.Errorf("GetPromptSummaries = %+v, want only the first prompt labeled", ranges)
+	}
+
+	if err := repo.SetPromptLabel("missing", "missing-1", "x"); err != ErrSessionNotFound {
+		t.Errorf("SetPromptLabel on a missing session = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_DeleteEventsForPrompt(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	prompt1, _ := repo.StartNewPrompt(session.ID)
+	repo.CreateEvent(session.ID, prompt1, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt1, "claude", []byte(`{"type":"assistant"}`))
+	repo.FinalizePrompt(session.ID, prompt1, PromptOutcome{Reply: "Hello", EventType: "done", EventData: []byte(`{"status":"complete"}`), Status: StreamStatusIdle})
+
+	// The second prompt is still running, its last error mid-stream
+	prompt2, _ := repo.StartNewPrompt(session.ID)
+	repo.CreateEvent(session.ID, prompt2, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "error", []byte(`{"error":"invalid JSON from Claude","terminal":false}`))
+	if _, err := repo.DeleteEventsForPrompt(session.ID, prompt2); err != ErrPromptStreaming {
+		t.Errorf("Deleting a streaming prompt's events = %v, want ErrPromptStreaming", err)
+	}
+
+	// A finished prompt's events can go while another prompt streams
+	deleted, err := repo.DeleteEventsForPrompt(session.ID, prompt1)
+	if err != nil {
+		t.Fatalf("DeleteEventsForPrompt failed: %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Deleted %d events, want 3", deleted)
+	}
+	if events, _ := repo.GetEventsSince(session.ID, 0, prompt1, 100); len(events) != 0 {
+		t.Errorf("Prompt 1 has %d events left, want 0", len(events))
+	}
+	if events, _ := repo.GetEventsSince(session.ID, 0, prompt2, 100); len(events) != 2 {
+		t.Errorf("Prompt 2 has %d events, want its 2 kept", len(events))
+	}
+	if messages, _ := repo.GetSessionMessages(session.ID); len(messages) != 1 || messages[0].Content != "Hello" {
+		t.Errorf("Messages = %+v, want the reply kept", messages)
+	}
+
+	if _, err := repo.DeleteEventsForPrompt("missing", "missing-1"); err != ErrSessionNotFound {
+		t.Errorf("Deleting events of a missing session = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_CountEventsSince(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	title := "Test"
+	session, _ := repo.CreateSession(&title, nil)
+	prompt1, prompt2 := session.ID+"-1", session.ID+"-2"
+	repo.CreateEvent(session.ID, prompt1, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt1, "claude", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt1, "done", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, prompt2, "done", []byte(`{}`))
+
+	tests := []struct {
+		since    int64
+		promptID string
+		want     int64
+	}{
+		{0, "", 5},
+		{1, "", 3},
+		{0, prompt1, 3},
+		{2, prompt1, 1},
+		{3, prompt1, 0},
+	}
+	for _, tt := range tests {
+		got, err := repo.CountEventsSince(session.ID, tt.since, tt.promptID)
+		if err != nil {
+			t.Fatalf("CountEventsSince failed: %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("CountEventsSince(%d, %q) = %d, want %d", tt.since, tt.promptID, got, tt.want)
+		}
+	}
+}
+
+func TestRepository_GetLastPromptTerminalEvent(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
 
-	title := "Test"
-	session, _ := repo.CreateSession(&title, nil)
-	promptID := session.ID + "-1"
+	session, _ := repo.CreateSession(nil, nil)
+	if got, err := repo.GetLastPromptTerminalEvent(session.ID); err != nil || got != "" {
+		t.Errorf("GetLastPromptTerminalEvent = %q, %v, want nothing before any prompt", got, err)
+	}
 
-	// Launch goroutines to create events concurrently
-	// Using moderate concurrency (3 workers) to test sequence uniqueness
-	// without overwhelming SQLite's transaction handling
-	const numGoroutines = 3
-	const eventsPerGoroutine = 3
-	totalEvents := numGoroutines * eventsPerGoroutine
+	// A mid-stream error followed by done is a success
+	promptID, _ := repo.StartNewPrompt(session.ID)
+	repo.CreateEvent(session.ID, promptID, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, promptID, "error", []byte(`{"error":"invalid JSON from Claude"}`))
+	repo.CreateEvent(session.ID, promptID, "done", []byte(`{}`))
+	repo.EndPrompt(session.ID, StreamStatusCompleted)
+	if got, _ := repo.GetLastPromptTerminalEvent(session.ID); got != "done" {
+		t.Errorf("GetLastPromptTerminalEvent = %q, want done", got)
+	}
 
-	var wg sync.WaitGroup
-	errCh := make(chan error, totalEvents)
-	seqCh := make(chan int64, totalEvents)
+	// Only the latest prompt counts
+	promptID, _ = repo.StartNewPrompt(session.ID)
+	repo.CreateEvent(session.ID, promptID, "connected", []byte(`{}`))
+	repo.CreateEvent(session.ID, promptID, "error", []byte(`{"error":"exit status 1","terminal":true}`))
+	repo.EndPrompt(session.ID, StreamStatusIdle)
+	if got, _ := repo.GetLastPromptTerminalEvent(session.ID); got != "error" {
+		t.Errorf("GetLastPromptTerminalEvent = %q, want error", got)
+	}
 
-	wg.Add(numGoroutines)
-	for i := 0; i < numGoroutines; i++ {
-		go func() {
-			defer wg.Done()
-			for j := 0; j < eventsPerGoroutine; j++ {
-				event, err := repo.CreateEvent(session.ID, promptID, "claude", []byte(`{}`))
-				if err != nil {
-					errCh <- err
-					return
-				}
-				seqCh <- event.Sequence
-			}
-		}()
+	if _, err := repo.GetLastPromptTerminalEvent("missing"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("GetLastPromptTerminalEvent error = %v, want ErrSessionNotFound", err)
 	}
+}
 
-	wg.Wait()
-	close(errCh)
-	close(seqCh)
+func TestRepository_StartRetryPrompt(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
 
-	// Check for errors
-	for err := range errCh {
-		t.Fatalf("CreateEvent failed: %v", err)
-	}
+	session, _ := repo.CreateSession(nil, nil)
+	repo.CreateMessage(session.ID, "user", "First", nil)
+	failed, _ := repo.CreateMessage(session.ID, "user", "Second", nil)
+	repo.CreateMessage(session.ID, "assistant", "Partial", nil)
 
-	// Collect all sequences
-	sequences := make(map[int64]bool)
-	for seq := range seqCh {
-		if sequences[seq] {
-			t.Errorf("Duplicate sequence number: %d", seq)
-		}
-		sequences[seq] = true
+	// A busy session neither starts the retry nor loses the turn
+	repo.StartNewPrompt(session.ID)
+	if _, err := repo.StartRetryPrompt(session.ID, false, failed.ID); !errors.Is(err, ErrSessionBusy) {
+		t.Errorf("StartRetryPrompt error = %v, want ErrSessionBusy", err)
 	}
+	if messages, _ := repo.GetSessionMessages(session.ID); len(messages) != 3 {
+		t.Errorf("Got %d messages, want the turn kept while busy", len(messages))
+	}
+	repo.EndPrompt(session.ID, StreamStatusIdle)
 
-	// Verify all sequences are present (1 to N)
-	if len(sequences) != totalEvents {
-		t.Errorf("Expected %d unique sequences, got %d", totalEvents, len(sequences))
+	if _, err := repo.StartRetryPrompt(session.ID, false, failed.ID); err != nil {
+		t.Fatalf("StartRetryPrompt failed: %v", err)
 	}
+	if messages, _ := repo.GetSessionMessages(session.ID); len(messages) != 1 || messages[0].Content != "First" {
+		t.Errorf("Messages = %+v, want the retried turn deleted", messages)
+	}
+	repo.EndPrompt(session.ID, StreamStatusIdle)
 
-	// Verify sequences are contiguous from 1 to N
-	for i := int64(1); i <= int64(totalEvents); i++ {
-		if !sequences[i] {
-			t.Errorf("Missing sequence number: %d", i)
-		}
+	// The turn is already gone, so nothing starts
+	if _, err := repo.StartRetryPrompt(session.ID, false, failed.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("StartRetryPrompt error = %v, want ErrMessageNotFound", err)
+	}
+	if s, _ := repo.GetSession(session.ID); s.StreamStatus == StreamStatusStreaming {
+		t.Error("A retry of a missing turn left the session streaming")
 	}
 }
 
-func TestRepository_GetEventsSince(t *testing.T) {
+func TestRepository_PromptSettings(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
 
-	title := "Test"
-	session, _ := repo.CreateSession(&title, nil)
-	promptID := session.ID + "-1"
+	session, _ := repo.CreateSession(nil, nil)
+	promptID, _ := repo.StartNewPrompt(session.ID)
 
-	// Create events
-	repo.CreateEvent(session.ID, promptID, "connected", []byte(`{}`))
-	repo.CreateEvent(session.ID, promptID, "claude", []byte(`{}`))
-	repo.CreateEvent(session.ID, promptID, "done", []byte(`{}`))
+	settings, err := repo.GetPromptSettings(session.ID, promptID)
+	if err != nil || settings != (PromptSettings{Priority: PriorityNormal}) {
+		t.Errorf("GetPromptSettings = %+v, %v; want normal priority by default", settings, err)
+	}
 
-	// Get all events
-	events, err := repo.GetEventsSince(session.ID, 0, promptID, 100)
-	if err != nil {
-		t.Fatalf("GetEventsSince failed: %v", err)
+	repo.SetPromptLabel(session.ID, promptID, "nightly")
+	if err := repo.SetPromptSettings(session.ID, promptID, PriorityLow, 5*time.Minute, true); err != nil {
+		t.Fatalf("SetPromptSettings failed: %v", err)
 	}
-	if len(events) != 3 {
-		t.Errorf("Got %d events, want 3", len(events))
+	settings, _ = repo.GetPromptSettings(session.ID, promptID)
+	if want := (PromptSettings{Label: "nightly", Priority: PriorityLow, Timeout: 5 * time.Minute, RawArgs: true}); settings != want {
+		t.Errorf("GetPromptSettings = %+v, want %+v", settings, want)
 	}
 
-	// Get events since sequence 1
-	events, err = repo.GetEventsSince(session.ID, 1, promptID, 100)
-	if err != nil {
-		t.Fatalf("GetEventsSince failed: %v", err)
+	if err := repo.SetPromptSettings("missing", "missing-1", PriorityLow, 0, false); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("SetPromptSettings error = %v, want ErrSessionNotFound", err)
 	}
-	if len(events) != 2 {
-		t.Errorf("Got %d events, want 2", len(events))
+}
+
+func TestRepository_DeleteTurn(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	repo.CreateSystemMessage(session.ID, "Be brief")
+	repo.CreateMessage(session.ID, "user", "first", nil)
+	repo.CreateMessage(session.ID, "assistant", "first reply", nil)
+	failed, _ := repo.CreateMessage(session.ID, "user", "second", nil)
+	repo.CreateMessage(session.ID, "assistant", "partial", nil)
+
+	if err := repo.DeleteTurn(session.ID, failed.ID); err != nil {
+		t.Fatalf("DeleteTurn failed: %v", err)
 	}
-	if events[0].Sequence != 2 {
-		t.Errorf("First event sequence = %d, want 2", events[0].Sequence)
+	messages, _ := repo.GetSessionMessages(session.ID)
+	var got []string
+	for _, m := range messages {
+		got = append(got, m.Content)
 	}
-
-	// Test limit
-	events, err = repo.GetEventsSince(session.ID, 0, promptID, 2)
-	if err != nil {
-		t.Fatalf("GetEventsSince failed: %v", err)
+	if want := []string{"Be brief", "first", "first reply"}; !slices.Equal(got, want) {
+		t.Errorf("Messages = %q, want %q", got, want)
 	}
-	if len(events) != 2 {
-		t.Errorf("Got %d events, want 2 (limited)", len(events))
+
+	if err := repo.DeleteTurn(session.ID, failed.ID); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("DeleteTurn error = %v, want ErrMessageNotFound for a deleted message", err)
 	}
 }
 
@@ -385,6 +1836,172 @@ func TestRepository_StartNewPrompt_NotFound(t *testing.T) {
 	}
 }
 
+func TestRepository_StartConcurrentPrompt(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSessionWithSettings(nil, nil, SessionSettings{ConcurrentPrompts: true})
+	if !session.ConcurrentPrompts {
+		t.Error("ConcurrentPrompts = false, want true")
+	}
+
+	first, err := repo.StartConcurrentPrompt(session.ID)
+	if err != nil {
+		t.Fatalf("StartConcurrentPrompt failed: %v", err)
+	}
+	second, err := repo.StartConcurrentPrompt(session.ID)
+	if err != nil {
+		t.Fatalf("Second StartConcurrentPrompt failed: %v", err)
+	}
+	if first != session.ID+"-1" || second != session.ID+"-2" {
+		t.Errorf("PromptIDs = %s, %s, want sequential", first, second)
+	}
+
+	// Single-flight prompts are still refused while any prompt streams
+	if _, err := repo.StartNewPrompt(session.ID); err != ErrSessionBusy {
+		t.Errorf("StartNewPrompt error = %v, want ErrSessionBusy", err)
+	}
+
+	// The session keeps streaming until the last prompt ends
+	if err := repo.EndPrompt(session.ID, StreamStatusIdle); err != nil {
+		t.Fatalf("EndPrompt failed: %v", err)
+	}
+	if got, _ := repo.GetSession(session.ID); got.StreamStatus != StreamStatusStreaming {
+		t.Errorf("StreamStatus after one prompt ended = %s, want streaming", got.StreamStatus)
+	}
+
+	_, _, err = repo.FinalizePrompt(session.ID, second, PromptOutcome{
+		EventType: "done", EventData: []byte(`{}`), Status: StreamStatusCompleted,
+	})
+	if err != nil {
+		t.Fatalf("FinalizePrompt failed: %v", err)
+	}
+	if got, _ := repo.GetSession(session.ID); got.StreamStatus != StreamStatusCompleted {
+		t.Errorf("StreamStatus after last prompt ended = %s, want completed", got.StreamStatus)
+	}
+
+	// With nothing running the counter starts over
+	if _, err := repo.StartNewPrompt(session.ID); err != nil {
+		t.Fatalf("StartNewPrompt failed: %v", err)
+	}
+	repo.EndPrompt(session.ID, StreamStatusIdle)
+	if got, _ := repo.GetSession(session.ID); got.StreamStatus != StreamStatusIdle {
+		t.Errorf("StreamStatus = %s, want idle", got.StreamStatus)
+	}
+}
+
+func TestRepository_StartNewPrompt_Deleted(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	repo.SoftDeleteSession(session.ID)
+
+	if _, err := repo.StartNewPrompt(session.ID); err != ErrSessionNotFound {
+		t.Errorf("StartNewPrompt on deleted session = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_CreateMessage_SessionNotFound(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	if _, err := repo.CreateMessage("nonexistent", "user", "Hello", nil); err != ErrSessionNotFound {
+		t.Errorf("CreateMessage for missing session = %v, want ErrSessionNotFound", err)
+	}
+}
+
+func TestRepository_QueuedPrompts(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+
+	first, err := repo.EnqueuePrompt(session.ID, "first", PriorityNormal)
+	if err != nil {
+		t.Fatalf("EnqueuePrompt failed: %v", err)
+	}
+	second, _ := repo.EnqueuePrompt(session.ID, "second", PriorityNormal)
+
+	queued, err := repo.ListQueuedPrompts(session.ID)
+	if err != nil {
+		t.Fatalf("ListQueuedPrompts failed: %v", err)
+	}
+	if len(queued) != 2 || queued[0].ID != first.ID || queued[1].ID != second.ID {
+		t.Fatalf("ListQueuedPrompts = %+v, want first then second", queued)
+	}
+	if queued[0].Status != QueuedPromptWaiting {
+		t.Errorf("Status = %s, want queued", queued[0].Status)
+	}
+
+	// Prompts leave the list once they start or are cancelled
+	repo.UpdateQueuedPromptStatus(first.ID, QueuedPromptStarted)
+	repo.UpdateQueuedPromptStatus(second.ID, QueuedPromptCancelled)
+
+	queued, _ = repo.ListQueuedPrompts(session.ID)
+	if len(queued) != 0 {
+		t.Errorf("Got %d queued prompts, want 0", len(queued))
+	}
+}
+
+func TestRepository_CancelQueuedPrompts(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	other, _ := repo.CreateSession(nil, nil)
+
+	started, _ := repo.EnqueuePrompt(session.ID, "started", PriorityNormal)
+	repo.UpdateQueuedPromptStatus(started.ID, QueuedPromptStarted)
+	repo.EnqueuePrompt(session.ID, "first", PriorityNormal)
+	repo.EnqueuePrompt(session.ID, "second", PriorityHigh)
+	repo.EnqueuePrompt(other.ID, "other", PriorityNormal)
+
+	n, err := repo.CancelQueuedPrompts(session.ID)
+	if err != nil {
+		t.Fatalf("CancelQueuedPrompts failed: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Cancelled %d prompts, want 2", n)
+	}
+
+	if queued, _ := repo.ListQueuedPrompts(session.ID); len(queued) != 0 {
+		t.Errorf("Got %d queued prompts, want 0", len(queued))
+	}
+	if queued, _ := repo.ListQueuedPrompts(other.ID); len(queued) != 1 {
+		t.Errorf("Other session has %d queued prompts, want 1", len(queued))
+	}
+}
+
+func TestRepository_CancelsStaleQueuedPromptsOnOpen(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "chai.db")
+	repo, err := NewRepository(dbPath, nil)
+	if err != nil {
+		t.Fatalf("NewRepository failed: %v", err)
+	}
+	session, _ := repo.CreateSession(nil, nil)
+	started, _ := repo.EnqueuePrompt(session.ID, "started", PriorityNormal)
+	repo.UpdateQueuedPromptStatus(started.ID, QueuedPromptStarted)
+	repo.EnqueuePrompt(session.ID, "waiting", PriorityNormal)
+	repo.Close()
+
+	// A restart finds the prompt still queued with nothing left to run it
+	repo, err = NewRepository(dbPath, nil)
+	if err != nil {
+		t.Fatalf("Reopening failed: %v", err)
+	}
+	defer repo.Close()
+
+	if queued, _ := repo.ListQueuedPrompts(session.ID); len(queued) != 0 {
+		t.Errorf("Got %d queued prompts after reopening, want 0", len(queued))
+	}
+	var cancelled int
+	repo.db.QueryRow(`SELECT COUNT(*) FROM queued_prompts WHERE status = ?`, string(QueuedPromptCancelled)).Scan(&cancelled)
+	if cancelled != 1 {
+		t.Errorf("Cancelled %d prompts, want 1 (the started one is left alone)", cancelled)
+	}
+}
+
 func TestRepository_SessionEvents_CascadeDelete(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -440,6 +2057,166 @@ func TestRepository_UpdateSessionStreamStatus(t *testing.T) {
 	}
 }
 
+func TestRepository_SessionStats(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	stats, err := repo.GetSessionStats(session.ID)
+	if err != nil {
+		t.Fatalf("GetSessionStats failed: %v", err)
+	}
+	if stats.Prompts != 0 || stats.PerPrompt == nil {
+		t.Errorf("Empty stats = %+v, want no prompts and an empty list", stats)
+	}
+
+	finalize := func(usage *PromptUsage) string {
+		promptID, err := repo.StartNewPrompt(session.ID)
+		if err != nil {
+			t.Fatalf("StartNewPrompt failed: %v", err)
+		}
+		_, _, err = repo.FinalizePrompt(session.ID, promptID, PromptOutcome{
+			EventType: "done", EventData: []byte(`{}`), Status: StreamStatusCompleted, Usage: usage,
+		})
+		if err != nil {
+			t.Fatalf("FinalizePrompt failed: %v", err)
+		}
+		return promptID
+	}
+	first := finalize(&PromptUsage{CostUSD: 0.25, InputTokens: 100, OutputTokens: 50, CacheReadInputTokens: 10})
+	finalize(nil) // no result event, e.g. an error
+	second := finalize(&PromptUsage{CostUSD: 0.5, InputTokens: 200, OutputTokens: 25, CacheCreationInputTokens: 5})
+
+	stats, err = repo.GetSessionStats(session.ID)
+	if err != nil {
+		t.Fatalf("GetSessionStats failed: %v", err)
+	}
+	if stats.Prompts != 2 || stats.CostUSD != 0.75 || stats.InputTokens != 300 || stats.OutputTokens != 75 ||
+		stats.CacheCreationInputTokens != 5 || stats.CacheReadInputTokens != 10 {
+		t.Errorf("Totals = %+v, want 2 prompts, $0.75, 300/75 tokens, 5/10 cache", stats)
+	}
+	if len(stats.PerPrompt) != 2 || stats.PerPrompt[0].PromptID != first || stats.PerPrompt[1].PromptID != second {
+		t.Errorf("PerPrompt = %+v, want %s then %s", stats.PerPrompt, first, second)
+	}
+
+	// Stats go with the session
+	repo.DeleteSession(session.ID)
+	var count int
+	repo.db.QueryRow(`SELECT COUNT(*) FROM prompt_stats`).Scan(&count)
+	if count != 0 {
+		t.Errorf("%d prompt_stats rows left after delete, want 0", count)
+	}
+}
+
+func TestRepository_ClientBookmark(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	if _, err := repo.GetClientBookmark(session.ID, ""); err != sql.ErrNoRows {
+		t.Fatalf("GetClientBookmark error = %v, want sql.ErrNoRows", err)
+	}
+
+	seq := int64(7)
+	if err := repo.SetClientBookmark(&ClientBookmark{SessionID: session.ID, PromptID: session.ID + "-2", Sequence: &seq}); err != nil {
+		t.Fatalf("SetClientBookmark failed: %v", err)
+	}
+	if err := repo.SetClientBookmark(&ClientBookmark{SessionID: session.ID, ClientID: "phone", Cursor: "opaque"}); err != nil {
+		t.Fatalf("SetClientBookmark failed: %v", err)
+	}
+
+	got, err := repo.GetClientBookmark(session.ID, "")
+	if err != nil {
+		t.Fatalf("GetClientBookmark failed: %v", err)
+	}
+	if got.PromptID != session.ID+"-2" || got.Sequence == nil || *got.Sequence != 7 || got.Cursor != "" {
+		t.Errorf("Bookmark = %+v, want prompt 2 at sequence 7", got)
+	}
+
+	// Saving again replaces the client's bookmark, including clearing fields
+	repo.SetClientBookmark(&ClientBookmark{SessionID: session.ID, ClientID: "phone", Sequence: &seq})
+	got, _ = repo.GetClientBookmark(session.ID, "phone")
+	if got.Cursor != "" || got.Sequence == nil || *got.Sequence != 7 {
+		t.Errorf("Bookmark = %+v, want the cursor replaced by sequence 7", got)
+	}
+
+	// Bookmarks go with their session
+	repo.DeleteSession(session.ID)
+	if _, err := repo.GetClientBookmark(session.ID, "phone"); err != sql.ErrNoRows {
+		t.Errorf("GetClientBookmark after delete error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRepository_PromptSnapshot(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID := session.ID + "-1"
+
+	if _, err := repo.GetPromptSnapshot(session.ID, promptID); err != sql.ErrNoRows {
+		t.Fatalf("GetPromptSnapshot error = %v, want sql.ErrNoRows", err)
+	}
+
+	snap := &PromptSnapshot{
+		PromptID:  promptID,
+		SessionID: session.ID,
+		Status:    PromptStatusComplete,
+		Text:      "Hello",
+		ToolCalls: json.RawMessage(`[{"type":"assistant"}]`),
+		Result:    json.RawMessage(`{"type":"result","subtype":"success"}`),
+		CreatedAt: time.Now(),
+	}
+	if err := repo.SavePromptSnapshot(snap); err != nil {
+		t.Fatalf("SavePromptSnapshot failed: %v", err)
+	}
+
+	got, err := repo.GetPromptSnapshot(session.ID, promptID)
+	if err != nil {
+		t.Fatalf("GetPromptSnapshot failed: %v", err)
+	}
+	if got.Status != PromptStatusComplete || got.Text != "Hello" ||
+		string(got.ToolCalls) != string(snap.ToolCalls) || string(got.Result) != string(snap.Result) {
+		t.Errorf("Snapshot = %+v, want %+v", got, snap)
+	}
+
+	// Saving again replaces the snapshot
+	snap.Status = PromptStatusError
+	snap.Error = "boom"
+	snap.ToolCalls = nil
+	repo.SavePromptSnapshot(snap)
+	got, _ = repo.GetPromptSnapshot(session.ID, promptID)
+	if got.Status != PromptStatusError || got.Error != "boom" || got.ToolCalls != nil {
+		t.Errorf("Snapshot = %+v, want the replacement", got)
+	}
+
+	// Snapshots are scoped to their session
+	if _, err := repo.GetPromptSnapshot("other", promptID); err != sql.ErrNoRows {
+		t.Errorf("GetPromptSnapshot for another session error = %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestRepository_UpdateEventData(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	session, _ := repo.CreateSession(nil, nil)
+	promptID := session.ID + "-1"
+
+	event, _ := repo.CreateEvent(session.ID, promptID, "error", []byte(`{"error":"boom"}`))
+	if err := repo.UpdateEventData(session.ID, promptID, event.Sequence, []byte(`{"count":2,"error":"boom"}`)); err != nil {
+		t.Fatalf("UpdateEventData failed: %v", err)
+	}
+
+	events, _ := repo.GetEventsSince(session.ID, 0, promptID, 10)
+	if len(events) != 1 {
+		t.Fatalf("Got %d events, want 1", len(events))
+	}
+	if string(events[0].Data) != `{"count":2,"error":"boom"}` {
+		t.Errorf("Data = %s, want updated data", events[0].Data)
+	}
+}
+
 func TestRepository_GetLatestEventSequence(t *testing.T) {
 	repo, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -550,3 +2327,36 @@ func TestRepository_DeleteEventsForCompletedSessions_RespectsAge(t *testing.T) {
 		t.Errorf("Expected 2 events, got %d", len(events))
 	}
 }
+
+func TestRepository_StartEventCleanup_Maintenance(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "chai.db")
+	repo, err := NewRepository(dbPath, nil)
+	if err != nil {
+		t.Fatalf("NewRepository failed: %v", err)
+	}
+	defer repo.Close()
+
+	session, _ := repo.CreateSession(nil, nil)
+	for i := 0; i < 50; i++ {
+		repo.CreateEvent(session.ID, session.ID+"-1", "claude", []byte(`{"text":"`+strings.Repeat("x", 4096)+`"}`))
+	}
+	repo.UpdateSessionStreamStatus(session.ID, StreamStatusCompleted)
+	if fileSize(t, dbPath+"-wal") == 0 {
+		t.Fatal("WAL is empty before cleanup")
+	}
+
+	// Deleting the events is followed by a checkpoint that truncates the WAL
+	stop := repo.StartEventCleanup(10*time.Millisecond, -time.Second, DBMaintenance{Interval: time.Hour})
+	defer stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for fileSize(t, dbPath+"-wal") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Event cleanup did not checkpoint the WAL after deleting events")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if events, _ := repo.GetEventsSince(session.ID, 0, "", 100); len(events) != 0 {
+		t.Errorf("Got %d events after cleanup, want 0", len(events))
+	}
+}
@@ -0,0 +1,18 @@
+package internal
+
+import "time"
+
+// retry calls fn up to attempts times, sleeping delay between failures.
+// It returns nil on the first success, otherwise the last error.
+func retry(attempts int, delay time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
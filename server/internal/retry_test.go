@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	errFail := errors.New("fail")
+
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"succeeds first try", 0, 3, 1, false},
+		{"succeeds after failures", 2, 3, 3, false},
+		{"exhausts attempts", 5, 3, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retry(tt.attempts, 0, func() error {
+				calls++
+				if calls <= tt.failures {
+					return errFail
+				}
+				return nil
+			})
+
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr && !errors.Is(err, errFail) {
+				t.Errorf("err = %v, want %v", err, errFail)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("err = %v, want nil", err)
+			}
+		})
+	}
+}
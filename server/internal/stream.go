@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prompt stream formats, chosen with ?format= on the prompt endpoint
+const (
+	StreamFormatSSE    = "sse"    // "event: <type>\ndata: <json>\n\n" frames
+	StreamFormatNDJSON = "ndjson" // one {"type":"<type>","data":<json>} object per line
+)
+
+// IsValidStreamFormat reports whether format is a known prompt stream format
+func IsValidStreamFormat(format string) bool {
+	return format == StreamFormatSSE || format == StreamFormatNDJSON
+}
+
+// Prompt stream event filters, chosen with ?events= on the prompt endpoint
+const (
+	StreamEventsAll  = "all"  // every event
+	StreamEventsText = "text" // normalized text events and the events ending the prompt
+)
+
+// IsValidStreamEvents reports whether events is a known prompt stream event filter
+func IsValidStreamEvents(events string) bool {
+	return events == StreamEventsAll || events == StreamEventsText
+}
+
+// textStreamEvents are the event types a StreamEventsText stream forwards
+var textStreamEvents = map[string]bool{"text": true, "done": true, "error": true, "cancelled": true}
+
+// eventStream delivers SSE (or NDJSON) frames for a single prompt to its client.
+//
+// With a positive buffer size, frames are queued on a bounded channel and written
+// by a dedicated goroutine so a slow client can't back-pressure the Claude read
+// loop. Callers persist every event before sending it, so delivery is best-effort:
+// when the buffer fills, the client is dropped (any write in progress is aborted)
+// and later frames are discarded, while the prompt keeps running and the client
+// can catch up via GetEvents.
+//
+// With a buffer size of 0, frames are written inline and write errors are
+// returned to the caller, which stops the prompt.
+//
+// Besides the handler that owns it, a stream may be sent a reconnect hint by
+// another goroutine, so sending and closing are serialized.
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	frames  chan []byte
+	done    chan struct{}
+	dropped atomic.Bool
+	ndjson  bool            // frame events as NDJSON lines instead of SSE
+	only    map[string]bool // event types to forward; nil forwards all
+
+	mu       sync.Mutex // guards sending against close
+	closed   bool
+	registry *streamRegistry // open streams, for reconnect hints; nil if untracked
+
+	// Connection accounting, recorded into stats (if set) by close
+	stats     *StreamStats
+	sessionID string
+	ctx       context.Context // the client's request context; ended means it disconnected
+	opened    time.Time
+	bytes     atomic.Int64 // bytes written to the client
+	events    atomic.Int64 // frames written to the client
+	terminal  string       // the last done, error or cancelled event sent
+}
+
+func newEventStream(w http.ResponseWriter, flusher http.Flusher, bufferSize int) *eventStream {
+	s := &eventStream{w: w, flusher: flusher, opened: time.Now()}
+	if bufferSize > 0 {
+		s.frames = make(chan []byte, bufferSize)
+		s.done = make(chan struct{})
+		go s.writeLoop()
+	}
+	return s
+}
+
+// send frames and delivers a single event. The data slice is copied, so callers
+// may reuse it after send returns. Event types the stream filters out are
+// skipped; callers have already persisted them for catch-up.
+func (s *eventStream) send(eventType string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sendLocked(eventType, data)
+}
+
+func (s *eventStream) sendLocked(eventType string, data []byte) error {
+	if eventType == "done" || eventType == "error" || eventType == "cancelled" {
+		s.terminal = eventType
+	}
+	if s.only != nil && !s.only[eventType] {
+		return nil
+	}
+	return s.deliver(s.frame(eventType, data))
+}
+
+// deliver writes or queues an encoded frame. The caller holds mu.
+func (s *eventStream) deliver(frame []byte) error {
+	if s.closed {
+		return nil
+	}
+	if s.frames == nil {
+		return s.write(frame)
+	}
+
+	if s.dropped.Load() {
+		return nil
+	}
+	select {
+	case s.frames <- frame:
+	default:
+		s.drop()
+	}
+	return nil
+}
+
+// reconnect sends a reconnect event suggesting the client wait delay before
+// reconnecting. SSE frames also carry a retry: field, which EventSource
+// clients apply to their automatic reconnects. The hint bypasses event
+// filters, since every client should honor it.
+func (s *eventStream) reconnect(delay time.Duration, reason string) {
+	data, _ := json.Marshal(map[string]any{"delay_ms": delay.Milliseconds(), "reason": reason})
+	frame := s.frame("reconnect", data)
+	if !s.ndjson {
+		frame = append(fmt.Appendf(nil, "retry: %d\n", delay.Milliseconds()), frame...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliver(frame)
+}
+
+// frame encodes one event. Only the framing differs between formats; the
+// data is the same JSON either way.
+func (s *eventStream) frame(eventType string, data []byte) []byte {
+	if s.ndjson {
+		typeJSON, _ := json.Marshal(eventType)
+		frame := fmt.Appendf(nil, `{"type":%s,"data":`, typeJSON)
+		frame = append(frame, data...)
+		return append(frame, "}\n"...)
+	}
+	return fmt.Appendf(nil, "event: %s\ndata: %s\n\n", eventType, data)
+}
+
+// drop disconnects a client that fell too far behind.
+func (s *eventStream) drop() {
+	if s.dropped.CompareAndSwap(false, true) {
+		log.Printf("SSE client fell behind, dropping connection (events remain available for catch-up)")
+		// Unblock a write stuck on the slow client so the writer goroutine can exit
+		http.NewResponseController(s.w).SetWriteDeadline(time.Now())
+	}
+}
+
+func (s *eventStream) writeLoop() {
+	defer close(s.done)
+	for frame := range s.frames {
+		if s.dropped.Load() {
+			continue
+		}
+		if err := s.write(frame); err != nil {
+			s.dropped.Store(true)
+		}
+	}
+}
+
+// write writes and flushes one frame, counting what reached the client.
+func (s *eventStream) write(frame []byte) error {
+	n, err := s.w.Write(frame)
+	s.bytes.Add(int64(n))
+	if err != nil {
+		return err
+	}
+	s.events.Add(1)
+	s.flusher.Flush()
+	return nil
+}
+
+// close flushes any queued frames and waits for the writer goroutine to exit,
+// then records the connection in the stream stats. It must be called before
+// the handler returns.
+func (s *eventStream) close() {
+	if s.registry != nil {
+		s.registry.remove(s)
+	}
+
+	s.mu.Lock()
+	// A stream cut off by MaxStreamDuration while queued, waiting for a slot
+	// or replaying hasn't sent a final event yet
+	if s.ctx != nil && s.terminal == "" && errors.Is(context.Cause(s.ctx), ErrStreamDurationExceeded) {
+		data, _ := json.Marshal(PromptErrorEvent{Error: ErrStreamDurationExceeded.Error(), Code: PromptErrorTimeout, Terminal: true})
+		s.sendLocked("error", data)
+	}
+	s.closed = true
+	if s.frames != nil {
+		close(s.frames)
+	}
+	s.mu.Unlock()
+
+	if s.frames != nil {
+		<-s.done
+	}
+	if s.stats != nil {
+		outcome, duration := s.outcome(), time.Since(s.opened)
+		log.Printf("Prompt stream for session %s closed: outcome=%s bytes=%d events=%d duration=%s",
+			s.sessionID, outcome, s.bytes.Load(), s.events.Load(), duration.Round(time.Millisecond))
+		s.stats.record(outcome, s.bytes.Load(), s.events.Load(), duration)
+	}
+}
+
+// outcome classifies how the connection ended. A client that went away or
+// was dropped for falling behind counts as such even if a final event was
+// sent after it, since that event never reached it.
+func (s *eventStream) outcome() string {
+	switch {
+	case s.dropped.Load():
+		return StreamOutcomeDropped
+	case s.ctx != nil && errors.Is(s.ctx.Err(), context.Canceled):
+		return StreamOutcomeDisconnected
+	case s.terminal != "":
+		return s.terminal
+	default:
+		// The handler gave up before a final event, e.g. a failed write
+		return StreamOutcomeError
+	}
+}
+
+// streamRegistry tracks the prompt streams that are open, so all of them can
+// be told to reconnect later, e.g. when the server shuts down.
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[*eventStream]struct{}
+}
+
+func newStreamRegistry() *streamRegistry {
+	return &streamRegistry{streams: make(map[*eventStream]struct{})}
+}
+
+func (sr *streamRegistry) add(s *eventStream) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	s.registry = sr
+	sr.streams[s] = struct{}{}
+}
+
+func (sr *streamRegistry) remove(s *eventStream) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	delete(sr.streams, s)
+}
+
+// reconnect sends a reconnect hint to every open stream and returns how many
+// there were.
+func (sr *streamRegistry) reconnect(delay time.Duration, reason string) int {
+	sr.mu.Lock()
+	streams := make([]*eventStream, 0, len(sr.streams))
+	for s := range sr.streams {
+		streams = append(streams, s)
+	}
+	sr.mu.Unlock()
+
+	for _, s := range streams {
+		s.reconnect(delay, reason)
+	}
+	return len(streams)
+}
+
+// Prompt stream outcomes, as reported by StreamStats
+const (
+	StreamOutcomeDone         = "done"         // ended with a done event
+	StreamOutcomeError        = "error"        // ended with an error event, or without a final event
+	StreamOutcomeCancelled    = "cancelled"    // ended with a cancelled event
+	StreamOutcomeDisconnected = "disconnected" // the client went away first
+	StreamOutcomeDropped      = "dropped"      // the client fell behind and was dropped
+)
+
+// StreamOutcomeStats totals the prompt stream connections that ended one way.
+type StreamOutcomeStats struct {
+	Connections   int64 `json:"connections"`
+	Bytes         int64 `json:"bytes"`  // written to clients
+	Events        int64 `json:"events"` // frames written to clients
+	DurationMS    int64 `json:"duration_ms"`
+	MaxDurationMS int64 `json:"max_duration_ms"`
+}
+
+// StreamStats counts prompt stream connections since startup by outcome,
+// for sizing how long clients hold connections and how much they're sent.
+type StreamStats struct {
+	mu       sync.Mutex
+	outcomes map[string]StreamOutcomeStats
+}
+
+// NewStreamStats creates empty stream stats.
+func NewStreamStats() *StreamStats {
+	return &StreamStats{outcomes: make(map[string]StreamOutcomeStats)}
+}
+
+func (st *StreamStats) record(outcome string, bytes, events int64, duration time.Duration) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	o := st.outcomes[outcome]
+	o.Connections++
+	o.Bytes += bytes
+	o.Events += events
+	o.DurationMS += duration.Milliseconds()
+	o.MaxDurationMS = max(o.MaxDurationMS, duration.Milliseconds())
+	st.outcomes[outcome] = o
+}
+
+// Snapshot returns the totals for every outcome, zero for outcomes not seen yet.
+func (st *StreamStats) Snapshot() map[string]StreamOutcomeStats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	snapshot := make(map[string]StreamOutcomeStats, 5)
+	for _, outcome := range []string{StreamOutcomeDone, StreamOutcomeError, StreamOutcomeCancelled, StreamOutcomeDisconnected, StreamOutcomeDropped} {
+		snapshot[outcome] = st.outcomes[outcome]
+	}
+	return snapshot
+}
@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingWriter simulates a client that never reads: writes block until a
+// write deadline is set, then fail.
+type blockingWriter struct {
+	header  http.Header
+	unblock chan struct{}
+	once    sync.Once
+}
+
+func newBlockingWriter() *blockingWriter {
+	return &blockingWriter{header: make(http.Header), unblock: make(chan struct{})}
+}
+
+func (b *blockingWriter) Header() http.Header { return b.header }
+func (b *blockingWriter) WriteHeader(int)     {}
+func (b *blockingWriter) Flush()              {}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.unblock
+	return 0, errors.New("write deadline exceeded")
+}
+
+func (b *blockingWriter) SetWriteDeadline(time.Time) error {
+	b.once.Do(func() { close(b.unblock) })
+	return nil
+}
+
+func TestEventStream_Inline(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 0)
+
+	if err := stream.send("connected", []byte(`{"prompt_id":"p-1"}`)); err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+	stream.close()
+
+	events := parseSSEEvents(strings.NewReader(w.Body.String()))
+	if len(events) != 1 || events[0].Event != "connected" {
+		t.Errorf("Events = %v, want one connected event", events)
+	}
+}
+
+func TestEventStream_NDJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 0)
+	stream.ndjson = true
+
+	stream.send("connected", []byte(`{"prompt_id":"p-1"}`))
+	stream.send("claude", []byte(`{"type":"assistant"}`))
+	stream.close()
+
+	want := `{"type":"connected","data":{"prompt_id":"p-1"}}` + "\n" +
+		`{"type":"claude","data":{"type":"assistant"}}` + "\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+}
+
+func TestEventStream_Only(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 0)
+	stream.only = textStreamEvents
+
+	stream.send("connected", []byte(`{"prompt_id":"p-1"}`))
+	stream.send("claude", []byte(`{"type":"assistant"}`))
+	stream.send("text", []byte(`{"text":"Hi"}`))
+	stream.send("done", []byte(`{}`))
+	stream.close()
+
+	var types []string
+	for _, e := range parseSSEEvents(strings.NewReader(w.Body.String())) {
+		types = append(types, e.Event)
+	}
+	if want := []string{"text", "done"}; !slices.Equal(types, want) {
+		t.Errorf("Events = %v, want %v", types, want)
+	}
+}
+
+func TestEventStream_Buffered(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 16)
+
+	data := []byte(`{"n":1}`)
+	for i := 0; i < 10; i++ {
+		stream.send("claude", data)
+	}
+	// Mutating the caller's buffer must not affect queued frames
+	data[5] = '2'
+	stream.close()
+
+	events := parseSSEEvents(strings.NewReader(w.Body.String()))
+	if len(events) != 10 {
+		t.Fatalf("Got %d events, want 10", len(events))
+	}
+	for _, e := range events {
+		if e.Data != `{"n":1}` {
+			t.Errorf("Data = %s, want {\"n\":1}", e.Data)
+		}
+	}
+}
+
+func TestEventStream_DropsSlowClient(t *testing.T) {
+	w := newBlockingWriter()
+	stream := newEventStream(w, w, 2)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			if err := stream.send("claude", []byte(`{}`)); err != nil {
+				t.Errorf("send returned %v, want nil for buffered stream", err)
+			}
+		}
+		stream.close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sending to a slow client blocked")
+	}
+
+	if !stream.dropped.Load() {
+		t.Error("Expected slow client to be dropped")
+	}
+	if got := stream.outcome(); got != StreamOutcomeDropped {
+		t.Errorf("Outcome = %s, want %s", got, StreamOutcomeDropped)
+	}
+}
+
+func TestEventStream_Stats(t *testing.T) {
+	stats := NewStreamStats()
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 16)
+	stream.stats, stream.ctx = stats, context.Background()
+	stream.only = textStreamEvents
+
+	stream.send("connected", []byte(`{}`))
+	stream.send("text", []byte(`{"text":"Hi"}`))
+	stream.send("done", []byte(`{}`))
+	stream.close()
+
+	// Filtered-out events aren't counted, but still end the stream as done
+	got := stats.Snapshot()[StreamOutcomeDone]
+	if got.Connections != 1 || got.Events != 2 || got.Bytes != int64(w.Body.Len()) {
+		t.Errorf("Done = %+v, want 1 connection with 2 events of %d bytes", got, w.Body.Len())
+	}
+
+	// A final event sent after the client went away never reached it
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream = newEventStream(httptest.NewRecorder(), w, 0)
+	stream.stats, stream.ctx = stats, gone
+	stream.send("error", []byte(`{}`))
+	stream.close()
+
+	snapshot := stats.Snapshot()
+	if snapshot[StreamOutcomeDisconnected].Connections != 1 || snapshot[StreamOutcomeError].Connections != 0 {
+		t.Errorf("Snapshot = %+v, want the second stream counted as disconnected", snapshot)
+	}
+	if len(snapshot) != 5 {
+		t.Errorf("Snapshot has %d outcomes, want all 5", len(snapshot))
+	}
+}
+
+func TestEventStream_Reconnect(t *testing.T) {
+	w := httptest.NewRecorder()
+	stream := newEventStream(w, w, 0)
+	stream.only = textStreamEvents
+
+	stream.reconnect(1500*time.Millisecond, ReconnectReasonShutdown)
+	stream.send("done", []byte(`{}`))
+	stream.close()
+	// Hints after close are dropped
+	stream.reconnect(time.Second, ReconnectReasonShutdown)
+
+	want := "retry: 1500\nevent: reconnect\ndata: {\"delay_ms\":1500,\"reason\":\"shutdown\"}\n\nevent: done\ndata: {}\n\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+
+	// NDJSON has no retry field; the event carries the delay alone
+	w = httptest.NewRecorder()
+	stream = newEventStream(w, w, 4)
+	stream.ndjson = true
+	stream.reconnect(time.Second, ReconnectReasonShutdown)
+	stream.close()
+	if got, want := w.Body.String(), `{"type":"reconnect","data":{"delay_ms":1000,"reason":"shutdown"}}`+"\n"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,236 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// promptAccumulator rebuilds the assistant reply from a prompt's Claude events.
+// The prompt handler uses it to save the assistant message, and GetEvents uses
+// it to summarize persisted events.
+type promptAccumulator struct {
+	content   strings.Builder
+	thinking  strings.Builder // reasoning from thinking blocks, kept out of content
+	toolCalls []json.RawMessage
+	blocks    []json.RawMessage // content blocks in the order Claude sent them
+	deltaText strings.Builder   // streamed text not yet closed into a block
+	result    json.RawMessage
+	messages  int // assistant events seen
+}
+
+// addClaudeEvent folds one raw Claude CLI JSON line into the accumulated reply.
+// The result event is kept as is; other lines that aren't assistant content
+// are ignored.
+func (a *promptAccumulator) addClaudeEvent(eventType string, line []byte) {
+	switch eventType {
+	case "assistant":
+		var msg AssistantMessage
+		if err := json.Unmarshal(line, &msg); err == nil {
+			a.messages++
+			for _, block := range msg.Message.Content {
+				if block.Type == "text" {
+					a.content.WriteString(block.Text)
+				} else if block.Type == "thinking" {
+					a.thinking.WriteString(block.Thinking)
+				} else if block.Type == "tool_use" {
+					a.toolCalls = append(a.toolCalls, json.RawMessage(line))
+				}
+			}
+			a.addBlocks(line)
+		}
+	case "content_block_delta":
+		var delta ContentBlockDelta
+		if err := json.Unmarshal(line, &delta); err == nil {
+			if delta.Delta.Type == "text_delta" {
+				a.content.WriteString(delta.Delta.Text)
+				a.deltaText.WriteString(delta.Delta.Text)
+			} else if delta.Delta.Type == "thinking_delta" {
+				a.thinking.WriteString(delta.Delta.Thinking)
+			}
+		}
+	case "result":
+		a.result = append(json.RawMessage(nil), line...)
+	}
+}
+
+// addBlocks appends an assistant event's content blocks verbatim, after any
+// streamed text that came before them.
+func (a *promptAccumulator) addBlocks(line []byte) {
+	var msg struct {
+		Message struct {
+			Content []json.RawMessage `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+	a.flushDeltaText()
+	for _, block := range msg.Message.Content {
+		a.blocks = append(a.blocks, append(json.RawMessage(nil), block...))
+	}
+}
+
+// flushDeltaText closes streamed text into a text block.
+func (a *promptAccumulator) flushDeltaText() {
+	if a.deltaText.Len() == 0 {
+		return
+	}
+	block, _ := json.Marshal(ContentBlock{Type: "text", Text: a.deltaText.String()})
+	a.blocks = append(a.blocks, block)
+	a.deltaText.Reset()
+}
+
+// toolActivity returns the tool calls and tool results carried by one raw
+// Claude CLI JSON line: tool_use blocks of assistant events and tool_result
+// blocks of user events.
+func toolActivity(eventType string, line []byte) (calls []ToolCallEvent, results []ToolResultEvent) {
+	switch eventType {
+	case "assistant":
+		var msg AssistantMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, nil
+		}
+		for _, block := range msg.Message.Content {
+			if block.Type == "tool_use" {
+				calls = append(calls, ToolCallEvent{ID: block.ID, Name: block.Name, Input: block.Input})
+			}
+		}
+	case "user":
+		var msg ToolResultMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, nil
+		}
+		for _, block := range msg.Message.Content {
+			if block.Type == "tool_result" {
+				results = append(results, ToolResultEvent{ToolUseID: block.ToolUseID, Content: block.Content, IsError: block.IsError})
+			}
+		}
+	}
+	return calls, results
+}
+
+// text returns the accumulated assistant text.
+func (a *promptAccumulator) text() string {
+	return a.content.String()
+}
+
+// thinkingText returns the accumulated reasoning from thinking blocks.
+func (a *promptAccumulator) thinkingText() string {
+	return a.thinking.String()
+}
+
+// toolCallsJSON returns the tool_use events as a JSON array, or nil if there were none.
+func (a *promptAccumulator) toolCallsJSON() json.RawMessage {
+	if len(a.toolCalls) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(a.toolCalls)
+	return data
+}
+
+// blocksJSON returns the reply's content blocks as a JSON array, or nil if
+// there were none.
+func (a *promptAccumulator) blocksJSON() json.RawMessage {
+	a.flushDeltaText()
+	if len(a.blocks) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(a.blocks)
+	return data
+}
+
+// doneEvent returns the done payload for a completed prompt, with the stats
+// from the result event when Claude sent one.
+func (a *promptAccumulator) doneEvent() DoneEvent {
+	done := DoneEvent{
+		Status:    "complete",
+		Messages:  a.messages,
+		ToolCalls: len(a.toolCalls),
+	}
+
+	var result ResultEvent
+	if a.result == nil || json.Unmarshal(a.result, &result) != nil {
+		return done
+	}
+	cost := result.TotalCostUSD
+	if cost == 0 {
+		cost = result.CostUSD
+	}
+	done.CostUSD = &cost
+	done.DurationMS = &result.DurationMS
+	done.DurationAPIMS = &result.DurationAPI
+	done.NumTurns = &result.NumTurns
+	if u := result.Usage; u != nil {
+		done.InputTokens = &u.InputTokens
+		done.OutputTokens = &u.OutputTokens
+		done.CacheCreationInputTokens = &u.CacheCreationInputTokens
+		done.CacheReadInputTokens = &u.CacheReadInputTokens
+	}
+	return done
+}
+
+// usage returns the cost and token counts from the result event, or nil when
+// Claude didn't send one.
+func (a *promptAccumulator) usage() *PromptUsage {
+	done := a.doneEvent()
+	if done.CostUSD == nil {
+		return nil
+	}
+	u := &PromptUsage{CostUSD: *done.CostUSD}
+	if done.InputTokens != nil {
+		u.InputTokens = *done.InputTokens
+		u.OutputTokens = *done.OutputTokens
+		u.CacheCreationInputTokens = *done.CacheCreationInputTokens
+		u.CacheReadInputTokens = *done.CacheReadInputTokens
+	}
+	return u
+}
+
+// summarizeEvents reduces persisted events to one summary per prompt, in the
+// order the prompts first appear.
+func summarizeEvents(events []SessionEvent) []PromptSummary {
+	summaries := []PromptSummary{}
+	accumulators := map[string]*promptAccumulator{}
+	index := map[string]int{}
+
+	for _, e := range events {
+		i, ok := index[e.PromptID]
+		if !ok {
+			i = len(summaries)
+			index[e.PromptID] = i
+			accumulators[e.PromptID] = &promptAccumulator{}
+			summaries = append(summaries, PromptSummary{
+				PromptID:      e.PromptID,
+				Status:        PromptStatusStreaming,
+				FirstSequence: e.Sequence,
+			})
+		}
+		s := &summaries[i]
+		s.LastSequence = e.Sequence
+
+		switch e.EventType {
+		case "claude":
+			var event ClaudeEvent
+			if err := json.Unmarshal(e.Data, &event); err == nil {
+				accumulators[e.PromptID].addClaudeEvent(event.Type, e.Data)
+			}
+		case "done":
+			s.Status = PromptStatusComplete
+		case "cancelled":
+			s.Status = PromptStatusCancelled
+		case "error":
+			var data struct {
+				Error string `json:"error"`
+			}
+			json.Unmarshal(e.Data, &data)
+			s.Status = PromptStatusError
+			s.Error = data.Error
+		}
+	}
+
+	for promptID, i := range index {
+		summaries[i].Text = accumulators[promptID].text()
+		summaries[i].ToolCalls = accumulators[promptID].toolCallsJSON()
+	}
+	return summaries
+}
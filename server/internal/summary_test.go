@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPromptAccumulator(t *testing.T) {
+	var a promptAccumulator
+
+	a.addClaudeEvent("system", []byte(`{"type":"system"}`))
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"text","text":"Hello"}]}}`))
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"text_delta","text":", world"}}`))
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"input_json_delta","text":"ignored"}}`))
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Read"}]}}`))
+
+	if a.text() != "Hello, world" {
+		t.Errorf("text = %q, want %q", a.text(), "Hello, world")
+	}
+
+	var toolCalls []json.RawMessage
+	if err := json.Unmarshal(a.toolCallsJSON(), &toolCalls); err != nil {
+		t.Fatalf("toolCallsJSON is not a JSON array: %v", err)
+	}
+	if len(toolCalls) != 1 {
+		t.Errorf("Got %d tool calls, want 1", len(toolCalls))
+	}
+
+	var empty promptAccumulator
+	if empty.toolCallsJSON() != nil {
+		t.Error("toolCallsJSON should be nil without tool calls")
+	}
+}
+
+func TestPromptAccumulator_Thinking(t *testing.T) {
+	var a promptAccumulator
+
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"thinking_delta","thinking":"The user "}}`))
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"thinking_delta","thinking":"wants a greeting. "}}`))
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"Keep it short.","signature":"sig"},{"type":"text","text":"Hi"}]}}`))
+
+	// Reasoning is kept apart from the answer
+	if a.text() != "Hi" {
+		t.Errorf("text = %q, want Hi", a.text())
+	}
+	if want := "The user wants a greeting. Keep it short."; a.thinkingText() != want {
+		t.Errorf("thinkingText = %q, want %q", a.thinkingText(), want)
+	}
+
+	// Blocks keep thinking blocks as Claude sent them
+	var blocks []ContentBlock
+	if err := json.Unmarshal(a.blocksJSON(), &blocks); err != nil {
+		t.Fatalf("blocksJSON is not a JSON array: %v", err)
+	}
+	if len(blocks) != 2 || blocks[0].Type != "thinking" || blocks[0].Thinking != "Keep it short." {
+		t.Errorf("blocks = %+v, want the thinking block then the text", blocks)
+	}
+}
+
+func TestPromptAccumulator_Blocks(t *testing.T) {
+	var a promptAccumulator
+
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"text_delta","text":"Let me "}}`))
+	a.addClaudeEvent("content_block_delta", []byte(`{"type":"content_block_delta","delta":{"type":"text_delta","text":"look."}}`))
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"t1","name":"Read","input":{"path":"a.go"}}]}}`))
+	a.addClaudeEvent("user", []byte(`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"t1","content":"ok"}]}}`))
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"text","text":"Done."},{"type":"thinking","thinking":"hmm"}]}}`))
+
+	var blocks []map[string]any
+	if err := json.Unmarshal(a.blocksJSON(), &blocks); err != nil {
+		t.Fatalf("blocksJSON is not a JSON array: %v", err)
+	}
+	var got []string
+	for _, b := range blocks {
+		got = append(got, b["type"].(string))
+	}
+	want := []string{"text", "tool_use", "text", "thinking"}
+	if len(got) != len(want) {
+		t.Fatalf("block types = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("block types = %v, want %v", got, want)
+		}
+	}
+	if blocks[0]["text"] != "Let me look." {
+		t.Errorf("streamed text block = %v, want the deltas joined", blocks[0])
+	}
+	if input, _ := blocks[1]["input"].(map[string]any); input["path"] != "a.go" {
+		t.Errorf("tool_use block = %v, want it kept verbatim", blocks[1])
+	}
+	// Blocks add structure; the flattened text is unchanged
+	if a.text() != "Let me look.Done." {
+		t.Errorf("text = %q", a.text())
+	}
+
+	var empty promptAccumulator
+	if empty.blocksJSON() != nil {
+		t.Error("blocksJSON should be nil without content")
+	}
+}
+
+func TestPromptAccumulator_DoneEvent(t *testing.T) {
+	var a promptAccumulator
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"text","text":"Hi"}]}}`))
+
+	// Without a result event only the counts are reported
+	done := a.doneEvent()
+	if done.Status != "complete" || done.Messages != 1 || done.ToolCalls != 0 {
+		t.Errorf("doneEvent = %+v, want complete with 1 message and 0 tool calls", done)
+	}
+	if done.CostUSD != nil || done.DurationMS != nil || done.InputTokens != nil {
+		t.Errorf("doneEvent without result should omit stats, got %+v", done)
+	}
+
+	a.addClaudeEvent("assistant", []byte(`{"type":"assistant","message":{"content":[{"type":"tool_use","name":"Read"}]}}`))
+	a.addClaudeEvent("result", []byte(`{"type":"result","subtype":"success","total_cost_usd":0.25,"duration_ms":1200,"duration_api_ms":900,"num_turns":2,"usage":{"input_tokens":10,"output_tokens":20,"cache_read_input_tokens":5}}`))
+
+	done = a.doneEvent()
+	if done.Messages != 2 || done.ToolCalls != 1 {
+		t.Errorf("counts = %d messages, %d tool calls, want 2 and 1", done.Messages, done.ToolCalls)
+	}
+	if done.CostUSD == nil || *done.CostUSD != 0.25 {
+		t.Errorf("CostUSD = %v, want 0.25", done.CostUSD)
+	}
+	if done.DurationMS == nil || *done.DurationMS != 1200 || done.DurationAPIMS == nil || *done.DurationAPIMS != 900 {
+		t.Errorf("durations = %v/%v, want 1200/900", done.DurationMS, done.DurationAPIMS)
+	}
+	if done.NumTurns == nil || *done.NumTurns != 2 {
+		t.Errorf("NumTurns = %v, want 2", done.NumTurns)
+	}
+	if done.InputTokens == nil || *done.InputTokens != 10 || done.OutputTokens == nil || *done.OutputTokens != 20 {
+		t.Errorf("tokens = %v/%v, want 10/20", done.InputTokens, done.OutputTokens)
+	}
+	if done.CacheReadInputTokens == nil || *done.CacheReadInputTokens != 5 {
+		t.Errorf("CacheReadInputTokens = %v, want 5", done.CacheReadInputTokens)
+	}
+
+	// Older CLIs report cost_usd instead of total_cost_usd
+	var legacy promptAccumulator
+	legacy.addClaudeEvent("result", []byte(`{"type":"result","subtype":"success","cost_usd":0.5}`))
+	if done := legacy.doneEvent(); done.CostUSD == nil || *done.CostUSD != 0.5 || done.InputTokens != nil {
+		t.Errorf("legacy doneEvent = %+v, want cost 0.5 and no tokens", done)
+	}
+}
+
+func TestPromptAccumulator_Usage(t *testing.T) {
+	var a promptAccumulator
+	if u := a.usage(); u != nil {
+		t.Errorf("usage without a result = %+v, want nil", u)
+	}
+
+	a.addClaudeEvent("result", []byte(`{"type":"result","subtype":"success","total_cost_usd":0.25,"usage":{"input_tokens":10,"output_tokens":20,"cache_creation_input_tokens":3,"cache_read_input_tokens":5}}`))
+	want := PromptUsage{CostUSD: 0.25, InputTokens: 10, OutputTokens: 20, CacheCreationInputTokens: 3, CacheReadInputTokens: 5}
+	if u := a.usage(); u == nil || *u != want {
+		t.Errorf("usage = %+v, want %+v", u, want)
+	}
+
+	// A result without usage still reports its cost
+	var costOnly promptAccumulator
+	costOnly.addClaudeEvent("result", []byte(`{"type":"result","subtype":"success","cost_usd":0.5}`))
+	if u := costOnly.usage(); u == nil || *u != (PromptUsage{CostUSD: 0.5}) {
+		t.Errorf("usage without token counts = %+v, want cost 0.5 only", u)
+	}
+}
+
+func TestToolActivity(t *testing.T) {
+	calls, results := toolActivity("assistant", []byte(`{"type":"assistant","message":{"content":[
+		{"type":"text","text":"Let me look"},
+		{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"main.go"}}]}}`))
+	if len(results) != 0 || len(calls) != 1 {
+		t.Fatalf("Got %d calls and %d results, want 1 call", len(calls), len(results))
+	}
+	if calls[0].ID != "toolu_1" || calls[0].Name != "Read" {
+		t.Errorf("Call = %+v, want toolu_1 Read", calls[0])
+	}
+	if input, _ := calls[0].Input.(map[string]any); input["file_path"] != "main.go" {
+		t.Errorf("Input = %v, want the tool's input", calls[0].Input)
+	}
+
+	calls, results = toolActivity("user", []byte(`{"type":"user","message":{"role":"user","content":[
+		{"type":"tool_result","tool_use_id":"toolu_1","content":"package main"},
+		{"type":"tool_result","tool_use_id":"toolu_2","content":[{"type":"text","text":"denied"}],"is_error":true}]}}`))
+	if len(calls) != 0 || len(results) != 2 {
+		t.Fatalf("Got %d calls and %d results, want 2 results", len(calls), len(results))
+	}
+	if results[0].ToolUseID != "toolu_1" || string(results[0].Content) != `"package main"` || results[0].IsError {
+		t.Errorf("First result = %+v", results[0])
+	}
+	if results[1].ToolUseID != "toolu_2" || !results[1].IsError {
+		t.Errorf("Second result = %+v, want an error for toolu_2", results[1])
+	}
+
+	// A user event whose content is a plain string has no tool results
+	if calls, results := toolActivity("user", []byte(`{"type":"user","message":{"content":"hi"}}`)); calls != nil || results != nil {
+		t.Errorf("Got %v, %v, want nothing", calls, results)
+	}
+	if calls, results := toolActivity("result", []byte(`{"type":"result"}`)); calls != nil || results != nil {
+		t.Errorf("Got %v, %v for a result event, want nothing", calls, results)
+	}
+}
+
+func TestSummarizeEvents(t *testing.T) {
+	events := []SessionEvent{
+		{PromptID: "s-1", Sequence: 1, EventType: "connected", Data: json.RawMessage(`{}`)},
+		{PromptID: "s-1", Sequence: 2, EventType: "claude", Data: json.RawMessage(`{"type":"assistant","message":{"content":[{"type":"text","text":"First "}]}}`)},
+		{PromptID: "s-1", Sequence: 3, EventType: "claude", Data: json.RawMessage(`{"type":"content_block_delta","delta":{"type":"text_delta","text":"answer"}}`)},
+		{PromptID: "s-1", Sequence: 4, EventType: "done", Data: json.RawMessage(`{"status":"complete"}`)},
+		{PromptID: "s-2", Sequence: 1, EventType: "connected", Data: json.RawMessage(`{}`)},
+		{PromptID: "s-2", Sequence: 2, EventType: "error", Data: json.RawMessage(`{"error":"exit status 1"}`)},
+		{PromptID: "s-3", Sequence: 1, EventType: "connected", Data: json.RawMessage(`{}`)},
+		{PromptID: "s-3", Sequence: 2, EventType: "claude", Data: json.RawMessage(`{"type":"assistant","message":{"content":[{"type":"text","text":"partial"}]}}`)},
+	}
+
+	summaries := summarizeEvents(events)
+	if len(summaries) != 3 {
+		t.Fatalf("Got %d summaries, want 3", len(summaries))
+	}
+
+	tests := []struct {
+		promptID string
+		status   PromptStatus
+		text     string
+		err      string
+		last     int64
+	}{
+		{"s-1", PromptStatusComplete, "First answer", "", 4},
+		{"s-2", PromptStatusError, "", "exit status 1", 2},
+		{"s-3", PromptStatusStreaming, "partial", "", 2},
+	}
+	for i, tt := range tests {
+		s := summaries[i]
+		if s.PromptID != tt.promptID {
+			t.Errorf("summaries[%d].PromptID = %s, want %s", i, s.PromptID, tt.promptID)
+		}
+		if s.Status != tt.status {
+			t.Errorf("%s: Status = %s, want %s", tt.promptID, s.Status, tt.status)
+		}
+		if s.Text != tt.text {
+			t.Errorf("%s: Text = %q, want %q", tt.promptID, s.Text, tt.text)
+		}
+		if s.Error != tt.err {
+			t.Errorf("%s: Error = %q, want %q", tt.promptID, s.Error, tt.err)
+		}
+		if s.FirstSequence != 1 || s.LastSequence != tt.last {
+			t.Errorf("%s: sequences = %d..%d, want 1..%d", tt.promptID, s.FirstSequence, s.LastSequence, tt.last)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// processTracker reports whether a session has a live Claude process.
+type processTracker interface {
+	IsActive(sessionID string) bool
+}
+
+// SweepOrphanedStreams resets sessions that are marked streaming in the database
+// but have no running Claude process, e.g. after a handler panic skipped the
+// status reset, to status. Sessions updated or with events within olderThan are
+// skipped so a prompt that is still starting up or finishing isn't reset around
+// its process. Returns the number of sessions reset.
+func SweepOrphanedStreams(repo *Repository, claude processTracker, olderThan time.Duration, status StreamStatus) (int, error) {
+	ids, err := repo.ListStaleStreamingSessions(olderThan)
+	if err != nil {
+		return 0, err
+	}
+
+	reset := 0
+	for _, id := range ids {
+		if claude.IsActive(id) {
+			continue
+		}
+		ok, err := repo.ResetStaleStreamingSession(id, olderThan, status)
+		if err != nil {
+			return reset, err
+		}
+		if ok {
+			log.Printf("Stream sweeper: reset orphaned streaming session %s to %s", id, status)
+			reset++
+		}
+	}
+	return reset, nil
+}
+
+// StartStreamSweeper starts a background goroutine that periodically runs
+// SweepOrphanedStreams. Returns a function to stop the sweeper.
+func StartStreamSweeper(repo *Repository, claude processTracker, interval, olderThan time.Duration, status StreamStatus) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := SweepOrphanedStreams(repo, claude, olderThan, status); err != nil {
+					log.Printf("Stream sweeper error: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// StartDeletedSessionPurger starts a background goroutine that periodically
+// purges sessions deleted more than retention ago. Returns a function to stop
+// the purger.
+func StartDeletedSessionPurger(repo *Repository, interval, retention time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				n, err := repo.PurgeDeletedSessions(retention)
+				if err != nil {
+					log.Printf("Session purger error: %v", err)
+				} else if n > 0 {
+					log.Printf("Session purger: purged %d deleted sessions", n)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// StartAutoArchiver starts a background goroutine that periodically archives
+// sessions inactive for longer than after. Returns a function to stop it.
+func StartAutoArchiver(repo *Repository, interval, after time.Duration) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				n, err := repo.ArchiveInactiveSessions(after)
+				if err != nil {
+					log.Printf("Auto-archiver error: %v", err)
+				} else if n > 0 {
+					log.Printf("Auto-archiver: archived %d inactive sessions", n)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// DBMaintenance configures the maintenance StartEventCleanup runs after
+// deleting old events. A zero Interval disables it.
+type DBMaintenance struct {
+	Interval time.Duration // minimum time between runs
+	Vacuum   bool          // also VACUUM, which rewrites the whole database
+}
+
+// RunDBMaintenance reclaims space left by deleted sessions and events: it
+// vacuums the database when vacuum is set, then checkpoints and truncates the WAL.
+func RunDBMaintenance(repo *Repository, vacuum bool) error {
+	if vacuum {
+		if err := repo.Vacuum(); err != nil {
+			return fmt.Errorf("vacuum: %w", err)
+		}
+	}
+	if err := repo.Checkpoint(); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
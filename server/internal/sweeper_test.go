@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setStaleStreaming marks a session as streaming with an old updated_at
+func setStaleStreaming(t *testing.T, repo *Repository, id string, age time.Duration) {
+	t.Helper()
+	_, err := repo.db.Exec(`UPDATE sessions SET stream_status = ?, updated_at = ? WHERE id = ?`,
+		string(StreamStatusStreaming), time.Now().Add(-age).Unix(), id)
+	if err != nil {
+		t.Fatalf("Failed to mark session streaming: %v", err)
+	}
+}
+
+func TestSweepOrphanedStreams(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	orphan, _ := repo.CreateSession(nil, nil)
+	setStaleStreaming(t, repo, orphan.ID, 10*time.Minute)
+
+	// Streaming with a live process: must be left alone
+	live, _ := repo.CreateSession(nil, nil)
+	setStaleStreaming(t, repo, live.ID, 10*time.Minute)
+	cm.mu.Lock()
+	cm.processes[live.ID] = &ClaudeProcess{cmd: &exec.Cmd{}, startedAt: time.Now()}
+	cm.mu.Unlock()
+
+	// Recently started prompt whose process hasn't registered yet: must be left alone
+	starting, _ := repo.CreateSession(nil, nil)
+	repo.UpdateSessionStreamStatus(starting.ID, StreamStatusStreaming)
+
+	reset, err := SweepOrphanedStreams(repo, cm, time.Minute, StreamStatusIdle)
+	if err != nil {
+		t.Fatalf("SweepOrphanedStreams failed: %v", err)
+	}
+	if reset != 1 {
+		t.Errorf("Reset %d sessions, want 1", reset)
+	}
+
+	tests := []struct {
+		id   string
+		want StreamStatus
+	}{
+		{orphan.ID, StreamStatusIdle},
+		{live.ID, StreamStatusStreaming},
+		{starting.ID, StreamStatusStreaming},
+	}
+	for _, tt := range tests {
+		got, _ := repo.GetSession(tt.id)
+		if got.StreamStatus != tt.want {
+			t.Errorf("Session %s StreamStatus = %s, want %s", tt.id, got.StreamStatus, tt.want)
+		}
+	}
+}
+
+func TestSweepOrphanedStreams_RecentEvents(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	cm := NewClaudeManager("/tmp", "claude", nil)
+
+	// A stale session that is still producing events is not reaped
+	busy, _ := repo.CreateSession(nil, nil)
+	repo.CreateEvent(busy.ID, busy.ID+"-1", "claude", []byte(`{"type":"assistant"}`))
+	setStaleStreaming(t, repo, busy.ID, 10*time.Minute)
+
+	// One whose last event is old is, to the configured status
+	quiet, _ := repo.CreateSession(nil, nil)
+	repo.CreateEvent(quiet.ID, quiet.ID+"-1", "claude", []byte(`{"type":"assistant"}`))
+	setStaleStreaming(t, repo, quiet.ID, 10*time.Minute)
+	if _, err := repo.db.Exec(`UPDATE session_events SET created_at = ? WHERE session_id = ?`,
+		time.Now().Add(-10*time.Minute).Unix(), quiet.ID); err != nil {
+		t.Fatalf("Failed to age events: %v", err)
+	}
+
+	reset, err := SweepOrphanedStreams(repo, cm, time.Minute, StreamStatusCompleted)
+	if err != nil {
+		t.Fatalf("SweepOrphanedStreams failed: %v", err)
+	}
+	if reset != 1 {
+		t.Errorf("Reset %d sessions, want 1", reset)
+	}
+	if got, _ := repo.GetSession(busy.ID); got.StreamStatus != StreamStatusStreaming {
+		t.Errorf("Session with recent events StreamStatus = %s, want streaming", got.StreamStatus)
+	}
+	if got, _ := repo.GetSession(quiet.ID); got.StreamStatus != StreamStatusCompleted {
+		t.Errorf("Quiet session StreamStatus = %s, want completed", got.StreamStatus)
+	}
+}
+
+func TestStartStreamSweeper(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	orphan, _ := repo.CreateSession(nil, nil)
+	setStaleStreaming(t, repo, orphan.ID, 10*time.Minute)
+
+	stop := StartStreamSweeper(repo, NewClaudeManager("/tmp", "claude", nil), 10*time.Millisecond, time.Minute, StreamStatusIdle)
+	defer stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := repo.GetSession(orphan.ID)
+		if got.StreamStatus == StreamStatusIdle {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Sweeper did not reset the orphaned session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setUpdatedAt backdates a session's last activity.
+func setUpdatedAt(t *testing.T, repo *Repository, id string, age time.Duration) {
+	t.Helper()
+	if _, err := repo.db.Exec(`UPDATE sessions SET updated_at = ? WHERE id = ?`, time.Now().Add(-age).Unix(), id); err != nil {
+		t.Fatalf("Failed to backdate session: %v", err)
+	}
+}
+
+func TestArchiveInactiveSessions(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	stale, _ := repo.CreateSession(nil, nil)
+	repo.UpdateSessionStreamStatus(stale.ID, StreamStatusCompleted)
+	setUpdatedAt(t, repo, stale.ID, 2*time.Hour)
+
+	staleStreaming, _ := repo.CreateSession(nil, nil)
+	setStaleStreaming(t, repo, staleStreaming.ID, 2*time.Hour)
+
+	recent, _ := repo.CreateSession(nil, nil)
+	repo.UpdateSessionStreamStatus(recent.ID, StreamStatusCompleted)
+
+	n, err := repo.ArchiveInactiveSessions(time.Hour)
+	if err != nil {
+		t.Fatalf("ArchiveInactiveSessions failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Archived %d sessions, want 1", n)
+	}
+
+	for _, tc := range []struct {
+		id           string
+		wantArchived bool
+	}{
+		{stale.ID, true},
+		{staleStreaming.ID, false},
+		{recent.ID, false},
+	} {
+		got, _ := repo.GetSession(tc.id)
+		if (got.ArchivedAt != nil) != tc.wantArchived {
+			t.Errorf("Session %s archived = %v, want %v", tc.id, got.ArchivedAt != nil, tc.wantArchived)
+		}
+	}
+
+	// Already archived sessions are left alone
+	if n, _ := repo.ArchiveInactiveSessions(time.Hour); n != 0 {
+		t.Errorf("Second run archived %d sessions, want 0", n)
+	}
+}
+
+func TestStartAutoArchiver(t *testing.T) {
+	repo, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	stale, _ := repo.CreateSession(nil, nil)
+	setUpdatedAt(t, repo, stale.ID, 2*time.Hour)
+
+	stop := StartAutoArchiver(repo, 10*time.Millisecond, time.Hour)
+	defer stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, _ := repo.GetSession(stale.ID)
+		if got.ArchivedAt != nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Auto-archiver did not archive the stale session")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunDBMaintenance(t *testing.T) {
+	for _, vacuum := range []bool{true, false} {
+		dbPath := filepath.Join(t.TempDir(), "chai.db")
+		repo, err := NewRepository(dbPath, nil)
+		if err != nil {
+			t.Fatalf("NewRepository failed: %v", err)
+		}
+
+		session, _ := repo.CreateSession(nil, nil)
+		for i := 0; i < 200; i++ {
+			repo.CreateEvent(session.ID, session.ID+"-1", "claude", []byte(`{"text":"`+strings.Repeat("x", 4096)+`"}`))
+		}
+		repo.Checkpoint()
+		full := fileSize(t, dbPath)
+		repo.DeleteSession(session.ID)
+
+		if err := RunDBMaintenance(repo, vacuum); err != nil {
+			t.Fatalf("RunDBMaintenance(vacuum=%t) failed: %v", vacuum, err)
+		}
+		if size := fileSize(t, dbPath+"-wal"); size != 0 {
+			t.Errorf("vacuum=%t: WAL size = %d, want 0", vacuum, size)
+		}
+		shrank := fileSize(t, dbPath) < full
+		if shrank != vacuum {
+			t.Errorf("vacuum=%t: file shrank = %t", vacuum, shrank)
+		}
+		repo.Close()
+	}
+}
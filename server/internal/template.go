@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// errExpandedPromptTooLarge is returned when expanding a prompt would exceed
+// its size limit.
+var errExpandedPromptTooLarge = errors.New("expanded prompt too large")
+
+// templateReference matches a "{{.name}}" reference, allowing spaces inside
+// the braces as text/template does.
+var templateReference = regexp.MustCompile(`\{\{\s*\.([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// expandPrompt replaces each "{{.name}}" reference in prompt with vars["name"].
+// Only plain references are supported: any other "{{" action is an error, so a
+// prompt can't loop or otherwise grow beyond its references. When strict, a
+// reference to a variable missing from vars is an error; otherwise it expands
+// to "". Expansion stops with errExpandedPromptTooLarge once the result passes
+// maxBytes, unless maxBytes is zero.
+func expandPrompt(prompt string, vars map[string]string, strict bool, maxBytes int) (string, error) {
+	var b strings.Builder
+	last := 0
+	for _, m := range templateReference.FindAllStringSubmatchIndex(prompt, -1) {
+		if err := checkTemplateText(prompt[last:m[0]]); err != nil {
+			return "", err
+		}
+		name := prompt[m[2]:m[3]]
+		value, ok := vars[name]
+		if !ok && strict {
+			return "", fmt.Errorf("expand prompt template: no entry for key %q", name)
+		}
+		if maxBytes > 0 && b.Len()+(m[0]-last)+len(value) > maxBytes {
+			return "", errExpandedPromptTooLarge
+		}
+		b.WriteString(prompt[last:m[0]])
+		b.WriteString(value)
+		last = m[1]
+	}
+	if err := checkTemplateText(prompt[last:]); err != nil {
+		return "", err
+	}
+	if maxBytes > 0 && b.Len()+len(prompt)-last > maxBytes {
+		return "", errExpandedPromptTooLarge
+	}
+	b.WriteString(prompt[last:])
+	return b.String(), nil
+}
+
+// checkTemplateText rejects literal text between references that still holds
+// an action, such as "{{range}}" or an unterminated "{{.name".
+func checkTemplateText(text string) error {
+	if strings.Contains(text, "{{") {
+		return errors.New("invalid prompt template: only {{.name}} references are allowed")
+	}
+	return nil
+}
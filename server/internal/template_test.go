@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpandPrompt(t *testing.T) {
+	vars := map[string]string{"file": "main.go", "lang": "Go"}
+
+	tests := []struct {
+		name    string
+		prompt  string
+		strict  bool
+		want    string
+		wantErr string
+	}{
+		{"substitutes", "Review {{.file}} as a {{.lang}} expert", true, "Review main.go as a Go expert", ""},
+		{"no placeholders", "Just a prompt", true, "Just a prompt", ""},
+		{"repeated", "{{.file}} and {{.file}}", true, "main.go and main.go", ""},
+		{"undefined strict", "Review {{.path}}", true, "", `no entry for key "path"`},
+		{"undefined lenient", "Review {{.path}}", false, "Review ", ""},
+		{"spaced", "Review {{ .file }}", true, "Review main.go", ""},
+		{"syntax error", "Review {{.file", true, "", "invalid prompt template"},
+		{"range", "{{range 100000000}}x{{end}}", true, "", "invalid prompt template"},
+		{"pipeline", `{{.file | printf "%s"}}`, true, "", "invalid prompt template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandPrompt(tt.prompt, vars, tt.strict, 0)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expandPrompt error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandPrompt failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expandPrompt = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPrompt_MaxBytes(t *testing.T) {
+	vars := map[string]string{"big": strings.Repeat("x", 100)}
+
+	if got, err := expandPrompt("{{.big}}", vars, true, 100); err != nil || len(got) != 100 {
+		t.Errorf("expandPrompt = %d bytes, %v; want the 100 byte expansion", len(got), err)
+	}
+	if _, err := expandPrompt("{{.big}}{{.big}}", vars, true, 150); !errors.Is(err, errExpandedPromptTooLarge) {
+		t.Errorf("expandPrompt error = %v, want errExpandedPromptTooLarge", err)
+	}
+	if _, err := expandPrompt("{{.big}}!", vars, true, 100); !errors.Is(err, errExpandedPromptTooLarge) {
+		t.Errorf("expandPrompt error = %v, want trailing text counted", err)
+	}
+}
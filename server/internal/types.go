@@ -14,47 +14,211 @@ const (
 	StreamStatusCompleted StreamStatus = "completed"
 )
 
+// IsValidStreamStatus reports whether status is a known stream status
+func IsValidStreamStatus(status StreamStatus) bool {
+	return status == StreamStatusIdle || status == StreamStatusStreaming || status == StreamStatusCompleted
+}
+
 // Session represents a Claude CLI session
 type Session struct {
-	ID               string       `json:"id"`
-	ClaudeSessionID  *string      `json:"claude_session_id,omitempty"`
-	Title            *string      `json:"title,omitempty"`
-	WorkingDirectory *string      `json:"working_directory,omitempty"`
-	StreamStatus     StreamStatus `json:"stream_status"`
-	PromptSequence   int64        `json:"-"` // Internal counter, not exposed in JSON
-	CreatedAt        time.Time    `json:"created_at"`
-	UpdatedAt        time.Time    `json:"updated_at"`
+	ID                string            `json:"id"`
+	ClaudeSessionID   *string           `json:"claude_session_id,omitempty"`
+	Title             *string           `json:"title,omitempty"`
+	WorkingDirectory  *string           `json:"working_directory,omitempty"`
+	StreamStatus      StreamStatus      `json:"stream_status"`
+	PromptSequence    int64             `json:"-"`                        // Internal counter, not exposed in JSON
+	LastPromptID      string            `json:"last_prompt_id,omitempty"` // the running or most recent prompt, for replaying its events
+	PermissionMode    *string           `json:"permission_mode,omitempty"`
+	QueuePrompts      bool              `json:"queue_prompts,omitempty"`
+	ConcurrentPrompts bool              `json:"concurrent_prompts,omitempty"` // prompts run side by side instead of one at a time
+	Env               map[string]string `json:"-"`                            // values may be secrets, so only their names are exposed
+	EnvNames          []string          `json:"env_names,omitempty"`          // the names of Env's variables, sorted
+	ExtraArgs         []string          `json:"extra_args,omitempty"`
+	ClaudeCmd         *string           `json:"claude_cmd,omitempty"`        // replaces the server's Claude CLI command
+	PromptTimeoutMS   int64             `json:"prompt_timeout_ms,omitempty"` // overrides the server's prompt timeout when set
+	ForkedFrom        *string           `json:"forked_from,omitempty"`       // session this one was forked from
+	ArchivedAt        *time.Time        `json:"archived_at,omitempty"`
+	DeletedAt         *time.Time        `json:"deleted_at,omitempty"` // set while the session is in the recycle bin
+	CreatedAt         time.Time         `json:"created_at"`
+	UpdatedAt         time.Time         `json:"updated_at"`
 }
 
 // Message represents a message in a session
 type Message struct {
-	ID        string          `json:"id"`
-	SessionID string          `json:"session_id"`
-	Role      string          `json:"role"` // "user", "assistant", "system"
-	Content   string          `json:"content"`
-	ToolCalls json.RawMessage `json:"tool_calls,omitempty"`
-	CreatedAt time.Time       `json:"created_at"`
+	ID           string           `json:"id"`
+	SessionID    string           `json:"session_id"`
+	Role         string           `json:"role"` // "user", "assistant", "system"
+	Content      string           `json:"content"`
+	ToolCalls    json.RawMessage  `json:"tool_calls,omitempty"`
+	Blocks       json.RawMessage  `json:"blocks,omitempty"`       // Assistant reply's content blocks in order, as Claude sent them
+	Thinking     string           `json:"thinking,omitempty"`     // Assistant reply's reasoning, kept apart from Content when persisted
+	Truncated    bool             `json:"truncated,omitempty"`    // Reply cut short by a cancelled prompt
+	Continuation bool             `json:"continuation,omitempty"` // User message sent by /continue
+	Attachments  []AttachmentInfo `json:"attachments,omitempty"`  // Images sent with a user prompt
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+// AttachmentInfo records an attachment on the user message, without its data
+type AttachmentInfo struct {
+	MediaType string `json:"media_type"`
+	SizeBytes int    `json:"size_bytes"`
+	Path      string `json:"path,omitempty"`
 }
 
 // API Request/Response types
 
 type CreateSessionRequest struct {
-	Title            string `json:"title,omitempty"`
-	WorkingDirectory string `json:"working_directory,omitempty"`
+	Title             string            `json:"title,omitempty"`
+	WorkingDirectory  string            `json:"working_directory,omitempty"`
+	PermissionMode    string            `json:"permission_mode,omitempty"`
+	QueuePrompts      bool              `json:"queue_prompts,omitempty"`
+	ConcurrentPrompts bool              `json:"concurrent_prompts,omitempty"` // needs the server's ConcurrentPrompts option
+	Env               map[string]string `json:"env,omitempty"`                // merged onto the server environment for the Claude CLI
+	ExtraArgs         []string          `json:"extra_args,omitempty"`         // appended to the Claude CLI args after the server's; needs AllowRawArgs and the auth token
+	ClaudeCmd         string            `json:"claude_cmd,omitempty"`         // must be in the server's ClaudeCmdAllow
+	PromptTimeout     string            `json:"prompt_timeout,omitempty"`     // duration such as "30m", bounded by the server's max
+}
+
+// ForkSessionRequest is the optional body of POST /api/sessions/{id}/fork
+type ForkSessionRequest struct {
+	UpToMessageID string `json:"up_to_message_id,omitempty"` // last message copied; all of them when empty
+	Title         string `json:"title,omitempty"`
+}
+
+// SessionSettings holds optional per-session overrides applied when running prompts
+type SessionSettings struct {
+	PermissionMode    *string
+	QueuePrompts      bool              // queue prompts sent while busy instead of rejecting them
+	ConcurrentPrompts bool              // run prompts side by side, each with its own Claude process
+	Env               map[string]string // extra environment for the Claude CLI
+	ExtraArgs         []string          // extra Claude CLI args
+	ClaudeCmd         *string           // replaces the server's Claude CLI command
+	PromptTimeout     time.Duration     // replaces the server's prompt timeout when non-zero
 }
 
 type SessionResponse struct {
-	Session  Session   `json:"session"`
-	Messages []Message `json:"messages,omitempty"`
+	Session           Session   `json:"session"`
+	Messages          []Message `json:"messages"`            // always an array, empty before the first message
+	LastEventSequence int64     `json:"last_event_sequence"` // latest event of the last prompt, 0 if none
 }
 
 type PromptRequest struct {
-	Prompt string `json:"prompt"`
+	Prompt      string            `json:"prompt"`
+	Priority    string            `json:"priority,omitempty"`    // "low", "normal" (default), or "high"; orders queued prompts
+	RawArgs     []string          `json:"raw_args,omitempty"`    // replaces the Claude CLI args; needs AllowRawArgs and the auth token
+	Attachments []Attachment      `json:"attachments,omitempty"` // images sent to Claude alongside the prompt
+	Variables   map[string]string `json:"variables,omitempty"`   // makes the prompt a text/template, expanding {{.name}}
+	Timeout     string            `json:"timeout,omitempty"`     // duration such as "30m" overriding the session's timeout
+	Label       string            `json:"label,omitempty"`       // names the prompt, to find it again when replaying events
+}
+
+// PreflightResponse describes the Claude run a prompt request would start
+type PreflightResponse struct {
+	ClaudeCommand
+	Model           string  `json:"model,omitempty"` // from --model in the args; empty means the CLI's default
+	PermissionMode  *string `json:"permission_mode,omitempty"`
+	SystemPrompt    string  `json:"system_prompt,omitempty"`
+	ResumeSessionID *string `json:"resume_session_id,omitempty"` // Claude session the prompt would resume
+	Prompt          string  `json:"prompt"`                      // the expanded prompt as Claude receives it
+	Timeout         string  `json:"timeout"`                     // the prompt's effective timeout
+}
+
+// Attachment is an image sent with a prompt, either inline as base64 data or
+// as a path to a file under the session's working directory
+type Attachment struct {
+	MediaType string `json:"media_type,omitempty"` // detected from the content when empty
+	Data      string `json:"data,omitempty"`       // base64-encoded image
+	Path      string `json:"path,omitempty"`       // file under the working directory
+}
+
+// ValidationError is the 400 body for a request with invalid fields. Fields
+// maps each bad field to its problem; Error summarizes them for clients that
+// only show a message.
+type ValidationError struct {
+	Error  string            `json:"error"`
+	Fields map[string]string `json:"fields"`
+}
+
+// SystemMessageRequest sets a session's system message before its first prompt
+type SystemMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// BookmarkRequest saves where a client left off reading a session's events:
+// the prompt and sequence it last rendered, to pass back to GetEvents as
+// prompt_id and since_sequence, and/or an opaque cursor of its own
+type BookmarkRequest struct {
+	PromptID string `json:"prompt_id,omitempty"`
+	Sequence *int64 `json:"sequence,omitempty"`
+	Cursor   string `json:"cursor,omitempty"`
 }
 
 type ApproveRequest struct {
 	ToolUseID string `json:"tool_use_id"`
-	Decision  string `json:"decision"` // "allow" or "deny"
+	Decision  string `json:"decision"`            // "allow" or "deny"
+	Message   string `json:"message,omitempty"`   // optional reason sent to Claude on deny
+	Interrupt bool   `json:"interrupt,omitempty"` // halt the current turn on deny
+}
+
+// QueuedPromptStatus tracks a queued prompt through the session's prompt queue
+type QueuedPromptStatus string
+
+const (
+	QueuedPromptWaiting   QueuedPromptStatus = "queued"
+	QueuedPromptStarted   QueuedPromptStatus = "started"
+	QueuedPromptCancelled QueuedPromptStatus = "cancelled"
+	QueuedPromptFailed    QueuedPromptStatus = "failed"
+)
+
+// QueuedPrompt is a prompt persisted while it waits for the session to become idle
+type QueuedPrompt struct {
+	ID        string             `json:"id"`
+	SessionID string             `json:"session_id"`
+	Prompt    string             `json:"prompt"`
+	Priority  string             `json:"priority"`
+	Status    QueuedPromptStatus `json:"status"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// ActiveProcessResponse describes a live Claude CLI process for the admin API
+type ActiveProcessResponse struct {
+	SessionID string    `json:"session_id"`
+	PromptID  string    `json:"prompt_id,omitempty"` // only set for concurrent prompts
+	StartedAt time.Time `json:"started_at"`
+	RunningMS int64     `json:"running_ms"`
+}
+
+// BulkKillResponse reports the processes killed by POST /api/admin/active/kill
+type BulkKillResponse struct {
+	Killed     int      `json:"killed"`
+	SessionIDs []string `json:"session_ids"`
+}
+
+// InfoResponse describes the server and the Claude CLI it runs
+type InfoResponse struct {
+	Version         string `json:"version"`
+	ClaudeCmd       string `json:"claude_cmd"`
+	ClaudeAvailable bool   `json:"claude_available"`
+	ClaudeVersion   string `json:"claude_version,omitempty"`
+	ClaudeError     string `json:"claude_error,omitempty"` // why the version could not be read
+}
+
+// BackupResponse describes a database backup written by the admin API
+type BackupResponse struct {
+	Path      string    `json:"path"`
+	SizeBytes int64     `json:"size_bytes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ReadOnlyRequest turns read-only mode on or off
+type ReadOnlyRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// ReadOnlyResponse reports whether the server is in read-only mode
+type ReadOnlyResponse struct {
+	ReadOnly bool `json:"read_only"`
 }
 
 // SessionEvent represents a persisted SSE event for mobile backgrounding resilience
@@ -70,10 +234,105 @@ type SessionEvent struct {
 
 // GetEventsResponse contains paginated events for catch-up after reconnection
 type GetEventsResponse struct {
-	Events       []SessionEvent `json:"events"`
-	LastSequence int64          `json:"last_sequence"`
-	HasMore      bool           `json:"has_more"`
-	StreamStatus StreamStatus   `json:"stream_status"`
+	Events        []SessionEvent `json:"events"`
+	FirstSequence int64          `json:"first_sequence"`
+	LastSequence  int64          `json:"last_sequence"`
+	HasMore       bool           `json:"has_more"`
+	StreamStatus  StreamStatus   `json:"stream_status"`
+	// TotalPending counts every event past since_sequence, including this
+	// page, so clients can show catch-up progress. Only set with
+	// include_total=true, as it costs an extra query.
+	TotalPending *int64 `json:"total_pending,omitempty"`
+	// Prompts maps out every prompt's events in the session, in the order the
+	// events are returned. Only set when the request isn't scoped to one prompt.
+	Prompts []PromptEventRange `json:"prompts,omitempty"`
+}
+
+// PromptEventRange describes where one prompt's events lie in the session's
+// event log
+type PromptEventRange struct {
+	PromptID      string `json:"prompt_id"`
+	Label         string `json:"label,omitempty"` // as given in the prompt request
+	FirstSequence int64  `json:"first_sequence"`
+	LastSequence  int64  `json:"last_sequence"`
+	EventCount    int64  `json:"event_count"`
+}
+
+// PromptStatus is the outcome of a prompt as reconstructed from its events
+type PromptStatus string
+
+const (
+	PromptStatusStreaming PromptStatus = "streaming" // no terminal event yet (or not in this page)
+	PromptStatusComplete  PromptStatus = "complete"
+	PromptStatusCancelled PromptStatus = "cancelled"
+	PromptStatusError     PromptStatus = "error"
+)
+
+// PromptSummary is a ready-to-render reconstruction of one prompt's events
+type PromptSummary struct {
+	PromptID      string          `json:"prompt_id"`
+	Status        PromptStatus    `json:"status"`
+	Text          string          `json:"text"`
+	ToolCalls     json.RawMessage `json:"tool_calls,omitempty"`
+	Error         string          `json:"error,omitempty"`
+	FirstSequence int64           `json:"first_sequence"`
+	LastSequence  int64           `json:"last_sequence"`
+}
+
+// ClientBookmark is a client's saved reading position in a session, keyed by
+// session and client ID ("" for a client that didn't give one)
+type ClientBookmark struct {
+	SessionID string    `json:"session_id"`
+	ClientID  string    `json:"client_id,omitempty"`
+	PromptID  string    `json:"prompt_id,omitempty"`
+	Sequence  *int64    `json:"sequence,omitempty"`
+	Cursor    string    `json:"cursor,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PromptSnapshot is the persisted final state of a prompt, written when it finishes
+type PromptSnapshot struct {
+	PromptID  string          `json:"prompt_id"`
+	SessionID string          `json:"session_id"`
+	Status    PromptStatus    `json:"status"`
+	Text      string          `json:"text"`
+	ToolCalls json.RawMessage `json:"tool_calls,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"` // the Claude CLI result event
+	Error     string          `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// PromptUsage is the cost and token counts Claude's result event reported for
+// one prompt. Token counts are zero when the result carried no usage.
+type PromptUsage struct {
+	PromptID                 string    `json:"prompt_id"`
+	CostUSD                  float64   `json:"cost_usd"`
+	InputTokens              int64     `json:"input_tokens"`
+	OutputTokens             int64     `json:"output_tokens"`
+	CacheCreationInputTokens int64     `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64     `json:"cache_read_input_tokens"`
+	CreatedAt                time.Time `json:"created_at"`
+}
+
+// SessionStats totals the usage of a session's prompts. Prompts that ended
+// without a result event (errors, cancels) report nothing and aren't counted.
+type SessionStats struct {
+	SessionID                string        `json:"session_id"`
+	Prompts                  int           `json:"prompts"`
+	CostUSD                  float64       `json:"cost_usd"`
+	InputTokens              int64         `json:"input_tokens"`
+	OutputTokens             int64         `json:"output_tokens"`
+	CacheCreationInputTokens int64         `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64         `json:"cache_read_input_tokens"`
+	PerPrompt                []PromptUsage `json:"per_prompt"`
+}
+
+// GetEventsSummaryResponse is the GetEvents response for format=summary
+type GetEventsSummaryResponse struct {
+	Prompts      []PromptSummary `json:"prompts"`
+	LastSequence int64           `json:"last_sequence"`
+	HasMore      bool            `json:"has_more"`
+	StreamStatus StreamStatus    `json:"stream_status"`
 }
 
 // Claude CLI streaming types (JSON lines from stdout)
@@ -96,11 +355,38 @@ type AssistantMsgV1 struct {
 }
 
 type ContentBlock struct {
-	Type  string `json:"type"` // "text", "tool_use", "tool_result"
-	Text  string `json:"text,omitempty"`
-	ID    string `json:"id,omitempty"`    // for tool_use
-	Name  string `json:"name,omitempty"`  // for tool_use
-	Input any    `json:"input,omitempty"` // for tool_use
+	Type      string          `json:"type"` // "text", "thinking", "tool_use", "tool_result"
+	Text      string          `json:"text,omitempty"`
+	Thinking  string          `json:"thinking,omitempty"`    // for thinking
+	ID        string          `json:"id,omitempty"`          // for tool_use
+	Name      string          `json:"name,omitempty"`        // for tool_use
+	Input     any             `json:"input,omitempty"`       // for tool_use
+	ToolUseID string          `json:"tool_use_id,omitempty"` // for tool_result
+	Content   json.RawMessage `json:"content,omitempty"`     // for tool_result: a string or content blocks
+	IsError   bool            `json:"is_error,omitempty"`    // for tool_result
+}
+
+// ToolResultMessage is a user event from the CLI carrying tool results back to Claude
+type ToolResultMessage struct {
+	Type    string `json:"type"` // "user"
+	Message struct {
+		Role    string         `json:"role"` // "user"
+		Content []ContentBlock `json:"content"`
+	} `json:"message"`
+}
+
+// ToolCallEvent is the normalized "tool_call" SSE event for a tool_use block
+type ToolCallEvent struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Input any    `json:"input"`
+}
+
+// ToolResultEvent is the normalized "tool_result" SSE event for a tool_result block
+type ToolResultEvent struct {
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content,omitempty"` // as Claude sent it: a string or content blocks
+	IsError   bool            `json:"is_error,omitempty"`
 }
 
 // Content block delta events
@@ -111,18 +397,60 @@ type ContentBlockDelta struct {
 }
 
 type ContentDeltaData struct {
-	Type string `json:"type"` // "text_delta"
-	Text string `json:"text"`
+	Type     string `json:"type"` // "text_delta", "thinking_delta"
+	Text     string `json:"text"`
+	Thinking string `json:"thinking,omitempty"` // for thinking_delta
 }
 
 // Result event (final)
 type ResultEvent struct {
-	Type        string  `json:"type"` // "result"
-	Subtype     string  `json:"subtype"`
-	SessionID   string  `json:"session_id"`
-	CostUSD     float64 `json:"cost_usd"`
-	DurationMS  int64   `json:"duration_ms"`
-	DurationAPI int64   `json:"duration_api_ms"`
+	Type         string       `json:"type"` // "result"
+	Subtype      string       `json:"subtype"`
+	SessionID    string       `json:"session_id"`
+	CostUSD      float64      `json:"cost_usd"`
+	TotalCostUSD float64      `json:"total_cost_usd"` // newer CLIs report cost here instead of cost_usd
+	DurationMS   int64        `json:"duration_ms"`
+	DurationAPI  int64        `json:"duration_api_ms"`
+	NumTurns     int          `json:"num_turns"`
+	Usage        *ResultUsage `json:"usage,omitempty"`
+}
+
+// ResultUsage is the token usage reported on the result event
+type ResultUsage struct {
+	InputTokens              int64 `json:"input_tokens"`
+	OutputTokens             int64 `json:"output_tokens"`
+	CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+}
+
+// PromptErrorEvent is the payload of an SSE error event. Terminal errors end
+// the stream; Code says why a prompt was cut off (see the PromptError
+// constants) so clients can decide whether to retry.
+type PromptErrorEvent struct {
+	Error    string `json:"error"`
+	Code     string `json:"code,omitempty"`
+	Terminal bool   `json:"terminal"`
+	// ExitCode and ExitSignal are set when the Claude CLI exited non-zero,
+	// e.g. 127 for a wrapper that couldn't find claude, or signal "killed"
+	// (exit code -1) for an OOM kill.
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	ExitSignal string `json:"exit_signal,omitempty"`
+}
+
+// DoneEvent is the payload of the SSE done event sent when a prompt completes.
+// Stats from Claude's result event are omitted when it didn't send one.
+type DoneEvent struct {
+	Status                   string   `json:"status"` // "complete"
+	CostUSD                  *float64 `json:"cost_usd,omitempty"`
+	DurationMS               *int64   `json:"duration_ms,omitempty"`
+	DurationAPIMS            *int64   `json:"duration_api_ms,omitempty"`
+	NumTurns                 *int     `json:"num_turns,omitempty"`
+	InputTokens              *int64   `json:"input_tokens,omitempty"`
+	OutputTokens             *int64   `json:"output_tokens,omitempty"`
+	CacheCreationInputTokens *int64   `json:"cache_creation_input_tokens,omitempty"`
+	CacheReadInputTokens     *int64   `json:"cache_read_input_tokens,omitempty"`
+	Messages                 int      `json:"messages"`   // assistant messages Claude produced
+	ToolCalls                int      `json:"tool_calls"` // tool_use blocks Claude produced
 }
 
 // Permission request from Claude CLI
@@ -133,6 +461,22 @@ type PermissionRequest struct {
 	Input     map[string]any `json:"input"`
 }
 
+// ControlRequest is sent by Claude CLI when it needs a decision from the client,
+// such as permission to use a tool
+// Format: {"type":"control_request","request_id":"...","request":{"subtype":"can_use_tool","tool_name":"Bash","input":{...}}}
+type ControlRequest struct {
+	Type      string             `json:"type"` // "control_request"
+	RequestID string             `json:"request_id"`
+	Request   ControlRequestBody `json:"request"`
+}
+
+// ControlRequestBody contains the control_request details
+type ControlRequestBody struct {
+	Subtype  string         `json:"subtype"` // "can_use_tool"
+	ToolName string         `json:"tool_name"`
+	Input    map[string]any `json:"input"`
+}
+
 // NestedControlResponse is the format for responding to control_request events via stdin
 // Format: {"type":"control_response","response":{"subtype":"success","request_id":"...","response":{"behavior":"allow","updatedInput":{...}}}}
 type NestedControlResponse struct {
@@ -152,6 +496,7 @@ type PermissionDecision struct {
 	Behavior     string         `json:"behavior"`               // "allow" or "deny"
 	UpdatedInput map[string]any `json:"updatedInput,omitempty"` // required for allow
 	Message      string         `json:"message,omitempty"`      // optional message for deny
+	Interrupt    bool           `json:"interrupt,omitempty"`    // stop the turn after a deny
 }
 
 // SSE Event types sent to client
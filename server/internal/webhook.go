@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Webhook event types
+const (
+	WebhookSessionCreated      = "session.created"
+	WebhookPromptStarted       = "prompt.started"
+	WebhookPromptCompleted     = "prompt.completed"
+	WebhookPromptFailed        = "prompt.failed"
+	WebhookPromptCancelled     = "prompt.cancelled"
+	WebhookPermissionRequested = "permission.requested"
+)
+
+// Webhook dispatcher defaults
+const (
+	DefaultWebhookQueueSize   = 256
+	DefaultWebhookMaxAttempts = 3
+	DefaultWebhookRetryDelay  = time.Second
+	DefaultWebhookTimeout     = 10 * time.Second
+)
+
+// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body,
+// keyed by the webhook secret, as "sha256=<hex>".
+const WebhookSignatureHeader = "X-Chai-Signature"
+
+// WebhookEvent is the JSON body POSTed to the webhook URL
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id"`
+	PromptID  string    `json:"prompt_id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data,omitempty"` // type-specific details, e.g. the done stats
+}
+
+// WebhookOptions configures a WebhookDispatcher. Zero values use the defaults.
+type WebhookOptions struct {
+	URL         string
+	Secret      string // signs each body when set
+	QueueSize   int    // events waiting for delivery; more are dropped
+	MaxAttempts int
+	RetryDelay  time.Duration // doubled after each failed attempt
+	Timeout     time.Duration // per attempt
+	Client      *http.Client
+}
+
+// WebhookDispatcher delivers webhook events from a bounded queue in the
+// background, so a slow or failing receiver never blocks request handling.
+// A nil dispatcher drops every event.
+type WebhookDispatcher struct {
+	opts   WebhookOptions
+	queue  chan WebhookEvent
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewWebhookDispatcher starts a dispatcher delivering to opts.URL. Stop it
+// with Close.
+func NewWebhookDispatcher(opts WebhookOptions) *WebhookDispatcher {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultWebhookQueueSize
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultWebhookMaxAttempts
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultWebhookRetryDelay
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultWebhookTimeout
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &WebhookDispatcher{
+		opts:   opts,
+		queue:  make(chan WebhookEvent, opts.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Send queues an event for delivery. It never blocks: when the queue is full
+// the event is dropped and logged.
+func (d *WebhookDispatcher) Send(eventType, sessionID, promptID string, data any) {
+	if d == nil {
+		return
+	}
+	event := WebhookEvent{
+		Type:      eventType,
+		SessionID: sessionID,
+		PromptID:  promptID,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	select {
+	case d.queue <- event:
+	default:
+		log.Printf("Warning: webhook queue full, dropping %s event for session %s", eventType, sessionID)
+	}
+}
+
+// Close stops the dispatcher, abandoning queued events and any delivery in
+// progress.
+func (d *WebhookDispatcher) Close() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+func (d *WebhookDispatcher) run() {
+	defer close(d.done)
+	for {
+		select {
+		case event := <-d.queue:
+			d.deliver(event)
+		case <-d.ctx.Done():
+			if n := len(d.queue); n > 0 {
+				log.Printf("Webhook dispatcher stopped with %d undelivered events", n)
+			}
+			return
+		}
+	}
+}
+
+// deliver POSTs one event, retrying with backoff on errors and non-2xx responses
+func (d *WebhookDispatcher) deliver(event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Warning: failed to encode %s webhook: %v", event.Type, err)
+		return
+	}
+
+	delay := d.opts.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err := d.post(body, event.Type)
+		if err == nil {
+			return
+		}
+		if attempt >= d.opts.MaxAttempts {
+			log.Printf("Warning: giving up on %s webhook for session %s after %d attempts: %v",
+				event.Type, event.SessionID, attempt, err)
+			return
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-d.ctx.Done():
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) post(body []byte, eventType string) error {
+	ctx, cancel := context.WithTimeout(d.ctx, d.opts.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chai-Event", eventType)
+	if d.opts.Secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhook(d.opts.Secret, body))
+	}
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header value for body: "sha256=" and the
+// hex HMAC-SHA256 of body keyed by secret. Receivers recompute it over the raw
+// body and compare with hmac.Equal.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the webhooks POSTed to it
+type webhookReceiver struct {
+	mu       sync.Mutex
+	events   []WebhookEvent
+	received chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T) (*webhookReceiver, *httptest.Server) {
+	t.Helper()
+	rec := &webhookReceiver{received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		rec.mu.Lock()
+		rec.events = append(rec.events, event)
+		rec.mu.Unlock()
+		if SignWebhook("secret", body) != r.Header.Get(WebhookSignatureHeader) {
+			t.Errorf("Signature %q doesn't match the body", r.Header.Get(WebhookSignatureHeader))
+		}
+		rec.received <- struct{}{}
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+// wait blocks until n webhooks have arrived
+func (rec *webhookReceiver) wait(t *testing.T, n int) []WebhookEvent {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-rec.received:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Received %d webhooks, want %d", i, n)
+		}
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]WebhookEvent(nil), rec.events...)
+}
+
+func TestWebhookDispatcher_Send(t *testing.T) {
+	rec, srv := newWebhookReceiver(t)
+	d := NewWebhookDispatcher(WebhookOptions{URL: srv.URL, Secret: "secret"})
+	defer d.Close()
+
+	d.Send(WebhookPromptCompleted, "session-1", "session-1-1", DoneEvent{Status: "complete"})
+
+	events := rec.wait(t, 1)
+	e := events[0]
+	if e.Type != WebhookPromptCompleted || e.SessionID != "session-1" || e.PromptID != "session-1-1" {
+		t.Errorf("Event = %+v, want prompt.completed for session-1-1", e)
+	}
+	if e.Timestamp.IsZero() {
+		t.Error("Timestamp should be set")
+	}
+	if data, _ := e.Data.(map[string]any); data["status"] != "complete" {
+		t.Errorf("Data = %v, want the done event", e.Data)
+	}
+}
+
+func TestWebhookDispatcher_Retries(t *testing.T) {
+	var attempts atomic.Int32
+	delivered := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		close(delivered)
+	}))
+	defer srv.Close()
+
+	d := NewWebhookDispatcher(WebhookOptions{URL: srv.URL, RetryDelay: time.Millisecond})
+	defer d.Close()
+	d.Send(WebhookSessionCreated, "session-1", "", nil)
+
+	select {
+	case <-delivered:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Webhook not delivered after %d attempts", attempts.Load())
+	}
+}
+
+func TestWebhookDispatcher_GivesUp(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	d := NewWebhookDispatcher(WebhookOptions{URL: srv.URL, MaxAttempts: 2, RetryDelay: time.Millisecond})
+	d.Send(WebhookSessionCreated, "session-1", "", nil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for attempts.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	d.Close()
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("Attempts = %d, want 2", n)
+	}
+}
+
+func TestWebhookDispatcher_FullQueueDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	d := NewWebhookDispatcher(WebhookOptions{URL: srv.URL, QueueSize: 1})
+	defer d.Close()
+
+	// One event is in flight, one queued; the rest are dropped without blocking
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			d.Send(WebhookPromptStarted, "session-1", "", nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked on a full queue")
+	}
+}
+
+func TestWebhookDispatcher_Nil(t *testing.T) {
+	var d *WebhookDispatcher
+	d.Send(WebhookSessionCreated, "session-1", "", nil)
+	d.Close()
+}
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '{"type":"session.created"}' | openssl dgst -sha256 -hmac secret
+	got := SignWebhook("secret", []byte(`{"type":"session.created"}`))
+	want := "sha256=a7b4ac39e4b72352cabee378a5909bc8c2b0dbba6c19f3ed8fefca3d4da27adf"
+	if got != want {
+		t.Errorf("SignWebhook = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// workdirLocks is an advisory lock per working directory, so prompts from
+// different sessions that share a directory don't edit files concurrently.
+// The lock is held by a session, so a concurrent session's prompts share it.
+type workdirLocks struct {
+	mu      sync.Mutex
+	holders map[string]*workdirHolder // resolved dir -> session holding the lock
+}
+
+// workdirHolder is the session holding a directory's lock and how many of its
+// prompts are running there.
+type workdirHolder struct {
+	sessionID string
+	prompts   int
+}
+
+func newWorkdirLocks() *workdirLocks {
+	return &workdirLocks{holders: make(map[string]*workdirHolder)}
+}
+
+// TryLock takes the lock on dir for one of sessionID's prompts. If another
+// session holds it, it returns false and that session's ID.
+func (l *workdirLocks) TryLock(dir, sessionID string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holder, ok := l.holders[dir]
+	if !ok {
+		holder = &workdirHolder{sessionID: sessionID}
+		l.holders[dir] = holder
+	} else if holder.sessionID != sessionID {
+		return holder.sessionID, false
+	}
+	holder.prompts++
+	return "", true
+}
+
+// Unlock releases a prompt's hold on dir, freeing it once the holding
+// session has no other prompt running there.
+func (l *workdirLocks) Unlock(dir string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holder, ok := l.holders[dir]
+	if !ok {
+		return
+	}
+	if holder.prompts--; holder.prompts <= 0 {
+		delete(l.holders, dir)
+	}
+}
+
+// resolveWorkDir returns the canonical form of dir so different spellings of
+// the same directory share a lock. An empty dir is the server's working directory.
+func resolveWorkDir(dir string) string {
+	if dir == "" {
+		dir = "."
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return filepath.Clean(dir)
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkdirLocks(t *testing.T) {
+	l := newWorkdirLocks()
+
+	if _, ok := l.TryLock("/a", "s1"); !ok {
+		t.Fatal("TryLock on a free dir failed")
+	}
+	if holder, ok := l.TryLock("/a", "s2"); ok || holder != "s1" {
+		t.Errorf("TryLock = (%q, %v), want (s1, false)", holder, ok)
+	}
+	if _, ok := l.TryLock("/b", "s2"); !ok {
+		t.Error("TryLock on a different dir failed")
+	}
+
+	l.Unlock("/a")
+	if _, ok := l.TryLock("/a", "s2"); !ok {
+		t.Error("TryLock after Unlock failed")
+	}
+}
+
+func TestWorkdirLocks_SameSession(t *testing.T) {
+	l := newWorkdirLocks()
+
+	// A session's concurrent prompts share its lock
+	l.TryLock("/a", "s1")
+	if _, ok := l.TryLock("/a", "s1"); !ok {
+		t.Fatal("TryLock by the holding session failed")
+	}
+
+	// The directory stays locked until the last of them unlocks
+	l.Unlock("/a")
+	if holder, ok := l.TryLock("/a", "s2"); ok || holder != "s1" {
+		t.Errorf("TryLock = (%q, %v), want (s1, false) while s1 has a prompt running", holder, ok)
+	}
+	l.Unlock("/a")
+	if _, ok := l.TryLock("/a", "s2"); !ok {
+		t.Error("TryLock after the last Unlock failed")
+	}
+}
+
+func TestResolveWorkDir(t *testing.T) {
+	dir, _ := filepath.EvalSymlinks(t.TempDir())
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	for _, in := range []string{dir, dir + "/", dir + "/sub/..", link} {
+		if got := resolveWorkDir(in); got != dir {
+			t.Errorf("resolveWorkDir(%q) = %q, want %q", in, got, dir)
+		}
+	}
+
+	cwd, _ := os.Getwd()
+	cwd, _ = filepath.EvalSymlinks(cwd)
+	if got := resolveWorkDir(""); got != cwd {
+		t.Errorf("resolveWorkDir(\"\") = %q, want %q", got, cwd)
+	}
+}